@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"regexp"
 	"runtime"
 	"scira2api/log"
 	"scira2api/pkg/constants"
 	"scira2api/pkg/errors"
+	"scira2api/pkg/tokenizer"
 	"strconv"
 	"strings" // 新增导入
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -23,7 +26,22 @@ type Config struct {
 	Cache           CacheConfig     `json:"cache"`
 	ConnPool        ConnPoolConfig  `json:"conn_pool"`
 	RateLimit       RateLimitConfig `json:"rate_limit"`
+	Session         SessionConfig   `json:"session"`
+	Concurrency     ConcurrencyConfig `json:"concurrency"`
+	ProxyPool       ProxyPoolConfig `json:"proxy_pool"`
+	Admin           AdminConfig     `json:"admin"`
+	Usage           UsageConfig     `json:"usage"`
+	Budget          BudgetConfig    `json:"budget"`
+	Metrics         MetricsConfig   `json:"metrics"`
+	Tracing         TracingConfig   `json:"tracing"`
+	Log             LogConfig       `json:"log"`
+	Capture         CaptureConfig   `json:"capture"`
+	Upstream        UpstreamConfig  `json:"upstream"`
+	Chaos           ChaosConfig     `json:"chaos"`
+	Tokenizer       TokenizerConfig `json:"tokenizer"`
 	ModelMappings   map[string]string `json:"model_mappings"` // 新增模型映射字段
+	
+	mappingMu sync.RWMutex // 保护运行时修改的模型映射
 }
 
 // ServerConfig 服务器配置
@@ -36,7 +54,9 @@ type ServerConfig struct {
 
 // AuthConfig 认证配置
 type AuthConfig struct {
-	ApiKey  string   `json:"api_key"`
+	ApiKey   string   `json:"api_key"`
+	ApiKeys  []string `json:"api_keys"`  // name:key 形式的多密钥配置
+	KeysFile string   `json:"keys_file"` // JSON格式的密钥策略文件
 }
 
 // ClientConfig 客户端配置
@@ -71,6 +91,166 @@ type RateLimitConfig struct {
 	Enabled     bool    `json:"enabled"`
 	RequestsPerSecond float64 `json:"requests_per_second"`
 	Burst       int     `json:"burst"`
+	Mode        string        `json:"mode"`     // wait 或 reject
+	MaxWait     time.Duration `json:"max_wait"` // wait 模式下的最长等待时间
+	QueueDepth  int           `json:"queue_depth"` // wait 模式下最多排队的请求数
+	
+	// 按API密钥（未认证时按客户端IP）限流
+	PerKeyEnabled bool                 `json:"per_key_enabled"`
+	KeyLimit      RateLimitTier        `json:"key_limit"` // 未指定等级的密钥及客户端IP的默认限制
+	Tiers         map[string]RateLimitTier `json:"tiers"`
+	
+	// 按模型限流
+	PerModelEnabled bool                 `json:"per_model_enabled"`
+	ModelLimit      RateLimitTier        `json:"model_limit"` // 未单独配置的模型的默认限制
+	ModelLimits     map[string]RateLimitTier `json:"model_limits"`
+	
+	// 按令牌数限流（TPM/TPD），分别作用于密钥（或客户端IP）和模型
+	TokensEnabled    bool                       `json:"tokens_enabled"`
+	KeyTokenLimit    TokenLimitTier             `json:"key_token_limit"` // 未指定等级的密钥及客户端IP的默认配额
+	TokenTiers       map[string]TokenLimitTier  `json:"token_tiers"`
+	ModelTokenLimit  TokenLimitTier             `json:"model_token_limit"` // 未单独配置的模型的默认配额
+	ModelTokenLimits map[string]TokenLimitTier  `json:"model_token_limits"`
+	
+	// 按键限流器中空闲令牌桶的清理时间
+	IdleTTL time.Duration `json:"idle_ttl"`
+	
+	// 多副本共享限流的 Redis 协议存储，RedisURL 为空时只使用本地限流
+	RedisURL     string        `json:"-"`
+	RedisPrefix  string        `json:"redis_prefix"`
+	RedisTimeout time.Duration `json:"redis_timeout"`
+}
+
+// TokenLimitTier 令牌数配额等级，0 表示不限制
+type TokenLimitTier struct {
+	TokensPerMinute int `json:"tokens_per_minute"`
+	TokensPerDay    int `json:"tokens_per_day"`
+}
+
+// RateLimitTier 限流等级
+type RateLimitTier struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// ConcurrencyConfig 上游请求并发限制配置，各级上限为0表示不限制
+type ConcurrencyConfig struct {
+	Global      int           `json:"global"`       // 全局同时进行的上游请求数
+	PerKey      int           `json:"per_key"`      // 每个API密钥（未认证时为客户端IP）
+	PerIdentity int           `json:"per_identity"` // 每个上游身份（userId）
+	Mode        string        `json:"mode"`         // queue 或 reject
+	MaxWait     time.Duration `json:"max_wait"`     // queue 模式下的最长排队时间
+}
+
+// SessionConfig 粘性会话配置
+type SessionConfig struct {
+	Enabled       bool          `json:"enabled"`
+	TTL           time.Duration `json:"ttl"`
+	QuarantineTTL time.Duration `json:"quarantine_ttl"`
+}
+
+// AdminConfig 管理接口配置
+type AdminConfig struct {
+	Key          string `json:"-"`              // 管理员密钥，为空时不启用管理接口
+	StorePath    string `json:"store_path"`     // 运行时修改的持久化存储文件
+	AuditLogPath string `json:"audit_log_path"` // 管理操作审计日志（JSONL）
+}
+
+// UsageConfig 用量账本配置
+type UsageConfig struct {
+	Enabled   bool          `json:"enabled"`
+	StorePath string        `json:"store_path"` // 账本文件，与管理接口的存储分开
+	Retention time.Duration `json:"retention"`  // 记录保留时间，0 表示永久保留
+}
+
+// BudgetConfig 按模型价格计算费用的预算配置
+type BudgetConfig struct {
+	Enabled        bool                  `json:"enabled"`
+	Prices         map[string]ModelPrice `json:"prices"`          // 外部模型名（或内部模型名）到价格
+	Daily          float64               `json:"daily"`           // 密钥未单独设置时的日预算，0 表示不限制
+	Monthly        float64               `json:"monthly"`         // 密钥未单独设置时的月预算，0 表示不限制
+	WarnThresholds []float64             `json:"warn_thresholds"` // 触发软限制告警的已用比例
+	WebhookURL     string                `json:"-"`
+	WebhookTimeout time.Duration         `json:"webhook_timeout"`
+}
+
+// ModelPrice 模型每1k tokens的价格（美元）
+type ModelPrice struct {
+	Input     float64 `json:"input"`
+	Output    float64 `json:"output"`
+	Reasoning float64 `json:"reasoning"`
+}
+
+// MetricsConfig 监控指标配置
+type MetricsConfig struct {
+	LatencyWindow time.Duration `json:"latency_window"` // 延迟分位数的统计窗口，0 表示统计启动以来的全部样本
+}
+
+// TracingConfig OpenTelemetry链路追踪配置
+type TracingConfig struct {
+	Exporter     string  `json:"exporter"`      // none, otlp, stdout, file
+	OTLPEndpoint string  `json:"otlp_endpoint"` // OTLP/HTTP 地址，为空时使用 OTEL_EXPORTER_OTLP_* 环境变量
+	File         string  `json:"file"`          // file 导出方式的文件路径
+	ServiceName  string  `json:"service_name"`
+	SampleRatio  float64 `json:"sample_ratio"` // 没有上游采样决定的请求的采样比例
+}
+
+// LogConfig 日志配置
+type LogConfig struct {
+	Level          int            `json:"level"`
+	PackageLevels  map[string]int `json:"package_levels"` // 包路径到级别，如 service、pkg/http
+	Format         string         `json:"format"`         // text, json, logfmt
+	File           string         `json:"file"`           // 为空时只输出到标准输出
+	MaxSize        int64          `json:"max_size"`       // 日志文件轮转大小（字节）
+	MaxBackups     int            `json:"max_backups"`
+	RedactPatterns []string       `json:"redact_patterns"` // 额外需要在日志和错误信息中屏蔽的正则
+}
+
+// CaptureConfig 请求捕获配置，没有指定密钥且采样比例为0时不捕获
+type CaptureConfig struct {
+	Keys       []string `json:"keys"`        // 总是捕获的API密钥名称
+	SampleRate float64  `json:"sample_rate"` // 其他请求的采样比例
+	File       string   `json:"file"`
+	MaxSize    int64    `json:"max_size"` // 捕获文件轮转大小（字节）
+	MaxBackups int      `json:"max_backups"`
+}
+
+// UpstreamConfig 上游录制/回放配置
+type UpstreamConfig struct {
+	Mode         string   `json:"mode"`          // live、record 或 replay
+	FixturesDir  string   `json:"fixtures_dir"`  // 录制文件目录
+	IgnoreFields []string `json:"ignore_fields"` // 匹配请求时忽略的请求体字段
+}
+
+// ChaosConfig 故障注入配置，规则也可以通过管理接口在运行时修改
+type ChaosConfig struct {
+	Enabled   bool   `json:"enabled"`
+	RulesFile string `json:"rules_file"` // JSON格式的故障规则文件
+}
+
+// TokenizerConfig 分词器与用量校正配置
+type TokenizerConfig struct {
+	Default             string            `json:"default"`              // 未匹配模型使用的BPE编码
+	Models              map[string]string `json:"models"`               // 模型名或以 * 结尾的前缀到编码
+	UsageCorrection     string            `json:"usage_correction"`     // server、local 或 threshold
+	CorrectionThreshold float64           `json:"correction_threshold"` // threshold 策略下改用本地计数的偏差比例
+	ContextWindows      map[string]int    `json:"context_windows"`      // 模型的上下文窗口（tokens），内置目录加上环境变量覆盖
+}
+
+// ProxyPoolConfig 动态代理池配置
+type ProxyPoolConfig struct {
+	Enabled             bool          `json:"enabled"`
+	Proxies             []string      `json:"proxies"`
+	File                string        `json:"file"`
+	Strategy            string        `json:"strategy"` // round_robin, random, sticky
+	HealthCheckURL      string        `json:"health_check_url"`
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+	HealthCheckTimeout  time.Duration `json:"health_check_timeout"`
+	MaxFailures         int           `json:"max_failures"`
+	
+	// 每个代理的Transport缓存
+	TransportCacheSize   int           `json:"transport_cache_size"`
+	TransportIdleTimeout time.Duration `json:"transport_idle_timeout"`
 }
 
 // NewConfig 创建新的配置实例
@@ -93,6 +273,19 @@ func NewConfig() (*Config, error) {
 		{"cache", config.loadCacheConfig},
 		{"conn_pool", config.loadConnPoolConfig},
 		{"rate_limit", config.loadRateLimitConfig},
+		{"session", config.loadSessionConfig},
+		{"concurrency", config.loadConcurrencyConfig},
+		{"proxy_pool", config.loadProxyPoolConfig},
+		{"admin", config.loadAdminConfig},
+		{"usage", config.loadUsageConfig},
+		{"budget", config.loadBudgetConfig},
+		{"metrics", config.loadMetricsConfig},
+		{"tracing", config.loadTracingConfig},
+		{"log", config.loadLogConfig},
+		{"capture", config.loadCaptureConfig},
+		{"upstream", config.loadUpstreamConfig},
+		{"chaos", config.loadChaosConfig},
+		{"tokenizer", config.loadTokenizerConfig},
 	}
 
 	for _, cl := range configLoaders {
@@ -125,6 +318,14 @@ func (c *Config) loadServerConfig() error {
 // loadAuthConfig 加载认证配置
 func (c *Config) loadAuthConfig() error {
 	c.Auth.ApiKey = os.Getenv("APIKEY")
+	
+	// 多密钥配置（逗号分隔，每项为 name:key 或 key）
+	for _, entry := range strings.Split(os.Getenv(constants.EnvApiKeys), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			c.Auth.ApiKeys = append(c.Auth.ApiKeys, entry)
+		}
+	}
+	c.Auth.KeysFile = os.Getenv(constants.EnvApiKeysFile)
 
 	return nil
 }
@@ -248,15 +449,602 @@ func (c *Config) loadRateLimitConfig() error {
 	// 突发请求数
 	c.RateLimit.Burst = getEnvAsInt("BURST", 10)
 	
+	// 限流模式
+	c.RateLimit.Mode = strings.ToLower(getEnvWithDefault(constants.EnvRateLimitMode, constants.DefaultRateLimitMode))
+	if c.RateLimit.Mode != constants.RateLimitModeWait && c.RateLimit.Mode != constants.RateLimitModeReject {
+		return fmt.Errorf("%s must be %s or %s, got: %s", constants.EnvRateLimitMode,
+			constants.RateLimitModeWait, constants.RateLimitModeReject, c.RateLimit.Mode)
+	}
+	if c.RateLimit.MaxWait, err = getEnvAsDuration(constants.EnvRateLimitMaxWait, constants.DefaultRateLimitMaxWait); err != nil {
+		return err
+	}
+	c.RateLimit.QueueDepth = getEnvAsInt(constants.EnvRateLimitQueueDepth, constants.DefaultRateLimitQueueDepth)
+	if c.RateLimit.QueueDepth <= 0 {
+		return fmt.Errorf("%s must be positive, got: %d", constants.EnvRateLimitQueueDepth, c.RateLimit.QueueDepth)
+	}
+	
+	// 按密钥/IP限流
+	if c.RateLimit.PerKeyEnabled, err = getEnvAsBool(constants.EnvRateLimitPerKey, false); err != nil {
+		return err
+	}
+	if c.RateLimit.KeyLimit, err = parseRateLimitTier(getEnvWithDefault(constants.EnvRateLimitKeyDefault, constants.DefaultRateLimitKeyLimit)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitKeyDefault, err)
+	}
+	if c.RateLimit.Tiers, err = parseRateLimitTiers(os.Getenv(constants.EnvRateLimitTiers)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitTiers, err)
+	}
+	
+	// 按模型限流
+	if c.RateLimit.PerModelEnabled, err = getEnvAsBool(constants.EnvRateLimitPerModel, false); err != nil {
+		return err
+	}
+	if c.RateLimit.ModelLimit, err = parseRateLimitTier(getEnvWithDefault(constants.EnvRateLimitModelDefault, constants.DefaultRateLimitModelLimit)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitModelDefault, err)
+	}
+	if c.RateLimit.ModelLimits, err = parseRateLimitTiers(os.Getenv(constants.EnvRateLimitModels)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitModels, err)
+	}
+	
+	// 按令牌数限流
+	if c.RateLimit.TokensEnabled, err = getEnvAsBool(constants.EnvRateLimitTokens, false); err != nil {
+		return err
+	}
+	if c.RateLimit.KeyTokenLimit, err = parseTokenLimitTier(getEnvWithDefault(constants.EnvRateLimitKeyTokens, constants.DefaultRateLimitKeyTokens)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitKeyTokens, err)
+	}
+	if c.RateLimit.TokenTiers, err = parseTokenLimitTiers(os.Getenv(constants.EnvRateLimitTokenTiers)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitTokenTiers, err)
+	}
+	if c.RateLimit.ModelTokenLimit, err = parseTokenLimitTier(getEnvWithDefault(constants.EnvRateLimitModelTokens, constants.DefaultRateLimitModelTokens)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitModelTokens, err)
+	}
+	if c.RateLimit.ModelTokenLimits, err = parseTokenLimitTiers(os.Getenv(constants.EnvRateLimitModelTokenLimits)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvRateLimitModelTokenLimits, err)
+	}
+	
+	if c.RateLimit.IdleTTL, err = getEnvAsDuration(constants.EnvRateLimitIdleTTL, constants.DefaultRateLimitIdleTTL); err != nil {
+		return err
+	}
+	
+	// 共享存储
+	c.RateLimit.RedisURL = os.Getenv(constants.EnvRateLimitRedisURL)
+	c.RateLimit.RedisPrefix = getEnvWithDefault(constants.EnvRateLimitRedisPrefix, constants.DefaultRateLimitRedisPrefix)
+	if c.RateLimit.RedisTimeout, err = getEnvAsDuration(constants.EnvRateLimitRedisTimeout, constants.DefaultRateLimitRedisTimeout); err != nil {
+		return err
+	}
+	
+	return nil
+}
+
+// parseRateLimitTier 解析 "每秒请求数:突发容量" 形式的限制
+func parseRateLimitTier(value string) (RateLimitTier, error) {
+	rateStr, burstStr, found := strings.Cut(strings.TrimSpace(value), ":")
+	if !found {
+		return RateLimitTier{}, fmt.Errorf("expected rps:burst, got: %s", value)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+	if err != nil {
+		return RateLimitTier{}, fmt.Errorf("invalid rate %q: %v", rateStr, err)
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(burstStr))
+	if err != nil {
+		return RateLimitTier{}, fmt.Errorf("invalid burst %q: %v", burstStr, err)
+	}
+	return RateLimitTier{RequestsPerSecond: rate, Burst: burst}, nil
+}
+
+// parseRateLimitTiers 解析 "名称:每秒请求数:突发容量" 形式的逗号分隔列表
+func parseRateLimitTiers(value string) (map[string]RateLimitTier, error) {
+	tiers := make(map[string]RateLimitTier)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, limit, found := strings.Cut(entry, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("expected name:rps:burst, got: %s", entry)
+		}
+		tier, err := parseRateLimitTier(limit)
+		if err != nil {
+			return nil, err
+		}
+		tiers[strings.TrimSpace(name)] = tier
+	}
+	return tiers, nil
+}
+
+// parseTokenLimitTier 解析 "每分钟令牌数:每天令牌数" 形式的配额
+func parseTokenLimitTier(value string) (TokenLimitTier, error) {
+	tpmStr, tpdStr, found := strings.Cut(strings.TrimSpace(value), ":")
+	if !found {
+		return TokenLimitTier{}, fmt.Errorf("expected tpm:tpd, got: %s", value)
+	}
+	tpm, err := strconv.Atoi(strings.TrimSpace(tpmStr))
+	if err != nil || tpm < 0 {
+		return TokenLimitTier{}, fmt.Errorf("invalid tokens per minute %q", tpmStr)
+	}
+	tpd, err := strconv.Atoi(strings.TrimSpace(tpdStr))
+	if err != nil || tpd < 0 {
+		return TokenLimitTier{}, fmt.Errorf("invalid tokens per day %q", tpdStr)
+	}
+	return TokenLimitTier{TokensPerMinute: tpm, TokensPerDay: tpd}, nil
+}
+
+// parseTokenLimitTiers 解析 "名称:每分钟令牌数:每天令牌数" 形式的逗号分隔列表
+func parseTokenLimitTiers(value string) (map[string]TokenLimitTier, error) {
+	tiers := make(map[string]TokenLimitTier)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, limit, found := strings.Cut(entry, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("expected name:tpm:tpd, got: %s", entry)
+		}
+		tier, err := parseTokenLimitTier(limit)
+		if err != nil {
+			return nil, err
+		}
+		tiers[strings.TrimSpace(name)] = tier
+	}
+	return tiers, nil
+}
+
+// loadSessionConfig 加载粘性会话配置
+func (c *Config) loadSessionConfig() error {
+	// 是否启用粘性会话（默认关闭）
+	sessionEnabledStr := getEnvWithDefault(constants.EnvSessionEnabled, "false")
+	sessionEnabled, err := strconv.ParseBool(sessionEnabledStr)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false, got: %s", constants.EnvSessionEnabled, sessionEnabledStr)
+	}
+	c.Session.Enabled = sessionEnabled
+	
+	// 会话空闲TTL
+	sessionTTL, err := getEnvAsDuration(constants.EnvSessionTTL, constants.DefaultSessionTTL)
+	if err != nil {
+		return err
+	}
+	c.Session.TTL = sessionTTL
+	
+	// 身份隔离时长
+	quarantineTTL, err := getEnvAsDuration(constants.EnvSessionQuarantineTTL, constants.DefaultSessionQuarantineTTL)
+	if err != nil {
+		return err
+	}
+	c.Session.QuarantineTTL = quarantineTTL
+	
+	return nil
+}
+
+// loadConcurrencyConfig 加载并发限制配置
+func (c *Config) loadConcurrencyConfig() error {
+	c.Concurrency.Global = getEnvAsInt(constants.EnvConcurrencyGlobal, 0)
+	c.Concurrency.PerKey = getEnvAsInt(constants.EnvConcurrencyPerKey, 0)
+	c.Concurrency.PerIdentity = getEnvAsInt(constants.EnvConcurrencyPerIdentity, 0)
+	
+	c.Concurrency.Mode = strings.ToLower(getEnvWithDefault(constants.EnvConcurrencyMode, constants.DefaultConcurrencyMode))
+	if c.Concurrency.Mode != constants.ConcurrencyModeQueue && c.Concurrency.Mode != constants.ConcurrencyModeReject {
+		return fmt.Errorf("%s must be %s or %s, got: %s", constants.EnvConcurrencyMode,
+			constants.ConcurrencyModeQueue, constants.ConcurrencyModeReject, c.Concurrency.Mode)
+	}
+	
+	maxWait, err := getEnvAsDuration(constants.EnvConcurrencyMaxWait, constants.DefaultConcurrencyMaxWait)
+	if err != nil {
+		return err
+	}
+	c.Concurrency.MaxWait = maxWait
+	
+	return nil
+}
+
+// loadProxyPoolConfig 加载动态代理池配置
+func (c *Config) loadProxyPoolConfig() error {
+	// 是否启用代理池（默认关闭）
+	poolEnabledStr := getEnvWithDefault(constants.EnvProxyPoolEnabled, "false")
+	poolEnabled, err := strconv.ParseBool(poolEnabledStr)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false, got: %s", constants.EnvProxyPoolEnabled, poolEnabledStr)
+	}
+	c.ProxyPool.Enabled = poolEnabled
+	
+	// 代理列表（逗号分隔）和代理文件（每行一个）
+	for _, proxy := range strings.Split(os.Getenv(constants.EnvProxyPool), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			c.ProxyPool.Proxies = append(c.ProxyPool.Proxies, proxy)
+		}
+	}
+	c.ProxyPool.File = os.Getenv(constants.EnvProxyPoolFile)
+	
+	// 选择策略
+	c.ProxyPool.Strategy = strings.ToLower(getEnvWithDefault(constants.EnvProxyStrategy, constants.DefaultProxyStrategy))
+	switch c.ProxyPool.Strategy {
+	case "round_robin", "random", "sticky":
+	default:
+		return fmt.Errorf("%s must be one of round_robin, random, sticky, got: %s", constants.EnvProxyStrategy, c.ProxyPool.Strategy)
+	}
+	
+	// 健康检查
+	c.ProxyPool.HealthCheckURL = getEnvWithDefault(constants.EnvProxyHealthCheckURL, constants.DefaultProxyHealthCheckURL)
+	if c.ProxyPool.HealthCheckInterval, err = getEnvAsDuration(constants.EnvProxyHealthCheckInterval, constants.DefaultProxyHealthCheckInterval); err != nil {
+		return err
+	}
+	if c.ProxyPool.HealthCheckTimeout, err = getEnvAsDuration(constants.EnvProxyHealthCheckTimeout, constants.DefaultProxyHealthCheckTimeout); err != nil {
+		return err
+	}
+	c.ProxyPool.MaxFailures = getEnvAsInt(constants.EnvProxyMaxFailures, constants.DefaultProxyMaxFailures)
+	
+	// 代理Transport缓存
+	c.ProxyPool.TransportCacheSize = getEnvAsInt(constants.EnvProxyTransportCacheSize, constants.DefaultProxyTransportCacheSize)
+	if c.ProxyPool.TransportIdleTimeout, err = getEnvAsDuration(constants.EnvProxyTransportIdleTimeout, constants.DefaultProxyTransportIdleTimeout); err != nil {
+		return err
+	}
+	
+	return nil
+}
+
+// loadAdminConfig 加载管理接口配置
+func (c *Config) loadAdminConfig() error {
+	c.Admin.Key = os.Getenv(constants.EnvAdminKey)
+	c.Admin.StorePath = getEnvWithDefault(constants.EnvAdminStorePath, constants.DefaultAdminStorePath)
+	c.Admin.AuditLogPath = getEnvWithDefault(constants.EnvAdminAuditLog, constants.DefaultAdminAuditLog)
+	return nil
+}
+
+// loadUsageConfig 加载用量账本配置
+func (c *Config) loadUsageConfig() error {
+	var err error
+	if c.Usage.Enabled, err = getEnvAsBool(constants.EnvUsageEnabled, constants.DefaultUsageEnabled); err != nil {
+		return err
+	}
+	c.Usage.StorePath = getEnvWithDefault(constants.EnvUsageStorePath, constants.DefaultUsageStorePath)
+	if c.Usage.Retention, err = getEnvAsDuration(constants.EnvUsageRetention, constants.DefaultUsageRetention); err != nil {
+		return err
+	}
+	if c.Usage.Retention < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvUsageRetention)
+	}
+	return nil
+}
+
+// loadBudgetConfig 加载预算配置
+func (c *Config) loadBudgetConfig() error {
+	var err error
+	if c.Budget.Enabled, err = getEnvAsBool(constants.EnvBudgetEnabled, false); err != nil {
+		return err
+	}
+	if c.Budget.Prices, err = parseModelPrices(os.Getenv(constants.EnvModelPrices)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvModelPrices, err)
+	}
+	if c.Budget.Daily, err = getEnvAsFloat(constants.EnvBudgetDaily, 0); err != nil {
+		return err
+	}
+	if c.Budget.Monthly, err = getEnvAsFloat(constants.EnvBudgetMonthly, 0); err != nil {
+		return err
+	}
+	if c.Budget.WarnThresholds, err = parseThresholds(getEnvWithDefault(constants.EnvBudgetWarnThresholds, constants.DefaultBudgetWarnThresholds)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvBudgetWarnThresholds, err)
+	}
+	c.Budget.WebhookURL = os.Getenv(constants.EnvBudgetWebhookURL)
+	if c.Budget.WebhookTimeout, err = getEnvAsDuration(constants.EnvBudgetWebhookTimeout, constants.DefaultBudgetWebhookTimeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadMetricsConfig 加载监控指标配置
+func (c *Config) loadMetricsConfig() error {
+	var err error
+	if c.Metrics.LatencyWindow, err = getEnvAsDuration(constants.EnvMetricsLatencyWindow, constants.DefaultMetricsLatencyWindow); err != nil {
+		return err
+	}
+	if c.Metrics.LatencyWindow < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvMetricsLatencyWindow)
+	}
+	return nil
+}
+
+// loadTracingConfig 加载链路追踪配置
+func (c *Config) loadTracingConfig() error {
+	c.Tracing.Exporter = strings.ToLower(getEnvWithDefault(constants.EnvTracingExporter, constants.DefaultTracingExporter))
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout", "file":
+	default:
+		return fmt.Errorf("invalid %s: %s, expected none, otlp, stdout or file", constants.EnvTracingExporter, c.Tracing.Exporter)
+	}
+	c.Tracing.OTLPEndpoint = os.Getenv(constants.EnvTracingOTLPEndpoint)
+	c.Tracing.File = getEnvWithDefault(constants.EnvTracingFile, constants.DefaultTracingFile)
+	c.Tracing.ServiceName = getEnvWithDefault(constants.EnvTracingServiceName, constants.DefaultTracingServiceName)
+
+	var err error
+	if c.Tracing.SampleRatio, err = getEnvAsFloat(constants.EnvTracingSampleRatio, constants.DefaultTracingSampleRatio); err != nil {
+		return err
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("%s must be between 0 and 1", constants.EnvTracingSampleRatio)
+	}
+	return nil
+}
+
+// loadLogConfig 加载日志配置
+func (c *Config) loadLogConfig() error {
+	levelName := getEnvWithDefault(constants.EnvLogLevel, constants.DefaultLogLevel)
+	level, ok := log.ParseLevel(levelName)
+	if !ok {
+		return fmt.Errorf("invalid %s: %s, expected debug, info, warn, error or fatal", constants.EnvLogLevel, levelName)
+	}
+	c.Log.Level = level
+
+	var err error
+	if c.Log.PackageLevels, err = parsePackageLevels(os.Getenv(constants.EnvLogLevels)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvLogLevels, err)
+	}
+
+	c.Log.Format = strings.ToLower(getEnvWithDefault(constants.EnvLogFormat, constants.DefaultLogFormat))
+	switch c.Log.Format {
+	case log.FormatText, log.FormatJSON, log.FormatLogfmt:
+	default:
+		return fmt.Errorf("invalid %s: %s, expected text, json or logfmt", constants.EnvLogFormat, c.Log.Format)
+	}
+
+	c.Log.File = os.Getenv(constants.EnvLogFile)
+	maxSizeMB := getEnvAsInt(constants.EnvLogFileMaxSize, constants.DefaultLogFileMaxSizeMB)
+	if maxSizeMB < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvLogFileMaxSize)
+	}
+	c.Log.MaxSize = int64(maxSizeMB) << 20
+	c.Log.MaxBackups = getEnvAsInt(constants.EnvLogFileMaxBackups, constants.DefaultLogFileBackups)
+	if c.Log.MaxBackups < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvLogFileMaxBackups)
+	}
+
+	c.Log.RedactPatterns = splitPatterns(os.Getenv(constants.EnvRedactPatterns))
+	for _, pattern := range c.Log.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", constants.EnvRedactPatterns, pattern, err)
+		}
+	}
+	return nil
+}
+
+// loadCaptureConfig 加载请求捕获配置
+func (c *Config) loadCaptureConfig() error {
+	c.Capture.Keys = nil
+	for _, key := range strings.Split(os.Getenv(constants.EnvCaptureKeys), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			c.Capture.Keys = append(c.Capture.Keys, key)
+		}
+	}
+
+	var err error
+	if c.Capture.SampleRate, err = getEnvAsFloat(constants.EnvCaptureSampleRate, 0); err != nil {
+		return err
+	}
+	if c.Capture.SampleRate > 1 {
+		return fmt.Errorf("%s must be between 0 and 1", constants.EnvCaptureSampleRate)
+	}
+
+	c.Capture.File = getEnvWithDefault(constants.EnvCaptureFile, constants.DefaultCaptureFile)
+	maxSizeMB := getEnvAsInt(constants.EnvCaptureFileMaxSize, constants.DefaultCaptureMaxSizeMB)
+	if maxSizeMB < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvCaptureFileMaxSize)
+	}
+	c.Capture.MaxSize = int64(maxSizeMB) << 20
+	c.Capture.MaxBackups = getEnvAsInt(constants.EnvCaptureFileMaxBackups, constants.DefaultCaptureBackups)
+	if c.Capture.MaxBackups < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvCaptureFileMaxBackups)
+	}
+	return nil
+}
+
+// loadUpstreamConfig 加载上游录制/回放配置
+func (c *Config) loadUpstreamConfig() error {
+	c.Upstream.Mode = strings.ToLower(getEnvWithDefault(constants.EnvUpstreamMode, constants.DefaultUpstreamMode))
+	switch c.Upstream.Mode {
+	case constants.UpstreamModeLive, constants.UpstreamModeRecord, constants.UpstreamModeReplay:
+	default:
+		return fmt.Errorf("%s must be one of %s, %s, %s, got: %s", constants.EnvUpstreamMode,
+			constants.UpstreamModeLive, constants.UpstreamModeRecord, constants.UpstreamModeReplay, c.Upstream.Mode)
+	}
+
+	c.Upstream.FixturesDir = getEnvWithDefault(constants.EnvUpstreamFixturesDir, constants.DefaultUpstreamFixturesDir)
+	c.Upstream.IgnoreFields = nil
+	for _, field := range strings.Split(getEnvWithDefault(constants.EnvUpstreamFixtureIgnoreFields, constants.DefaultUpstreamFixtureIgnoreFields), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			c.Upstream.IgnoreFields = append(c.Upstream.IgnoreFields, field)
+		}
+	}
+	return nil
+}
+
+// loadChaosConfig 加载故障注入配置
+func (c *Config) loadChaosConfig() error {
+	var err error
+	if c.Chaos.Enabled, err = getEnvAsBool(constants.EnvChaosEnabled, false); err != nil {
+		return err
+	}
+	c.Chaos.RulesFile = os.Getenv(constants.EnvChaosRulesFile)
+	return nil
+}
+
+// loadTokenizerConfig 加载分词器与用量校正配置
+func (c *Config) loadTokenizerConfig() error {
+	c.Tokenizer.Default = strings.ToLower(getEnvWithDefault(constants.EnvTokenizerDefault, constants.DefaultTokenizerEncoding))
+	if !tokenizer.IsSupported(c.Tokenizer.Default) {
+		return fmt.Errorf("invalid %s: %s", constants.EnvTokenizerDefault, c.Tokenizer.Default)
+	}
+
+	var err error
+	if c.Tokenizer.Models, err = parseTokenizerModels(os.Getenv(constants.EnvTokenizerModels)); err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvTokenizerModels, err)
+	}
+
+	c.Tokenizer.UsageCorrection = strings.ToLower(getEnvWithDefault(constants.EnvUsageCorrection, constants.DefaultUsageCorrection))
+	switch c.Tokenizer.UsageCorrection {
+	case "server", "local", "threshold":
+	default:
+		return fmt.Errorf("invalid %s: %s, expected server, local or threshold", constants.EnvUsageCorrection, c.Tokenizer.UsageCorrection)
+	}
+	if c.Tokenizer.CorrectionThreshold, err = getEnvAsFloat(constants.EnvUsageCorrectionThreshold, constants.DefaultUsageCorrectionThreshold); err != nil {
+		return err
+	}
+	if c.Tokenizer.CorrectionThreshold < 0 {
+		return fmt.Errorf("%s must not be negative", constants.EnvUsageCorrectionThreshold)
+	}
+
+	c.Tokenizer.ContextWindows = make(map[string]int, len(ModelContextWindows))
+	for model, window := range ModelContextWindows {
+		c.Tokenizer.ContextWindows[model] = window
+	}
+	overrides, err := parseContextWindows(os.Getenv(constants.EnvModelContextWindows))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", constants.EnvModelContextWindows, err)
+	}
+	for model, window := range overrides {
+		c.Tokenizer.ContextWindows[model] = window
+	}
 	return nil
 }
 
+// parseContextWindows 解析 "模型:tokens" 形式的逗号分隔列表
+func parseContextWindows(value string) (map[string]int, error) {
+	windows := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, tokens, ok := strings.Cut(entry, ":")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("entry %q must be model:tokens", entry)
+		}
+		window, err := strconv.Atoi(strings.TrimSpace(tokens))
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid context window in %s", entry)
+		}
+		windows[model] = window
+	}
+	return windows, nil
+}
+
+// parseTokenizerModels 解析 "模型=编码" 形式的逗号分隔列表，模型名以 * 结尾时按前缀匹配，如 gpt-4*=cl100k_base
+func parseTokenizerModels(value string) (map[string]string, error) {
+	models := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, encoding, ok := strings.Cut(entry, "=")
+		model, encoding = strings.TrimSpace(model), strings.ToLower(strings.TrimSpace(encoding))
+		if !ok || model == "" {
+			return nil, fmt.Errorf("entry %q must be model=encoding", entry)
+		}
+		if !tokenizer.IsSupported(encoding) {
+			return nil, fmt.Errorf("unsupported encoding %q for model %s", encoding, model)
+		}
+		models[model] = encoding
+	}
+	return models, nil
+}
+
+// splitPatterns 按逗号拆分正则列表，正则中的逗号写作 \,（在正则中同样匹配逗号）
+func splitPatterns(value string) []string {
+	var patterns []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == ',' && (i == 0 || value[i-1] != '\\') {
+			if pattern := strings.TrimSpace(value[start:i]); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+			start = i + 1
+		}
+	}
+	if pattern := strings.TrimSpace(value[start:]); pattern != "" {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// parsePackageLevels 解析 "包路径=级别" 形式的逗号分隔列表，如 service=debug,pkg/http=warn
+func parsePackageLevels(value string) (map[string]int, error) {
+	levels := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pkg, levelName, ok := strings.Cut(entry, "=")
+		pkg = strings.Trim(strings.TrimSpace(pkg), "/")
+		if !ok || pkg == "" {
+			return nil, fmt.Errorf("entry %q must be package=level", entry)
+		}
+		level, ok := log.ParseLevel(levelName)
+		if !ok {
+			return nil, fmt.Errorf("unknown level %q for package %s", levelName, pkg)
+		}
+		levels[pkg] = level
+	}
+	return levels, nil
+}
+
+// parseModelPrices 解析 "模型:输入价格:输出价格[:推理价格]" 形式的逗号分隔列表，未设置推理价格时使用输出价格
+func parseModelPrices(value string) (map[string]ModelPrice, error) {
+	prices := make(map[string]ModelPrice)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("expected model:input:output[:reasoning], got: %s", entry)
+		}
+
+		values := make([]float64, len(parts)-1)
+		for i, part := range parts[1:] {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("invalid price in %s", entry)
+			}
+			values[i] = v
+		}
+
+		price := ModelPrice{Input: values[0], Output: values[1], Reasoning: values[1]}
+		if len(values) == 3 {
+			price.Reasoning = values[2]
+		}
+		prices[strings.TrimSpace(parts[0])] = price
+	}
+	return prices, nil
+}
+
+// parseThresholds 解析逗号分隔的比例列表，每个值需在 (0, 1] 之间
+func parseThresholds(value string) ([]float64, error) {
+	var thresholds []float64
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(entry, 64)
+		if err != nil || v <= 0 || v > 1 {
+			return nil, fmt.Errorf("threshold must be between 0 and 1, got: %s", entry)
+		}
+		thresholds = append(thresholds, v)
+	}
+	return thresholds, nil
+}
+
 // loadModelMappings 加载模型映射配置
 func (c *Config) loadModelMappings() {
 	mappingsStr := os.Getenv("MODEL_MAPPINGS")
 	if mappingsStr == "" {
 		log.Info("MODEL_MAPPINGS not set, using default model mappings.")
-		c.ModelMappings = ModelMapping // 使用硬编码的默认值
+		c.ModelMappings = copyMapping(ModelMapping) // 使用硬编码的默认值
 		return
 	}
 
@@ -282,7 +1070,7 @@ func (c *Config) loadModelMappings() {
 		log.Info("Loaded model mappings from MODEL_MAPPINGS environment variable.")
 	} else {
 		log.Warn("MODEL_MAPPINGS was set but no valid mappings were parsed, using default model mappings.")
-		c.ModelMappings = ModelMapping // 解析失败或无有效映射时，使用硬编码的默认值
+		c.ModelMappings = copyMapping(ModelMapping) // 解析失败或无有效映射时，使用硬编码的默认值
 	}
 }
 
@@ -325,6 +1113,51 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return value
 }
 
+// getEnvAsFloat 获取环境变量并解析为非负浮点数
+func getEnvAsFloat(key string, defaultValue float64) (float64, error) {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number, got: %s", key, valueStr)
+	}
+
+	return value, nil
+}
+
+// getEnvAsDuration 获取环境变量并解析为时间间隔
+func getEnvAsDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s, error: %v", key, valueStr, err)
+	}
+
+	return value, nil
+}
+
+// getEnvAsBool 获取环境变量并解析为布尔值
+func getEnvAsBool(key string, defaultValue bool) (bool, error) {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got: %s", key, valueStr)
+	}
+
+	return value, nil
+}
+
 // getProxy 获取代理设置
 func getProxy() string {
 	if proxy := os.Getenv("HTTP_PROXY"); proxy != "" {
@@ -354,7 +1187,7 @@ func (c *Config) Models() []string {
 	// 从ModelMapping中获取所有内部模型名称
 	internalModels := make(map[string]bool)
 	// 从 c.ModelMappings 获取模型名称
-	for _, internalName := range c.ModelMappings {
+	for _, internalName := range c.GetModelMapping() {
 		internalModels[internalName] = true
 	}
 	
@@ -374,12 +1207,41 @@ func (c *Config) Retry() int {
 // GetModelMapping 返回模型映射。
 // 此函数允许其他包安全地访问 ModelMapping，
 // 而无需直接访问包级变量，从而保持封装性。
+// 映射可通过管理接口在运行时修改，因此返回副本。
 func (c *Config) GetModelMapping() map[string]string {
-	// 返回 ModelMapping 的副本以防止外部修改
-	// 或者直接返回 ModelMapping 如果不担心外部修改。
-	// 为了简单和性能，这里直接返回。
-	// 如果需要更强的封装，可以考虑返回一个副本。
-	return c.ModelMappings
+	c.mappingMu.RLock()
+	defer c.mappingMu.RUnlock()
+	return copyMapping(c.ModelMappings)
+}
+
+// SetModelMapping 添加或更新外部模型名到内部模型名的映射
+func (c *Config) SetModelMapping(external, internal string) {
+	c.mappingMu.Lock()
+	defer c.mappingMu.Unlock()
+	if c.ModelMappings == nil {
+		c.ModelMappings = make(map[string]string)
+	}
+	c.ModelMappings[external] = internal
+}
+
+// DeleteModelMapping 删除模型映射，返回映射是否存在
+func (c *Config) DeleteModelMapping(external string) bool {
+	c.mappingMu.Lock()
+	defer c.mappingMu.Unlock()
+	if _, ok := c.ModelMappings[external]; !ok {
+		return false
+	}
+	delete(c.ModelMappings, external)
+	return true
+}
+
+// copyMapping 复制模型映射
+func copyMapping(mapping map[string]string) map[string]string {
+	copied := make(map[string]string, len(mapping))
+	for k, v := range mapping {
+		copied[k] = v
+	}
+	return copied
 }
 
 // ModelMapping 定义模型名称映射
@@ -394,3 +1256,16 @@ var ModelMapping = map[string]string{
 	"gemini-2.5-flash-preview-05-20": "scira-google",
 	"gemini-2.5-pro-preview-05-06":   "scira-google-pro",
 }
+
+// ModelContextWindows 定义外部模型名的上下文窗口（tokens）
+var ModelContextWindows = map[string]int{
+	"claude-4-sonnet":                200000,
+	"claude-4-sonnet-thinking":       200000,
+	"gpt-4o":                         128000,
+	"o4-mini":                        200000,
+	"grok-3":                         131072,
+	"grok-3-mini":                    131072,
+	"grok-2-vision":                  32768,
+	"gemini-2.5-flash-preview-05-20": 1048576,
+	"gemini-2.5-pro-preview-05-06":   1048576,
+}
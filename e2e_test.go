@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"scira2api/config"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/mockupstream"
+	"scira2api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testAPIKey = "sk-e2e-test-key"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetLevel(log.WARN)
+	os.Exit(m.Run())
+}
+
+// testEnv 连接模拟上游的完整服务：配置、处理器和 setupRoutes 注册的路由
+type testEnv struct {
+	t        *testing.T
+	upstream *mockupstream.Server
+	server   *httptest.Server
+}
+
+// newTestEnv 启动模拟上游和服务，env 覆盖默认的测试配置
+// 默认关闭缓存、限流和用量账本，重试次数为1，各测试按需打开
+func newTestEnv(t *testing.T, opts mockupstream.Options, env map[string]string) *testEnv {
+	t.Helper()
+
+	upstream, upstreamServer := mockupstream.NewTestServer(opts)
+	t.Cleanup(upstreamServer.Close)
+
+	settings := map[string]string{
+		"BASE_URL":                   upstreamServer.URL + "/",
+		"APIKEY":                     testAPIKey,
+		constants.EnvCacheEnabled:    "false",
+		"RATE_LIMIT_ENABLED":         "false",
+		constants.EnvUsageEnabled:    "false",
+		"RETRY":                      "1",
+		constants.EnvUpstreamMode:    constants.UpstreamModeLive,
+		constants.EnvCaptureKeys:     "",
+		constants.EnvTracingExporter: "none",
+	}
+	for key, value := range env {
+		settings[key] = value
+	}
+	for key, value := range settings {
+		t.Setenv(key, value)
+	}
+
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	keyStore, err := setupKeyStore(cfg)
+	if err != nil {
+		t.Fatalf("setupKeyStore: %v", err)
+	}
+	handler := service.NewChatHandler(cfg)
+	t.Cleanup(func() { handler.Close() })
+
+	server := httptest.NewServer(newRouter(cfg, handler, nil, keyStore))
+	t.Cleanup(server.Close)
+	return &testEnv{t: t, upstream: upstream, server: server}
+}
+
+// chat 发送聊天请求，返回响应和完整的响应体
+func (e *testEnv) chat(stream bool, message string, apiKey string) (*http.Response, string) {
+	e.t.Helper()
+
+	body, _ := json.Marshal(models.OpenAIChatCompletionsRequest{
+		Model:    "gpt-4o",
+		Stream:   stream,
+		Messages: []models.Message{{Role: "user", Content: message}},
+	})
+	req, err := http.NewRequest(http.MethodPost, e.server.URL+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatalf("POST /v1/chat/completions: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatalf("read response: %v", err)
+	}
+	return resp, string(data)
+}
+
+// completion 发送非流式请求并解析响应，状态码不是200时测试失败
+func (e *testEnv) completion(message string) models.OpenAIChatCompletionsResponse {
+	e.t.Helper()
+
+	resp, body := e.chat(false, message, testAPIKey)
+	if resp.StatusCode != http.StatusOK {
+		e.t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+	}
+	var completion models.OpenAIChatCompletionsResponse
+	if err := json.Unmarshal([]byte(body), &completion); err != nil {
+		e.t.Fatalf("decode completion %q: %v", body, err)
+	}
+	return completion
+}
+
+// parseSSE 按SSE格式拆分事件：每个事件只有一行 "data: ..."，事件之间以空行分隔，最后一个事件为 [DONE]
+func parseSSE(t *testing.T, body string) []models.OpenAIChatCompletionsStreamResponse {
+	t.Helper()
+
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Fatalf("stream does not end with [DONE]: %q", body)
+	}
+	events := strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n")
+	var chunks []models.OpenAIChatCompletionsStreamResponse
+	for i, event := range events {
+		if !strings.HasPrefix(event, "data: ") || strings.Contains(event, "\n") {
+			t.Fatalf("event %d is not a single data line: %q", i, event)
+		}
+		data := strings.TrimPrefix(event, "data: ")
+		if i == len(events)-1 {
+			if data != "[DONE]" {
+				t.Fatalf("last event = %q, want [DONE]", data)
+			}
+			break
+		}
+		var chunk models.OpenAIChatCompletionsStreamResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("event %d is not JSON: %q: %v", i, data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// streamText 拼接流式响应中的文本和推理内容
+func streamText(chunks []models.OpenAIChatCompletionsStreamResponse) (content, reasoning string) {
+	for _, chunk := range chunks {
+		for _, choice := range chunk.Choices {
+			content += choice.Delta.Content
+			reasoning += choice.Delta.ReasoningContent
+		}
+	}
+	return content, reasoning
+}
+
+func TestStreamSSEFraming(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{ChunkSize: 5}, nil)
+
+	resp, body := env.chat(true, "hello", testAPIKey)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, constants.SSEContentType) {
+		t.Fatalf("Content-Type = %q", contentType)
+	}
+
+	chunks := parseSSE(t, body)
+	if len(chunks) < 3 {
+		t.Fatalf("expected initial, content and final chunks, got %d", len(chunks))
+	}
+	first, last := chunks[0], chunks[len(chunks)-1]
+	if first.Choices[0].Delta.Role != constants.RoleAssistant {
+		t.Fatalf("first chunk delta = %+v, want role assistant", first.Choices[0].Delta)
+	}
+	if last.Choices[0].FinishReason != "stop" {
+		t.Fatalf("final chunk finish_reason = %q", last.Choices[0].FinishReason)
+	}
+	for i, chunk := range chunks {
+		if chunk.ID != first.ID || chunk.Object != constants.ObjectChatCompletionChunk || chunk.Model != "gpt-4o" {
+			t.Fatalf("chunk %d has id=%q object=%q model=%q", i, chunk.ID, chunk.Object, chunk.Model)
+		}
+	}
+
+	content, reasoning := streamText(chunks)
+	if content != mockupstream.DefaultText {
+		t.Fatalf("content = %q", content)
+	}
+	if reasoning != mockupstream.DefaultReasoning {
+		t.Fatalf("reasoning = %q", reasoning)
+	}
+	if usage := last.Usage; usage.TotalTokens != usage.PromptTokens+usage.CompletionTokens || usage.CompletionTokens == 0 {
+		t.Fatalf("final usage = %+v", usage)
+	}
+}
+
+func TestSyncCompletion(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, nil)
+
+	completion := env.completion("hello")
+	if completion.Object != constants.ObjectChatCompletion || completion.Model != "gpt-4o" || len(completion.Choices) != 1 {
+		t.Fatalf("unexpected completion: %+v", completion)
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Role != constants.RoleAssistant || choice.Message.Content != mockupstream.DefaultText || choice.FinishReason != "stop" {
+		t.Fatalf("unexpected choice: %+v", choice)
+	}
+
+	requests := env.upstream.Requests()
+	if len(requests) != 1 || requests[0].LastMessage != "hello" {
+		t.Fatalf("upstream requests = %+v", requests)
+	}
+}
+
+func TestUsageCorrection(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, nil)
+	message := strings.Repeat("How many tokens does this prompt use? ", 8)
+	text := strings.Repeat("The answer is long enough to count. ", 8)
+
+	// 上游不返回用量时使用本地计算值
+	env.upstream.Enqueue(mockupstream.Response{Lines: []string{`0:` + quoteJSON(text)}})
+	calculated := env.completion(message).Usage
+	if calculated.PromptTokens < 10 || calculated.CompletionTokens < 10 {
+		t.Fatalf("calculated usage too small for the test: %+v", calculated)
+	}
+
+	cases := []struct {
+		name             string
+		prompt, complete int
+		want             models.Usage
+	}{
+		{
+			name:   "deviation over 20% uses calculated",
+			prompt: calculated.PromptTokens * 10, complete: calculated.CompletionTokens * 10,
+			want: calculated,
+		},
+		{
+			name:   "deviation within 20% keeps upstream",
+			prompt: calculated.PromptTokens * 11 / 10, complete: calculated.CompletionTokens * 11 / 10,
+			want: models.Usage{
+				PromptTokens:     calculated.PromptTokens * 11 / 10,
+				CompletionTokens: calculated.CompletionTokens * 11 / 10,
+				TotalTokens:      calculated.PromptTokens*11/10 + calculated.CompletionTokens*11/10,
+			},
+		},
+	}
+	for _, c := range cases {
+		env.upstream.Enqueue(mockupstream.Response{Text: text, PromptTokens: c.prompt, CompletionTokens: c.complete})
+		if got := env.completion(message).Usage; got != c.want {
+			t.Errorf("%s: usage = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	// 流式响应的最终用量同样经过校正
+	env.upstream.Enqueue(mockupstream.Response{Lines: []string{`0:` + quoteJSON(text)}})
+	_, body := env.chat(true, message, testAPIKey)
+	streamChunks := parseSSE(t, body)
+	streamCalculated := streamChunks[len(streamChunks)-1].Usage
+
+	env.upstream.Enqueue(mockupstream.Response{Text: text, PromptTokens: 5000, CompletionTokens: 5000})
+	_, body = env.chat(true, message, testAPIKey)
+	streamChunks = parseSSE(t, body)
+	if got := streamChunks[len(streamChunks)-1].Usage; got != streamCalculated {
+		t.Fatalf("stream usage = %+v, want calculated %+v", got, streamCalculated)
+	}
+}
+
+func TestRetryOnUpstreamFailure(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, map[string]string{"RETRY": "3"})
+
+	// 前两次尝试失败，第三次成功
+	env.upstream.Enqueue(
+		mockupstream.Response{Status: http.StatusInternalServerError, Error: "boom"},
+		mockupstream.Response{Status: http.StatusBadGateway, Error: "bad gateway"},
+	)
+	if content := env.completion("retry me").Choices[0].Message.Content; content != mockupstream.DefaultText {
+		t.Fatalf("content = %q", content)
+	}
+	if n := len(env.upstream.Requests()); n != 3 {
+		t.Fatalf("upstream received %d requests, want 3", n)
+	}
+
+	// 流式请求同样重试
+	env.upstream.Enqueue(mockupstream.Response{Status: http.StatusInternalServerError})
+	resp, body := env.chat(true, "retry stream", testAPIKey)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream status = %d, body = %s", resp.StatusCode, body)
+	}
+	if content, _ := streamText(parseSSE(t, body)); content != mockupstream.DefaultText {
+		t.Fatalf("stream content = %q", content)
+	}
+	if n := len(env.upstream.Requests()); n != 5 {
+		t.Fatalf("upstream received %d requests, want 5", n)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, map[string]string{"RETRY": "2"})
+	env.upstream.Enqueue(
+		mockupstream.Response{Status: http.StatusInternalServerError},
+		mockupstream.Response{Status: http.StatusInternalServerError},
+	)
+
+	resp, body := env.chat(false, "fail", testAPIKey)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, `"error"`) {
+		t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+	}
+	if n := len(env.upstream.Requests()); n != 2 {
+		t.Fatalf("upstream received %d requests, want 2", n)
+	}
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, map[string]string{constants.EnvCacheEnabled: "true"})
+
+	first := env.completion("cache me")
+	second := env.completion("cache me")
+	if second.ID != first.ID || second.Choices[0].Message.Content != first.Choices[0].Message.Content {
+		t.Fatalf("second response was not served from cache: %+v vs %+v", first, second)
+	}
+	if n := len(env.upstream.Requests()); n != 1 {
+		t.Fatalf("upstream received %d requests, want 1", n)
+	}
+
+	// 不同的请求不命中缓存
+	env.completion("something else")
+	if n := len(env.upstream.Requests()); n != 2 {
+		t.Fatalf("upstream received %d requests, want 2", n)
+	}
+}
+
+func TestAuthRejection(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, nil)
+
+	for _, apiKey := range []string{"", "sk-wrong-key"} {
+		resp, body := env.chat(false, "hello", apiKey)
+		if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body, `"error"`) {
+			t.Fatalf("key %q: status = %d, body = %s", apiKey, resp.StatusCode, body)
+		}
+	}
+	if n := len(env.upstream.Requests()); n != 0 {
+		t.Fatalf("rejected requests reached the upstream %d times", n)
+	}
+
+	// 模型列表是公开接口，不需要认证
+	resp, err := http.Get(env.server.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/v1/models status = %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimitRejection(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, map[string]string{
+		"RATE_LIMIT_ENABLED":       "true",
+		"REQUESTS_PER_SECOND":      "0.01",
+		"BURST":                    "1",
+		constants.EnvRateLimitMode: constants.RateLimitModeReject,
+	})
+
+	if resp, body := env.chat(false, "first", testAPIKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request status = %d, body = %s", resp.StatusCode, body)
+	}
+
+	resp, body := env.chat(false, "second", testAPIKey)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, `"error"`) {
+		t.Fatalf("second request status = %d, body = %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get(constants.HeaderRetryAfter) == "" {
+		t.Fatal("429 response has no Retry-After header")
+	}
+	if remaining := resp.Header.Get(constants.HeaderRateLimitRemainingRequests); remaining != "0" {
+		t.Fatalf("%s = %q, want 0", constants.HeaderRateLimitRemainingRequests, remaining)
+	}
+	if n := len(env.upstream.Requests()); n != 1 {
+		t.Fatalf("upstream received %d requests, want 1", n)
+	}
+}
+
+func TestConcurrencyRejection(t *testing.T) {
+	for _, mode := range []string{constants.ConcurrencyModeReject, constants.ConcurrencyModeQueue} {
+		t.Run(mode, func(t *testing.T) {
+			env := newTestEnv(t, mockupstream.Options{Latency: 300 * time.Millisecond}, map[string]string{
+				constants.EnvConcurrencyGlobal:  "1",
+				constants.EnvConcurrencyMode:    mode,
+				constants.EnvConcurrencyMaxWait: "50ms",
+			})
+
+			// 第一个请求占住唯一的名额
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				env.chat(false, "slow", testAPIKey)
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			// 两种模式的拒绝都带固定的 Retry-After，与 CONCURRENCY_MAX_WAIT 无关
+			resp, body := env.chat(false, "second", testAPIKey)
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+			}
+			if retryAfter := resp.Header.Get(constants.HeaderRetryAfter); retryAfter != "1" {
+				t.Fatalf("Retry-After = %q, want 1", retryAfter)
+			}
+			<-done
+		})
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{ChunkSize: 3, ChunkDelay: time.Millisecond}, nil)
+
+	// 并发的流式请求各自独立地转换和刷新，在 -race 下检查流处理中的共享状态
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := env.chat(true, "concurrent", testAPIKey)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, body = %s", resp.StatusCode, body)
+				return
+			}
+			if content, _ := streamText(parseSSE(t, body)); content != mockupstream.DefaultText {
+				t.Errorf("content = %q", content)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestChaosFaults(t *testing.T) {
+	// chaosEnv 启动按规则注入故障的服务
+	chaosEnv := func(t *testing.T, rules string, env map[string]string) *testEnv {
+		path := filepath.Join(t.TempDir(), "chaos.json")
+		if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		settings := map[string]string{
+			constants.EnvChaosEnabled:   "true",
+			constants.EnvChaosRulesFile: path,
+		}
+		for key, value := range env {
+			settings[key] = value
+		}
+		return newTestEnv(t, mockupstream.Options{ChunkSize: 3}, settings)
+	}
+
+	t.Run("status", func(t *testing.T) {
+		env := chaosEnv(t, `[{"fault":"status","status":503}]`, map[string]string{"RETRY": "2"})
+
+		// 每次尝试都按上游返回503处理，重试耗尽后与真实故障一样返回503，请求没有到达上游
+		resp, body := env.chat(false, "chaos", testAPIKey)
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, `"error"`) {
+			t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+		}
+		if n := len(env.upstream.Requests()); n != 0 {
+			t.Fatalf("upstream received %d requests, want 0", n)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		env := chaosEnv(t, `[{"fault":"malformed","after":1,"models":["gpt-4o"]}]`, nil)
+
+		resp, body := env.chat(true, "chaos", testAPIKey)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+		}
+
+		// 第二个事件之前多出一个截断的数据块，其余事件不受影响
+		events := strings.Split(body, "\n\n")
+		if len(events) < 3 || json.Valid([]byte(strings.TrimPrefix(events[1], "data: "))) {
+			t.Fatalf("event 1 should be malformed: %q", body)
+		}
+		if !strings.HasPrefix(events[2], events[1]) {
+			t.Fatalf("malformed event %q is not a truncated copy of %q", events[1], events[2])
+		}
+		intact := strings.Join(append(events[:1:1], events[2:]...), "\n\n")
+		if content, _ := streamText(parseSSE(t, intact)); content != mockupstream.DefaultText {
+			t.Fatalf("content = %q", content)
+		}
+	})
+}
+
+func TestUpstreamFixtures(t *testing.T) {
+	dir := t.TempDir()
+
+	// 录制模式访问上游并保存响应
+	recorder := newTestEnv(t, mockupstream.Options{}, map[string]string{
+		constants.EnvUpstreamMode:        constants.UpstreamModeRecord,
+		constants.EnvUpstreamFixturesDir: dir,
+	})
+	recorded := recorder.completion("fixture").Choices[0].Message.Content
+	if recorded != mockupstream.DefaultText {
+		t.Fatalf("recorded content = %q", recorded)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("fixtures dir has %d entries, want 1", len(entries))
+	}
+
+	// 回放模式用录制的响应应答同一请求，不访问上游；chatId和userId不同也能命中
+	replayer := newTestEnv(t, mockupstream.Options{}, map[string]string{
+		constants.EnvUpstreamMode:        constants.UpstreamModeReplay,
+		constants.EnvUpstreamFixturesDir: dir,
+		"RETRY":                          "3",
+	})
+	if content := replayer.completion("fixture").Choices[0].Message.Content; content != recorded {
+		t.Fatalf("replayed content = %q, want %q", content, recorded)
+	}
+
+	// 没有录制的请求直接失败，错误信息带请求哈希，不换身份重试
+	resp, body := replayer.chat(false, "not recorded", testAPIKey)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "hash") {
+		t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+	}
+	if stats := replayer.fixtureStats(); stats["hits"] != float64(1) || stats["misses"] != float64(1) {
+		t.Fatalf("fixture stats = %v, want 1 hit and 1 miss", stats)
+	}
+	if n := len(replayer.upstream.Requests()); n != 0 {
+		t.Fatalf("upstream received %d requests in replay mode, want 0", n)
+	}
+}
+
+// fixtureStats 读取 /metrics 中的上游录制/回放统计
+func (e *testEnv) fixtureStats() map[string]interface{} {
+	e.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, e.server.URL+"/metrics", nil)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e.t.Fatalf("GET /metrics status = %d", resp.StatusCode)
+	}
+	var metrics struct {
+		FixtureStats map[string]interface{} `json:"fixture_stats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		e.t.Fatalf("decode metrics: %v", err)
+	}
+	return metrics.FixtureStats
+}
+
+// quoteJSON 把文本编码为上游数据行中的JSON字符串
+func quoteJSON(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func TestTokenize(t *testing.T) {
+	env := newTestEnv(t, mockupstream.Options{}, map[string]string{
+		constants.EnvModelPrices: "gpt-4o:0.0025:0.01",
+	})
+	request := models.OpenAIChatCompletionsRequest{
+		Model: "gpt-4o",
+		Messages: []models.Message{
+			{Role: "system", Content: "You are a helpful assistant."},
+			{Role: "user", Content: "hello"},
+		},
+	}
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest(http.MethodPost, env.server.URL+"/v1/tokenize", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /v1/tokenize: %v", err)
+	}
+	defer resp.Body.Close()
+	var result models.TokenizeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, decode error = %v", resp.StatusCode, err)
+	}
+	if len(env.upstream.Requests()) != 0 {
+		t.Fatalf("tokenize called upstream: %+v", env.upstream.Requests())
+	}
+
+	sum := result.ReplyTokens
+	for _, m := range result.Messages {
+		sum += m.Tokens
+	}
+	if result.Encoding != "o200k_base" || len(result.Messages) != 2 || sum != result.PromptTokens {
+		t.Fatalf("unexpected breakdown: %+v", result)
+	}
+	if result.ContextWindow == nil || *result.ContextWindow != 128000 || *result.RemainingTokens != 128000-result.PromptTokens {
+		t.Fatalf("unexpected context window: %+v", result)
+	}
+	if want := float64(result.PromptTokens) * 0.0025 / 1000; result.EstimatedCost == nil || *result.EstimatedCost != want {
+		t.Fatalf("estimated cost = %v, want %v", result.EstimatedCost, want)
+	}
+
+	// 与聊天请求计算的提示tokens一致
+	env.upstream.Enqueue(mockupstream.Response{Lines: []string{`0:"ok"`}})
+	chatReq, _ := http.NewRequest(http.MethodPost, env.server.URL+"/v1/chat/completions", bytes.NewReader(body))
+	chatReq.Header.Set("Authorization", "Bearer "+testAPIKey)
+	chatResp, err := http.DefaultClient.Do(chatReq)
+	if err != nil {
+		t.Fatalf("POST /v1/chat/completions: %v", err)
+	}
+	defer chatResp.Body.Close()
+	var completion models.OpenAIChatCompletionsResponse
+	if err := json.NewDecoder(chatResp.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	if completion.Usage.PromptTokens != result.PromptTokens {
+		t.Fatalf("chat prompt tokens = %d, tokenize = %d", completion.Usage.PromptTokens, result.PromptTokens)
+	}
+}
@@ -0,0 +1,148 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 请求日志的标准字段
+const (
+	FieldRequestID        = "request_id"
+	FieldKey              = "key"
+	FieldModel            = "model"
+	FieldUpstreamIdentity = "upstream_identity"
+	FieldTraceID          = "trace_id"
+)
+
+// Field 日志字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// fieldsKey 上下文中保存日志字段的键
+type fieldsKey struct{}
+
+// fieldSet 一个请求（或其中一个阶段）的日志字段，添加的字段对持有同一上下文的所有代码可见
+type fieldSet struct {
+	mu     sync.RWMutex
+	fields []Field
+}
+
+// snapshot 返回字段的副本
+func (s *fieldSet) snapshot() []Field {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Field(nil), s.fields...)
+}
+
+// set 添加或替换字段
+func (s *fieldSet) set(fields []Field) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fields = mergeFields(s.fields, fields)
+}
+
+// mergeFields 按键合并字段，后出现的值覆盖先出现的值，保持首次出现的顺序
+func mergeFields(base, extra []Field) []Field {
+	for _, field := range extra {
+		replaced := false
+		for i := range base {
+			if base[i].Key == field.Key {
+				base[i].Value = field.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			base = append(base, field)
+		}
+	}
+	return base
+}
+
+// pairs 把 key, value, key, value... 转换为字段，键不是字符串时用其字符串形式
+func pairs(kv []interface{}) []Field {
+	fields := make([]Field, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		fields = append(fields, Field{Key: key, Value: kv[i+1]})
+	}
+	return fields
+}
+
+// fieldsFrom 获取上下文中的字段集合
+func fieldsFrom(ctx context.Context) *fieldSet {
+	if ctx == nil {
+		return nil
+	}
+	set, _ := ctx.Value(fieldsKey{}).(*fieldSet)
+	return set
+}
+
+// WithFields 返回带有日志字段的新上下文，包含父上下文已有的字段
+// 之后在新上下文上 AddFields 不会影响父上下文
+func WithFields(ctx context.Context, kv ...interface{}) context.Context {
+	var fields []Field
+	if parent := fieldsFrom(ctx); parent != nil {
+		fields = parent.snapshot()
+	}
+	return context.WithValue(ctx, fieldsKey{}, &fieldSet{fields: mergeFields(fields, pairs(kv))})
+}
+
+// AddFields 向上下文已有的字段集合添加字段，上下文中没有字段集合时忽略
+func AddFields(ctx context.Context, kv ...interface{}) {
+	if set := fieldsFrom(ctx); set != nil {
+		set.set(pairs(kv))
+	}
+}
+
+// Entry 带有请求字段的日志记录器
+type Entry struct {
+	ctx context.Context
+}
+
+// Ctx 返回使用上下文中请求字段的日志记录器，上下文中有追踪span时附带 trace_id
+func Ctx(ctx context.Context) Entry {
+	return Entry{ctx: ctx}
+}
+
+// fields 返回当前的字段
+func (e Entry) fields() []Field {
+	var fields []Field
+	if set := fieldsFrom(e.ctx); set != nil {
+		fields = set.snapshot()
+	}
+	if e.ctx != nil {
+		if sc := trace.SpanContextFromContext(e.ctx); sc.HasTraceID() {
+			fields = append(fields, Field{Key: FieldTraceID, Value: sc.TraceID().String()})
+		}
+	}
+	return fields
+}
+
+// Debug 打印调试日志
+func (e Entry) Debug(format string, args ...interface{}) {
+	write(DEBUG, e.fields(), format, args...)
+}
+
+// Info 打印信息日志
+func (e Entry) Info(format string, args ...interface{}) {
+	write(INFO, e.fields(), format, args...)
+}
+
+// Warn 打印警告日志
+func (e Entry) Warn(format string, args ...interface{}) {
+	write(WARN, e.fields(), format, args...)
+}
+
+// Error 打印错误日志
+func (e Entry) Error(format string, args ...interface{}) {
+	write(ERROR, e.fields(), format, args...)
+}
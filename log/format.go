@@ -0,0 +1,102 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// record 一条待输出的日志
+type record struct {
+	time    time.Time
+	level   int
+	message string
+	caller  string
+	fields  []Field
+}
+
+// text 文本格式：[时间] [级别] 消息 key=value...，color 为true时给消息加颜色
+func (r record) text(colored bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] [%s] ", r.time.Format("2006-01-02 15:04:05.000"), levelNames[r.level])
+	if colored {
+		b.WriteString(levelColors[r.level]("%s", r.message))
+	} else {
+		b.WriteString(r.message)
+	}
+	for _, field := range r.fields {
+		b.WriteByte(' ')
+		b.WriteString(field.Key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(field.Value))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// json JSON格式，固定字段在前，请求字段在后
+func (r record) json() []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSON(&b, r.time.Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, strings.ToLower(levelNames[r.level]))
+	b.WriteString(`,"msg":`)
+	writeJSON(&b, r.message)
+	if r.caller != "" {
+		b.WriteString(`,"caller":`)
+		writeJSON(&b, r.caller)
+	}
+	for _, field := range r.fields {
+		b.WriteByte(',')
+		writeJSON(&b, field.Key)
+		b.WriteByte(':')
+		writeJSON(&b, field.Value)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// logfmt logfmt格式
+func (r record) logfmt() []byte {
+	var b bytes.Buffer
+	b.WriteString("time=")
+	b.WriteString(r.time.Format(time.RFC3339Nano))
+	b.WriteString(" level=")
+	b.WriteString(strings.ToLower(levelNames[r.level]))
+	b.WriteString(" msg=")
+	b.WriteString(logfmtValue(r.message))
+	if r.caller != "" {
+		b.WriteString(" caller=")
+		b.WriteString(logfmtValue(r.caller))
+	}
+	for _, field := range r.fields {
+		b.WriteByte(' ')
+		b.WriteString(field.Key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(field.Value))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// writeJSON 写出JSON值，无法编码的值按字符串输出
+func writeJSON(b *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(data)
+}
+
+// logfmtValue 格式化logfmt的值，包含空白、引号或等号时加引号
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -2,9 +2,17 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"scira2api/pkg/redact"
+	"scira2api/pkg/rotate"
+
 	"github.com/fatih/color"
 )
 
@@ -17,6 +25,16 @@ const (
 	FATAL
 )
 
+// 输出格式
+const (
+	FormatText   = "text"   // 带颜色的文本，与之前的输出保持一致
+	FormatJSON   = "json"   // 每行一个JSON对象
+	FormatLogfmt = "logfmt" // 每行一组 key=value
+)
+
+// modulePrefix 本项目的模块路径前缀，计算包路径时去掉
+const modulePrefix = "scira2api/"
+
 var levelNames = map[int]string{
 	DEBUG: "DEBUG",
 	INFO:  "INFO",
@@ -33,19 +51,29 @@ var levelColors = map[int]func(format string, a ...interface{}) string{
 	FATAL: color.New(color.FgHiRed, color.Bold).SprintfFunc(),
 }
 
-// 全局日志级别，默认为INFO
-var logLevel = INFO
+// 全局日志级别，默认为INFO（可在运行时修改，使用原子操作读写）
+var logLevel int32 = INFO
 
 // SetLevel 设置日志级别
 func SetLevel(level int) {
 	if level >= DEBUG && level <= FATAL {
-		logLevel = level
+		atomic.StoreInt32(&logLevel, int32(level))
 	}
 }
 
 // GetLevel 获取当前日志级别
 func GetLevel() int {
-	return logLevel
+	return int(atomic.LoadInt32(&logLevel))
+}
+
+// ParseLevel 将级别名称（不区分大小写）解析为日志级别
+func ParseLevel(name string) (int, bool) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(levelName, strings.TrimSpace(name)) {
+			return level, true
+		}
+	}
+	return 0, false
 }
 
 // GetLevelName 获取日志级别名称
@@ -56,21 +84,165 @@ func GetLevelName(level int) string {
 	return "UNKNOWN"
 }
 
-// 基础日志打印函数
-func log(level int, format string, args ...interface{}) {
-	if level < logLevel {
-		return
+// Options 日志输出配置
+type Options struct {
+	Level         int
+	PackageLevels map[string]int // 包路径（如 service、pkg/http）到级别，覆盖全局级别，子包继承
+	Format        string
+	File          string // 为空时只输出到标准输出
+	MaxSize       int64  // 日志文件达到该大小（字节）后轮转
+	MaxBackups    int    // 保留的轮转文件数
+}
+
+// output 当前的输出配置，Configure 时整体替换
+type output struct {
+	format        string
+	packageLevels map[string]int
+	file          *rotate.File
+	mu            sync.Mutex // 保证多个输出的行不交错
+}
+
+var (
+	current atomic.Pointer[output]
+	callers sync.Map  // 调用点PC到包路径的缓存
+	stdout  io.Writer = os.Stdout
+)
+
+func init() {
+	current.Store(&output{format: FormatText})
+}
+
+// Configure 设置日志级别、格式和文件输出，替换后关闭之前的日志文件
+func Configure(opts Options) error {
+	format := strings.ToLower(opts.Format)
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON, FormatLogfmt:
+	default:
+		return fmt.Errorf("unsupported log format %q, expected text, json or logfmt", opts.Format)
+	}
+
+	out := &output{format: format, packageLevels: opts.PackageLevels}
+	if opts.File != "" {
+		file, err := rotate.Open(opts.File, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return err
+		}
+		out.file = file
 	}
 
-	now := time.Now().Format("2006-01-02 15:04:05.000")
-	levelName := levelNames[level]
-	colorFunc := levelColors[level]
+	SetLevel(opts.Level)
+	previous := current.Swap(out)
+	if previous != nil && previous.file != nil {
+		previous.file.Close()
+	}
+	return nil
+}
 
-	logContent := fmt.Sprintf(format, args...)
-	logPrefix := fmt.Sprintf("[%s] [%s] ", now, levelName)
+// Close 关闭日志文件，之后的日志只输出到标准输出，格式和包级别保持不变
+func Close() error {
+	previous := current.Swap(current.Load().withoutFile())
+	if previous != nil && previous.file != nil {
+		return previous.file.Close()
+	}
+	return nil
+}
 
-	// 使用颜色输出日志级别
-	fmt.Fprintf(os.Stdout, "%s%s\n", logPrefix, colorFunc(logContent))
+// withoutFile 复制除日志文件外的全部输出配置（mu 属于各自的输出，不复制）
+func (o *output) withoutFile() *output {
+	return &output{format: o.format, packageLevels: o.packageLevels}
+}
+
+// levelFor 返回包的有效级别：最长匹配的包级别优先，否则使用全局级别
+func (o *output) levelFor(pkg string) int {
+	level, matched := GetLevel(), -1
+	for prefix, l := range o.packageLevels {
+		if (pkg == prefix || strings.HasPrefix(pkg, prefix+"/")) && len(prefix) > matched {
+			level, matched = l, len(prefix)
+		}
+	}
+	return level
+}
+
+// callerPackage 返回调用点所在的包路径（去掉模块前缀）和 文件:行号
+func callerPackage(skip int) (string, string) {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "", ""
+	}
+	location := fmt.Sprintf("%s:%d", trimPath(file), line)
+	if pkg, ok := callers.Load(pc); ok {
+		return pkg.(string), location
+	}
+
+	pkg := ""
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		name := fn.Name()
+		// 函数名形如 scira2api/pkg/http.(*Request).sendRequest，包路径到最后一个 / 之后的第一个 . 为止
+		slash := strings.LastIndex(name, "/")
+		if dot := strings.Index(name[slash+1:], "."); dot != -1 {
+			name = name[:slash+1+dot]
+		}
+		pkg = strings.TrimPrefix(name, modulePrefix)
+	}
+	callers.Store(pc, pkg)
+	return pkg, location
+}
+
+// trimPath 只保留文件路径的最后两级
+func trimPath(file string) string {
+	if i := strings.LastIndex(file, "/"); i != -1 {
+		if j := strings.LastIndex(file[:i], "/"); j != -1 {
+			return file[j+1:]
+		}
+	}
+	return file
+}
+
+// write 格式化并输出一条日志，skip 为到业务调用点的栈深度
+func write(level int, fields []Field, format string, args ...interface{}) {
+	out := current.Load()
+
+	// 没有包级别时先按全局级别过滤，避免获取调用点的开销
+	if len(out.packageLevels) == 0 && level < GetLevel() {
+		return
+	}
+	pkg, location := callerPackage(2)
+	if level < out.levelFor(pkg) {
+		return
+	}
+
+	// 写出前屏蔽消息和字段中的密钥、令牌、代理凭据和Cookie
+	rec := record{
+		time:    time.Now(),
+		level:   level,
+		message: redact.String(fmt.Sprintf(format, args...)),
+		caller:  location,
+		fields:  redactFields(fields),
+	}
+
+	out.mu.Lock()
+	switch out.format {
+	case FormatJSON:
+		line := rec.json()
+		stdout.Write(line)
+		if out.file != nil {
+			out.file.Write(line)
+		}
+	case FormatLogfmt:
+		line := rec.logfmt()
+		stdout.Write(line)
+		if out.file != nil {
+			out.file.Write(line)
+		}
+	default:
+		fmt.Fprint(stdout, rec.text(true))
+		if out.file != nil {
+			io.WriteString(out.file, rec.text(false))
+		}
+	}
+	out.mu.Unlock()
 
 	// 如果是致命错误，则退出程序
 	if level == FATAL {
@@ -78,27 +250,37 @@ func log(level int, format string, args ...interface{}) {
 	}
 }
 
+// redactFields 屏蔽字符串类型的字段值
+func redactFields(fields []Field) []Field {
+	for i, field := range fields {
+		if s, ok := field.Value.(string); ok {
+			fields[i].Value = redact.String(s)
+		}
+	}
+	return fields
+}
+
 // Debug 打印调试日志
 func Debug(format string, args ...interface{}) {
-	log(DEBUG, format, args...)
+	write(DEBUG, nil, format, args...)
 }
 
 // Info 打印信息日志
 func Info(format string, args ...interface{}) {
-	log(INFO, format, args...)
+	write(INFO, nil, format, args...)
 }
 
 // Warn 打印警告日志
 func Warn(format string, args ...interface{}) {
-	log(WARN, format, args...)
+	write(WARN, nil, format, args...)
 }
 
 // Error 打印错误日志
 func Error(format string, args ...interface{}) {
-	log(ERROR, format, args...)
+	write(ERROR, nil, format, args...)
 }
 
 // Fatal 打印致命错误日志并退出程序
 func Fatal(format string, args ...interface{}) {
-	log(FATAL, format, args...)
+	write(FATAL, nil, format, args...)
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -14,6 +15,11 @@ import (
 	"scira2api/config"
 	"scira2api/log"
 	"scira2api/middleware"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/redact"
+	"scira2api/pkg/tracing"
 	"scira2api/service"
 
 	"github.com/gin-gonic/gin"
@@ -51,6 +57,14 @@ type SystemMetrics struct {
 	CacheStats      map[string]interface{} `json:"cache_stats,omitempty"`    // 缓存指标
 	ConnStats       map[string]interface{} `json:"conn_stats,omitempty"`     // 连接池指标
 	RateStats       map[string]interface{} `json:"rate_stats,omitempty"`     // 限流器指标
+	ProxyStats      map[string]interface{} `json:"proxy_stats,omitempty"`    // 代理池指标
+	ConcurrencyStats map[string]interface{} `json:"concurrency_stats,omitempty"` // 并发限制指标
+	UsageStats      map[string]interface{} `json:"usage_stats,omitempty"`   // 用量账本指标
+	BudgetStats     map[string]interface{} `json:"budget_stats,omitempty"`  // 费用预算指标
+	LatencyStats    map[string]interface{} `json:"latency_stats,omitempty"` // 按模型的延迟分位数
+	CaptureStats    map[string]interface{} `json:"capture_stats,omitempty"` // 请求捕获指标
+	FixtureStats    map[string]interface{} `json:"fixture_stats,omitempty"` // 上游录制/回放指标
+	ChaosStats      map[string]interface{} `json:"chaos_stats,omitempty"`   // 故障注入指标
 	
 	// 系统负载
 	LoadAverage     []float64         `json:"load_average,omitempty"`  // 系统负载平均值
@@ -69,6 +83,16 @@ var (
 // 目的: 确保服务能够正确响应系统信号，优雅地关闭资源
 // 预期效果: 提高服务稳定性，防止资源泄漏
 func main() {
+	// 子命令：回放捕获文件、启动模拟上游
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "mock-upstream":
+			os.Exit(runMockUpstream(os.Args[2:]))
+		}
+	}
+	
 	// 记录启动时间
 	startTime = time.Now()
 	
@@ -78,6 +102,24 @@ func main() {
 		log.Fatal("加载配置失败: %v", err)
 	}
 	
+	// 日志和返回给客户端的错误信息中屏蔽配置的正则和已知的密钥
+	if err := redact.Configure(cfg.Log.RedactPatterns, configuredSecrets(cfg)...); err != nil {
+		log.Fatal("初始化敏感信息屏蔽失败: %v", err)
+	}
+	
+	// 按配置设置日志级别、格式和文件输出
+	if err := log.Configure(log.Options{
+		Level:         cfg.Log.Level,
+		PackageLevels: cfg.Log.PackageLevels,
+		Format:        cfg.Log.Format,
+		File:          cfg.Log.File,
+		MaxSize:       cfg.Log.MaxSize,
+		MaxBackups:    cfg.Log.MaxBackups,
+	}); err != nil {
+		log.Fatal("初始化日志失败: %v", err)
+	}
+	defer log.Close()
+	
 	// 优化点: 启动前验证配置
 	// 目的: 提前发现配置问题，避免运行时错误
 	// 预期效果: 提高系统稳定性和可靠性
@@ -85,36 +127,33 @@ func main() {
 		log.Fatal("配置验证失败: %v", err)
 	}
 	
-	// 创建处理器
-	handler := service.NewChatHandler(cfg)
+	// 初始化链路追踪
+	tracer, err := setupTracing(cfg)
+	if err != nil {
+		log.Fatal("初始化链路追踪失败: %v", err)
+	}
 	
-	// 创建路由器
-	router := gin.Default()
+	// 加载API密钥
+	keyStore, err := setupKeyStore(cfg)
+	if err != nil {
+		log.Fatal("加载API密钥失败: %v", err)
+	}
 	
-	// 添加全局中间件
-	setupMiddlewares(router, cfg)
+	// 创建处理器
+	handler := service.NewChatHandler(cfg)
 	
-	// 优化点: 添加请求计数中间件
-	// 目的: 收集请求统计数据
-	// 预期效果: 更好的监控系统性能
-	router.Use(func(c *gin.Context) {
-		// 请求计数器递增
-		atomic.AddInt64(&requestCount, 1)
-		
-		// 处理请求
-		c.Next()
-		
-		// 根据状态码更新统计
-		status := c.Writer.Status()
-		if status >= 200 && status < 400 {
-			atomic.AddInt64(&successCount, 1)
-		} else {
-			atomic.AddInt64(&errorCount, 1)
+	// 创建管理接口处理器（未配置管理员密钥时不启用）
+	var admin *service.AdminHandler
+	if cfg.Admin.Key != "" {
+		if admin, err = service.NewAdminHandler(cfg, handler, keyStore); err != nil {
+			log.Fatal("初始化管理接口失败: %v", err)
 		}
-	})
+	} else {
+		log.Info("未配置 %s，管理接口未启用", constants.EnvAdminKey)
+	}
 	
-	// 注册路由
-	setupRoutes(router, handler)
+	// 创建路由器
+	router := newRouter(cfg, handler, admin, keyStore)
 	
 	// 创建HTTP服务器
 	server := &http.Server{
@@ -157,6 +196,14 @@ func main() {
 	if err := handler.Close(); err != nil {
 		log.Error("处理器资源释放失败: %v", err)
 	}
+	if admin != nil {
+		if err := admin.Close(); err != nil {
+			log.Error("管理接口资源释放失败: %v", err)
+		}
+	}
+	if err := tracer.Shutdown(ctx); err != nil {
+		log.Error("导出剩余的链路追踪数据失败: %v", err)
+	}
 	
 	log.Info("服务器已成功关闭")
 }
@@ -187,12 +234,120 @@ func validateConfig(cfg *config.Config) error {
 	return nil
 }
 
+// configuredSecrets 返回配置中的密钥原文，日志中出现时按原文屏蔽
+// 不符合内置格式（如 sk- 前缀）的密钥也能被屏蔽；API_KEYS_FILE 中的密钥在加载时登记
+func configuredSecrets(cfg *config.Config) []string {
+	secrets := []string{cfg.Auth.ApiKey, cfg.Admin.Key}
+	for i, entry := range cfg.Auth.ApiKeys {
+		_, key := parseAPIKeyEntry(i, entry)
+		secrets = append(secrets, key)
+	}
+	return secrets
+}
+
+// parseAPIKeyEntry 解析 API_KEYS 的一项，格式为 name:key，省略名称时命名为 key-N
+func parseAPIKeyEntry(i int, entry string) (name, key string) {
+	name, key, found := strings.Cut(entry, ":")
+	if !found {
+		name, key = fmt.Sprintf("key-%d", i+1), entry
+	}
+	return name, key
+}
+
+// setupTracing 根据配置初始化OpenTelemetry链路追踪，未配置导出方式时只传播 traceparent
+func setupTracing(cfg *config.Config) (*tracing.Provider, error) {
+	provider, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.OTLPEndpoint,
+		File:        cfg.Tracing.File,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if provider.Enabled() {
+		log.Info("链路追踪已启用: 导出方式=%s, 采样比例=%.2f", cfg.Tracing.Exporter, cfg.Tracing.SampleRatio)
+	}
+	return provider, nil
+}
+
+// setupKeyStore 根据配置加载API密钥
+// APIKEY 作为名为 default 的密钥保留兼容，API_KEYS 和 API_KEYS_FILE 提供多密钥及其访问策略
+func setupKeyStore(cfg *config.Config) (*auth.KeyStore, error) {
+	keyStore := auth.NewKeyStore()
+	
+	if cfg.Auth.ApiKey != "" {
+		if err := keyStore.Add(auth.APIKey{Name: "default", Key: cfg.Auth.ApiKey, Enabled: true}); err != nil {
+			return nil, err
+		}
+	}
+	
+	for i, entry := range cfg.Auth.ApiKeys {
+		name, key := parseAPIKeyEntry(i, entry)
+		if err := keyStore.Add(auth.APIKey{Name: name, Key: key, Enabled: true}); err != nil {
+			return nil, err
+		}
+	}
+	
+	if cfg.Auth.KeysFile != "" {
+		loaded, err := keyStore.LoadFile(cfg.Auth.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("从 %s 加载了 %d 个API密钥", cfg.Auth.KeysFile, loaded)
+	}
+	
+	if keyStore.Len() == 0 {
+		log.Warn("未配置API密钥，受保护路由的认证已禁用")
+	} else {
+		log.Info("API密钥认证已启用: 密钥数=%d", keyStore.Len())
+	}
+	return keyStore, nil
+}
+
+// newRouter 创建路由器并注册中间件和路由
+// 访问日志由 RequestLogMiddleware 按配置的日志格式输出，panic由 ErrorMiddleware 恢复
+func newRouter(cfg *config.Config, handler *service.ChatHandler, admin *service.AdminHandler, keyStore *auth.KeyStore) *gin.Engine {
+	router := gin.New()
+	
+	// 添加全局中间件
+	setupMiddlewares(router, keyStore)
+	
+	// 优化点: 添加请求计数中间件
+	// 目的: 收集请求统计数据
+	// 预期效果: 更好的监控系统性能
+	router.Use(func(c *gin.Context) {
+		// 请求计数器递增
+		atomic.AddInt64(&requestCount, 1)
+		
+		// 处理请求
+		c.Next()
+		
+		// 根据状态码更新统计
+		status := c.Writer.Status()
+		if status >= 200 && status < 400 {
+			atomic.AddInt64(&successCount, 1)
+		} else {
+			atomic.AddInt64(&errorCount, 1)
+		}
+	})
+	
+	// 注册路由
+	setupRoutes(router, handler, admin, cfg)
+	return router
+}
+
 // 优化点: 分离中间件设置逻辑
 // 目的: 提高代码可读性，集中中间件管理
 // 预期效果: 更易于维护的中间件代码
-func setupMiddlewares(router *gin.Engine, cfg *config.Config) {
+func setupMiddlewares(router *gin.Engine, keyStore *auth.KeyStore) {
+	// 请求日志、链路追踪和指标中间件放在最外层，认证失败和panic恢复后的响应同样计入
+	router.Use(middleware.RequestLogMiddleware())
+	router.Use(middleware.TracingMiddleware())
+	router.Use(middleware.MetricsMiddleware())
 	router.Use(middleware.ErrorMiddleware())
-	router.Use(middleware.AuthMiddleware(cfg))
+	router.Use(middleware.AuthMiddleware(keyStore))
 	router.Use(middleware.CorsMiddleware())
 	
 	// 可以在这里添加更多中间件
@@ -202,7 +357,7 @@ func setupMiddlewares(router *gin.Engine, cfg *config.Config) {
 // 优化点: 分离路由注册逻辑
 // 目的: 提高代码可读性，降低main函数复杂度
 // 预期效果: 更模块化、更易于维护的路由管理
-func setupRoutes(router *gin.Engine, handler *service.ChatHandler) {
+func setupRoutes(router *gin.Engine, handler *service.ChatHandler, admin *service.AdminHandler, cfg *config.Config) {
 	// 添加健康检查路由
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -211,14 +366,22 @@ func setupRoutes(router *gin.Engine, handler *service.ChatHandler) {
 		})
 	})
 	
-	// 添加性能监控路由
+	// 添加性能监控路由，/metrics 保留JSON格式，Prometheus抓取使用文本格式路径
 	router.GET("/metrics", getMetricsHandler(handler))
+	router.GET(constants.PrometheusMetricsPath, gin.WrapH(metrics.Handler()))
 	
 	// API版本v1路由
 	v1 := router.Group("/v1")
 	{
 		v1.GET("/models", handler.ModelGetHandler)
 		v1.POST("/chat/completions", handler.ChatCompletionsHandler)
+		v1.POST("/tokenize", handler.TokenizeHandler)
+		v1.GET("/usage", handler.UsageHandler)
+	}
+	
+	// 管理接口路由，使用独立的管理员凭据
+	if admin != nil {
+		admin.RegisterRoutes(router.Group(middleware.AdminPathPrefix, middleware.AdminAuthMiddleware(cfg.Admin.Key)))
 	}
 	
 	log.Info("路由注册完成")
@@ -253,14 +416,22 @@ func getMetricsHandler(handler *service.ChatHandler) gin.HandlerFunc {
 			NumGC:        memStats.NumGC,
 			
 			// 请求统计
-			RequestCount: requestCount,
-			SuccessCount: successCount,
-			ErrorCount:   errorCount,
+			RequestCount: atomic.LoadInt64(&requestCount),
+			SuccessCount: atomic.LoadInt64(&successCount),
+			ErrorCount:   atomic.LoadInt64(&errorCount),
 			
 			// 组件指标
 			CacheStats:   handler.GetCacheMetrics(),
 			ConnStats:    handler.GetConnPoolMetrics(),
 			RateStats:    handler.GetRateLimiterMetrics(),
+			ProxyStats:   handler.GetProxyPoolMetrics(),
+			ConcurrencyStats: handler.GetConcurrencyMetrics(),
+			UsageStats:   handler.GetUsageMetrics(),
+			BudgetStats:  handler.GetBudgetMetrics(),
+			LatencyStats: handler.GetLatencyMetrics(),
+			CaptureStats: handler.GetCaptureMetrics(),
+			FixtureStats: handler.GetFixtureMetrics(),
+			ChaosStats:   handler.GetChaosMetrics(),
 		}
 		
 		// 添加更多指标
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"scira2api/log"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminPathPrefix 管理接口路径前缀，使用独立的管理员凭据认证
+const AdminPathPrefix = "/admin"
+
+// AdminAuthMiddleware 管理接口认证中间件
+// 通过 x-admin-key 或 Authorization: Bearer 提交管理员密钥，比较前先哈希以保证常量时间
+func AdminAuthMiddleware(adminKey string) gin.HandlerFunc {
+	expected := []byte(auth.HashKey(adminKey))
+
+	return func(c *gin.Context) {
+		token := strings.TrimSpace(c.GetHeader(constants.AdminKeyHeader))
+		if token == "" {
+			authHeader := c.GetHeader("Authorization")
+			if bearer := strings.TrimPrefix(authHeader, "Bearer "); bearer != authHeader {
+				token = strings.TrimSpace(bearer)
+			}
+		}
+
+		if token == "" {
+			SendAPIError(c, errors.NewUnauthorizedError("Missing admin credentials"))
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(auth.HashKey(token)), expected) != 1 {
+			log.Warn("管理接口认证失败, 客户端: %s", c.ClientIP())
+			SendAPIError(c, errors.NewUnauthorizedError("Invalid admin credentials"))
+			return
+		}
+
+		c.Next()
+	}
+}
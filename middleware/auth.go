@@ -1,11 +1,17 @@
 package middleware
 
 import (
-	"scira2api/config"
+	stderrors "errors"
+	"net/http"
+	"scira2api/log"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
 	"scira2api/pkg/errors"
+	"scira2api/pkg/tracing"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // 公共路径白名单，这些路径不需要认证
@@ -20,31 +26,79 @@ func isPublicPath(path string) bool {
 }
 
 // AuthMiddleware 认证中间件
-func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
+// 密钥存储为空时不启用认证；认证通过的密钥会写入gin上下文和请求上下文，供后续日志和计量使用
+func AuthMiddleware(keyStore *auth.KeyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 检查请求路径是否是公共路径
-		if isPublicPath(c.Request.URL.Path) {
+		// 检查请求路径是否是公共路径，CORS预检请求同样无需认证
+		// 管理接口由 AdminAuthMiddleware 单独认证
+		if isPublicPath(c.Request.URL.Path) || c.Request.Method == http.MethodOptions ||
+			strings.HasPrefix(c.Request.URL.Path, AdminPathPrefix+"/") {
 			c.Next()
 			return
 		}
 		
-		apiKey := cfg.Auth.ApiKey
-		if apiKey != "" {
-			authHeader := c.GetHeader("Authorization")
-			if authHeader == "" {
-				apiErr := errors.NewUnauthorizedError("Missing Authorization header")
-				SendAPIError(c, apiErr)
-				return
-			}
-
-			// 移除Bearer前缀
-			token := strings.TrimPrefix(authHeader, "Bearer ")
-			if token == authHeader || token != apiKey {
-				apiErr := errors.NewUnauthorizedError("Invalid API key")
-				SendAPIError(c, apiErr)
-				return
-			}
+		if keyStore == nil || keyStore.Len() == 0 {
+			c.Next()
+			return
 		}
+		
+		_, span := tracing.Start(c.Request.Context(), "auth")
+		
+		token := extractAPIKey(c)
+		if token == "" {
+			apiErr := errors.NewUnauthorizedError("Missing Authorization header")
+			tracing.End(span, apiErr)
+			SendAPIError(c, apiErr)
+			return
+		}
+		
+		key, err := keyStore.Authenticate(token)
+		if err != nil {
+			log.Ctx(c.Request.Context()).Warn("API密钥认证失败: %v, 客户端: %s", err, c.ClientIP())
+			tracing.End(span, err)
+			SendAPIError(c, errors.NewUnauthorizedError(authErrorMessage(err)))
+			return
+		}
+		
+		span.SetAttributes(attribute.String("api_key.name", key.Name))
+		if !key.AllowsEndpoint(c.Request.URL.Path) {
+			log.Ctx(c.Request.Context()).Warn("API密钥 %s 无权访问 %s", key.Name, c.Request.URL.Path)
+			apiErr := errors.NewForbiddenError("API key is not allowed to access this endpoint")
+			tracing.End(span, apiErr)
+			SendAPIError(c, apiErr)
+			return
+		}
+		span.End()
+		
+		c.Set(auth.ContextKey, key)
+		log.AddFields(c.Request.Context(), log.FieldKey, key.Name)
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), key))
 		c.Next()
 	}
 }
+
+// extractAPIKey 从 x-api-key 或 Authorization: Bearer 请求头中提取密钥
+func extractAPIKey(c *gin.Context) string {
+	if key := strings.TrimSpace(c.GetHeader(constants.APIKeyHeader)); key != "" {
+		return key
+	}
+	
+	authHeader := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if token == authHeader {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authErrorMessage 返回给客户端的认证错误信息，不包含密钥名称
+func authErrorMessage(err error) string {
+	switch {
+	case stderrors.Is(err, auth.ErrKeyDisabled):
+		return "API key is disabled"
+	case stderrors.Is(err, auth.ErrKeyExpired):
+		return "API key has expired"
+	default:
+		return "Invalid API key"
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"scira2api/log"
+	"scira2api/pkg/constants"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRequestIDLength 接受的调用方请求ID的最大长度
+const maxRequestIDLength = 128
+
+// RequestLogMiddleware 为每个请求分配请求ID并在请求结束时输出一行访问日志
+// 调用方带有合法的 X-Request-ID 时沿用，否则生成新的ID；ID写入响应头、gin上下文和请求上下文的日志字段，
+// 之后通过 log.Ctx 打印的日志都带有请求ID，以及认证、模型解析和上游请求阶段补充的密钥名称、模型和上游身份
+func RequestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := sanitizeRequestID(c.GetHeader(constants.HeaderRequestID))
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		c.Set(constants.ContextKeyRequestID, requestID)
+		c.Header(constants.HeaderRequestID, requestID)
+		c.Request = c.Request.WithContext(log.WithFields(c.Request.Context(), log.FieldRequestID, requestID))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := log.Ctx(c.Request.Context())
+		logf := entry.Info
+		switch {
+		case status >= http.StatusInternalServerError:
+			logf = entry.Error
+		case status >= http.StatusBadRequest:
+			logf = entry.Warn
+		}
+		logf("%s %s %d %s %s", c.Request.Method, c.Request.URL.Path, status,
+			time.Since(start).Round(time.Microsecond), c.ClientIP())
+	}
+}
+
+// sanitizeRequestID 只接受长度受限的可打印ASCII字符，避免把任意内容写入日志和响应头
+func sanitizeRequestID(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return ""
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' {
+			return ""
+		}
+	}
+	return id
+}
+
+// newRequestID 生成 req_ 开头的随机请求ID
+func newRequestID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "req_" + time.Now().Format("20060102150405.000000000")
+	}
+	return "req_" + hex.EncodeToString(buf)
+}
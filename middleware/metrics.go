@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/metrics"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsMiddleware 记录请求的Prometheus指标
+// 路由取gin的路由模板，模型由聊天处理器写入gin上下文，未认证的请求统一计入 anonymous
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		key := auth.KeyName(c.Request.Context())
+		if key == "" {
+			key = constants.UsageAnonymousKey
+		}
+		metrics.ObserveRequest(c.FullPath(), c.GetString(constants.ContextKeyModel), c.Writer.Status(), key, time.Since(start))
+	}
+}
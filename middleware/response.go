@@ -3,6 +3,7 @@ package middleware
 import (
 	"scira2api/log"
 	"scira2api/pkg/errors"
+	"scira2api/pkg/redact"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,6 +22,9 @@ type ErrorDetail struct {
 
 // SendErrorResponse 发送统一格式的错误响应
 func SendErrorResponse(c *gin.Context, statusCode int, errorType string, message string) {
+	// 错误信息可能包含上游响应或代理地址，返回前屏蔽其中的凭据
+	message = redact.String(message)
+	
 	response := ErrorResponse{
 		Error: ErrorDetail{
 			Type:    errorType,
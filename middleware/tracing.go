@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// TracingMiddleware 为每个请求创建入口span，请求带有W3C traceparent头时延续调用方的链路
+// span写入请求上下文，后续各处理阶段的span都是它的子span
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracing.StartServer(ctx, name,
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.URLPath(c.Request.URL.Path),
+			semconv.ClientAddress(c.ClientIP()),
+		)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if key := auth.KeyName(c.Request.Context()); key != "" {
+			span.SetAttributes(attribute.String("api_key.name", key))
+		}
+		if model := c.GetString(constants.ContextKeyModel); model != "" {
+			span.SetAttributes(attribute.String("llm.model", model))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
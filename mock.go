@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"scira2api/log"
+	"scira2api/pkg/mockupstream"
+)
+
+// runMockUpstream 执行 mock-upstream 子命令：启动模拟的 Scira 上游，BASE_URL 指向该地址即可离线开发和测试
+// 用法: scira2api mock-upstream [-addr 127.0.0.1:8081] [-latency 0] [-chunk-delay 20ms] [-chunk-size 8] [-failure-rate 0] [-script script.json]
+func runMockUpstream(args []string) int {
+	flags := flag.NewFlagSet("mock-upstream", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:8081", "监听地址")
+	latency := flags.Duration("latency", 0, "返回响应头之前的延迟")
+	chunkDelay := flags.Duration("chunk-delay", 0, "数据行之间的延迟")
+	chunkSize := flags.Int("chunk-size", 0, "推理和文本内容每行的最大字符数，0 表示整段输出")
+	failureRate := flags.Float64("failure-rate", 0, "随机注入失败的比例 (0-1)")
+	failureStatus := flags.Int("failure-status", http.StatusInternalServerError, "注入失败时返回的状态码")
+	scriptFile := flags.String("script", "", "脚本化响应的JSON文件，内容为响应数组，按 match 匹配最后一条用户消息")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 || *failureRate < 0 || *failureRate > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	opts := mockupstream.Options{
+		Latency:       *latency,
+		ChunkDelay:    *chunkDelay,
+		ChunkSize:     *chunkSize,
+		FailureRate:   *failureRate,
+		FailureStatus: *failureStatus,
+	}
+	if *scriptFile != "" {
+		data, err := os.ReadFile(*scriptFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "读取脚本文件失败: %v\n", err)
+			return 1
+		}
+		if err := json.Unmarshal(data, &opts.Script); err != nil {
+			fmt.Fprintf(os.Stderr, "解析脚本文件失败: %v\n", err)
+			return 1
+		}
+	}
+
+	server := &http.Server{Addr: *addr, Handler: mockupstream.New(opts)}
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		server.Close()
+	}()
+
+	log.Info("模拟上游已启动: http://%s%s (脚本响应 %d 条，失败比例 %.2f)", *addr, mockupstream.SearchPath, len(opts.Script), *failureRate)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "模拟上游启动失败: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -30,6 +30,7 @@ type OpenAIChatCompletionsRequest struct {
 	Model    string    `json:"model"`
 	Messages []Message `json:"messages"`
 	Stream   bool      `json:"stream"`
+	User     string    `json:"user,omitempty"`
 }
 
 // Message 消息结构体
@@ -152,6 +153,26 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+// TokenizeResponse 提示tokens计数结果，不调用上游
+type TokenizeResponse struct {
+	Object          string            `json:"object"`
+	Model           string            `json:"model"`
+	Encoding        string            `json:"encoding"`
+	PromptTokens    int               `json:"prompt_tokens"`
+	Messages        []TokenizeMessage `json:"messages"`
+	ReplyTokens     int               `json:"reply_tokens"`     // 回复前缀的格式tokens
+	ContextWindow   *int              `json:"context_window"`   // 未知时为null
+	RemainingTokens *int              `json:"remaining_tokens"` // 上下文窗口减去提示tokens，可能为负数
+	EstimatedCost   *float64          `json:"estimated_cost"`   // 提示部分的预估费用（美元），未配置价格时为null
+}
+
+// TokenizeMessage 单条消息的tokens，包含消息格式开销
+type TokenizeMessage struct {
+	Index  int    `json:"index"`
+	Role   string `json:"role"`
+	Tokens int    `json:"tokens"`
+}
+
 // 构建响应的辅助函数
 
 // NewOaiStreamResponse 创建新的OpenAI流式响应
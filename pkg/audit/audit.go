@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"scira2api/log"
+)
+
+// 内存中保留的最近审计记录数
+const recentEntries = 200
+
+// Entry 一条审计记录
+type Entry struct {
+	Time     time.Time   `json:"time"`
+	Actor    string      `json:"actor"`
+	RemoteIP string      `json:"remote_ip,omitempty"`
+	Action   string      `json:"action"`
+	Target   string      `json:"target,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+	Success  bool        `json:"success"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Logger 审计日志，以JSONL格式追加写入文件，并在内存中保留最近的记录
+type Logger struct {
+	file   *os.File
+	recent []Entry
+	mu     sync.Mutex
+}
+
+// NewLogger 创建审计日志，path 为空时只保留内存记录
+func NewLogger(path string) (*Logger, error) {
+	l := &Logger{
+		recent: make([]Entry, 0, recentEntries),
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("创建审计日志目录失败: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("打开审计日志失败: %w", err)
+	}
+	l.file = file
+	return l, nil
+}
+
+// Log 写入一条审计记录
+func (l *Logger) Log(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.recent) == recentEntries {
+		copy(l.recent, l.recent[1:])
+		l.recent = l.recent[:recentEntries-1]
+	}
+	l.recent = append(l.recent, entry)
+
+	if l.file == nil {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("序列化审计记录失败: %v", err)
+		return
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.Error("写入审计日志失败: %v", err)
+	}
+}
+
+// Recent 返回最近的审计记录，最新的在前
+func (l *Logger) Recent(limit int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit <= 0 || limit > len(l.recent) {
+		limit = len(l.recent)
+	}
+	entries := make([]Entry, 0, limit)
+	for i := len(l.recent) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, l.recent[i])
+	}
+	return entries
+}
+
+// Close 关闭审计日志文件
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,30 @@
+package auth
+
+import "context"
+
+// ContextKey gin上下文中保存API密钥的键
+const ContextKey = "api_key"
+
+type contextKey struct{}
+
+// NewContext 返回携带API密钥的上下文
+func NewContext(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// FromContext 获取上下文中的API密钥，未认证时返回nil
+func FromContext(ctx context.Context) *APIKey {
+	if ctx == nil {
+		return nil
+	}
+	key, _ := ctx.Value(contextKey{}).(*APIKey)
+	return key
+}
+
+// KeyName 获取上下文中的API密钥名称，未认证时返回空串
+func KeyName(ctx context.Context) string {
+	if key := FromContext(ctx); key != nil {
+		return key.Name
+	}
+	return ""
+}
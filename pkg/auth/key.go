@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// RateLimit 单个API密钥的速率限制
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+	TokensPerMinute   int     `json:"tokens_per_minute,omitempty"` // 每分钟令牌配额
+	TokensPerDay      int     `json:"tokens_per_day,omitempty"`    // 每天令牌配额
+}
+
+// Budget 单个API密钥的费用预算（美元），0 表示使用默认预算
+type Budget struct {
+	Daily   float64 `json:"daily,omitempty"`
+	Monthly float64 `json:"monthly,omitempty"`
+}
+
+// APIKey API密钥及其访问策略
+// 密钥只以SHA-256哈希的形式保存，明文仅在加载时出现
+type APIKey struct {
+	Name             string            `json:"name"`
+	Key              string            `json:"key,omitempty"`      // 明文密钥，仅用于加载，哈希后清空
+	KeyHash          string            `json:"key_hash,omitempty"` // 密钥的SHA-256十六进制哈希
+	Enabled          bool              `json:"enabled"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+	AllowedModels    []string          `json:"allowed_models,omitempty"`    // 为空时允许所有模型
+	AllowedEndpoints []string          `json:"allowed_endpoints,omitempty"` // 路径前缀，为空时允许所有端点
+	RateLimit        RateLimit         `json:"rate_limit"`
+	Budget           Budget            `json:"budget"`
+	Tier             string            `json:"tier,omitempty"`     // 限流等级，RateLimit 未设置时使用
+	Priority         int               `json:"priority,omitempty"` // 限流排队优先级，数值越大越先获得令牌
+	TimeZone         string            `json:"timezone,omitempty"` // 发往上游的默认时区
+	Group            string            `json:"group,omitempty"`    // 发往上游的默认分组
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+}
+
+// HashKey 计算密钥的SHA-256哈希
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsExpired 检查密钥是否已过期
+func (k *APIKey) IsExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// AllowsModel 检查密钥是否允许使用指定模型
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, allowed := range k.AllowedModels {
+		if allowed == "*" || strings.EqualFold(allowed, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsEndpoint 检查密钥是否允许访问指定路径
+func (k *APIKey) AllowsEndpoint(path string) bool {
+	if len(k.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, allowed := range k.AllowedEndpoints {
+		// 以 * 结尾时按前缀匹配，否则匹配该路径及其子路径
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == allowed || strings.HasPrefix(path, strings.TrimSuffix(allowed, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Public 返回不含哈希的副本，用于日志和接口输出
+func (k *APIKey) Public() APIKey {
+	public := *k
+	public.Key = ""
+	public.KeyHash = ""
+	return public
+}
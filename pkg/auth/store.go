@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"scira2api/pkg/redact"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 认证相关错误
+var (
+	ErrInvalidKey  = errors.New("无效的API密钥")
+	ErrKeyDisabled = errors.New("API密钥已禁用")
+	ErrKeyExpired  = errors.New("API密钥已过期")
+	ErrKeyExists   = errors.New("API密钥名称已存在")
+	ErrKeyNotFound = errors.New("API密钥不存在")
+)
+
+// KeyStore API密钥存储
+// 校验时对所有密钥的哈希逐一做常量时间比较，不因匹配位置不同而泄露时间信息
+type KeyStore struct {
+	keys map[string]*APIKey // name -> key
+	mu   sync.RWMutex
+
+	authSuccess int64
+	authFailure int64
+}
+
+// NewKeyStore 创建空的密钥存储
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		keys: make(map[string]*APIKey),
+	}
+}
+
+// Add 添加密钥，明文密钥会被哈希后清空
+func (s *KeyStore) Add(key APIKey) error {
+	if err := normalizeKey(&key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.keys[key.Name]; exists {
+		return fmt.Errorf("%w: %s", ErrKeyExists, key.Name)
+	}
+	for _, existing := range s.keys {
+		if existing.KeyHash == key.KeyHash {
+			return fmt.Errorf("%w: 密钥与 %s 重复", ErrKeyExists, existing.Name)
+		}
+	}
+
+	s.keys[key.Name] = &key
+	return nil
+}
+
+// Put 添加或替换同名密钥
+func (s *KeyStore) Put(key APIKey) error {
+	if err := normalizeKey(&key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, existing := range s.keys {
+		if name != key.Name && existing.KeyHash == key.KeyHash {
+			return fmt.Errorf("%w: 密钥与 %s 重复", ErrKeyExists, name)
+		}
+	}
+	s.keys[key.Name] = &key
+	return nil
+}
+
+// normalizeKey 校验密钥并把明文转换为哈希
+func normalizeKey(key *APIKey) error {
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return fmt.Errorf("API密钥名称不能为空")
+	}
+
+	if key.Key != "" {
+		key.KeyHash = HashKey(key.Key)
+		key.Key = ""
+	}
+	key.KeyHash = strings.ToLower(strings.TrimPrefix(key.KeyHash, "sha256:"))
+	if decoded, err := hex.DecodeString(key.KeyHash); err != nil || len(decoded) != 32 {
+		return fmt.Errorf("API密钥 %s 缺少有效的密钥或SHA-256哈希", key.Name)
+	}
+
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	return nil
+}
+
+// Get 按名称获取密钥副本
+func (s *KeyStore) Get(name string) (APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[name]
+	if !ok {
+		return APIKey{}, false
+	}
+	return *key, true
+}
+
+// Remove 删除密钥
+func (s *KeyStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, name)
+	}
+	delete(s.keys, name)
+	return nil
+}
+
+// List 返回按名称排序的所有密钥副本
+func (s *KeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Len 返回密钥数量
+func (s *KeyStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// Authenticate 校验客户端提交的密钥，返回匹配的密钥副本
+func (s *KeyStore) Authenticate(token string) (*APIKey, error) {
+	hash := HashKey(token)
+
+	s.mu.RLock()
+	var matched *APIKey
+	for _, key := range s.keys {
+		// 不提前退出，保证比较次数与匹配位置无关
+		if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hash)) == 1 {
+			matched = key
+		}
+	}
+	var result APIKey
+	if matched != nil {
+		result = *matched
+	}
+	s.mu.RUnlock()
+
+	if matched == nil {
+		atomic.AddInt64(&s.authFailure, 1)
+		return nil, ErrInvalidKey
+	}
+	if !result.Enabled {
+		atomic.AddInt64(&s.authFailure, 1)
+		return nil, fmt.Errorf("%w: %s", ErrKeyDisabled, result.Name)
+	}
+	if result.IsExpired(time.Now()) {
+		atomic.AddInt64(&s.authFailure, 1)
+		return nil, fmt.Errorf("%w: %s", ErrKeyExpired, result.Name)
+	}
+
+	atomic.AddInt64(&s.authSuccess, 1)
+	return &result, nil
+}
+
+// LoadFile 从JSON文件加载密钥列表
+// 文件内容为密钥数组，每项可提供明文 key 或 key_hash；未指定 enabled 时默认启用
+// 明文密钥在哈希前登记到日志屏蔽器
+func (s *KeyStore) LoadFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("读取密钥文件失败: %w", err)
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("解析密钥文件失败: %w", err)
+	}
+
+	loaded := 0
+	for i, raw := range entries {
+		key := APIKey{Enabled: true}
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return loaded, fmt.Errorf("解析密钥文件第 %d 项失败: %w", i+1, err)
+		}
+		redact.AddSecrets(key.Key)
+		if err := s.Add(key); err != nil {
+			return loaded, err
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+// GetMetrics 获取认证指标
+func (s *KeyStore) GetMetrics() map[string]interface{} {
+	s.mu.RLock()
+	total := len(s.keys)
+	enabled := 0
+	for _, key := range s.keys {
+		if key.Enabled {
+			enabled++
+		}
+	}
+	s.mu.RUnlock()
+
+	return map[string]interface{}{
+		"enabled":      total > 0,
+		"keys":         total,
+		"enabled_keys": enabled,
+		"auth_success": atomic.LoadInt64(&s.authSuccess),
+		"auth_failure": atomic.LoadInt64(&s.authFailure),
+	}
+}
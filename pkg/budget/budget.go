@@ -0,0 +1,410 @@
+package budget
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"scira2api/log"
+)
+
+// 预算周期
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// ErrBudgetExceeded 请求的预估费用超出剩余预算
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Price 模型每1k tokens的价格
+type Price struct {
+	Input     float64 `json:"input"`
+	Output    float64 `json:"output"`
+	Reasoning float64 `json:"reasoning"`
+}
+
+// Cost 计算一次请求的费用；completion 包含推理tokens，推理部分按推理价格计算
+func (p Price) Cost(prompt, completion, reasoning int) float64 {
+	output := completion - reasoning
+	if output < 0 {
+		output = 0
+	}
+	return (float64(prompt)*p.Input + float64(output)*p.Output + float64(reasoning)*p.Reasoning) / 1000
+}
+
+// Limit 单个API密钥的预算，0 表示不限制
+type Limit struct {
+	Daily   float64
+	Monthly float64
+}
+
+// IsZero 检查是否未设置任何预算
+func (l Limit) IsZero() bool {
+	return l.Daily <= 0 && l.Monthly <= 0
+}
+
+// Status 一个预算周期的状态
+type Status struct {
+	Period    string    `json:"period"`
+	Limit     float64   `json:"limit"`
+	Spent     float64   `json:"spent"` // 已结算费用加上进行中请求的预估费用
+	Remaining float64   `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// UsedRatio 返回已用预算的比例
+func (s Status) UsedRatio() float64 {
+	if s.Limit <= 0 {
+		return 0
+	}
+	return s.Spent / s.Limit
+}
+
+// Alert 预算告警：已用比例首次达到阈值，或请求因预算不足被拒绝（Threshold 为 1）
+type Alert struct {
+	Key       string    `json:"key"`
+	Period    string    `json:"period"`
+	Threshold float64   `json:"threshold"`
+	Limit     float64   `json:"limit"`
+	Spent     float64   `json:"spent"`
+	Exceeded  bool      `json:"exceeded"`
+	Time      time.Time `json:"time"`
+}
+
+// Notifier 接收预算告警
+type Notifier interface {
+	Notify(alert Alert)
+}
+
+// period 一个预算周期的累计费用
+type period struct {
+	name     string
+	start    time.Time
+	spent    float64 // 已结算
+	reserved float64 // 进行中请求的预估费用
+	warned   float64 // 本周期已告警的最高阈值
+}
+
+// roll 周期结束时清零
+func (p *period) roll(now time.Time) {
+	if start := periodStart(p.name, now); !start.Equal(p.start) {
+		p.start = start
+		p.spent = 0
+		p.reserved = 0
+		p.warned = 0
+	}
+}
+
+// status 返回周期状态
+func (p *period) status(limit float64) Status {
+	spent := p.spent + p.reserved
+	remaining := limit - spent
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Status{Period: p.name, Limit: limit, Spent: spent, Remaining: remaining, Reset: periodEnd(p.name, p.start)}
+}
+
+// account 单个API密钥的费用
+type account struct {
+	day      period
+	month    period
+	requests int64
+	rejected int64
+}
+
+// Tracker 按API密钥累计费用并检查日预算和月预算，周期按UTC自然日和自然月划分
+type Tracker struct {
+	thresholds []float64
+	notifier   Notifier
+
+	mu       sync.Mutex
+	accounts map[string]*account
+	alerts   int64
+}
+
+// NewTracker 创建预算跟踪器，thresholds 为触发告警的已用比例（如 0.8），notifier 可以为nil
+func NewTracker(thresholds []float64, notifier Notifier) *Tracker {
+	sorted := append([]float64(nil), thresholds...)
+	sort.Float64s(sorted)
+	return &Tracker{
+		thresholds: sorted,
+		notifier:   notifier,
+		accounts:   make(map[string]*account),
+	}
+}
+
+// accountLocked 获取或创建密钥的费用记录，并滚动到当前周期，调用方需持有锁
+func (t *Tracker) accountLocked(key string, now time.Time) *account {
+	acc, ok := t.accounts[key]
+	if !ok {
+		acc = &account{day: period{name: PeriodDaily}, month: period{name: PeriodMonthly}}
+		t.accounts[key] = acc
+	}
+	acc.day.roll(now)
+	acc.month.roll(now)
+	return acc
+}
+
+// Seed 计入历史费用，用于启动时从用量账本恢复当前周期的累计费用
+func (t *Tracker) Seed(key string, at time.Time, cost float64) {
+	if cost <= 0 {
+		return
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	acc := t.accountLocked(key, now)
+	if !at.Before(acc.month.start) {
+		acc.month.spent += cost
+	}
+	if !at.Before(acc.day.start) {
+		acc.day.spent += cost
+	}
+}
+
+// Reservation 一次请求的预算预留，请求结束后按实际费用结算
+type Reservation struct {
+	tracker    *Tracker
+	key        string
+	limit      Limit
+	estimated  float64
+	dayStart   time.Time
+	monthStart time.Time
+	once       sync.Once
+}
+
+// Reserve 为请求预留预估费用
+// 任一周期的剩余预算不足时返回 ErrBudgetExceeded，状态中包含超出的周期；否则返回所有设置了预算的周期的状态
+func (t *Tracker) Reserve(key string, estimated float64, limit Limit) (*Reservation, []Status, error) {
+	if limit.IsZero() {
+		return nil, nil, nil
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	acc := t.accountLocked(key, now)
+	acc.requests++
+
+	var statuses []Status
+	for _, p := range []struct {
+		period *period
+		limit  float64
+	}{{&acc.day, limit.Daily}, {&acc.month, limit.Monthly}} {
+		if p.limit <= 0 {
+			continue
+		}
+		status := p.period.status(p.limit)
+		if status.Spent >= p.limit || status.Spent+estimated > p.limit {
+			acc.rejected++
+			alert := t.alertLocked(key, p.period, p.limit, 1, now)
+			t.mu.Unlock()
+			t.notify(alert)
+			return nil, []Status{status}, fmt.Errorf("%w: %s budget of $%.4f has $%.4f remaining, request needs about $%.4f",
+				ErrBudgetExceeded, p.period.name, p.limit, status.Remaining, estimated)
+		}
+		statuses = append(statuses, status)
+	}
+
+	acc.day.reserved += estimated
+	acc.month.reserved += estimated
+	t.mu.Unlock()
+
+	return &Reservation{
+		tracker:    t,
+		key:        key,
+		limit:      limit,
+		estimated:  estimated,
+		dayStart:   acc.day.start,
+		monthStart: acc.month.start,
+	}, statuses, nil
+}
+
+// Settle 按实际费用结算，释放预估费用并检查告警阈值；只有第一次调用生效
+func (r *Reservation) Settle(actual float64) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.tracker.settle(r, actual)
+	})
+}
+
+// settle 结算预留，周期已经滚动时只计入新周期
+func (t *Tracker) settle(r *Reservation, actual float64) {
+	now := time.Now()
+	if actual < 0 {
+		actual = 0
+	}
+
+	t.mu.Lock()
+	acc := t.accountLocked(r.key, now)
+	var alerts []Alert
+	for _, p := range []struct {
+		period *period
+		start  time.Time
+		limit  float64
+	}{{&acc.day, r.dayStart, r.limit.Daily}, {&acc.month, r.monthStart, r.limit.Monthly}} {
+		if p.period.start.Equal(p.start) {
+			p.period.reserved -= r.estimated
+			if p.period.reserved < 0 {
+				p.period.reserved = 0
+			}
+		}
+		p.period.spent += actual
+
+		if p.limit <= 0 {
+			continue
+		}
+		ratio := (p.period.spent + p.period.reserved) / p.limit
+		for i := len(t.thresholds) - 1; i >= 0; i-- {
+			if threshold := t.thresholds[i]; ratio >= threshold {
+				if threshold > p.period.warned {
+					alerts = append(alerts, t.alertLocked(r.key, p.period, p.limit, threshold, now))
+				}
+				break
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, alert := range alerts {
+		t.notify(alert)
+	}
+}
+
+// alertLocked 生成告警并记录本周期已告警的阈值；阈值已告警过时返回空告警，调用方需持有锁
+func (t *Tracker) alertLocked(key string, p *period, limit, threshold float64, now time.Time) Alert {
+	if threshold <= p.warned {
+		return Alert{}
+	}
+	p.warned = threshold
+	t.alerts++
+	return Alert{
+		Key:       key,
+		Period:    p.name,
+		Threshold: threshold,
+		Limit:     limit,
+		Spent:     p.spent + p.reserved,
+		Exceeded:  threshold >= 1,
+		Time:      now,
+	}
+}
+
+// notify 记录并发送告警
+func (t *Tracker) notify(alert Alert) {
+	if alert.Key == "" {
+		return
+	}
+	log.Warn("预算告警: 密钥=%s, 周期=%s, 已用=$%.4f/$%.4f (阈值 %.0f%%)",
+		alert.Key, alert.Period, alert.Spent, alert.Limit, alert.Threshold*100)
+	if t.notifier != nil {
+		t.notifier.Notify(alert)
+	}
+}
+
+// Status 返回密钥在设置了预算的周期中的状态
+func (t *Tracker) Status(key string, limit Limit) []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	acc := t.accountLocked(key, time.Now())
+	var statuses []Status
+	if limit.Daily > 0 {
+		statuses = append(statuses, acc.day.status(limit.Daily))
+	}
+	if limit.Monthly > 0 {
+		statuses = append(statuses, acc.month.status(limit.Monthly))
+	}
+	return statuses
+}
+
+// Warning 返回已用比例达到的最高告警阈值，未达到任何阈值时返回0
+func (t *Tracker) Warning(status Status) float64 {
+	ratio := status.UsedRatio()
+	for i := len(t.thresholds) - 1; i >= 0; i-- {
+		if ratio >= t.thresholds[i] {
+			return t.thresholds[i]
+		}
+	}
+	return 0
+}
+
+// GetMetrics 获取指标，包括本月费用最高的密钥
+func (t *Tracker) GetMetrics() map[string]interface{} {
+	type keyStats struct {
+		Key        string  `json:"key"`
+		SpentToday float64 `json:"spent_today"`
+		SpentMonth float64 `json:"spent_month"`
+		Requests   int64   `json:"requests"`
+		Rejected   int64   `json:"rejected"`
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	var today, month float64
+	var rejected int64
+	stats := make([]keyStats, 0, len(t.accounts))
+	for key := range t.accounts {
+		acc := t.accountLocked(key, now)
+		today += acc.day.spent
+		month += acc.month.spent
+		rejected += acc.rejected
+		stats = append(stats, keyStats{
+			Key:        key,
+			SpentToday: roundCost(acc.day.spent),
+			SpentMonth: roundCost(acc.month.spent),
+			Requests:   acc.requests,
+			Rejected:   acc.rejected,
+		})
+	}
+	alerts := t.alerts
+	t.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].SpentMonth != stats[j].SpentMonth {
+			return stats[i].SpentMonth > stats[j].SpentMonth
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if len(stats) > 10 {
+		stats = stats[:10]
+	}
+
+	return map[string]interface{}{
+		"spent_today":  roundCost(today),
+		"spent_month":  roundCost(month),
+		"rejected":     rejected,
+		"alerts":       alerts,
+		"thresholds":   t.thresholds,
+		"top_spenders": stats,
+	}
+}
+
+// roundCost 把费用四舍五入到百万分之一美元，避免指标中出现浮点误差
+func roundCost(cost float64) float64 {
+	return math.Round(cost*1e6) / 1e6
+}
+
+// periodStart 返回 now 所在周期的开始时间（UTC）
+func periodStart(name string, now time.Time) time.Time {
+	now = now.UTC()
+	if name == PeriodMonthly {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// periodEnd 返回周期的结束时间
+func periodEnd(name string, start time.Time) time.Time {
+	if name == PeriodMonthly {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,84 @@
+package budget
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"scira2api/log"
+)
+
+// WebhookNotifier 以JSON POST把预算告警发送到webhook，发送在后台进行，不阻塞请求
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+	sent   int64
+	failed int64
+}
+
+// NewWebhookNotifier 创建webhook告警
+func NewWebhookNotifier(url string, timeout time.Duration) *WebhookNotifier {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Notify 发送告警
+func (w *WebhookNotifier) Notify(alert Alert) {
+	go func() {
+		if err := w.send(alert); err != nil {
+			atomic.AddInt64(&w.failed, 1)
+			log.Error("发送预算告警失败: 密钥=%s, 周期=%s: %v", alert.Key, alert.Period, err)
+			return
+		}
+		atomic.AddInt64(&w.sent, 1)
+	}()
+}
+
+// send 发送一次告警请求
+func (w *WebhookNotifier) send(alert Alert) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"event": eventName(alert),
+		"alert": alert,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// GetMetrics 获取指标
+func (w *WebhookNotifier) GetMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"sent":   atomic.LoadInt64(&w.sent),
+		"failed": atomic.LoadInt64(&w.failed),
+	}
+}
+
+// eventName 告警事件名称
+func eventName(alert Alert) string {
+	if alert.Exceeded {
+		return "budget.exceeded"
+	}
+	return "budget.threshold"
+}
@@ -80,6 +80,11 @@ func (rc *ResponseCache) Clear() {
 	log.Info("Response cache cleared")
 }
 
+// InvalidateModelCache 使模型列表缓存失效，模型映射变化后调用
+func (rc *ResponseCache) InvalidateModelCache() {
+	rc.modelCache.Delete(constants.ModelCacheKey)
+}
+
 // SetModelCache 缓存模型列表
 func (rc *ResponseCache) SetModelCache(models []models.OpenAIModelResponse) {
 	if !rc.IsEnabled() {
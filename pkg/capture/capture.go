@@ -0,0 +1,326 @@
+// Package capture 把选中的请求完整记录到按大小轮转的JSONL文件，用于排查客户端反馈的问题
+// 每行一条记录：客户端的OpenAI请求、转换后的Scira请求、上游原始数据行和最终返回给客户端的响应
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"scira2api/log"
+	"scira2api/pkg/redact"
+	"scira2api/pkg/rotate"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options 捕获配置
+type Options struct {
+	File          string   // JSONL文件路径
+	MaxSize       int64    // 文件达到该大小（字节）后轮转
+	MaxBackups    int      // 保留的轮转文件数
+	Keys          []string // 总是捕获的API密钥名称
+	SampleRate    float64  // 其他请求的采样比例 (0-1)
+	MaxRecordSize int      // 单条记录中上游数据行和响应的最大字节数，超出部分丢弃并标记 truncated
+}
+
+// Record 一个请求的捕获记录
+type Record struct {
+	Time            time.Time       `json:"time"`
+	RequestID       string          `json:"request_id"`
+	Key             string          `json:"key,omitempty"`
+	Model           string          `json:"model"`
+	Stream          bool            `json:"stream"`
+	Request         json.RawMessage `json:"request"`
+	UpstreamRequest json.RawMessage `json:"upstream_request,omitempty"`
+	UpstreamLines   []string        `json:"upstream_lines"`
+	Status          int             `json:"status"`
+	Response        string          `json:"response"`
+	DurationMs      int64           `json:"duration_ms"`
+	Truncated       bool            `json:"truncated,omitempty"`
+}
+
+// Recorder 捕获器，决定哪些请求需要捕获并写出记录
+type Recorder struct {
+	opts Options
+	keys map[string]bool
+	file *rotate.File
+
+	mu   sync.Mutex // 保护文件写入和随机数生成器
+	rand *rand.Rand
+
+	captured  int64
+	truncated int64
+	failed    int64
+}
+
+// New 创建捕获器，没有指定密钥且采样比例为0时返回nil（不捕获）
+func New(opts Options) (*Recorder, error) {
+	if len(opts.Keys) == 0 && opts.SampleRate <= 0 {
+		return nil, nil
+	}
+	file, err := rotate.Open(opts.File, opts.MaxSize, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(opts.Keys))
+	for _, key := range opts.Keys {
+		keys[key] = true
+	}
+	return &Recorder{
+		opts: opts,
+		keys: keys,
+		file: file,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// ShouldCapture 判断是否捕获该密钥的请求：指定的密钥总是捕获，其他请求按比例采样
+func (r *Recorder) ShouldCapture(key string) bool {
+	if r == nil {
+		return false
+	}
+	if r.keys[key] {
+		return true
+	}
+	if r.opts.SampleRate <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Float64() < r.opts.SampleRate
+}
+
+// Start 开始捕获一个请求，返回的上下文携带捕获会话，供上游请求和流处理阶段追加内容
+func (r *Recorder) Start(ctx context.Context, requestID, key, model string, stream bool, request interface{}) (context.Context, *Session) {
+	session := &Session{
+		recorder: r,
+		started:  time.Now(),
+		record: Record{
+			Time:      time.Now(),
+			RequestID: requestID,
+			Key:       key,
+			Model:     model,
+			Stream:    stream,
+			Request:   marshalRedacted(request),
+		},
+	}
+	return context.WithValue(ctx, sessionKey{}, session), session
+}
+
+// write 写出一条记录
+func (r *Recorder) write(record Record) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		atomic.AddInt64(&r.failed, 1)
+		return
+	}
+	data = append(data, '\n')
+
+	r.mu.Lock()
+	_, err = r.file.Write(data)
+	r.mu.Unlock()
+	if err != nil {
+		atomic.AddInt64(&r.failed, 1)
+		log.Error("写入请求捕获记录失败: %v", err)
+		return
+	}
+	atomic.AddInt64(&r.captured, 1)
+	if record.Truncated {
+		atomic.AddInt64(&r.truncated, 1)
+	}
+}
+
+// Close 关闭捕获文件
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// GetMetrics 获取捕获统计
+func (r *Recorder) GetMetrics() map[string]interface{} {
+	if r == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return map[string]interface{}{
+		"enabled":     true,
+		"file":        r.opts.File,
+		"keys":        r.opts.Keys,
+		"sample_rate": r.opts.SampleRate,
+		"captured":    atomic.LoadInt64(&r.captured),
+		"truncated":   atomic.LoadInt64(&r.truncated),
+		"failed":      atomic.LoadInt64(&r.failed),
+	}
+}
+
+// sessionKey 上下文中保存捕获会话的键
+type sessionKey struct{}
+
+// Session 一个请求的捕获会话，方法可以在nil上调用，未捕获的请求无需判断
+type Session struct {
+	recorder *Recorder
+	started  time.Time
+
+	mu       sync.Mutex
+	record   Record
+	response []byte
+	size     int
+	finished bool
+}
+
+// FromContext 获取上下文中的捕获会话，请求未被捕获时返回nil
+func FromContext(ctx context.Context) *Session {
+	if ctx == nil {
+		return nil
+	}
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// SetUpstreamRequest 记录发往上游的请求，重试时只保留最后一次请求及其上游数据
+func (s *Session) SetUpstreamRequest(request interface{}) {
+	if s == nil {
+		return
+	}
+	data := marshalRedacted(request)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.record.UpstreamRequest = data
+	for _, line := range s.record.UpstreamLines {
+		s.size -= len(line)
+	}
+	s.record.UpstreamLines = nil
+}
+
+// AddUpstreamLine 追加一行上游原始数据
+func (s *Session) AddUpstreamLine(line string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reserve(len(line)) {
+		s.record.UpstreamLines = append(s.record.UpstreamLines, line)
+	}
+}
+
+// AppendResponse 追加写给客户端的响应数据
+func (s *Session) AppendResponse(p []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reserve(len(p)) {
+		s.response = append(s.response, p...)
+	}
+}
+
+// reserve 检查记录大小限制，超出时标记截断，调用方需持有锁
+func (s *Session) reserve(n int) bool {
+	if s.finished {
+		return false
+	}
+	if max := s.recorder.opts.MaxRecordSize; max > 0 && s.size+n > max {
+		s.record.Truncated = true
+		return false
+	}
+	s.size += n
+	return true
+}
+
+// Finish 屏蔽敏感信息后写出记录，只有第一次调用生效
+func (s *Session) Finish(status int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	record := s.record
+	record.Response = string(s.response)
+	s.mu.Unlock()
+
+	record.Status = status
+	record.DurationMs = time.Since(s.started).Milliseconds()
+	lines := make([]string, len(record.UpstreamLines))
+	for i, line := range record.UpstreamLines {
+		lines[i] = redact.String(line)
+	}
+	record.UpstreamLines = lines
+	record.Response = redact.String(record.Response)
+	s.recorder.write(record)
+}
+
+// marshalRedacted 把值编码为JSON并屏蔽敏感信息
+// 优先屏蔽整段JSON文本，这样 "api_key": "..." 这类键值对也能识别；屏蔽结果不是合法JSON时改为逐个屏蔽字符串
+func marshalRedacted(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	if redacted := redact.String(string(data)); json.Valid([]byte(redacted)) {
+		return json.RawMessage(redacted)
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return data
+	}
+	redacted, err := json.Marshal(redactTree(tree))
+	if err != nil {
+		return data
+	}
+	return redacted
+}
+
+// redactTree 递归屏蔽JSON值中的字符串
+func redactTree(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return redact.String(value)
+	case []interface{}:
+		for i := range value {
+			value[i] = redactTree(value[i])
+		}
+	case map[string]interface{}:
+		for k := range value {
+			value[k] = redactTree(value[k])
+		}
+	}
+	return v
+}
+
+// Read 逐条读取JSONL捕获文件，fn 返回错误时停止读取
+func Read(r io.Reader, fn func(Record) error) error {
+	reader := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && len(bytes.TrimSpace(line)) > 0 {
+			var record Record
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				return fmt.Errorf("line %d: %w", lineNo, jsonErr)
+			}
+			if fnErr := fn(record); fnErr != nil {
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,443 @@
+// Package chaos 为客户端的容错测试注入故障
+// 规则按API密钥和模型限定范围，上游故障（延迟、首字节延迟、429/5xx、上游断开）在上游请求的Transport中注入，
+// 流式故障（客户端连接断开、格式错误的数据块）在SSE写出时注入，客户端看到的与真实故障相同
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"scira2api/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 故障类型
+const (
+	FaultLatency            = "latency"             // 发送上游请求前等待 delay
+	FaultFirstByte          = "first_byte"          // 收到上游响应头后，等待 delay 再返回第一个字节
+	FaultStatus             = "status"              // 不访问上游，直接返回 status（429 或 5xx）
+	FaultUpstreamDisconnect = "upstream_disconnect" // 上游响应在 after 行之后中断
+	FaultDisconnect         = "disconnect"          // 向客户端写出 after 个SSE事件后断开连接
+	FaultMalformed          = "malformed"           // 写出 after 个SSE事件后插入一个格式错误的数据块
+)
+
+// Duration 以 "250ms"、"2s" 形式编码为JSON的时长
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule 一条故障规则，每条规则注入一种故障，多条规则可以同时生效
+type Rule struct {
+	Name        string   `json:"name,omitempty"`
+	Keys        []string `json:"keys,omitempty"`        // API密钥名称，为空时匹配所有密钥
+	Models      []string `json:"models,omitempty"`      // 请求中的模型名称，为空时匹配所有模型
+	Fault       string   `json:"fault"`                 // 故障类型
+	Probability float64  `json:"probability,omitempty"` // 每次注入的概率 (0-1]，0 表示总是注入
+	Delay       Duration `json:"delay,omitempty"`       // latency 和 first_byte 的延迟
+	Status      int      `json:"status,omitempty"`      // status 返回的状态码
+	After       int      `json:"after,omitempty"`       // 断开或插入格式错误数据块之前的行数/事件数
+}
+
+// label 日志和错误信息中的规则名称，未命名时使用故障类型
+func (r Rule) label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Fault
+}
+
+// Validate 检查规则是否完整
+func (r Rule) Validate() error {
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("rule %s: probability must be between 0 and 1", r.label())
+	}
+	if r.After < 0 {
+		return fmt.Errorf("rule %s: after must not be negative", r.label())
+	}
+	switch r.Fault {
+	case FaultLatency, FaultFirstByte:
+		if r.Delay <= 0 {
+			return fmt.Errorf("rule %s: %s requires a positive delay", r.label(), r.Fault)
+		}
+	case FaultStatus:
+		if r.Status != http.StatusTooManyRequests && (r.Status < 500 || r.Status > 599) {
+			return fmt.Errorf("rule %s: status must be 429 or 5xx, got %d", r.label(), r.Status)
+		}
+	case FaultUpstreamDisconnect, FaultDisconnect, FaultMalformed:
+	default:
+		return fmt.Errorf("rule %s: unknown fault %q", r.label(), r.Fault)
+	}
+	return nil
+}
+
+// matches 检查规则是否适用于指定的密钥和模型
+func (r Rule) matches(key, model string) bool {
+	return matchAny(r.Keys, key) && matchAny(r.Models, model)
+}
+
+func matchAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRules 从JSON文件读取规则数组
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("decode chaos rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Injector 故障注入器，未启用时不影响请求
+type Injector struct {
+	mu       sync.RWMutex
+	enabled  bool
+	rules    []Rule
+	rand     *rand.Rand
+	injected map[string]int64 // 按故障类型统计的注入次数
+}
+
+// New 创建故障注入器，规则不合法时返回错误
+func New(enabled bool, rules []Rule) (*Injector, error) {
+	i := &Injector{
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		injected: make(map[string]int64),
+	}
+	if err := i.SetRules(rules); err != nil {
+		return nil, err
+	}
+	i.enabled = enabled
+	return i, nil
+}
+
+// Enable 启用故障注入
+func (i *Injector) Enable() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.enabled = true
+}
+
+// Disable 停止故障注入，已开始的请求不受影响
+func (i *Injector) Disable() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.enabled = false
+}
+
+// IsEnabled 是否启用
+func (i *Injector) IsEnabled() bool {
+	if i == nil {
+		return false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.enabled
+}
+
+// Rules 返回当前规则
+func (i *Injector) Rules() []Rule {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return append([]Rule{}, i.rules...)
+}
+
+// SetRules 替换全部规则
+func (i *Injector) SetRules(rules []Rule) error {
+	for n, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", n, err)
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rules = append([]Rule{}, rules...)
+	return nil
+}
+
+// Plan 选出适用于请求的规则，未启用或没有匹配的规则时返回nil
+func (i *Injector) Plan(key, model string) *Plan {
+	if i == nil {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if !i.enabled {
+		return nil
+	}
+	var rules []Rule
+	for _, rule := range i.rules {
+		if rule.matches(key, model) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return &Plan{injector: i, rules: rules}
+}
+
+// roll 按概率决定是否注入
+func (i *Injector) roll(probability float64) bool {
+	if probability <= 0 || probability >= 1 {
+		return true
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rand.Float64() < probability
+}
+
+// record 记录一次注入
+func (i *Injector) record(ctx context.Context, rule Rule) {
+	i.mu.Lock()
+	i.injected[rule.Fault]++
+	i.mu.Unlock()
+	log.Ctx(ctx).Warn("故障注入: 规则=%s, 故障=%s", rule.label(), rule.Fault)
+}
+
+// GetMetrics 获取故障注入统计
+func (i *Injector) GetMetrics() map[string]interface{} {
+	if i == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	injected := make(map[string]int64, len(i.injected))
+	for fault, count := range i.injected {
+		injected[fault] = count
+	}
+	return map[string]interface{}{
+		"enabled":  i.enabled,
+		"rules":    len(i.rules),
+		"injected": injected,
+	}
+}
+
+// Plan 一个请求适用的故障规则
+type Plan struct {
+	injector *Injector
+	rules    []Rule
+}
+
+type contextKey struct{}
+
+// NewContext 返回携带故障规则的上下文
+func NewContext(ctx context.Context, plan *Plan) context.Context {
+	if plan == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, plan)
+}
+
+// FromContext 获取上下文中的故障规则，没有时返回nil
+func FromContext(ctx context.Context) *Plan {
+	if ctx == nil {
+		return nil
+	}
+	plan, _ := ctx.Value(contextKey{}).(*Plan)
+	return plan
+}
+
+// fire 返回本次需要注入的指定类型的规则
+func (p *Plan) fire(ctx context.Context, fault string) (Rule, bool) {
+	if p == nil {
+		return Rule{}, false
+	}
+	for _, rule := range p.rules {
+		if rule.Fault == fault && p.injector.roll(rule.Probability) {
+			p.injector.record(ctx, rule)
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Wrap 包装上游请求使用的Transport，请求上下文中有故障规则时注入上游故障
+func (i *Injector) Wrap(next http.RoundTripper) http.RoundTripper {
+	if i == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return transport{next: next}
+}
+
+// transport 注入上游故障的Transport，每次上游请求（包括重试）分别按概率注入
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	plan := FromContext(ctx)
+	if plan == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	if rule, ok := plan.fire(ctx, FaultLatency); ok {
+		if err := sleep(ctx, time.Duration(rule.Delay)); err != nil {
+			return nil, err
+		}
+	}
+
+	if rule, ok := plan.fire(ctx, FaultStatus); ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return statusResponse(req, rule.Status), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &faultyBody{ReadCloser: resp.Body, ctx: ctx, cutAfter: -1}
+	if rule, ok := plan.fire(ctx, FaultFirstByte); ok {
+		body.delay = time.Duration(rule.Delay)
+	}
+	if rule, ok := plan.fire(ctx, FaultUpstreamDisconnect); ok {
+		body.cutAfter = rule.After
+	}
+	if body.delay > 0 || body.cutAfter >= 0 {
+		resp.Body = body
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+// statusResponse 构造上游的错误响应
+func statusResponse(req *http.Request, status int) *http.Response {
+	body := fmt.Sprintf(`{"error":%q}`, http.StatusText(status))
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if status == http.StatusTooManyRequests {
+		header.Set("Retry-After", "1")
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// faultyBody 延迟返回第一个字节，或在读到指定行数后像连接断开一样返回 io.ErrUnexpectedEOF
+type faultyBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	delay    time.Duration
+	cutAfter int // 小于0时不中断
+	lines    int
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	if b.delay > 0 {
+		delay := b.delay
+		b.delay = 0
+		if err := sleep(b.ctx, delay); err != nil {
+			return 0, err
+		}
+	}
+	if b.cutAfter >= 0 && b.lines >= b.cutAfter {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if b.cutAfter < 0 {
+		return n, err
+	}
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			b.lines++
+			if b.lines >= b.cutAfter {
+				return i + 1, nil
+			}
+		}
+	}
+	return n, err
+}
+
+// StreamFaults 单个SSE响应流的故障，创建时按概率决定本次响应注入哪些故障
+type StreamFaults struct {
+	events       int
+	disconnectAt int // 小于0时不断开
+	malformedAt  int // 小于0时不插入
+}
+
+// StreamFaults 返回本次流式响应需要注入的故障，没有时返回nil
+func (p *Plan) StreamFaults(ctx context.Context) *StreamFaults {
+	faults := &StreamFaults{disconnectAt: -1, malformedAt: -1}
+	if rule, ok := p.fire(ctx, FaultDisconnect); ok {
+		faults.disconnectAt = rule.After
+	}
+	if rule, ok := p.fire(ctx, FaultMalformed); ok {
+		faults.malformedAt = rule.After
+	}
+	if faults.disconnectAt < 0 && faults.malformedAt < 0 {
+		return nil
+	}
+	return faults
+}
+
+// Next 在写出一个SSE事件之前调用，返回是否先写出格式错误的数据块，以及是否应在写出之前断开连接
+func (s *StreamFaults) Next() (malformed, disconnect bool) {
+	index := s.events
+	s.events++
+	return index == s.malformedAt, index == s.disconnectAt
+}
+
+// Malformed 返回截断的SSE事件：保留 "data: " 和一半的JSON，像上游或网络截断的数据块一样无法解析
+func Malformed(event []byte) []byte {
+	payload := strings.TrimSpace(strings.TrimPrefix(string(event), "data: "))
+	return []byte("data: " + payload[:len(payload)/2] + "\n\n")
+}
+
+// sleep 等待指定时间，上下文取消时返回错误
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,345 @@
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"scira2api/log"
+)
+
+func init() {
+	log.SetLevel(log.ERROR)
+}
+
+// upstream 记录请求次数并返回固定响应体的上游Transport
+type upstream struct {
+	body  string
+	calls int
+}
+
+func (u *upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.calls++
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(u.body)),
+		ContentLength: int64(len(u.body)),
+		Request:       req,
+	}, nil
+}
+
+// newPlan 创建只包含指定规则的已启用注入器，并返回请求的故障规则
+func newPlan(t *testing.T, rules ...Rule) *Plan {
+	t.Helper()
+	injector, err := New(true, rules)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return injector.Plan("alice", "gpt-4o")
+}
+
+// roundTrip 带着故障规则经由注入Transport发送请求，读取完整响应体
+func roundTrip(t *testing.T, plan *Plan, up *upstream) (*http.Response, string, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(NewContext(context.Background(), plan), http.MethodPost, "http://upstream.test/api", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&Injector{}).Wrap(up).RoundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, string(body), err
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		ok   bool
+	}{
+		{Rule{Fault: FaultLatency, Delay: Duration(time.Second)}, true},
+		{Rule{Fault: FaultLatency}, false},
+		{Rule{Fault: FaultFirstByte, Delay: Duration(-time.Second)}, false},
+		{Rule{Fault: FaultStatus, Status: 429}, true},
+		{Rule{Fault: FaultStatus, Status: 503}, true},
+		{Rule{Fault: FaultStatus, Status: 404}, false},
+		{Rule{Fault: FaultUpstreamDisconnect}, true},
+		{Rule{Fault: FaultDisconnect, After: -1}, false},
+		{Rule{Fault: FaultMalformed, Probability: 1.5}, false},
+		{Rule{Fault: "meteor"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok=%v", tt.rule, err, tt.ok)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var rule Rule
+	if err := json.Unmarshal([]byte(`{"fault":"latency","delay":"250ms"}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(rule.Delay) != 250*time.Millisecond {
+		t.Fatalf("delay = %v, want 250ms", time.Duration(rule.Delay))
+	}
+	if err := json.Unmarshal([]byte(`{"delay":250}`), &rule); err == nil {
+		t.Fatal("numeric delay should be rejected")
+	}
+}
+
+func TestPlanScope(t *testing.T) {
+	injector, err := New(true, []Rule{
+		{Name: "alice-only", Fault: FaultStatus, Status: 503, Keys: []string{"alice"}},
+		{Name: "claude", Fault: FaultMalformed, Models: []string{"Claude-4-Sonnet"}},
+		{Name: "any", Fault: FaultDisconnect, Keys: []string{"*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, model string
+		want       []string
+	}{
+		{"alice", "gpt-4o", []string{"alice-only", "any"}},
+		{"bob", "claude-4-sonnet", []string{"claude", "any"}}, // 模型名不区分大小写
+		{"", "gpt-4o", []string{"any"}},
+	}
+	for _, tt := range tests {
+		plan := injector.Plan(tt.key, tt.model)
+		var got []string
+		for _, rule := range plan.rules {
+			got = append(got, rule.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Plan(%q, %q) = %v, want %v", tt.key, tt.model, got, tt.want)
+		}
+	}
+
+	injector.Disable()
+	if plan := injector.Plan("alice", "gpt-4o"); plan != nil {
+		t.Fatal("disabled injector should not plan faults")
+	}
+	var nilInjector *Injector
+	if nilInjector.Plan("alice", "gpt-4o") != nil || nilInjector.IsEnabled() {
+		t.Fatal("nil injector should be disabled")
+	}
+}
+
+func TestProbability(t *testing.T) {
+	injector, err := New(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injector.rand = rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		probability float64
+		min, max    int
+	}{
+		{0, 1000, 1000}, // 0 表示总是注入
+		{1, 1000, 1000},
+		{0.25, 200, 300},
+	}
+	for _, tt := range tests {
+		hits := 0
+		for i := 0; i < 1000; i++ {
+			if injector.roll(tt.probability) {
+				hits++
+			}
+		}
+		if hits < tt.min || hits > tt.max {
+			t.Errorf("probability %v: %d/1000 injected, want %d-%d", tt.probability, hits, tt.min, tt.max)
+		}
+	}
+}
+
+func TestTransportFaults(t *testing.T) {
+	const body = "data: 1\ndata: 2\ndata: 3\n"
+	tests := []struct {
+		name     string
+		rules    []Rule
+		status   int
+		body     string
+		err      error // 读取响应体时的错误
+		calls    int   // 上游收到的请求数
+		minDelay time.Duration
+	}{
+		{name: "no plan", status: 200, body: body, calls: 1},
+		{
+			name:   "status 503",
+			rules:  []Rule{{Fault: FaultStatus, Status: 503}},
+			status: 503, body: `{"error":"Service Unavailable"}`, calls: 0,
+		},
+		{
+			name:   "status 429",
+			rules:  []Rule{{Fault: FaultStatus, Status: 429}},
+			status: 429, body: `{"error":"Too Many Requests"}`, calls: 0,
+		},
+		{
+			name:   "disconnect before first line",
+			rules:  []Rule{{Fault: FaultUpstreamDisconnect, After: 0}},
+			status: 200, body: "", err: io.ErrUnexpectedEOF, calls: 1,
+		},
+		{
+			name:   "disconnect after two lines",
+			rules:  []Rule{{Fault: FaultUpstreamDisconnect, After: 2}},
+			status: 200, body: "data: 1\ndata: 2\n", err: io.ErrUnexpectedEOF, calls: 1,
+		},
+		{
+			name:   "disconnect after the last line",
+			rules:  []Rule{{Fault: FaultUpstreamDisconnect, After: 5}},
+			status: 200, body: body, calls: 1,
+		},
+		{
+			name:   "latency",
+			rules:  []Rule{{Fault: FaultLatency, Delay: Duration(20 * time.Millisecond)}},
+			status: 200, body: body, calls: 1, minDelay: 20 * time.Millisecond,
+		},
+		{
+			name:   "first byte",
+			rules:  []Rule{{Fault: FaultFirstByte, Delay: Duration(20 * time.Millisecond)}},
+			status: 200, body: body, calls: 1, minDelay: 20 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var plan *Plan
+			if tt.rules != nil {
+				plan = newPlan(t, tt.rules...)
+			}
+			up := &upstream{body: body}
+
+			start := time.Now()
+			resp, got, err := roundTrip(t, plan, up)
+			if resp == nil {
+				t.Fatalf("RoundTrip: %v", err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("read error = %v, want %v", err, tt.err)
+			}
+			if resp.StatusCode != tt.status || got != tt.body {
+				t.Fatalf("response = %d %q, want %d %q", resp.StatusCode, got, tt.status, tt.body)
+			}
+			if up.calls != tt.calls {
+				t.Fatalf("upstream calls = %d, want %d", up.calls, tt.calls)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Fatalf("returned after %v, want at least %v", elapsed, tt.minDelay)
+			}
+		})
+	}
+}
+
+func TestTransportStatusLooksReal(t *testing.T) {
+	resp, _, err := roundTrip(t, newPlan(t, Rule{Fault: FaultStatus, Status: 429}), &upstream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "429 Too Many Requests" || resp.Header.Get("Retry-After") != "1" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected 429 response: %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestTransportLatencyCanceled(t *testing.T) {
+	plan := newPlan(t, Rule{Fault: FaultLatency, Delay: Duration(time.Minute)})
+	ctx, cancel := context.WithTimeout(NewContext(context.Background(), plan), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://upstream.test/api", nil)
+
+	up := &upstream{}
+	if _, err := (&Injector{}).Wrap(up).RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if up.calls != 0 {
+		t.Fatal("canceled request should not reach upstream")
+	}
+}
+
+func TestStreamFaults(t *testing.T) {
+	type step struct{ malformed, disconnect bool }
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  []step // nil 表示不注入流式故障
+	}{
+		{name: "upstream faults only", rules: []Rule{{Fault: FaultStatus, Status: 503, Probability: 0}}},
+		{
+			name:  "disconnect before first event",
+			rules: []Rule{{Fault: FaultDisconnect, After: 0}},
+			want:  []step{{false, true}, {false, false}},
+		},
+		{
+			name:  "malformed then disconnect",
+			rules: []Rule{{Fault: FaultMalformed, After: 1}, {Fault: FaultDisconnect, After: 3}},
+			want:  []step{{false, false}, {true, false}, {false, false}, {false, true}},
+		},
+		{
+			name:  "malformed and disconnect at the same event",
+			rules: []Rule{{Fault: FaultMalformed, After: 2}, {Fault: FaultDisconnect, After: 2}},
+			want:  []step{{false, false}, {false, false}, {true, true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faults := newPlan(t, tt.rules...).StreamFaults(context.Background())
+			if tt.want == nil {
+				if faults != nil {
+					t.Fatal("no stream faults expected")
+				}
+				return
+			}
+			for i, want := range tt.want {
+				malformed, disconnect := faults.Next()
+				if malformed != want.malformed || disconnect != want.disconnect {
+					t.Fatalf("event %d: malformed=%v disconnect=%v, want %+v", i, malformed, disconnect, want)
+				}
+			}
+		})
+	}
+
+	var nilPlan *Plan
+	if nilPlan.StreamFaults(context.Background()) != nil {
+		t.Fatal("nil plan should not inject stream faults")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	event := []byte(`data: {"id":"chatcmpl-1","choices":[{"delta":{"content":"hello"}}]}` + "\n\n")
+	got := string(Malformed(event))
+
+	if !strings.HasPrefix(got, "data: {") || !strings.HasSuffix(got, "\n\n") {
+		t.Fatalf("malformed event is not an SSE data event: %q", got)
+	}
+	payload := strings.TrimSuffix(strings.TrimPrefix(got, "data: "), "\n\n")
+	if !strings.HasPrefix(string(event), "data: "+payload) {
+		t.Fatalf("malformed payload %q is not a prefix of the original event", payload)
+	}
+	if json.Valid([]byte(payload)) {
+		t.Fatalf("malformed payload %q should not be valid JSON", payload)
+	}
+}
+
+func TestInjectedMetrics(t *testing.T) {
+	injector, err := New(true, []Rule{{Fault: FaultStatus, Status: 503}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		roundTrip(t, injector.Plan("alice", "gpt-4o"), &upstream{})
+	}
+	injected := injector.GetMetrics()["injected"].(map[string]int64)
+	if injected[FaultStatus] != 3 {
+		t.Fatalf("injected = %v, want 3 status faults", injected)
+	}
+}
@@ -88,6 +88,10 @@ func (m *ConnPoolMetrics) GetMetrics() map[string]interface{} {
 type ConnPool struct {
 	options *ConnPoolOptions
 	metrics *ConnPoolMetrics
+	
+	// 按标签（代理地址或 direct）分组的连接指标
+	labeled   map[string]*ConnPoolMetrics
+	labeledMu sync.RWMutex
 }
 
 // NewConnPool 创建一个新的连接池管理器
@@ -99,6 +103,7 @@ func NewConnPool(options *ConnPoolOptions) *ConnPool {
 	return &ConnPool{
 		options: options,
 		metrics: &ConnPoolMetrics{},
+		labeled: make(map[string]*ConnPoolMetrics),
 	}
 }
 
@@ -143,26 +148,79 @@ func (p *ConnPool) ConfigureHTTPClient(client *http.Client) {
 	transport.DisableKeepAlives = p.options.DisableKeepAlives
 	
 	// 使用自定义的拨号器以便跟踪连接
-	if transport.DialContext != nil {
-		originalDialContext := transport.DialContext
-		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := originalDialContext(ctx, network, addr)
-			if err == nil && conn != nil {
-				p.metrics.RecordConnCreated()
-				p.metrics.RecordActiveConn(1)
-				
-				// 包装连接以跟踪关闭
-				return &metricConn{
-					Conn:    conn,
-					metrics: p.metrics,
-				}, nil
-			}
+	p.InstrumentTransport(transport, "")
+	
+	log.Info("HTTP连接池配置完成: MaxIdleConns=%d, MaxConnsPerHost=%d, MaxIdleConnsPerHost=%d",
+		p.options.MaxIdleConns, p.options.MaxConnsPerHost, p.options.MaxIdleConnsPerHost)
+}
+
+// Options 返回连接池选项的副本
+func (p *ConnPool) Options() ConnPoolOptions {
+	return *p.options
+}
+
+// InstrumentTransport 包装Transport的拨号器以跟踪连接指标
+// label 非空时（例如代理地址）额外按标签记录指标
+func (p *ConnPool) InstrumentTransport(transport *http.Transport, label string) {
+	dialContext := transport.DialContext
+	if dialContext == nil {
+		dialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: p.options.KeepAlive,
+		}).DialContext
+	}
+	
+	var labeled *ConnPoolMetrics
+	if label != "" {
+		labeled = p.labelMetrics(label)
+	}
+	
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialContext(ctx, network, addr)
+		if err != nil || conn == nil {
 			return conn, err
 		}
+		
+		p.metrics.RecordConnCreated()
+		p.metrics.RecordActiveConn(1)
+		if labeled != nil {
+			labeled.RecordConnCreated()
+			labeled.RecordActiveConn(1)
+		}
+		
+		// 包装连接以跟踪关闭
+		return &metricConn{
+			Conn:    conn,
+			metrics: p.metrics,
+			labeled: labeled,
+		}, nil
+	}
+}
+
+// labelMetrics 获取或创建标签对应的指标
+func (p *ConnPool) labelMetrics(label string) *ConnPoolMetrics {
+	p.labeledMu.RLock()
+	metrics, ok := p.labeled[label]
+	p.labeledMu.RUnlock()
+	if ok {
+		return metrics
 	}
 	
-	log.Info("HTTP连接池配置完成: MaxIdleConns=%d, MaxConnsPerHost=%d, MaxIdleConnsPerHost=%d",
-		p.options.MaxIdleConns, p.options.MaxConnsPerHost, p.options.MaxIdleConnsPerHost)
+	p.labeledMu.Lock()
+	defer p.labeledMu.Unlock()
+	if metrics, ok = p.labeled[label]; !ok {
+		metrics = &ConnPoolMetrics{}
+		p.labeled[label] = metrics
+	}
+	return metrics
+}
+
+// RecordConnReused 记录一次连接复用，label 非空时同时计入标签指标
+func (p *ConnPool) RecordConnReused(label string) {
+	p.metrics.RecordConnReused()
+	if label != "" {
+		p.labelMetrics(label).RecordConnReused()
+	}
 }
 
 // ConfigureRestyClient 配置Resty客户端的连接池
@@ -181,7 +239,18 @@ func (p *ConnPool) ConfigureRestyClient(client *resty.Client) {
 
 // GetMetrics 获取连接池指标
 func (p *ConnPool) GetMetrics() map[string]interface{} {
-	return p.metrics.GetMetrics()
+	metrics := p.metrics.GetMetrics()
+	
+	p.labeledMu.RLock()
+	defer p.labeledMu.RUnlock()
+	if len(p.labeled) > 0 {
+		perProxy := make(map[string]interface{}, len(p.labeled))
+		for label, m := range p.labeled {
+			perProxy[label] = m.GetMetrics()
+		}
+		metrics["per_proxy"] = perProxy
+	}
+	return metrics
 }
 
 // CloseIdleConnections 关闭所有空闲连接
@@ -197,16 +266,20 @@ func (p *ConnPool) CloseIdleConnections(client *http.Client) {
 // metricConn 是对net.Conn的包装，用于跟踪连接指标
 type metricConn struct {
 	net.Conn
-	metrics *ConnPoolMetrics
-	closed  bool
+	metrics   *ConnPoolMetrics
+	labeled   *ConnPoolMetrics
+	closeOnce sync.Once
 }
 
 // Close 关闭连接并更新指标
 func (c *metricConn) Close() error {
-	if !c.closed {
+	c.closeOnce.Do(func() {
 		c.metrics.RecordActiveConn(-1)
 		c.metrics.RecordConnClosed()
-		c.closed = true
-	}
+		if c.labeled != nil {
+			c.labeled.RecordActiveConn(-1)
+			c.labeled.RecordConnClosed()
+		}
+	})
 	return c.Conn.Close()
 }
\ No newline at end of file
@@ -30,6 +30,7 @@ const (
 const (
 	ObjectChatCompletion      = "chat.completion"
 	ObjectChatCompletionChunk = "chat.completion.chunk"
+	ObjectTokenize            = "tokenize"
 	RoleAssistant             = "assistant"
 	ProviderScira             = "scira"
 	ChatGroup                 = "chat"
@@ -82,6 +83,296 @@ const (
 	EnvCleanupInterval = "CACHE_CLEANUP_INTERVAL"
 )
 
+// 会话相关常量
+const (
+	// 会话键请求头
+	SessionIDHeader = "X-Session-ID"
+	
+	// 默认会话过期时间
+	DefaultSessionTTL           = 30 * time.Minute // 会话空闲30分钟后过期
+	DefaultSessionQuarantineTTL = 10 * time.Minute // 身份隔离10分钟
+	
+	// 会话配置环境变量
+	EnvSessionEnabled       = "SESSION_ENABLED"
+	EnvSessionTTL           = "SESSION_TTL"
+	EnvSessionQuarantineTTL = "SESSION_QUARANTINE_TTL"
+)
+
+// 认证相关常量
+const (
+	// API密钥请求头（Authorization: Bearer 之外的另一种方式）
+	APIKeyHeader = "x-api-key"
+	
+	// 认证配置环境变量
+	EnvApiKeys     = "API_KEYS"
+	EnvApiKeysFile = "API_KEYS_FILE"
+)
+
+// 分层限流相关常量
+const (
+	// 默认限制（每秒请求数:突发容量）
+	DefaultRateLimitKeyLimit   = "1:10"
+	DefaultRateLimitModelLimit = "5:20"
+	DefaultRateLimitIdleTTL    = 10 * time.Minute
+	
+	// 默认令牌配额（每分钟令牌数:每天令牌数，0 表示不限制）
+	DefaultRateLimitKeyTokens   = "100000:0"
+	DefaultRateLimitModelTokens = "0:0"
+	
+	// 分层限流配置环境变量
+	EnvRateLimitPerKey       = "RATE_LIMIT_PER_KEY"
+	EnvRateLimitKeyDefault   = "RATE_LIMIT_KEY_DEFAULT"
+	EnvRateLimitTiers        = "RATE_LIMIT_TIERS"
+	EnvRateLimitPerModel     = "RATE_LIMIT_PER_MODEL"
+	EnvRateLimitModelDefault = "RATE_LIMIT_MODEL_DEFAULT"
+	EnvRateLimitModels       = "RATE_LIMIT_MODELS"
+	EnvRateLimitIdleTTL      = "RATE_LIMIT_IDLE_TTL"
+	
+	// 令牌配额配置环境变量
+	EnvRateLimitTokens           = "RATE_LIMIT_TOKENS"
+	EnvRateLimitKeyTokens        = "RATE_LIMIT_KEY_TOKENS"
+	EnvRateLimitTokenTiers       = "RATE_LIMIT_TOKEN_TIERS"
+	EnvRateLimitModelTokens      = "RATE_LIMIT_MODEL_TOKENS"
+	EnvRateLimitModelTokenLimits = "RATE_LIMIT_MODEL_TOKEN_LIMITS"
+	
+	// 全局限流模式：wait 在 RATE_LIMIT_MAX_WAIT 内等待令牌，reject 立即返回429
+	RateLimitModeWait       = "wait"
+	RateLimitModeReject     = "reject"
+	DefaultRateLimitMode    = RateLimitModeWait
+	DefaultRateLimitMaxWait = 30 * time.Second
+	EnvRateLimitMode        = "RATE_LIMIT_MODE"
+	EnvRateLimitMaxWait     = "RATE_LIMIT_MAX_WAIT"
+	
+	// wait 模式下等待队列的最大深度
+	DefaultRateLimitQueueDepth = 100
+	EnvRateLimitQueueDepth     = "RATE_LIMIT_QUEUE_DEPTH"
+	
+	// 多副本共享限流的 Redis 协议存储，未设置地址时只使用本地限流
+	DefaultRateLimitRedisPrefix  = "scira2api:ratelimit:"
+	DefaultRateLimitRedisTimeout = 200 * time.Millisecond
+	EnvRateLimitRedisURL         = "RATE_LIMIT_REDIS_URL"
+	EnvRateLimitRedisPrefix      = "RATE_LIMIT_REDIS_PREFIX"
+	EnvRateLimitRedisTimeout     = "RATE_LIMIT_REDIS_TIMEOUT"
+	
+	// OpenAI 风格的请求限流响应头
+	HeaderRateLimitLimitRequests     = "x-ratelimit-limit-requests"
+	HeaderRateLimitRemainingRequests = "x-ratelimit-remaining-requests"
+	HeaderRateLimitResetRequests     = "x-ratelimit-reset-requests"
+	HeaderRetryAfter                 = "Retry-After"
+	
+	// OpenAI 风格的令牌限流响应头
+	HeaderRateLimitLimitTokens     = "x-ratelimit-limit-tokens"
+	HeaderRateLimitRemainingTokens = "x-ratelimit-remaining-tokens"
+	HeaderRateLimitResetTokens     = "x-ratelimit-reset-tokens"
+)
+
+// 并发限制相关常量
+const (
+	// 达到上限时的处理方式：queue 排队等待，reject 立即返回429
+	ConcurrencyModeQueue      = "queue"
+	ConcurrencyModeReject     = "reject"
+	DefaultConcurrencyMode    = ConcurrencyModeQueue
+	DefaultConcurrencyMaxWait = 30 * time.Second
+	ConcurrencyRetryAfter     = time.Second // 并发名额被拒绝时建议客户端重试的间隔
+	
+	// 并发限制环境变量（0 表示不限制）
+	EnvConcurrencyGlobal      = "CONCURRENCY_GLOBAL"
+	EnvConcurrencyPerKey      = "CONCURRENCY_PER_KEY"
+	EnvConcurrencyPerIdentity = "CONCURRENCY_PER_IDENTITY"
+	EnvConcurrencyMode        = "CONCURRENCY_MODE"
+	EnvConcurrencyMaxWait     = "CONCURRENCY_MAX_WAIT"
+)
+
+// 管理接口相关常量
+const (
+	// 管理员密钥请求头（也可使用 Authorization: Bearer）
+	AdminKeyHeader = "x-admin-key"
+	
+	// 默认存储路径
+	DefaultAdminStorePath = "data/scira2api.db"
+	DefaultAdminAuditLog  = "data/admin_audit.log"
+	
+	// 管理接口配置环境变量
+	EnvAdminKey       = "ADMIN_KEY"
+	EnvAdminStorePath = "ADMIN_STORE_PATH"
+	EnvAdminAuditLog  = "ADMIN_AUDIT_LOG"
+)
+
+// 用量账本相关常量
+const (
+	// 未认证请求在账本中的密钥名称
+	UsageAnonymousKey = "anonymous"
+	
+	// 默认配置
+	DefaultUsageEnabled   = true
+	DefaultUsageStorePath = "data/usage.db"
+	DefaultUsageRetention = 90 * 24 * time.Hour
+	DefaultUsageRange     = 30 * 24 * time.Hour // 查询未指定 from 时的默认时间范围
+	
+	// 用量账本配置环境变量
+	EnvUsageEnabled   = "USAGE_ENABLED"
+	EnvUsageStorePath = "USAGE_STORE_PATH"
+	EnvUsageRetention = "USAGE_RETENTION"
+)
+
+// 预算相关常量
+const (
+	// 默认配置
+	DefaultBudgetWarnThresholds = "0.8,0.9"
+	DefaultBudgetWebhookTimeout = 5 * time.Second
+	
+	// 预算响应头
+	HeaderBudgetLimitDaily       = "x-budget-limit-daily"
+	HeaderBudgetRemainingDaily   = "x-budget-remaining-daily"
+	HeaderBudgetLimitMonthly     = "x-budget-limit-monthly"
+	HeaderBudgetRemainingMonthly = "x-budget-remaining-monthly"
+	HeaderBudgetWarning          = "x-budget-warning"
+	
+	// 预算配置环境变量
+	EnvBudgetEnabled        = "BUDGET_ENABLED"
+	EnvModelPrices          = "MODEL_PRICES"
+	EnvBudgetDaily          = "BUDGET_DAILY"
+	EnvBudgetMonthly        = "BUDGET_MONTHLY"
+	EnvBudgetWarnThresholds = "BUDGET_WARN_THRESHOLDS"
+	EnvBudgetWebhookURL     = "BUDGET_WEBHOOK_URL"
+	EnvBudgetWebhookTimeout = "BUDGET_WEBHOOK_TIMEOUT"
+)
+
+// 监控指标相关常量
+const (
+	// Prometheus文本格式指标路径，/metrics 保留原有的JSON格式
+	PrometheusMetricsPath = "/metrics/prometheus"
+	
+	// gin上下文中保存请求模型的键，用于按模型统计请求指标
+	ContextKeyModel = "request_model"
+	
+	// 延迟分位数的默认统计窗口
+	DefaultMetricsLatencyWindow = 15 * time.Minute
+	
+	// 监控指标配置环境变量
+	EnvMetricsLatencyWindow = "METRICS_LATENCY_WINDOW"
+)
+
+// 链路追踪相关常量
+const (
+	// 默认配置
+	DefaultTracingExporter    = "none"
+	DefaultTracingFile        = "data/traces.jsonl"
+	DefaultTracingServiceName = "scira2api"
+	DefaultTracingSampleRatio = 1.0
+	
+	// 链路追踪配置环境变量
+	EnvTracingExporter     = "TRACING_EXPORTER"
+	EnvTracingOTLPEndpoint = "TRACING_OTLP_ENDPOINT"
+	EnvTracingFile         = "TRACING_FILE"
+	EnvTracingServiceName  = "TRACING_SERVICE_NAME"
+	EnvTracingSampleRatio  = "TRACING_SAMPLE_RATIO"
+)
+
+// 日志相关常量
+const (
+	// 请求ID的请求头和响应头
+	HeaderRequestID = "X-Request-ID"
+	
+	// gin上下文中保存请求ID的键
+	ContextKeyRequestID = "request_id"
+	
+	// 默认配置
+	DefaultLogLevel         = "info"
+	DefaultLogFormat        = "text"
+	DefaultLogFileMaxSizeMB = 100
+	DefaultLogFileBackups   = 5
+	
+	// 日志配置环境变量
+	EnvLogLevel          = "LOG_LEVEL"
+	EnvLogLevels         = "LOG_LEVELS"
+	EnvLogFormat         = "LOG_FORMAT"
+	EnvLogFile           = "LOG_FILE"
+	EnvLogFileMaxSize    = "LOG_FILE_MAX_SIZE"
+	EnvLogFileMaxBackups = "LOG_FILE_MAX_BACKUPS"
+	EnvRedactPatterns    = "REDACT_PATTERNS"
+)
+
+// 请求捕获相关常量
+const (
+	// 默认配置
+	DefaultCaptureFile          = "data/capture.jsonl"
+	DefaultCaptureMaxSizeMB     = 100
+	DefaultCaptureBackups       = 5
+	DefaultCaptureMaxRecordSize = 4 << 20 // 单条记录的上游数据和响应最多4MB
+	
+	// 请求捕获配置环境变量
+	EnvCaptureKeys           = "CAPTURE_KEYS"
+	EnvCaptureSampleRate     = "CAPTURE_SAMPLE_RATE"
+	EnvCaptureFile           = "CAPTURE_FILE"
+	EnvCaptureFileMaxSize    = "CAPTURE_FILE_MAX_SIZE"
+	EnvCaptureFileMaxBackups = "CAPTURE_FILE_MAX_BACKUPS"
+)
+
+// 上游录制/回放相关常量
+const (
+	// 上游模式
+	UpstreamModeLive   = "live"
+	UpstreamModeRecord = "record"
+	UpstreamModeReplay = "replay"
+	
+	// 默认配置
+	DefaultUpstreamMode                = UpstreamModeLive
+	DefaultUpstreamFixturesDir         = "data/fixtures"
+	DefaultUpstreamFixtureIgnoreFields = "id,user_id" // chatId和userId每次请求随机生成，不参与请求匹配
+	
+	// 上游录制/回放配置环境变量
+	EnvUpstreamMode                = "UPSTREAM_MODE"
+	EnvUpstreamFixturesDir         = "UPSTREAM_FIXTURES_DIR"
+	EnvUpstreamFixtureIgnoreFields = "UPSTREAM_FIXTURE_IGNORE_FIELDS"
+)
+
+// 故障注入相关常量
+const (
+	// 故障注入环境变量
+	EnvChaosEnabled   = "CHAOS_ENABLED"
+	EnvChaosRulesFile = "CHAOS_RULES_FILE"
+)
+
+// 分词与用量校正相关常量
+const (
+	// 默认配置
+	DefaultTokenizerEncoding        = "o200k_base"
+	DefaultUsageCorrection          = "threshold"
+	DefaultUsageCorrectionThreshold = 0.2
+	
+	// 分词与用量校正环境变量
+	EnvTokenizerDefault         = "TOKENIZER_DEFAULT"
+	EnvTokenizerModels          = "TOKENIZER_MODELS"
+	EnvUsageCorrection          = "USAGE_CORRECTION"
+	EnvUsageCorrectionThreshold = "USAGE_CORRECTION_THRESHOLD"
+	EnvModelContextWindows      = "MODEL_CONTEXT_WINDOWS"
+)
+
+// 代理池相关常量
+const (
+	// 默认代理池参数
+	DefaultProxyStrategy             = "round_robin"
+	DefaultProxyHealthCheckURL       = "https://scira.ai/"
+	DefaultProxyHealthCheckInterval  = time.Minute
+	DefaultProxyHealthCheckTimeout   = 10 * time.Second
+	DefaultProxyMaxFailures          = 3
+	DefaultProxyTransportCacheSize   = 64
+	DefaultProxyTransportIdleTimeout = 5 * time.Minute
+	
+	// 代理池配置环境变量
+	EnvProxyPoolEnabled          = "PROXY_POOL_ENABLED"
+	EnvProxyPool                 = "PROXY_POOL"
+	EnvProxyPoolFile             = "PROXY_POOL_FILE"
+	EnvProxyStrategy             = "PROXY_POOL_STRATEGY"
+	EnvProxyHealthCheckURL       = "PROXY_HEALTH_CHECK_URL"
+	EnvProxyHealthCheckInterval  = "PROXY_HEALTH_CHECK_INTERVAL"
+	EnvProxyHealthCheckTimeout   = "PROXY_HEALTH_CHECK_TIMEOUT"
+	EnvProxyMaxFailures          = "PROXY_MAX_FAILURES"
+	EnvProxyTransportCacheSize   = "PROXY_TRANSPORT_CACHE_SIZE"
+	EnvProxyTransportIdleTimeout = "PROXY_TRANSPORT_IDLE_TIMEOUT"
+)
+
 // GetRandomUserAgent 算法随机生成UserAgent字符串
 func GetRandomUserAgent() string {
 	rand.Seed(time.Now().UnixNano())
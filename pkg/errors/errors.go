@@ -29,6 +29,7 @@ func (e *APIError) Unwrap() error {
 var (
 	ErrInvalidRequest        = &APIError{Code: http.StatusBadRequest, Message: "Invalid request", Type: "invalid_request"}
 	ErrUnauthorized          = &APIError{Code: http.StatusUnauthorized, Message: "Unauthorized", Type: "unauthorized"}
+	ErrForbidden             = &APIError{Code: http.StatusForbidden, Message: "Forbidden", Type: "forbidden"}
 	ErrNotFound              = &APIError{Code: http.StatusNotFound, Message: "Not found", Type: "not_found"}
 	ErrInternalServer        = &APIError{Code: http.StatusInternalServerError, Message: "Internal server error", Type: "internal_error"}
 	ErrServiceUnavailable    = &APIError{Code: http.StatusServiceUnavailable, Message: "Service unavailable", Type: "service_unavailable"}
@@ -54,6 +55,14 @@ func NewUnauthorizedError(message string) *APIError {
 	}
 }
 
+func NewForbiddenError(message string) *APIError {
+	return &APIError{
+		Code:    http.StatusForbidden,
+		Message: message,
+		Type:    "forbidden",
+	}
+}
+
 func NewInternalServerError(message string, err error) *APIError {
 	return &APIError{
 		Code:    http.StatusInternalServerError,
@@ -81,6 +90,27 @@ func NewTooManyRequestsError(message string, err error) *APIError {
 	}
 }
 
+func NewInsufficientQuotaError(message string, err error) *APIError {
+	return &APIError{
+		Code:    http.StatusPaymentRequired,
+		Message: message,
+		Type:    "insufficient_quota",
+		Err:     err,
+	}
+}
+
+// StatusClientClosedRequest 客户端在响应前断开，沿用 nginx 的非标准状态码，主要用于日志和指标
+const StatusClientClosedRequest = 499
+
+func NewClientClosedError(message string, err error) *APIError {
+	return &APIError{
+		Code:    StatusClientClosedRequest,
+		Message: message,
+		Type:    "client_closed",
+		Err:     err,
+	}
+}
+
 // 配置错误
 var (
 	ErrConfigLoad       = errors.New("failed to load configuration")
@@ -0,0 +1,308 @@
+// Package fixture 实现上游请求的录制和回放
+// record 模式把真实的上游响应按规范化后的请求哈希保存为JSON文件，replay 模式只从这些文件返回响应，不访问网络，
+// 客户端的集成测试和CI可以在没有网络和Scira账号的环境中运行
+package fixture
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"scira2api/log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 上游模式
+const (
+	ModeLive   = "live"   // 直接访问上游
+	ModeRecord = "record" // 访问上游并保存响应
+	ModeReplay = "replay" // 只使用保存的响应
+)
+
+// ErrMiss 回放模式下没有与请求匹配的录制响应
+var ErrMiss = errors.New("no recorded upstream fixture")
+
+// MissError 回放未命中的请求，带有请求哈希，便于补充录制
+type MissError struct {
+	Method string
+	Path   string
+	Hash   string
+}
+
+func (e *MissError) Error() string {
+	return fmt.Sprintf("%s: %s %s (hash %s)", ErrMiss, e.Method, e.Path, e.Hash)
+}
+
+// Is 使 errors.Is(err, ErrMiss) 成立
+func (e *MissError) Is(target error) bool {
+	return target == ErrMiss
+}
+
+// Options 录制/回放配置
+type Options struct {
+	Mode         string   // live、record 或 replay
+	Dir          string   // 录制文件目录
+	IgnoreFields []string // 计算请求哈希时忽略的请求体顶层字段（每次请求都会变化的ID等）
+}
+
+// Fixture 一次录制的上游交互
+type Fixture struct {
+	Hash       string            `json:"hash"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Request    json.RawMessage   `json:"request"` // 规范化后的请求体
+	Status     int               `json:"status"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       string            `json:"body"`
+	RecordedAt time.Time         `json:"recorded_at"`
+}
+
+// Store 录制文件存储
+type Store struct {
+	opts   Options
+	ignore map[string]bool
+	mu     sync.Mutex // 保护录制文件写入
+
+	hits     int64
+	misses   int64
+	recorded int64
+	failed   int64
+}
+
+// New 创建录制/回放存储，live 模式返回nil
+func New(opts Options) (*Store, error) {
+	switch opts.Mode {
+	case "", ModeLive:
+		return nil, nil
+	case ModeRecord, ModeReplay:
+	default:
+		return nil, fmt.Errorf("unknown upstream mode: %s", opts.Mode)
+	}
+	ignore := make(map[string]bool, len(opts.IgnoreFields))
+	for _, field := range opts.IgnoreFields {
+		ignore[field] = true
+	}
+	return &Store{opts: opts, ignore: ignore}, nil
+}
+
+// Mode 当前模式，nil 表示 live
+func (s *Store) Mode() string {
+	if s == nil {
+		return ModeLive
+	}
+	return s.opts.Mode
+}
+
+// Replaying 是否处于回放模式
+func (s *Store) Replaying() bool {
+	return s.Mode() == ModeReplay
+}
+
+// Hash 计算请求哈希：方法、路径和规范化的请求体
+// JSON请求体去掉忽略的顶层字段后按键排序重新编码，其他请求体按原样参与计算
+func (s *Store) Hash(method, path string, body []byte) (string, []byte) {
+	normalized := bytes.TrimSpace(body)
+	var tree interface{}
+	if len(normalized) > 0 && json.Unmarshal(normalized, &tree) == nil {
+		if object, ok := tree.(map[string]interface{}); ok {
+			for field := range s.ignore {
+				delete(object, field)
+			}
+		}
+		if data, err := json.Marshal(tree); err == nil {
+			normalized = data
+		}
+	}
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %s\n", strings.ToUpper(method), path)
+	sum.Write(normalized)
+	return hex.EncodeToString(sum.Sum(nil)), normalized
+}
+
+// Wrap 按模式包装上游请求使用的Transport，nil 存储原样返回
+func (s *Store) Wrap(next http.RoundTripper) http.RoundTripper {
+	if s == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if s.Replaying() {
+		return replayTransport{store: s}
+	}
+	return recordTransport{store: s, next: next}
+}
+
+// path 录制文件路径
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.opts.Dir, hash+".json")
+}
+
+// Load 读取请求哈希对应的录制文件
+func (s *Store) Load(hash string) (*Fixture, error) {
+	data, err := os.ReadFile(s.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("decode fixture %s: %w", hash, err)
+	}
+	return &fixture, nil
+}
+
+// Save 保存录制文件，同一请求哈希的旧文件被覆盖
+func (s *Store) Save(fixture *Fixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.opts.Dir, 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，回放方不会读到写了一半的文件
+	tmp := s.path(fixture.Hash) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(fixture.Hash))
+}
+
+// GetMetrics 获取录制/回放统计
+func (s *Store) GetMetrics() map[string]interface{} {
+	if s == nil {
+		return map[string]interface{}{"mode": ModeLive}
+	}
+	return map[string]interface{}{
+		"mode":     s.opts.Mode,
+		"dir":      s.opts.Dir,
+		"hits":     atomic.LoadInt64(&s.hits),
+		"misses":   atomic.LoadInt64(&s.misses),
+		"recorded": atomic.LoadInt64(&s.recorded),
+		"failed":   atomic.LoadInt64(&s.failed),
+	}
+}
+
+// readBody 读取请求体并恢复，Transport 之后仍可发送
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// replayTransport 只从录制文件返回响应
+type replayTransport struct {
+	store *Store
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	hash, _ := t.store.Hash(req.Method, req.URL.RequestURI(), body)
+	fixture, err := t.store.Load(hash)
+	if err != nil {
+		atomic.AddInt64(&t.store.misses, 1)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &MissError{Method: req.Method, Path: req.URL.RequestURI(), Hash: hash}
+		}
+		return nil, err
+	}
+	atomic.AddInt64(&t.store.hits, 1)
+
+	header := make(http.Header, len(fixture.Header))
+	for key, value := range fixture.Header {
+		header.Set(key, value)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fixture.Status, http.StatusText(fixture.Status)),
+		StatusCode:    fixture.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(fixture.Body)),
+		ContentLength: int64(len(fixture.Body)),
+		Request:       req,
+	}, nil
+}
+
+// recordTransport 访问上游并在响应体读完后保存录制文件
+type recordTransport struct {
+	store *Store
+	next  http.RoundTripper
+}
+
+func (t recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, normalized := t.store.Hash(req.Method, req.URL.RequestURI(), body)
+	fixture := &Fixture{
+		Hash:    hash,
+		Method:  req.Method,
+		Path:    req.URL.RequestURI(),
+		Request: normalized,
+		Status:  resp.StatusCode,
+	}
+	if !json.Valid(normalized) {
+		fixture.Request, _ = json.Marshal(string(normalized))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		fixture.Header = map[string]string{"Content-Type": contentType}
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, store: t.store, fixture: fixture}
+	return resp, nil
+}
+
+// recordingBody 在读取响应体的同时保存内容，读到结尾才写出录制文件，中途断开的响应不保存
+type recordingBody struct {
+	io.ReadCloser
+	store   *Store
+	fixture *Fixture
+	buf     bytes.Buffer
+	saved   bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.fixture.Body = b.buf.String()
+		b.fixture.RecordedAt = time.Now()
+		if saveErr := b.store.Save(b.fixture); saveErr != nil {
+			atomic.AddInt64(&b.store.failed, 1)
+			log.Error("保存上游录制文件 %s 失败: %v", b.fixture.Hash, saveErr)
+		} else {
+			atomic.AddInt64(&b.store.recorded, 1)
+		}
+	}
+	return n, err
+}
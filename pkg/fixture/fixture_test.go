@@ -0,0 +1,202 @@
+package fixture
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"scira2api/log"
+	"scira2api/pkg/mockupstream"
+)
+
+// newStore 创建使用临时目录的存储，忽略每次请求随机生成的ID
+func newStore(t *testing.T, mode, dir string) *Store {
+	t.Helper()
+	store, err := New(Options{Mode: mode, Dir: dir, IgnoreFields: []string{"id", "user_id"}})
+	if err != nil {
+		t.Fatalf("New(%s): %v", mode, err)
+	}
+	return store
+}
+
+// post 通过包装后的Transport发送请求，返回状态码、Content-Type和完整的响应体
+func post(t *testing.T, transport http.RoundTripper, url, body string) (int, string, string, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(data), nil
+}
+
+func TestNew(t *testing.T) {
+	for _, mode := range []string{"", ModeLive} {
+		if store, err := New(Options{Mode: mode}); store != nil || err != nil {
+			t.Fatalf("New(%q) = %v, %v; want nil store for live mode", mode, store, err)
+		}
+	}
+	if _, err := New(Options{Mode: "bogus"}); err == nil {
+		t.Fatal("unknown mode should be rejected")
+	}
+
+	// nil 存储表示 live 模式，Transport 原样返回
+	var store *Store
+	if store.Mode() != ModeLive || store.Replaying() || store.Wrap(http.DefaultTransport) != http.DefaultTransport {
+		t.Fatal("nil store should behave as live mode")
+	}
+}
+
+func TestHash(t *testing.T) {
+	store := newStore(t, ModeReplay, t.TempDir())
+	base, normalized := store.Hash("POST", "/api/search", []byte(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	if string(normalized) != `{"messages":[{"content":"hi","role":"user"}],"model":"m"}` {
+		t.Fatalf("normalized = %s", normalized)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		same   bool
+	}{
+		{"key order", "POST", "/api/search", `{"messages":[{"content":"hi","role":"user"}],"model":"m"}`, true},
+		{"whitespace", "post", "/api/search", "\n{ \"model\": \"m\",\n  \"messages\": [{\"role\": \"user\", \"content\": \"hi\"}] }\n", true},
+		{"ignored fields", "POST", "/api/search", `{"id":"chat-1","user_id":"user-1","model":"m","messages":[{"role":"user","content":"hi"}]}`, true},
+		{"other ids", "POST", "/api/search", `{"id":"chat-2","user_id":"user-2","model":"m","messages":[{"role":"user","content":"hi"}]}`, true},
+		{"body", "POST", "/api/search", `{"model":"m","messages":[{"role":"user","content":"bye"}]}`, false},
+		{"method", "PUT", "/api/search", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, false},
+		{"path", "POST", "/api/search?stream=1", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, false},
+		// 只忽略顶层字段，嵌套的同名字段仍参与计算
+		{"nested id", "POST", "/api/search", `{"model":"m","messages":[{"id":"x","role":"user","content":"hi"}]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, _ := store.Hash(tt.method, tt.path, []byte(tt.body))
+			if (hash == base) != tt.same {
+				t.Fatalf("hash equal = %v, want %v", hash == base, tt.same)
+			}
+		})
+	}
+
+	// 非JSON请求体按原样参与计算
+	raw, normalized := store.Hash("POST", "/upload", []byte("not json"))
+	if string(normalized) != "not json" {
+		t.Fatalf("normalized = %q", normalized)
+	}
+	if other, _ := store.Hash("POST", "/upload", []byte("not  json")); other == raw {
+		t.Fatal("different raw bodies should hash differently")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	log.SetLevel(log.ERROR)
+	upstream, server := mockupstream.NewTestServer(mockupstream.Options{ChunkSize: 4})
+	defer server.Close()
+	dir := t.TempDir()
+	url := server.URL + mockupstream.SearchPath
+	body := `{"id":"chat-1","user_id":"user-1","model":"scira-default","messages":[{"role":"user","content":"hello"}]}`
+
+	// 录制：请求到达上游，响应体读完后保存
+	recorder := newStore(t, ModeRecord, dir)
+	status, contentType, recorded, err := post(t, recorder.Wrap(nil), url, body)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("record: status=%d err=%v", status, err)
+	}
+	if !strings.Contains(recorded, mockupstream.DefaultText[:4]) {
+		t.Fatalf("recorded body = %q", recorded)
+	}
+	if metrics := recorder.GetMetrics(); metrics["recorded"] != int64(1) || metrics["failed"] != int64(0) {
+		t.Fatalf("unexpected record metrics: %v", metrics)
+	}
+	hash, _ := recorder.Hash(http.MethodPost, mockupstream.SearchPath, []byte(body))
+	fixture, err := recorder.Load(hash)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if fixture.Status != http.StatusOK || fixture.Body != recorded || fixture.Header["Content-Type"] != contentType {
+		t.Fatalf("unexpected fixture: %+v", fixture)
+	}
+
+	// 回放：ID不同的同一请求返回录制的响应，不访问上游
+	replayer := newStore(t, ModeReplay, dir)
+	other := strings.NewReplacer("chat-1", "chat-2", "user-1", "user-2").Replace(body)
+	status, replayedType, replayed, err := post(t, replayer.Wrap(nil), url, other)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if status != http.StatusOK || replayedType != contentType || replayed != recorded {
+		t.Fatalf("replay: status=%d type=%q body=%q, want the recorded response", status, replayedType, replayed)
+	}
+	if n := len(upstream.Requests()); n != 1 {
+		t.Fatalf("upstream received %d requests, want 1", n)
+	}
+	if metrics := replayer.GetMetrics(); metrics["hits"] != int64(1) || metrics["misses"] != int64(0) {
+		t.Fatalf("unexpected replay metrics: %v", metrics)
+	}
+}
+
+func TestRecordSkipsUnfinishedBody(t *testing.T) {
+	_, server := mockupstream.NewTestServer(mockupstream.Options{ChunkSize: 4})
+	defer server.Close()
+	dir := t.TempDir()
+
+	// 中途关闭的响应不保存，回放时按未命中处理
+	recorder := newStore(t, ModeRecord, dir)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+mockupstream.SearchPath, strings.NewReader(`{"model":"m"}`))
+	resp, err := recorder.Wrap(nil).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if metrics := recorder.GetMetrics(); metrics["recorded"] != int64(0) {
+		t.Fatalf("unexpected record metrics: %v", metrics)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("unfinished response saved: %v", entries)
+	}
+}
+
+func TestReplayMiss(t *testing.T) {
+	store := newStore(t, ModeReplay, t.TempDir())
+	body := `{"model":"m"}`
+
+	_, _, _, err := post(t, store.Wrap(nil), "http://upstream.invalid/api/search?x=1", body)
+	if !errors.Is(err, ErrMiss) {
+		t.Fatalf("err = %v, want ErrMiss", err)
+	}
+	var miss *MissError
+	if !errors.As(err, &miss) {
+		t.Fatalf("err = %T, want *MissError", err)
+	}
+	hash, _ := store.Hash(http.MethodPost, "/api/search?x=1", []byte(body))
+	if miss.Method != http.MethodPost || miss.Path != "/api/search?x=1" || miss.Hash != hash {
+		t.Fatalf("unexpected miss: %+v", miss)
+	}
+	if !strings.Contains(miss.Error(), hash) {
+		t.Fatalf("error %q should include the request hash", miss.Error())
+	}
+	if errors.Is(errors.New("other"), ErrMiss) {
+		t.Fatal("unrelated errors must not match ErrMiss")
+	}
+	if metrics := store.GetMetrics(); metrics["misses"] != int64(1) || metrics["hits"] != int64(0) {
+		t.Fatalf("unexpected metrics: %v", metrics)
+	}
+}
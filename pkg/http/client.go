@@ -8,6 +8,11 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"scira2api/log"
+	"scira2api/pkg/chaos"
+	"scira2api/pkg/connpool"
+	"scira2api/pkg/fixture"
+	"scira2api/pkg/redact"
 	"strings"
 	"time"
 
@@ -28,6 +33,16 @@ type ProxyManager interface {
 	GetProxy() (string, error)
 }
 
+// KeyedProxyManager 支持按身份选择代理的代理管理器（可选接口）
+type KeyedProxyManager interface {
+	GetProxyFor(key string) (string, error)
+}
+
+// ProxyResultReporter 接收代理请求结果反馈的代理管理器（可选接口）
+type ProxyResultReporter interface {
+	ReportResult(proxyAddr string, success bool, latency time.Duration)
+}
+
 // TransportConfig 传输配置
 // 优化点：提取Transport配置为独立结构体，便于集中管理HTTP传输参数
 type TransportConfig struct {
@@ -39,6 +54,7 @@ type TransportConfig struct {
 	
 	// TLS配置
 	TLSConfig           *tls.Config   // TLS配置
+	TLSHandshakeTimeout time.Duration // TLS握手超时时间
 	
 	// 超时配置
 	DialTimeout         time.Duration // 拨号超时时间
@@ -62,6 +78,7 @@ func DefaultTransportConfig() *TransportConfig {
 		IdleConnTimeout:     90 * time.Second,
 		DialTimeout:         30 * time.Second,
 		DialKeepAlive:       30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
 		ForceAttemptHTTP2:   true,
 	}
 }
@@ -84,6 +101,17 @@ type HttpClient struct {
 	// 传输配置
 	transportConfig *TransportConfig
 	
+	// 动态代理Transport缓存与连接池指标
+	transportCache        *transportCache
+	transportCacheOptions TransportCacheOptions
+	connPool              *connpool.ConnPool
+	
+	// 上游录制/回放（live 模式为nil）
+	fixtures              *fixture.Store
+	
+	// 故障注入（未设置时为nil）
+	chaos                 *chaos.Injector
+	
 	// 钩子函数
 	beforeRequest   []func(*http.Request) error
 	
@@ -103,7 +131,8 @@ func NewHttpClient() *HttpClient {
 		},
 		headers:         make(map[string]string),
 		beforeRequest:   []func(*http.Request) error{},
-		transportConfig: config,
+		transportConfig:       config,
+		transportCacheOptions: DefaultTransportCacheOptions(),
 	}
 }
 
@@ -112,14 +141,12 @@ func NewHttpClient() *HttpClient {
 func createTransport(config *TransportConfig) *http.Transport {
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   config.DialTimeout,
-			KeepAlive: config.DialKeepAlive,
-		}).DialContext,
+		DialContext:         newDialer(config).DialContext,
 		MaxIdleConns:        config.MaxIdleConns,
 		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
 		MaxConnsPerHost:     config.MaxConnsPerHost,
 		IdleConnTimeout:     config.IdleConnTimeout,
+		TLSHandshakeTimeout: config.TLSHandshakeTimeout,
 		DisableCompression:  config.DisableCompression,
 		DisableKeepAlives:   config.DisableKeepAlives,
 		ForceAttemptHTTP2:   config.ForceAttemptHTTP2,
@@ -207,72 +234,111 @@ func (client *HttpClient) SetProxy(proxyURLStr string) (*HttpClient, error) {
 func (client *HttpClient) applyTransportConfig() (*HttpClient, error) {
 	config := client.transportConfig
 	
-	// 如果代理URL为空，则清除代理设置
-	if config.ProxyURL == "" {
-		transport := createTransport(config)
-		client.client.Transport = transport
-		return client, nil
+	// 根据传输配置和代理URL创建Transport（代理URL为空时不使用代理）
+	transport, err := buildTransport(config, config.ProxyURL)
+	if err != nil {
+		return client, err
 	}
 	
-	// 解析代理URL
-	parsedURL, err := url.Parse(config.ProxyURL)
-	if err != nil {
-		return client, fmt.Errorf("%w: %s (%v)", ErrInvalidProxyURL, config.ProxyURL, err)
+	// 统计连接指标
+	if client.connPool != nil {
+		client.connPool.InstrumentTransport(transport, connLabel(config.ProxyURL))
 	}
 	
+	// 应用新的Transport
+	client.client.Transport = transport
+	
+	// 传输配置变化后，已缓存的动态代理Transport需要按新配置重建
+	if client.transportCache != nil {
+		client.transportCache.Purge()
+	}
+	return client, nil
+}
+
+// buildTransport 根据传输配置创建使用指定代理的Transport
+// 静态代理和动态代理共用此函数，保证两者的连接池、TLS和拨号参数一致
+func buildTransport(config *TransportConfig, proxyURLStr string) (*http.Transport, error) {
 	// 获取基础Transport
 	transport := createTransport(config)
+	if proxyURLStr == "" {
+		return transport, nil
+	}
+	
+	// 解析代理URL
+	parsedURL, err := url.Parse(proxyURLStr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s (%v)", ErrInvalidProxyURL, maskProxyURL(proxyURLStr), err)
+	}
 	
 	// 根据代理类型配置Transport
 	switch strings.ToLower(parsedURL.Scheme) {
 	case "http", "https":
 		// 设置HTTP/HTTPS代理
-		if err := configureHTTPProxy(transport, config.ProxyURL); err != nil {
-			return client, fmt.Errorf("%w: %v", ErrProxySetupFailed, err)
-		}
-	case "socks5":
+		configureHTTPProxy(transport, parsedURL, config)
+	case "socks5", "socks5h":
 		// 设置SOCKS5代理
-		if err := configureSOCKS5Proxy(transport, parsedURL.Host); err != nil {
-			return client, fmt.Errorf("%w: %v", ErrProxySetupFailed, err)
+		if err := configureSOCKS5Proxy(transport, parsedURL, config); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrProxySetupFailed, err)
 		}
 	default:
-		return client, fmt.Errorf("%w: %s", ErrUnsupportedScheme, parsedURL.Scheme)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, parsedURL.Scheme)
 	}
 	
-	// 应用新的Transport
-	client.client.Transport = transport
-	return client, nil
+	return transport, nil
+}
+
+// maskProxyURL 返回用于错误信息的代理地址，尽量隐藏凭据
+func maskProxyURL(proxyURLStr string) string {
+	if at := strings.LastIndex(proxyURLStr, "@"); at != -1 {
+		if scheme := strings.Index(proxyURLStr, "://"); scheme != -1 && scheme < at {
+			return proxyURLStr[:scheme+3] + "***" + proxyURLStr[at:]
+		}
+		return "***" + proxyURLStr[at:]
+	}
+	return proxyURLStr
+}
+
+// connLabel 返回连接指标使用的标签：代理地址（隐藏用户名和密码）或 direct
+func connLabel(proxyAddr string) string {
+	if parsedURL, err := url.Parse(proxyAddr); err == nil && parsedURL.Host != "" {
+		return redact.URL(proxyAddr)
+	}
+	return "direct"
 }
 
 // configureHTTPProxy 配置HTTP代理
 // 优化点：分离HTTP代理配置逻辑，提高代码清晰度
-func configureHTTPProxy(transport *http.Transport, proxyURLStr string) error {
-	parsedURL, err := url.Parse(proxyURLStr)
-	if err != nil {
-		return err
-	}
-	
-	transport.Proxy = http.ProxyURL(parsedURL)
+func configureHTTPProxy(transport *http.Transport, proxyURL *url.URL, config *TransportConfig) {
+	transport.Proxy = http.ProxyURL(proxyURL)
 	// 确保SOCKS拨号器不被使用
-	transport.DialContext = (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).DialContext
-	
-	return nil
+	transport.DialContext = newDialer(config).DialContext
 }
 
 // configureSOCKS5Proxy 配置SOCKS5代理
 // 优化点：分离SOCKS5代理配置逻辑，提高代码清晰度
-func configureSOCKS5Proxy(transport *http.Transport, proxyHost string) error {
-	dialer, err := proxy.SOCKS5("tcp", proxyHost, nil, proxy.Direct)
+func configureSOCKS5Proxy(transport *http.Transport, proxyURL *url.URL, config *TransportConfig) error {
+	// 代理URL中的用户名密码作为SOCKS5认证信息
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{
+			User:     proxyURL.User.Username(),
+			Password: password,
+		}
+	}
+	
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, newDialer(config))
 	if err != nil {
 		return err
 	}
 	
-	// 转换为DialContext函数
-	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
+	// 优先使用支持上下文的拨号器，使请求取消能中断拨号
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		transport.DialContext = contextDialer.DialContext
+	} else {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		}
 	}
 	
 	// 确保HTTP代理不被使用
@@ -281,6 +347,14 @@ func configureSOCKS5Proxy(transport *http.Transport, proxyHost string) error {
 	return nil
 }
 
+// newDialer 根据传输配置创建拨号器
+func newDialer(config *TransportConfig) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.DialKeepAlive,
+	}
+}
+
 // ConfigureTransport 配置传输参数
 // 优化点：新增方法，允许用户完全自定义传输参数，提高灵活性
 func (client *HttpClient) ConfigureTransport(config *TransportConfig) (*HttpClient, error) {
@@ -299,18 +373,59 @@ func (client *HttpClient) SetConnectionPool(maxIdleConns, maxIdleConnsPerHost, m
 	client.transportConfig.MaxIdleConnsPerHost = maxIdleConnsPerHost
 	client.transportConfig.MaxConnsPerHost = maxConnsPerHost
 	
-	// 更新Transport
-	transport := createTransport(client.transportConfig)
-	if client.transportConfig.ProxyURL != "" {
-		// 如果已配置代理，需要重新应用代理设置
-		_, _ = client.applyTransportConfig()
-	} else {
-		client.client.Transport = transport
+	// 更新Transport（如果已配置代理，会重新应用代理设置）
+	if _, err := client.applyTransportConfig(); err != nil {
+		log.Error("应用连接池参数失败: %v", err)
 	}
 	
 	return client
 }
 
+// SetConnPool 应用连接池选项并启用连接指标统计
+// 连接池选项会写入传输配置，静态客户端和动态代理Transport都会使用
+func (client *HttpClient) SetConnPool(pool *connpool.ConnPool) *HttpClient {
+	if client.transportConfig == nil {
+		client.transportConfig = DefaultTransportConfig()
+	}
+	
+	client.connPool = pool
+	if pool != nil {
+		options := pool.Options()
+		client.transportConfig.MaxIdleConns = options.MaxIdleConns
+		client.transportConfig.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+		client.transportConfig.MaxConnsPerHost = options.MaxConnsPerHost
+		client.transportConfig.IdleConnTimeout = options.IdleConnTimeout
+		client.transportConfig.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+		client.transportConfig.DialKeepAlive = options.KeepAlive
+		client.transportConfig.DisableCompression = options.DisableCompression
+		client.transportConfig.DisableKeepAlives = options.DisableKeepAlives
+	}
+	
+	if _, err := client.applyTransportConfig(); err != nil {
+		log.Error("应用连接池选项失败: %v", err)
+	}
+	
+	return client
+}
+
+// SetFixtures 设置上游录制/回放存储
+// record 模式下每次请求在原有的Transport外录制响应，replay 模式下请求不经过代理和网络，只从录制文件返回
+func (client *HttpClient) SetFixtures(store *fixture.Store) *HttpClient {
+	client.fixtures = store
+	return client
+}
+
+// GetFixtureMetrics 获取上游录制/回放统计
+func (client *HttpClient) GetFixtureMetrics() map[string]interface{} {
+	return client.fixtures.GetMetrics()
+}
+
+// SetChaos 设置故障注入器，请求上下文中带有故障规则时在Transport中注入上游故障
+func (client *HttpClient) SetChaos(injector *chaos.Injector) *HttpClient {
+	client.chaos = injector
+	return client
+}
+
 // SetTLSConfig 设置TLS配置
 // 优化点：新增方法，支持自定义TLS配置，提高安全性和灵活性
 func (client *HttpClient) SetTLSConfig(tlsConfig *tls.Config) *HttpClient {
@@ -320,13 +435,9 @@ func (client *HttpClient) SetTLSConfig(tlsConfig *tls.Config) *HttpClient {
 	
 	client.transportConfig.TLSConfig = tlsConfig
 	
-	// 更新Transport
-	transport := createTransport(client.transportConfig)
-	if client.transportConfig.ProxyURL != "" {
-		// 如果已配置代理，需要重新应用代理设置
-		_, _ = client.applyTransportConfig()
-	} else {
-		client.client.Transport = transport
+	// 更新Transport（如果已配置代理，会重新应用代理设置）
+	if _, err := client.applyTransportConfig(); err != nil {
+		log.Error("应用TLS配置失败: %v", err)
 	}
 	
 	return client
@@ -373,9 +484,57 @@ func (client *HttpClient) R() *Request {
 func (client *HttpClient) SetProxyManager(manager ProxyManager) *HttpClient {
 	client.proxyManager = manager
 	client.dynamicProxy = (manager != nil)
+	
+	// 动态代理按代理地址复用Transport
+	if client.dynamicProxy && client.transportCache == nil {
+		client.transportCache = newTransportCache(client.transportCacheOptions, client.buildDynamicTransport)
+	}
 	return client
 }
 
+// SetTransportCacheOptions 设置动态代理Transport缓存选项
+func (client *HttpClient) SetTransportCacheOptions(options TransportCacheOptions) *HttpClient {
+	client.transportCacheOptions = options
+	
+	// 已创建的缓存按新选项重建
+	if client.transportCache != nil {
+		client.transportCache.Close()
+		client.transportCache = newTransportCache(options, client.buildDynamicTransport)
+	}
+	return client
+}
+
+// buildDynamicTransport 为动态代理创建Transport，使用与静态客户端相同的传输配置
+func (client *HttpClient) buildDynamicTransport(proxyAddr string) (*http.Transport, error) {
+	transport, err := buildTransport(client.transportConfig, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if client.connPool != nil {
+		client.connPool.InstrumentTransport(transport, connLabel(proxyAddr))
+	}
+	return transport, nil
+}
+
+// GetTransportCacheMetrics 获取动态代理Transport缓存指标
+func (client *HttpClient) GetTransportCacheMetrics() map[string]interface{} {
+	if client.transportCache == nil {
+		return map[string]interface{}{
+			"enabled": false,
+		}
+	}
+	return client.transportCache.GetMetrics()
+}
+
+// Close 释放客户端持有的连接资源
+func (client *HttpClient) Close() error {
+	if client.transportCache != nil {
+		client.transportCache.Close()
+	}
+	client.client.CloseIdleConnections()
+	return nil
+}
+
 // SetUserAgent 设置User-Agent
 // 优化点：改进方法接收者命名
 func (client *HttpClient) SetUserAgent(ua string) *HttpClient {
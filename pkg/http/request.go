@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"scira2api/log" // Import custom logger
 	"scira2api/pkg/constants"
+	"scira2api/pkg/fixture"
+	"scira2api/pkg/redact"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Request 请求构建器
@@ -25,6 +32,7 @@ type Request struct {
 	body               io.Reader
 	doNotParseResponse bool
 	context            context.Context
+	proxyKey           string
 }
 
 // SetHeader 设置请求头
@@ -85,6 +93,12 @@ func (r *Request) SetContext(ctx context.Context) *Request {
 	return r
 }
 
+// SetProxyKey 设置代理选择键（例如上游身份），用于粘性代理选择
+func (r *Request) SetProxyKey(key string) *Request {
+	r.proxyKey = key
+	return r
+}
+
 // SetDoNotParseResponse 设置不解析响应
 func (r *Request) SetDoNotParseResponse(flag bool) *Request {
 	r.doNotParseResponse = flag
@@ -160,6 +174,13 @@ func (r *Request) addQueryParams(urlStr string) string {
 // prepareRequest 创建并准备HTTP请求对象
 // 优化: 将请求准备逻辑封装为单独函数，简化Execute方法
 func (r *Request) prepareRequest(fullURL string) (*http.Request, error) {
+	// 重试时请求体需要从头读取
+	if seeker, ok := r.body.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("重置请求体失败: %w", err)
+		}
+	}
+	
 	// 创建请求
 	req, err := http.NewRequest(r.method, fullURL, r.body)
 	if err != nil {
@@ -199,78 +220,155 @@ func (r *Request) prepareRequest(fullURL string) (*http.Request, error) {
 // sendRequest 发送请求并处理响应
 // 优化: 统一请求执行逻辑，减少代码重复，统一错误处理
 func (r *Request) sendRequest(client *http.Client, req *http.Request, proxyType, proxyAddr string) (*Response, error) {
-	// 记录请求开始
-	log.Info("使用%s发送请求: %s", proxyType, proxyAddr)
+	// 记录请求开始，代理地址隐藏凭据后再写入日志和span
+	proxyAddr = redact.URL(proxyAddr)
+	log.Ctx(req.Context()).Info("使用%s发送请求: %s", proxyType, proxyAddr)
+	
+	// 在调用方的span中记录每次连接尝试使用的代理
+	span := trace.SpanFromContext(req.Context())
+	proxyAttrs := []attribute.KeyValue{
+		attribute.String("proxy.type", proxyType),
+		attribute.String("proxy.address", proxyAddr),
+	}
 	
-	// 执行请求
+	// 录制/回放模式下在Transport外包装一层，复制客户端避免影响其他请求
+	if fixtures := r.client.fixtures; fixtures != nil {
+		wrapped := *client
+		wrapped.Transport = fixtures.Wrap(client.Transport)
+		client = &wrapped
+	}
+	
+	// 故障注入在录制/回放之外，回放模式下同样可以注入
+	if injector := r.client.chaos; injector != nil {
+		wrapped := *client
+		wrapped.Transport = injector.Wrap(client.Transport)
+		client = &wrapped
+	}
+	
+	// 执行请求，Do 在收到响应头后返回
+	started := time.Now()
 	httpResp, err := client.Do(req)
 	if err != nil {
-		log.Warn("%s请求失败: %v", proxyType, err)
+		// 代理拨号错误可能带有代理地址
+		err = redact.Error(err)
+		log.Ctx(req.Context()).Warn("%s请求失败: %v", proxyType, err)
+		span.AddEvent("upstream request failed", trace.WithAttributes(append(proxyAttrs, attribute.String("error", err.Error()))...))
 		return nil, fmt.Errorf("%s请求失败: %w", proxyType, err)
 	}
 	
-	log.Info("%s请求成功，状态码: %d", proxyType, httpResp.StatusCode)
+	log.Ctx(req.Context()).Info("%s请求成功，状态码: %d", proxyType, httpResp.StatusCode)
+	span.SetAttributes(append(proxyAttrs, attribute.Int("http.response.status_code", httpResp.StatusCode))...)
 	
 	// 创建响应对象
 	resp := &Response{
-		httpResp: httpResp,
-		request:  req,
+		httpResp:   httpResp,
+		request:    req,
+		receivedAt: time.Now(),
+		firstByte:  time.Since(started),
 	}
 	
 	// 如果不需要解析响应体，直接返回
 	if r.doNotParseResponse {
-		log.Info("请求完成，使用: %s (%s)", proxyType, proxyAddr)
+		log.Ctx(req.Context()).Info("请求完成，使用: %s (%s)", proxyType, proxyAddr)
 		return resp, nil
 	}
 	
 	// 解析响应体
 	if err := resp.parseBody(); err != nil {
 		resp.httpResp.Body.Close()
-		log.Warn("解析%s响应失败: %v", proxyType, err)
+		log.Ctx(req.Context()).Warn("解析%s响应失败: %v", proxyType, err)
 		return nil, fmt.Errorf("解析%s响应失败: %w", proxyType, err)
 	}
 	
-	log.Info("请求完成，使用: %s (%s)", proxyType, proxyAddr)
+	log.Ctx(req.Context()).Info("请求完成，使用: %s (%s)", proxyType, proxyAddr)
 	return resp, nil
 }
 
+// withConnTrace 在配置了连接池时跟踪连接复用情况
+func (r *Request) withConnTrace(req *http.Request, label string) *http.Request {
+	pool := r.client.connPool
+	if pool == nil {
+		return req
+	}
+	
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				pool.RecordConnReused(label)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
 // tryDynamicProxy 尝试使用动态代理
 // 优化: 将动态代理逻辑封装为独立函数，便于维护和测试
 func (r *Request) tryDynamicProxy(req *http.Request) (*Response, error) {
-	if !r.client.dynamicProxy || r.client.proxyManager == nil {
+	if !r.client.dynamicProxy || r.client.proxyManager == nil || r.client.transportCache == nil {
 		return nil, fmt.Errorf("动态代理未启用或代理管理器未配置")
 	}
 	
 	// 获取动态代理地址
-	log.Info("尝试获取动态代理...")
-	proxyAddr, err := r.client.proxyManager.GetProxy()
+	log.Ctx(req.Context()).Info("尝试获取动态代理...")
+	proxyAddr, err := r.getDynamicProxy()
 	if err != nil {
-		log.Warn("动态代理管理器获取代理失败: %v", err)
+		log.Ctx(req.Context()).Warn("动态代理管理器获取代理失败: %v", err)
 		return nil, fmt.Errorf("获取动态代理失败: %w", err)
 	}
 	
-	log.Info("成功获取动态代理: %s", proxyAddr)
+	log.Ctx(req.Context()).Info("成功获取动态代理: %s", redact.URL(proxyAddr))
 	
 	// 解析代理URL
 	proxyURL, err := url.Parse(proxyAddr)
 	if err != nil {
-		log.Warn("解析动态代理地址 %s 失败: %v", proxyAddr, err)
+		log.Ctx(req.Context()).Warn("解析动态代理地址 %s 失败: %v", redact.URL(proxyAddr), redact.Error(err))
 		return nil, fmt.Errorf("解析动态代理地址失败: %w", err)
 	}
 	
-	// 创建临时Transport和Client
-	// 优化: 只设置必要的Transport配置，减少内存分配
-	transport := &http.Transport{
-		Proxy: http.ProxyURL(proxyURL),
+	// 从缓存获取该代理的Transport，同一代理的请求复用连接
+	transport, err := r.client.transportCache.Get(proxyURL.String())
+	if err != nil {
+		log.Ctx(req.Context()).Warn("创建动态代理 %s 的Transport失败: %v", connLabel(proxyAddr), err)
+		return nil, fmt.Errorf("创建动态代理Transport失败: %w", err)
 	}
 	
-	tempClient := &http.Client{
-		Transport: transport,
-		Timeout:   r.client.timeout,
+	proxyClient := &http.Client{
+		Transport:     transport,
+		Timeout:       r.client.client.Timeout,
+		CheckRedirect: r.client.client.CheckRedirect,
 	}
 	
-	// 使用临时客户端执行请求
-	return r.sendRequest(tempClient, req, "动态代理", proxyAddr)
+	// 执行请求，并将结果反馈给代理管理器
+	// 调用方取消或超时导致的失败不是代理的故障，不反馈，避免客户端断开把健康的代理移出轮换
+	start := time.Now()
+	resp, err := r.sendRequest(proxyClient, r.withConnTrace(req, connLabel(proxyAddr)), "动态代理", proxyAddr)
+	if reporter, ok := r.client.proxyManager.(ProxyResultReporter); ok && req.Context().Err() == nil {
+		reporter.ReportResult(proxyAddr, err == nil, time.Since(start))
+	}
+	return resp, err
+}
+
+// getDynamicProxy 从代理管理器获取代理，设置了代理选择键时优先按键选择
+func (r *Request) getDynamicProxy() (string, error) {
+	if r.proxyKey != "" {
+		if keyed, ok := r.client.proxyManager.(KeyedProxyManager); ok {
+			return keyed.GetProxyFor(r.proxyKey)
+		}
+	}
+	return r.client.proxyManager.GetProxy()
+}
+
+// rewindRequestBody 在同一次尝试内切换连接方式前重置请求体
+func rewindRequestBody(req *http.Request) {
+	if req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		log.Ctx(req.Context()).Warn("重置请求体失败: %v", err)
+		return
+	}
+	req.Body = body
 }
 
 // tryStaticProxy 尝试使用静态代理
@@ -280,19 +378,19 @@ func (r *Request) tryStaticProxy(req *http.Request) (*Response, error) {
 		return nil, fmt.Errorf("静态代理未配置")
 	}
 	
-	log.Info("尝试使用静态代理: %s", r.client.proxyURL)
+	log.Ctx(req.Context()).Info("尝试使用静态代理: %s", redact.URL(r.client.proxyURL))
 	
 	// 使用已配置代理的客户端执行请求
-	return r.sendRequest(r.client.client, req, "静态代理", r.client.proxyURL)
+	return r.sendRequest(r.client.client, r.withConnTrace(req, connLabel(r.client.proxyURL)), "静态代理", r.client.proxyURL)
 }
 
 // tryDirectConnection 尝试直接连接
 // 优化: 将直接连接逻辑封装为独立函数，统一代理处理流程
 func (r *Request) tryDirectConnection(req *http.Request) (*Response, error) {
-	log.Info("尝试使用直接连接发送请求")
+	log.Ctx(req.Context()).Info("尝试使用直接连接发送请求")
 	
 	// 使用标准客户端执行请求
-	return r.sendRequest(r.client.client, req, "直接连接", "无代理")
+	return r.sendRequest(r.client.client, r.withConnTrace(req, connLabel(r.client.proxyURL)), "直接连接", "无代理")
 }
 
 // Execute 执行请求
@@ -308,7 +406,7 @@ func (r *Request) Execute(method, path string) (*Response, error) {
 	fullURL = r.addQueryParams(fullURL)
 	
 	// 记录请求开始
-	log.Info("开始处理请求: %s %s", method, fullURL)
+	log.Ctx(r.context).Info("开始处理请求: %s %s", method, fullURL)
 	
 	// 初始化重试计数和最后一个错误
 	attempts := r.client.retryCount + 1
@@ -325,7 +423,7 @@ func (r *Request) Execute(method, path string) (*Response, error) {
 				waitTime += time.Duration(rand.Int63n(int64(maxJitter)))
 			}
 			
-			log.Warn("请求尝试 %d/%d 失败: %v. 等待 %v 后重试...",
+			log.Ctx(r.context).Warn("请求尝试 %d/%d 失败: %v. 等待 %v 后重试...",
 				attempt+1, attempts, lastErr, waitTime)
 			
 			// 等待后重试，支持上下文取消
@@ -346,6 +444,21 @@ func (r *Request) Execute(method, path string) (*Response, error) {
 		// 代理处理策略：先尝试动态代理，再尝试静态代理，最后使用标准客户端
 		var resp *Response
 		
+		// 0. 回放模式下只使用录制文件，不访问代理和网络
+		if r.client.fixtures.Replaying() {
+			resp, err = r.sendRequest(r.client.client, req, "录制回放", "fixtures")
+			if err == nil {
+				return resp, nil
+			}
+			// 没有录制的请求重试也不会命中
+			if errors.Is(err, fixture.ErrMiss) {
+				log.Ctx(r.context).Error("回放模式下没有匹配的录制响应: %v", err)
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		
 		// 1. 尝试动态代理（如果已启用）
 		if r.client.dynamicProxy && r.client.proxyManager != nil {
 			resp, err = r.tryDynamicProxy(req)
@@ -357,6 +470,7 @@ func (r *Request) Execute(method, path string) (*Response, error) {
 		
 		// 2. 尝试静态代理（如果已配置）
 		if r.client.proxyURL != "" {
+			rewindRequestBody(req)
 			resp, err = r.tryStaticProxy(req)
 			if err == nil {
 				return resp, nil
@@ -365,6 +479,7 @@ func (r *Request) Execute(method, path string) (*Response, error) {
 		}
 		
 		// 3. 尝试直接连接
+		rewindRequestBody(req)
 		resp, err = r.tryDirectConnection(req)
 		if err == nil {
 			return resp, nil
@@ -373,7 +488,7 @@ func (r *Request) Execute(method, path string) (*Response, error) {
 	}
 	
 	// 所有尝试都失败
-	log.Error("所有请求尝试都失败了: %v", lastErr)
+	log.Ctx(r.context).Error("所有请求尝试都失败了: %v", lastErr)
 	if lastErr != nil {
 		return nil, fmt.Errorf("请求失败: %w", lastErr)
 	}
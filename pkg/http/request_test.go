@@ -0,0 +1,65 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"scira2api/log"
+)
+
+// reportingProxyManager 记录请求结果反馈的代理管理器
+type reportingProxyManager struct {
+	staticProxyManager
+	mu      sync.Mutex
+	results []bool
+}
+
+func (m *reportingProxyManager) ReportResult(proxyAddr string, success bool, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results = append(m.results, success)
+}
+
+func (m *reportingProxyManager) reported() []bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]bool(nil), m.results...)
+}
+
+func TestDynamicProxyIgnoresCallerCancellation(t *testing.T) {
+	log.SetLevel(log.ERROR)
+
+	// 代理一直不应答，直到客户端断开
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer proxyServer.Close()
+
+	manager := &reportingProxyManager{staticProxyManager: staticProxyManager{addr: proxyServer.URL}}
+	client := NewHttpClient()
+	client.SetProxyManager(manager)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.R().SetContext(ctx).Get("http://upstream.invalid/api"); err == nil {
+		t.Fatal("request should fail after the caller cancels")
+	}
+	if results := manager.reported(); len(results) != 0 {
+		t.Fatalf("caller cancellation reported to the proxy manager: %v", results)
+	}
+
+	// 代理本身的结果仍然反馈
+	ok := newForwardProxy(t)
+	manager.addr = ok.URL
+	if _, err := client.R().Get("http://upstream.invalid/api"); err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	if results := manager.reported(); len(results) != 1 || !results[0] {
+		t.Fatalf("results = %v, want one success", results)
+	}
+}
@@ -52,6 +52,7 @@ type Response struct {
 	request     *http.Request   // 对应的请求
 	receivedAt  time.Time       // 接收响应的时间
 	executionTime time.Duration // 请求执行时间
+	firstByte   time.Duration   // 发出请求到收到响应头的时间
 	statusText  string          // 状态码描述
 	streamMode  bool            // 是否使用流式处理模式
 	size        int64           // 响应大小
@@ -193,6 +194,11 @@ func (r *Response) SetExecutionTime(duration time.Duration) *Response {
 	return r
 }
 
+// TimeToFirstByte 获取发出请求到收到响应头的时间
+func (r *Response) TimeToFirstByte() time.Duration {
+	return r.firstByte
+}
+
 // ReceivedAt 获取接收时间
 // 优化点：新增方法，提供时间信息
 func (r *Response) ReceivedAt() time.Time {
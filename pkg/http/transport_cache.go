@@ -0,0 +1,187 @@
+package http
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportCacheOptions 动态代理Transport缓存选项
+type TransportCacheOptions struct {
+	MaxEntries  int           // 最多缓存的代理Transport数量，超出时按LRU淘汰
+	IdleTimeout time.Duration // Transport空闲多久后被清理
+}
+
+// DefaultTransportCacheOptions 返回默认的Transport缓存选项
+func DefaultTransportCacheOptions() TransportCacheOptions {
+	return TransportCacheOptions{
+		MaxEntries:  64,
+		IdleTimeout: 5 * time.Minute,
+	}
+}
+
+// transportCacheEntry Transport缓存项
+type transportCacheEntry struct {
+	key       string
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// transportCache 按代理URL缓存Transport，使同一代理的请求可以复用连接
+type transportCache struct {
+	options TransportCacheOptions
+	build   func(proxyAddr string) (*http.Transport, error)
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // 队首为最近使用
+
+	hits      int64
+	misses    int64
+	evictions int64
+
+	stopCleanup chan struct{}
+	closeOnce   sync.Once
+}
+
+// newTransportCache 创建Transport缓存并启动空闲清理
+func newTransportCache(options TransportCacheOptions, build func(proxyAddr string) (*http.Transport, error)) *transportCache {
+	defaults := DefaultTransportCacheOptions()
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = defaults.MaxEntries
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = defaults.IdleTimeout
+	}
+
+	c := &transportCache{
+		options:     options,
+		build:       build,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		stopCleanup: make(chan struct{}),
+	}
+
+	go c.cleanupLoop()
+	return c
+}
+
+// Get 获取代理对应的Transport，不存在时创建
+func (c *transportCache) Get(proxyAddr string) (*http.Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[proxyAddr]; ok {
+		entry := elem.Value.(*transportCacheEntry)
+		entry.lastUsed = time.Now()
+		c.lru.MoveToFront(elem)
+		atomic.AddInt64(&c.hits, 1)
+		return entry.transport, nil
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	transport, err := c.build(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[proxyAddr] = c.lru.PushFront(&transportCacheEntry{
+		key:       proxyAddr,
+		transport: transport,
+		lastUsed:  time.Now(),
+	})
+
+	// 超出容量时淘汰最久未使用的Transport
+	for c.lru.Len() > c.options.MaxEntries {
+		c.removeElementLocked(c.lru.Back())
+	}
+
+	return transport, nil
+}
+
+// removeElementLocked 移除缓存项并关闭其空闲连接（调用方需持有锁）
+// 正在进行的请求不受影响，其连接在请求结束后由Transport的空闲超时回收
+func (c *transportCache) removeElementLocked(elem *list.Element) {
+	entry := elem.Value.(*transportCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	entry.transport.CloseIdleConnections()
+	atomic.AddInt64(&c.evictions, 1)
+}
+
+// cleanupLoop 定期清理空闲的Transport
+func (c *transportCache) cleanupLoop() {
+	interval := c.options.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.evictIdle()
+		case <-c.stopCleanup:
+			return
+		}
+	}
+}
+
+// evictIdle 淘汰空闲超时的Transport
+func (c *transportCache) evictIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; {
+		entry := elem.Value.(*transportCacheEntry)
+		if now.Sub(entry.lastUsed) <= c.options.IdleTimeout {
+			break // 越靠近队首越新，后面的都未过期
+		}
+		prev := elem.Prev()
+		c.removeElementLocked(elem)
+		elem = prev
+	}
+}
+
+// Purge 清空缓存，传输配置变化时调用
+func (c *transportCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; elem = c.lru.Front() {
+		c.removeElementLocked(elem)
+	}
+}
+
+// Len 返回缓存的Transport数量
+func (c *transportCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// GetMetrics 获取缓存指标
+func (c *transportCache) GetMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":      true,
+		"size":         c.Len(),
+		"max_entries":  c.options.MaxEntries,
+		"idle_timeout": c.options.IdleTimeout.String(),
+		"hits":         atomic.LoadInt64(&c.hits),
+		"misses":       atomic.LoadInt64(&c.misses),
+		"evictions":    atomic.LoadInt64(&c.evictions),
+	}
+}
+
+// Close 停止清理并关闭所有缓存的Transport
+func (c *transportCache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stopCleanup)
+		c.Purge()
+	})
+}
@@ -0,0 +1,137 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"scira2api/log"
+)
+
+// staticProxyManager 固定返回同一个代理的代理管理器
+type staticProxyManager struct {
+	addr string
+}
+
+func (m *staticProxyManager) GetProxy() (string, error) {
+	return m.addr, nil
+}
+
+// newForwardProxy 启动一个充当HTTP正向代理的测试服务器，直接应答经其转发的请求
+func newForwardProxy(tb testing.TB) *httptest.Server {
+	tb.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	tb.Cleanup(server.Close)
+	return server
+}
+
+func TestTransportCacheLRUEviction(t *testing.T) {
+	built := 0
+	cache := newTransportCache(TransportCacheOptions{MaxEntries: 2, IdleTimeout: time.Minute}, func(string) (*http.Transport, error) {
+		built++
+		return &http.Transport{}, nil
+	})
+	defer cache.Close()
+
+	a, _ := cache.Get("http://a:1")
+	cache.Get("http://b:1")
+	if again, _ := cache.Get("http://a:1"); again != a {
+		t.Fatal("同一代理应返回缓存的Transport")
+	}
+
+	// a 最近被使用，加入 c 时应淘汰 b
+	cache.Get("http://c:1")
+	if cache.Len() != 2 {
+		t.Fatalf("缓存大小应为2，实际为%d", cache.Len())
+	}
+	cache.Get("http://b:1")
+	if built != 4 {
+		t.Fatalf("被淘汰的代理应重新创建Transport，共创建%d次", built)
+	}
+
+	metrics := cache.GetMetrics()
+	if metrics["hits"].(int64) != 1 || metrics["evictions"].(int64) != 2 {
+		t.Fatalf("缓存指标不正确: %v", metrics)
+	}
+}
+
+func TestTransportCacheIdleCleanup(t *testing.T) {
+	cache := newTransportCache(TransportCacheOptions{MaxEntries: 4, IdleTimeout: time.Minute}, func(string) (*http.Transport, error) {
+		return &http.Transport{}, nil
+	})
+	defer cache.Close()
+
+	cache.Get("http://a:1")
+	cache.mu.Lock()
+	cache.lru.Front().Value.(*transportCacheEntry).lastUsed = time.Now().Add(-2 * time.Minute)
+	cache.mu.Unlock()
+	cache.Get("http://b:1")
+
+	cache.evictIdle()
+	if cache.Len() != 1 {
+		t.Fatalf("空闲的Transport应被清理，剩余%d个", cache.Len())
+	}
+}
+
+func TestDynamicProxyReusesConnections(t *testing.T) {
+	log.SetLevel(log.ERROR)
+	proxyServer := newForwardProxy(t)
+
+	client := NewHttpClient()
+	client.SetProxyManager(&staticProxyManager{addr: proxyServer.URL})
+	defer client.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.R().Get("http://upstream.invalid/api"); err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+	}
+
+	metrics := client.GetTransportCacheMetrics()
+	if metrics["misses"].(int64) != 1 || metrics["hits"].(int64) != 4 {
+		t.Fatalf("同一代理的请求应复用Transport: %v", metrics)
+	}
+}
+
+// BenchmarkDynamicProxyCachedTransport 动态代理复用缓存的Transport
+func BenchmarkDynamicProxyCachedTransport(b *testing.B) {
+	log.SetLevel(log.ERROR)
+	proxyServer := newForwardProxy(b)
+
+	client := NewHttpClient()
+	client.SetProxyManager(&staticProxyManager{addr: proxyServer.URL})
+	defer client.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.R().Get("http://upstream.invalid/api"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDynamicProxyNewTransport 每次请求新建Transport（缓存引入前的行为）
+func BenchmarkDynamicProxyNewTransport(b *testing.B) {
+	log.SetLevel(log.ERROR)
+	proxyServer := newForwardProxy(b)
+	proxyURL, _ := url.Parse(proxyServer.URL)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+		client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+		resp, err := client.Get("http://upstream.invalid/api")
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+	}
+}
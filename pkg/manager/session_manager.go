@@ -0,0 +1,244 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"scira2api/log"
+)
+
+// Session 上游会话，在多轮对话之间保持相同的 chatId/userId
+type Session struct {
+	Key      string    `json:"key"`
+	ChatId   string    `json:"chat_id"`
+	UserId   string    `json:"user_id"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Turns    int64     `json:"turns"`
+}
+
+// SessionManager 粘性会话管理器
+// 按会话键（OpenAI user 字段或 X-Session-ID）绑定上游 chatId/userId，
+// 空闲超过 TTL 的会话会被清理，被隔离的身份会解除所有绑定
+type SessionManager struct {
+	sessions        map[string]*Session
+	quarantined     map[string]time.Time // userId -> 隔离截止时间
+	ttl             time.Duration
+	quarantineTTL   time.Duration
+	chatIdGenerator *ChatIdGenerator
+	userManager     *UserManager
+	mu              sync.Mutex
+	stopCleanup     chan struct{}
+	closeOnce       sync.Once
+}
+
+// NewSessionManager 创建新的会话管理器
+// ttl 为会话空闲过期时间，quarantineTTL 为身份被隔离的时长
+func NewSessionManager(ttl, quarantineTTL time.Duration, chatIdGenerator *ChatIdGenerator, userManager *UserManager) *SessionManager {
+	if chatIdGenerator == nil {
+		chatIdGenerator = NewChatIdGenerator("")
+	}
+	if userManager == nil {
+		userManager = NewUserManager()
+	}
+
+	m := &SessionManager{
+		sessions:        make(map[string]*Session),
+		quarantined:     make(map[string]time.Time),
+		ttl:             ttl,
+		quarantineTTL:   quarantineTTL,
+		chatIdGenerator: chatIdGenerator,
+		userManager:     userManager,
+		stopCleanup:     make(chan struct{}),
+	}
+
+	if ttl > 0 {
+		go m.startCleanupTimer(cleanupIntervalFor(ttl))
+	}
+
+	return m
+}
+
+// cleanupIntervalFor 根据TTL计算清理间隔
+func cleanupIntervalFor(ttl time.Duration) time.Duration {
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// startCleanupTimer 定期清理过期会话和隔离记录
+func (m *SessionManager) startCleanupTimer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.DeleteExpired()
+		case <-m.stopCleanup:
+			return
+		}
+	}
+}
+
+// Acquire 获取会话键对应的 chatId/userId，不存在或已过期时创建新的绑定
+func (m *SessionManager) Acquire(key string) (chatId, userId string) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[key]; ok && !m.isExpiredLocked(session, now) && !m.isQuarantinedLocked(session.UserId, now) {
+		session.LastUsed = now
+		session.Turns++
+		return session.ChatId, session.UserId
+	}
+
+	session := &Session{
+		Key:      key,
+		ChatId:   m.chatIdGenerator.GenerateId(),
+		UserId:   m.nextUserIdLocked(now),
+		Created:  now,
+		LastUsed: now,
+		Turns:    1,
+	}
+	m.sessions[key] = session
+	log.Debug("创建粘性会话: key=%s, chatId=%s, userId=%s", key, session.ChatId, session.UserId)
+
+	return session.ChatId, session.UserId
+}
+
+// nextUserIdLocked 生成一个未被隔离的用户ID
+func (m *SessionManager) nextUserIdLocked(now time.Time) string {
+	userId := m.userManager.GetNextUserId()
+	for i := 0; i < 3 && m.isQuarantinedLocked(userId, now); i++ {
+		userId = m.userManager.GetNextUserId()
+	}
+	return userId
+}
+
+// Quarantine 隔离上游身份并解除其所有会话绑定，返回被解除的会话数
+func (m *SessionManager) Quarantine(userId string) int {
+	if userId == "" {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.quarantineTTL > 0 {
+		m.quarantined[userId] = time.Now().Add(m.quarantineTTL)
+	}
+
+	dropped := 0
+	for key, session := range m.sessions {
+		if session.UserId == userId {
+			delete(m.sessions, key)
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		log.Info("上游身份 %s 已隔离，解除 %d 个会话绑定", userId, dropped)
+	}
+	return dropped
+}
+
+// IsQuarantined 检查上游身份是否处于隔离期
+func (m *SessionManager) IsQuarantined(userId string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isQuarantinedLocked(userId, time.Now())
+}
+
+// isQuarantinedLocked 检查隔离状态（调用方需持有锁）
+func (m *SessionManager) isQuarantinedLocked(userId string, now time.Time) bool {
+	until, ok := m.quarantined[userId]
+	return ok && now.Before(until)
+}
+
+// isExpiredLocked 检查会话是否空闲过期（调用方需持有锁）
+func (m *SessionManager) isExpiredLocked(session *Session, now time.Time) bool {
+	return m.ttl > 0 && now.Sub(session.LastUsed) > m.ttl
+}
+
+// Remove 删除指定会话
+func (m *SessionManager) Remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, key)
+}
+
+// DeleteExpired 删除所有过期的会话和隔离记录
+func (m *SessionManager) DeleteExpired() {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, session := range m.sessions {
+		if m.isExpiredLocked(session, now) {
+			delete(m.sessions, key)
+		}
+	}
+	for userId, until := range m.quarantined {
+		if !now.Before(until) {
+			delete(m.quarantined, userId)
+		}
+	}
+}
+
+// Sessions 返回当前所有会话的副本
+func (m *SessionManager) Sessions() []Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make([]Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, *session)
+	}
+	return sessions
+}
+
+// Quarantined 返回处于隔离期的上游身份及其隔离截止时间
+func (m *SessionManager) Quarantined() map[string]time.Time {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	quarantined := make(map[string]time.Time, len(m.quarantined))
+	for userId, until := range m.quarantined {
+		if now.Before(until) {
+			quarantined[userId] = until
+		}
+	}
+	return quarantined
+}
+
+// GetMetrics 获取会话指标
+func (m *SessionManager) GetMetrics() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return map[string]interface{}{
+		"enabled":        true,
+		"sessions":       len(m.sessions),
+		"quarantined":    len(m.quarantined),
+		"ttl":            m.ttl.String(),
+		"quarantine_ttl": m.quarantineTTL.String(),
+	}
+}
+
+// Close 停止后台清理
+func (m *SessionManager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stopCleanup)
+	})
+	return nil
+}
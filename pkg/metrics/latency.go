@@ -0,0 +1,255 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 延迟类型
+const (
+	LatencyTotal        = "total"         // 请求总耗时，流式请求包含整个响应流
+	LatencyUpstreamTTFB = "upstream_ttfb" // 上游请求发出到收到响应头
+	LatencyFirstToken   = "first_token"   // 请求开始到发出首个内容或推理数据块
+	LatencyChunkGap     = "chunk_gap"     // 流式响应相邻数据块的间隔
+)
+
+// latencyKinds 输出指标时的延迟类型顺序
+var latencyKinds = []string{LatencyTotal, LatencyUpstreamTTFB, LatencyFirstToken, LatencyChunkGap}
+
+// 对数分桶参数：最小1ms，每个桶比上一个大5%，300个桶覆盖到约36分钟
+const (
+	sketchMin     = time.Millisecond
+	sketchGrowth  = 1.05
+	sketchBuckets = 300
+)
+
+// sketchLogGrowth 预先计算的 ln(sketchGrowth)
+var sketchLogGrowth = math.Log(sketchGrowth)
+
+// sketchWindow 一个时间窗口内的分桶计数
+type sketchWindow struct {
+	counts [sketchBuckets]uint32
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// Sketch 有界的对数分桶延迟直方图，分位数的相对误差不超过5%，内存占用固定
+// 设置窗口时保留当前和上一个窗口，分位数反映最近一到两个窗口内的样本；窗口为0时统计全部样本
+type Sketch struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	current  *sketchWindow
+	previous *sketchWindow
+	rotated  time.Time
+	total    uint64
+}
+
+// NewSketch 创建延迟直方图
+func NewSketch(window time.Duration) *Sketch {
+	return &Sketch{
+		window:   window,
+		current:  &sketchWindow{},
+		previous: &sketchWindow{},
+		rotated:  time.Now(),
+	}
+}
+
+// Observe 记录一个样本
+func (s *Sketch) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	idx := sketchIndex(d)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotateLocked(time.Now())
+	w := s.current
+	w.counts[idx]++
+	w.count++
+	w.sum += d
+	if d > w.max {
+		w.max = d
+	}
+	s.total++
+}
+
+// rotateLocked 窗口到期时轮转，超过两个窗口没有样本时清空，调用方需持有锁
+func (s *Sketch) rotateLocked(now time.Time) {
+	if s.window <= 0 {
+		return
+	}
+	elapsed := now.Sub(s.rotated)
+	if elapsed < s.window {
+		return
+	}
+	if elapsed >= 2*s.window {
+		s.previous = &sketchWindow{}
+	} else {
+		s.previous = s.current
+	}
+	s.current = &sketchWindow{}
+	s.rotated = now
+}
+
+// LatencySummary 延迟分布摘要（毫秒）
+type LatencySummary struct {
+	Count  uint64  `json:"count"` // 统计窗口内的样本数
+	Total  uint64  `json:"total"` // 启动以来的样本数
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// Summary 返回统计窗口内的分位数
+func (s *Sketch) Summary() LatencySummary {
+	s.mu.Lock()
+	s.rotateLocked(time.Now())
+	var merged sketchWindow
+	for _, w := range []*sketchWindow{s.previous, s.current} {
+		for i, n := range w.counts {
+			merged.counts[i] += n
+		}
+		merged.count += w.count
+		merged.sum += w.sum
+		if w.max > merged.max {
+			merged.max = w.max
+		}
+	}
+	total := s.total
+	s.mu.Unlock()
+
+	summary := LatencySummary{Count: merged.count, Total: total}
+	if merged.count == 0 {
+		return summary
+	}
+	summary.MeanMs = millis(merged.sum / time.Duration(merged.count))
+	summary.P50Ms = millis(merged.quantile(0.50))
+	summary.P90Ms = millis(merged.quantile(0.90))
+	summary.P99Ms = millis(merged.quantile(0.99))
+	summary.MaxMs = millis(merged.max)
+	return summary
+}
+
+// quantile 返回分位数所在桶的上界，不超过最大样本
+func (w *sketchWindow) quantile(q float64) time.Duration {
+	rank := uint64(math.Ceil(q * float64(w.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range w.counts {
+		seen += uint64(n)
+		if seen >= rank {
+			if bound := sketchBound(i); bound < w.max {
+				return bound
+			}
+			return w.max
+		}
+	}
+	return w.max
+}
+
+// sketchIndex 返回样本所在的桶，小于1ms的样本计入第一个桶，超出范围的计入最后一个桶
+func sketchIndex(d time.Duration) int {
+	if d <= sketchMin {
+		return 0
+	}
+	idx := int(math.Ceil(math.Log(float64(d)/float64(sketchMin)) / sketchLogGrowth))
+	if idx >= sketchBuckets {
+		return sketchBuckets - 1
+	}
+	return idx
+}
+
+// sketchBound 返回桶的上界
+func sketchBound(idx int) time.Duration {
+	return time.Duration(float64(sketchMin) * math.Pow(sketchGrowth, float64(idx)))
+}
+
+// millis 转换为保留两位小数的毫秒数
+func millis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+}
+
+// LatencyTracker 按模型和延迟类型记录延迟分布，同时写入对应的Prometheus直方图
+type LatencyTracker struct {
+	window time.Duration
+
+	mu       sync.RWMutex
+	sketches map[string]map[string]*Sketch
+}
+
+// NewLatencyTracker 创建延迟跟踪器，window 为分位数的统计窗口
+func NewLatencyTracker(window time.Duration) *LatencyTracker {
+	return &LatencyTracker{
+		window:   window,
+		sketches: make(map[string]map[string]*Sketch),
+	}
+}
+
+// Observe 记录一个延迟样本
+func (t *LatencyTracker) Observe(model, kind string, d time.Duration) {
+	observeLatencyHistogram(model, kind, d)
+	t.sketch(model, kind).Observe(d)
+}
+
+// sketch 获取或创建模型和延迟类型对应的直方图
+func (t *LatencyTracker) sketch(model, kind string) *Sketch {
+	t.mu.RLock()
+	s, ok := t.sketches[model][kind]
+	t.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	kinds, ok := t.sketches[model]
+	if !ok {
+		kinds = make(map[string]*Sketch)
+		t.sketches[model] = kinds
+	}
+	if s, ok = kinds[kind]; !ok {
+		s = NewSketch(t.window)
+		kinds[kind] = s
+	}
+	return s
+}
+
+// GetMetrics 获取指标，按模型列出各延迟类型的分位数
+func (t *LatencyTracker) GetMetrics() map[string]interface{} {
+	t.mu.RLock()
+	models := make([]string, 0, len(t.sketches))
+	for model := range t.sketches {
+		models = append(models, model)
+	}
+	t.mu.RUnlock()
+	sort.Strings(models)
+
+	perModel := make(map[string]interface{}, len(models))
+	for _, model := range models {
+		summaries := make(map[string]LatencySummary)
+		for _, kind := range latencyKinds {
+			t.mu.RLock()
+			s, ok := t.sketches[model][kind]
+			t.mu.RUnlock()
+			if ok {
+				summaries[kind] = s.Summary()
+			}
+		}
+		perModel[model] = summaries
+	}
+
+	return map[string]interface{}{
+		"window": t.window.String(),
+		"models": perModel,
+	}
+}
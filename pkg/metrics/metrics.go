@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace 所有指标的名称前缀
+const namespace = "scira2api"
+
+// 限流拒绝的层级
+const (
+	LimiterGlobal      = "global"
+	LimiterKey         = "key"
+	LimiterModel       = "model"
+	LimiterTokens      = "tokens"
+	LimiterConcurrency = "concurrency"
+	LimiterBudget      = "budget"
+)
+
+// 上游请求尝试的结果
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeBusy    = "busy" // 上游身份并发已满，未发出请求
+)
+
+// 缓存类型
+const (
+	CacheResponse = "response"
+	CacheModels   = "models"
+)
+
+// registry 独立的指标注册表，不使用全局默认注册表，避免依赖库注册的指标混入
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, model, status code and API key.",
+	}, []string{"route", "model", "status", "key"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and model, including the whole response stream.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"route", "model"})
+
+	timeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time from accepting a streaming request to sending its first content or reasoning chunk.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30},
+	}, []string{"model"})
+
+	upstreamTTFB = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_ttfb_seconds",
+		Help:      "Time from sending an upstream request to receiving its response headers.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30},
+	}, []string{"model"})
+
+	streamChunkGap = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_chunk_gap_seconds",
+		Help:      "Gap between consecutive content or reasoning chunks of a streaming response.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"model"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Billed tokens by model, API key and type (prompt, completion, reasoning).",
+	}, []string{"model", "key", "type"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result (hit, miss).",
+	}, []string{"cache", "result"})
+
+	limiterRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ratelimit_rejections_total",
+		Help:      "Requests rejected by a limiter, by limiter layer.",
+	}, []string{"limiter"})
+
+	upstreamAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_attempts_total",
+		Help:      "Upstream request attempts by model, mode and outcome (success, failure, busy).",
+	}, []string{"model", "mode", "outcome"})
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Upstream attempts made after the first one, by model and mode.",
+	}, []string{"model", "mode"})
+
+	upstreamFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_failures_total",
+		Help:      "Requests that failed after exhausting all upstream attempts, by model and mode.",
+	}, []string{"model", "mode"})
+
+	streamsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "streams_in_flight",
+		Help:      "Streaming responses currently being served.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		timeToFirstToken,
+		upstreamTTFB,
+		streamChunkGap,
+		tokensTotal,
+		cacheRequests,
+		limiterRejections,
+		upstreamAttempts,
+		upstreamRetries,
+		upstreamFailures,
+		streamsInFlight,
+	)
+}
+
+// Handler 返回Prometheus文本格式的指标处理器
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// ObserveRequest 记录一次HTTP请求；route 为路由模板，未匹配路由的请求统一记为 unmatched
+func ObserveRequest(route, model string, status int, key string, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	requestsTotal.WithLabelValues(route, model, strconv.Itoa(status), key).Inc()
+	requestDuration.WithLabelValues(route, model).Observe(duration.Seconds())
+}
+
+// observeLatencyHistogram 把延迟样本写入对应的Prometheus直方图，总耗时由请求中间件按路由记录
+func observeLatencyHistogram(model, kind string, latency time.Duration) {
+	switch kind {
+	case LatencyFirstToken:
+		timeToFirstToken.WithLabelValues(model).Observe(latency.Seconds())
+	case LatencyUpstreamTTFB:
+		upstreamTTFB.WithLabelValues(model).Observe(latency.Seconds())
+	case LatencyChunkGap:
+		streamChunkGap.WithLabelValues(model).Observe(latency.Seconds())
+	}
+}
+
+// AddTokens 累加计费的tokens
+func AddTokens(model, key string, prompt, completion, reasoning int) {
+	for _, t := range []struct {
+		name  string
+		count int
+	}{{"prompt", prompt}, {"completion", completion}, {"reasoning", reasoning}} {
+		if t.count > 0 {
+			tokensTotal.WithLabelValues(model, key, t.name).Add(float64(t.count))
+		}
+	}
+}
+
+// CacheLookup 记录一次缓存查找
+func CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// LimiterRejected 记录一次限流拒绝
+func LimiterRejected(limiter string) {
+	limiterRejections.WithLabelValues(limiter).Inc()
+}
+
+// UpstreamAttempt 记录一次上游请求尝试，attempt 从0开始，大于0时计为重试
+func UpstreamAttempt(model string, stream bool, attempt int, outcome string) {
+	mode := requestMode(stream)
+	upstreamAttempts.WithLabelValues(model, mode, outcome).Inc()
+	if attempt > 0 {
+		upstreamRetries.WithLabelValues(model, mode).Inc()
+	}
+}
+
+// UpstreamFailed 记录一次用尽所有尝试后仍然失败的上游请求
+func UpstreamFailed(model string, stream bool) {
+	upstreamFailures.WithLabelValues(model, requestMode(stream)).Inc()
+}
+
+// StreamStarted 记录一个流式响应开始，返回的函数在响应结束时调用
+func StreamStarted() func() {
+	streamsInFlight.Inc()
+	return streamsInFlight.Dec
+}
+
+// requestMode 请求模式标签
+func requestMode(stream bool) string {
+	if stream {
+		return "stream"
+	}
+	return "sync"
+}
@@ -0,0 +1,332 @@
+// Package mockupstream 模拟 Scira 的 /api/search 接口，用于本地开发和测试
+// 响应使用与真实上游相同的数据流格式：f: 消息开始、g: 推理内容、h: 来源、0: 文本、3: 错误、e: 步骤结束、d: 用量，
+// 可以配置延迟、分块大小、失败注入和脚本化的响应
+package mockupstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// SearchPath 模拟的上游接口路径
+const SearchPath = "/api/search"
+
+// 默认响应内容
+const (
+	DefaultReasoning = "Let me think about this question."
+	DefaultText      = "This is a mock response from the Scira upstream."
+)
+
+// Source 响应中引用的来源
+type Source struct {
+	URL   string `json:"url"`
+	Title string `json:"title,omitempty"`
+}
+
+// Response 一次上游响应的内容
+type Response struct {
+	Match            string   `json:"match,omitempty"`             // 只用于最后一条用户消息包含该文本的请求，空串匹配所有请求
+	Status           int      `json:"status,omitempty"`            // 非200时直接返回该状态码和 Error
+	Reasoning        string   `json:"reasoning,omitempty"`         // g: 推理内容
+	Text             string   `json:"text,omitempty"`              // 0: 文本内容
+	Sources          []Source `json:"sources,omitempty"`           // h: 来源
+	Error            string   `json:"error,omitempty"`             // 状态码为200时在数据流中输出 3: 错误行并结束
+	FinishReason     string   `json:"finish_reason,omitempty"`     // 默认 stop
+	PromptTokens     int      `json:"prompt_tokens,omitempty"`     // 为0时按请求内容估算
+	CompletionTokens int      `json:"completion_tokens,omitempty"` // 为0时按响应内容估算
+	DropAfter        int      `json:"drop_after,omitempty"`        // 输出指定行数后断开连接，模拟上游中途断开
+	Lines            []string `json:"lines,omitempty"`             // 原样输出的数据行，设置后忽略上面的内容字段
+}
+
+// Options 模拟上游配置
+type Options struct {
+	Latency       time.Duration // 返回响应头之前的延迟
+	ChunkDelay    time.Duration // 数据行之间的延迟
+	ChunkSize     int           // 推理和文本内容每行的最大字符数，0 表示整段输出
+	FailureRate   float64       // 随机注入失败的比例 (0-1)
+	FailureStatus int           // 注入失败时返回的状态码，默认500
+	Script        []Response    // 按 Match 选择的响应，可重复使用
+	Default       *Response     // 没有匹配的脚本时使用的响应，nil 时使用内置的默认响应
+	Seed          int64         // 失败注入的随机种子，0 表示使用当前时间
+}
+
+// Request 模拟上游收到的请求，供测试断言
+type Request struct {
+	ChatID      string `json:"id"`
+	UserID      string `json:"user_id"`
+	Model       string `json:"model"`
+	Group       string `json:"group"`
+	LastMessage string `json:"last_message"`
+	Body        []byte `json:"-"`
+}
+
+// Server 模拟的 Scira 上游
+type Server struct {
+	opts Options
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	queue    []Response // 一次性的响应，按顺序优先使用
+	requests []Request
+}
+
+// New 创建模拟上游
+func New(opts Options) *Server {
+	if opts.FailureStatus == 0 {
+		opts.FailureStatus = http.StatusInternalServerError
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Server{opts: opts, rand: rand.New(rand.NewSource(seed))}
+}
+
+// NewTestServer 创建模拟上游并在本地随机端口启动，返回的 httptest.Server 由调用方关闭
+func NewTestServer(opts Options) (*Server, *httptest.Server) {
+	server := New(opts)
+	return server, httptest.NewServer(server)
+}
+
+// Enqueue 追加一次性的响应，后续请求按顺序使用，优先于脚本和默认响应
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, responses...)
+}
+
+// Requests 返回收到的请求
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// sciraRequest 上游请求中用到的字段
+type sciraRequest struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	Model    string `json:"model"`
+	Group    string `json:"group"`
+	Messages []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"messages"`
+}
+
+// ServeHTTP 处理 /api/search 请求
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != SearchPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		http.Error(w, "read request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var parsed sciraRequest
+	if err := json.Unmarshal(body.Bytes(), &parsed); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := Request{
+		ChatID: parsed.ID,
+		UserID: parsed.UserID,
+		Model:  parsed.Model,
+		Group:  parsed.Group,
+		Body:   body.Bytes(),
+	}
+	for i := len(parsed.Messages) - 1; i >= 0; i-- {
+		if parsed.Messages[i].Role == "user" {
+			request.LastMessage = parsed.Messages[i].Content
+			break
+		}
+	}
+
+	response, fail := s.next(request)
+	if !sleep(r, s.opts.Latency) {
+		return
+	}
+	if fail {
+		http.Error(w, `{"error":"injected upstream failure"}`, s.opts.FailureStatus)
+		return
+	}
+	if response.Status != 0 && response.Status != http.StatusOK {
+		message := response.Error
+		if message == "" {
+			message = http.StatusText(response.Status)
+		}
+		data, _ := json.Marshal(map[string]string{"error": message})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.Status)
+		w.Write(data)
+		return
+	}
+
+	s.stream(w, r, response.lines(request, s.opts.ChunkSize), response.DropAfter)
+}
+
+// next 记录请求并选择响应：一次性响应 > 匹配的脚本 > 默认响应，失败注入优先于所有响应
+func (s *Server) next(request Request) (Response, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, request)
+
+	if s.opts.FailureRate > 0 && s.rand.Float64() < s.opts.FailureRate {
+		return Response{}, true
+	}
+	if len(s.queue) > 0 {
+		response := s.queue[0]
+		s.queue = s.queue[1:]
+		return response, false
+	}
+	for _, response := range s.opts.Script {
+		if response.Match == "" || strings.Contains(request.LastMessage, response.Match) {
+			return response, false
+		}
+	}
+	if s.opts.Default != nil {
+		return *s.opts.Default, false
+	}
+	return Response{
+		Reasoning: DefaultReasoning,
+		Text:      DefaultText,
+		Sources:   []Source{{URL: "https://example.com/mock", Title: "Mock source"}},
+	}, false
+}
+
+// stream 逐行输出数据流，dropAfter 大于0时输出指定行数后断开连接
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, lines []string, dropAfter int) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Vercel-AI-Data-Stream", "v1")
+	w.WriteHeader(http.StatusOK)
+
+	for i, line := range lines {
+		if dropAfter > 0 && i >= dropAfter {
+			// 中止处理器会直接关闭连接，客户端读到不完整的响应
+			panic(http.ErrAbortHandler)
+		}
+		if i > 0 && !sleep(r, s.opts.ChunkDelay) {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// lines 生成响应的数据行
+func (resp Response) lines(request Request, chunkSize int) []string {
+	if len(resp.Lines) > 0 {
+		return resp.Lines
+	}
+
+	lines := []string{fmt.Sprintf(`f:{"messageId":"msg-%s"}`, request.ChatID)}
+	for _, chunk := range split(resp.Reasoning, chunkSize) {
+		lines = append(lines, "g:"+quote(chunk))
+	}
+	for i, source := range resp.Sources {
+		data, _ := json.Marshal(map[string]string{
+			"sourceType": "url",
+			"id":         fmt.Sprintf("source-%d", i+1),
+			"url":        source.URL,
+			"title":      source.Title,
+		})
+		lines = append(lines, "h:"+string(data))
+	}
+	for _, chunk := range split(resp.Text, chunkSize) {
+		lines = append(lines, "0:"+quote(chunk))
+	}
+	if resp.Error != "" {
+		return append(lines, "3:"+quote(resp.Error))
+	}
+
+	finishReason := resp.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	promptTokens := resp.PromptTokens
+	if promptTokens == 0 {
+		promptTokens = estimateTokens(request.LastMessage)
+	}
+	completionTokens := resp.CompletionTokens
+	if completionTokens == 0 {
+		completionTokens = estimateTokens(resp.Reasoning) + estimateTokens(resp.Text)
+	}
+	usage := fmt.Sprintf(`{"prompt_tokens":%d,"completion_tokens":%d}`, promptTokens, completionTokens)
+	return append(lines,
+		fmt.Sprintf(`e:{"finishReason":%q,"usage":%s,"isContinued":false}`, finishReason, usage),
+		fmt.Sprintf(`d:{"finishReason":%q,"usage":%s}`, finishReason, usage),
+	)
+}
+
+// split 按字符数切分内容，size 不大于0时整段返回
+func split(s string, size int) []string {
+	if s == "" {
+		return nil
+	}
+	if size <= 0 || utf8.RuneCountInString(s) <= size {
+		return []string{s}
+	}
+	var chunks []string
+	runes := []rune(s)
+	for start := 0; start < len(runes); start += size {
+		end := start + size
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[start:end]))
+	}
+	return chunks
+}
+
+// quote 把内容编码为JSON字符串，与上游一样不转义HTML字符
+func quote(s string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// estimateTokens 粗略估算token数：约4个字符一个token
+func estimateTokens(s string) int {
+	if s == "" {
+		return 0
+	}
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
+
+// sleep 等待指定时间，请求被取消时返回false
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
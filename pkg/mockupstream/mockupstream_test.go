@@ -0,0 +1,258 @@
+package mockupstream
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// search 向模拟上游发送一条用户消息，返回状态码和响应数据行
+func search(t *testing.T, url, message string) (int, []string, error) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":       "chat-1",
+		"user_id":  "user-1",
+		"model":    "scira-default",
+		"group":    "web",
+		"messages": []map[string]string{{"role": "assistant", "content": "earlier"}, {"role": "user", "content": message}},
+	})
+	resp, err := http.Post(url+SearchPath, "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("POST %s: %v", SearchPath, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), err
+}
+
+// prefixes 返回每行的前缀
+func prefixes(lines []string) string {
+	var result []string
+	for _, line := range lines {
+		result = append(result, line[:strings.Index(line, ":")])
+	}
+	return strings.Join(result, ",")
+}
+
+// unquote 解码 g:/0:/3: 行中的JSON字符串
+func unquote(t *testing.T, line string) string {
+	t.Helper()
+	value, err := strconv.Unquote(line[2:])
+	if err != nil {
+		t.Fatalf("unquote %q: %v", line, err)
+	}
+	return value
+}
+
+func TestDefaultResponseStream(t *testing.T) {
+	mock, server := NewTestServer(Options{})
+	defer server.Close()
+
+	status, lines, err := search(t, server.URL, "hello there")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("status=%d err=%v", status, err)
+	}
+	if got := prefixes(lines); got != "f,g,h,0,e,d" {
+		t.Fatalf("unexpected line order %s:\n%s", got, strings.Join(lines, "\n"))
+	}
+	if got := unquote(t, lines[1]); got != DefaultReasoning {
+		t.Fatalf("reasoning = %q", got)
+	}
+	if got := unquote(t, lines[3]); got != DefaultText {
+		t.Fatalf("text = %q", got)
+	}
+
+	var finish struct {
+		FinishReason string `json:"finishReason"`
+		Usage        struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(lines[5][2:]), &finish); err != nil {
+		t.Fatalf("decode d: line: %v", err)
+	}
+	if finish.FinishReason != "stop" || finish.Usage.PromptTokens != 3 || finish.Usage.CompletionTokens == 0 {
+		t.Fatalf("unexpected finish data: %+v", finish)
+	}
+
+	requests := mock.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 recorded request, got %d", len(requests))
+	}
+	if r := requests[0]; r.ChatID != "chat-1" || r.UserID != "user-1" || r.Model != "scira-default" || r.LastMessage != "hello there" {
+		t.Fatalf("unexpected recorded request: %+v", r)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	_, server := NewTestServer(Options{ChunkSize: 4, Default: &Response{Text: "abcdefghij", Reasoning: "思考一下这个问题"}})
+	defer server.Close()
+
+	_, lines, err := search(t, server.URL, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reasoning, text []string
+	for _, line := range lines {
+		switch line[:2] {
+		case "g:":
+			reasoning = append(reasoning, unquote(t, line))
+		case "0:":
+			text = append(text, unquote(t, line))
+		}
+	}
+	if got := strings.Join(text, "|"); got != "abcd|efgh|ij" {
+		t.Fatalf("text chunks = %s", got)
+	}
+	if got := strings.Join(reasoning, "|"); got != "思考一下|这个问题" {
+		t.Fatalf("reasoning chunks = %s", got)
+	}
+}
+
+func TestScriptedResponses(t *testing.T) {
+	mock, server := NewTestServer(Options{Script: []Response{
+		{Match: "weather", Text: "sunny"},
+		{Text: "fallback"},
+	}})
+	defer server.Close()
+	mock.Enqueue(Response{Text: "once"})
+
+	cases := []struct {
+		message string
+		want    string
+	}{
+		{"what is the weather", "once"}, // 一次性响应优先
+		{"what is the weather", "sunny"},
+		{"something else", "fallback"},
+	}
+	for _, c := range cases {
+		_, lines, err := search(t, server.URL, c.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text string
+		for _, line := range lines {
+			if strings.HasPrefix(line, "0:") {
+				text += unquote(t, line)
+			}
+		}
+		if text != c.want {
+			t.Fatalf("message %q: text = %q, want %q", c.message, text, c.want)
+		}
+	}
+}
+
+func TestLinesAreSentVerbatim(t *testing.T) {
+	raw := []string{`0:"a"`, `x:unknown`, `d:{"finishReason":"length"}`}
+	_, server := NewTestServer(Options{Default: &Response{Lines: raw}})
+	defer server.Close()
+
+	_, lines, err := search(t, server.URL, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, "\n") != strings.Join(raw, "\n") {
+		t.Fatalf("lines = %q", lines)
+	}
+}
+
+func TestFailureInjection(t *testing.T) {
+	_, server := NewTestServer(Options{FailureRate: 1, FailureStatus: http.StatusServiceUnavailable, Seed: 1})
+	defer server.Close()
+
+	status, _, _ := search(t, server.URL, "hi")
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", status)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	mock, server := NewTestServer(Options{})
+	defer server.Close()
+	mock.Enqueue(
+		Response{Status: http.StatusTooManyRequests, Error: "slow down"},
+		Response{Text: "partial", Error: "model overloaded"},
+	)
+
+	status, lines, _ := search(t, server.URL, "hi")
+	if status != http.StatusTooManyRequests || !strings.Contains(lines[0], "slow down") {
+		t.Fatalf("status=%d body=%q", status, lines)
+	}
+
+	status, lines, err := search(t, server.URL, "hi")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("status=%d err=%v", status, err)
+	}
+	if got := prefixes(lines); got != "f,0,3" {
+		t.Fatalf("line order = %s", got)
+	}
+	if got := unquote(t, lines[2]); got != "model overloaded" {
+		t.Fatalf("error line = %q", got)
+	}
+}
+
+func TestDropAfter(t *testing.T) {
+	_, server := NewTestServer(Options{Default: &Response{Text: "abcdef", DropAfter: 2}, ChunkSize: 1})
+	defer server.Close()
+
+	_, lines, err := search(t, server.URL, "hi")
+	if err == nil {
+		t.Fatalf("expected truncated response, got lines %q", lines)
+	}
+	if got := prefixes(lines); got != "f,0" {
+		t.Fatalf("lines before drop = %s", got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	_, server := NewTestServer(Options{Latency: 50 * time.Millisecond, ChunkDelay: 10 * time.Millisecond})
+	defer server.Close()
+
+	start := time.Now()
+	if _, _, err := search(t, server.URL, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	// 默认响应6行：响应头前50ms，行间5个间隔各10ms
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("response took %v, expected at least 100ms", elapsed)
+	}
+}
+
+func TestRejectsOtherRoutes(t *testing.T) {
+	_, server := NewTestServer(Options{})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + SearchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/api/other", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown path status = %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+SearchPath, "application/json", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid body status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"scira2api/log"
+)
+
+// Strategy 代理选择策略
+type Strategy string
+
+const (
+	// StrategyRoundRobin 轮询选择
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyRandom 随机选择
+	StrategyRandom Strategy = "random"
+	// StrategySticky 按身份粘性选择，同一身份尽量使用同一个代理
+	StrategySticky Strategy = "sticky"
+)
+
+// 粘性绑定的空闲过期时间
+const stickyBindingTTL = 30 * time.Minute
+
+// PoolOptions 代理池选项
+type PoolOptions struct {
+	Strategy            Strategy
+	HealthCheckURL      string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	MaxFailures         int // 连续失败多少次后移出轮换
+}
+
+// DefaultPoolOptions 返回默认的代理池选项
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{
+		Strategy:            StrategyRoundRobin,
+		HealthCheckURL:      "https://scira.ai/",
+		HealthCheckInterval: time.Minute,
+		HealthCheckTimeout:  10 * time.Second,
+		MaxFailures:         3,
+	}
+}
+
+// stickyBinding 身份与代理的绑定
+type stickyBinding struct {
+	proxy    *Proxy
+	lastUsed time.Time
+}
+
+// Pool 轮换代理池，实现 http.ProxyManager 接口
+type Pool struct {
+	proxies []*Proxy
+	options PoolOptions
+
+	next   uint64 // 轮询游标
+	sticky map[string]*stickyBinding
+
+	mu         sync.Mutex
+	stopCheck  chan struct{}
+	closeOnce  sync.Once
+	checkCount int64
+	evictCount int64
+}
+
+// NewPool 根据代理地址列表创建代理池，无效地址会被跳过并记录日志
+func NewPool(addrs []string, options PoolOptions) (*Pool, error) {
+	defaults := DefaultPoolOptions()
+	if options.Strategy == "" {
+		options.Strategy = defaults.Strategy
+	}
+	if options.HealthCheckTimeout <= 0 {
+		options.HealthCheckTimeout = defaults.HealthCheckTimeout
+	}
+	if options.MaxFailures <= 0 {
+		options.MaxFailures = defaults.MaxFailures
+	}
+
+	switch options.Strategy {
+	case StrategyRoundRobin, StrategyRandom, StrategySticky:
+	default:
+		return nil, fmt.Errorf("不支持的代理选择策略: %s", options.Strategy)
+	}
+
+	seen := make(map[string]bool)
+	proxies := make([]*Proxy, 0, len(addrs))
+	for _, addr := range addrs {
+		p, err := ParseProxy(addr)
+		if err != nil {
+			log.Warn("跳过无效代理: %v", err)
+			continue
+		}
+		if seen[p.String()] {
+			continue
+		}
+		seen[p.String()] = true
+		proxies = append(proxies, p)
+	}
+
+	if len(proxies) == 0 {
+		return nil, ErrNoProxies
+	}
+
+	return &Pool{
+		proxies:   proxies,
+		options:   options,
+		sticky:    make(map[string]*stickyBinding),
+		stopCheck: make(chan struct{}),
+	}, nil
+}
+
+// Start 启动后台健康检查，未配置探测URL或间隔时不启动
+func (p *Pool) Start() {
+	if p.options.HealthCheckURL == "" || p.options.HealthCheckInterval <= 0 {
+		log.Info("代理池健康检查未启用")
+		return
+	}
+
+	go p.healthCheckLoop()
+	log.Info("代理池健康检查已启动: URL=%s, 间隔=%v", p.options.HealthCheckURL, p.options.HealthCheckInterval)
+}
+
+// GetProxy 按策略选择一个健康代理
+func (p *Pool) GetProxy() (string, error) {
+	proxy, err := p.pick("")
+	if err != nil {
+		return "", err
+	}
+	return proxy.String(), nil
+}
+
+// GetProxyFor 为指定身份选择代理，粘性策略下同一身份会复用同一个健康代理
+func (p *Pool) GetProxyFor(key string) (string, error) {
+	proxy, err := p.pick(key)
+	if err != nil {
+		return "", err
+	}
+	return proxy.String(), nil
+}
+
+// pick 选择代理
+func (p *Pool) pick(key string) (*Proxy, error) {
+	healthy := p.healthyProxies()
+	if len(healthy) == 0 {
+		return nil, ErrNoHealthyProxy
+	}
+
+	switch p.options.Strategy {
+	case StrategyRandom:
+		return healthy[rand.Intn(len(healthy))], nil
+	case StrategySticky:
+		if key != "" {
+			return p.pickSticky(key, healthy), nil
+		}
+	}
+
+	idx := atomic.AddUint64(&p.next, 1) - 1
+	return healthy[idx%uint64(len(healthy))], nil
+}
+
+// pickSticky 获取或创建身份的粘性绑定
+func (p *Pool) pickSticky(key string, healthy []*Proxy) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if binding, ok := p.sticky[key]; ok && binding.proxy.IsHealthy() {
+		binding.lastUsed = now
+		return binding.proxy
+	}
+
+	idx := atomic.AddUint64(&p.next, 1) - 1
+	proxy := healthy[idx%uint64(len(healthy))]
+	p.sticky[key] = &stickyBinding{proxy: proxy, lastUsed: now}
+	return proxy
+}
+
+// healthyProxies 返回当前处于轮换中的代理
+func (p *Pool) healthyProxies() []*Proxy {
+	healthy := make([]*Proxy, 0, len(p.proxies))
+	for _, proxy := range p.proxies {
+		if proxy.IsHealthy() {
+			healthy = append(healthy, proxy)
+		}
+	}
+	return healthy
+}
+
+// find 按完整地址查找代理
+func (p *Pool) find(addr string) *Proxy {
+	for _, proxy := range p.proxies {
+		if proxy.String() == addr {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// ReportResult 记录一次经由代理的请求结果，连续失败的代理会被移出轮换
+func (p *Pool) ReportResult(addr string, success bool, latency time.Duration) {
+	proxy := p.find(addr)
+	if proxy == nil {
+		return
+	}
+
+	if success {
+		proxy.recordSuccess(latency)
+		return
+	}
+
+	if proxy.recordFailure(fmt.Errorf("请求失败"), p.options.MaxFailures) {
+		atomic.AddInt64(&p.evictCount, 1)
+		log.Warn("代理 %s 连续失败，已移出轮换", proxy.Redacted())
+	}
+}
+
+// healthCheckLoop 定期探测所有代理
+func (p *Pool) healthCheckLoop() {
+	p.CheckAll()
+
+	ticker := time.NewTicker(p.options.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.CheckAll()
+			p.cleanupSticky()
+		case <-p.stopCheck:
+			return
+		}
+	}
+}
+
+// CheckAll 并发探测所有代理（包括已移出轮换的代理，探测成功后会重新加入）
+func (p *Pool) CheckAll() {
+	var wg sync.WaitGroup
+	for _, proxy := range p.proxies {
+		wg.Add(1)
+		go func(proxy *Proxy) {
+			defer wg.Done()
+			p.check(proxy)
+		}(proxy)
+	}
+	wg.Wait()
+	atomic.AddInt64(&p.checkCount, 1)
+}
+
+// check 通过代理请求探测URL
+func (p *Pool) check(proxy *Proxy) {
+	transport := &http.Transport{
+		Proxy:             http.ProxyURL(proxy.URL()),
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   p.options.HealthCheckTimeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.options.HealthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.options.HealthCheckURL, nil)
+	if err != nil {
+		log.Error("创建代理探测请求失败: %v", err)
+		return
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("探测返回状态码 %d", resp.StatusCode)
+		}
+	}
+
+	proxy.mu.Lock()
+	proxy.lastCheck = time.Now()
+	proxy.mu.Unlock()
+
+	if err != nil {
+		wasHealthy := proxy.IsHealthy()
+		if proxy.recordFailure(err, p.options.MaxFailures) {
+			atomic.AddInt64(&p.evictCount, 1)
+			log.Warn("代理 %s 健康检查失败，已移出轮换: %v", proxy.Redacted(), err)
+		} else if wasHealthy {
+			log.Debug("代理 %s 健康检查失败: %v", proxy.Redacted(), err)
+		}
+		return
+	}
+
+	if !proxy.IsHealthy() {
+		log.Info("代理 %s 健康检查恢复，重新加入轮换", proxy.Redacted())
+	}
+	proxy.recordSuccess(latency)
+}
+
+// cleanupSticky 清理长期未使用的粘性绑定
+func (p *Pool) cleanupSticky() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for key, binding := range p.sticky {
+		if now.Sub(binding.lastUsed) > stickyBindingTTL {
+			delete(p.sticky, key)
+		}
+	}
+}
+
+// Stats 获取所有代理的统计快照
+func (p *Pool) Stats() []ProxyStats {
+	stats := make([]ProxyStats, 0, len(p.proxies))
+	for _, proxy := range p.proxies {
+		stats = append(stats, proxy.Stats())
+	}
+	return stats
+}
+
+// GetMetrics 获取代理池指标
+func (p *Pool) GetMetrics() map[string]interface{} {
+	p.mu.Lock()
+	stickyCount := len(p.sticky)
+	p.mu.Unlock()
+
+	return map[string]interface{}{
+		"enabled":         true,
+		"strategy":        string(p.options.Strategy),
+		"total":           len(p.proxies),
+		"healthy":         len(p.healthyProxies()),
+		"sticky_bindings": stickyCount,
+		"health_checks":   atomic.LoadInt64(&p.checkCount),
+		"evictions":       atomic.LoadInt64(&p.evictCount),
+		"proxies":         p.Stats(),
+	}
+}
+
+// Close 停止健康检查
+func (p *Pool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stopCheck)
+	})
+	return nil
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"scira2api/pkg/redact"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 代理相关错误
+var (
+	ErrNoProxies        = errors.New("代理池为空")
+	ErrNoHealthyProxy   = errors.New("没有可用的健康代理")
+	ErrInvalidProxyAddr = errors.New("无效的代理地址")
+)
+
+// 延迟的指数加权移动平均系数
+const latencyEWMAAlpha = 0.3
+
+// Proxy 代理池中的单个代理及其统计数据
+type Proxy struct {
+	url *url.URL
+	raw string
+
+	mu                  sync.RWMutex
+	healthy             bool
+	consecutiveFailures int
+	successCount        int64
+	failureCount        int64
+	lastLatency         time.Duration
+	avgLatency          time.Duration
+	lastCheck           time.Time
+	lastError           string
+}
+
+// ProxyStats 代理统计快照
+type ProxyStats struct {
+	Proxy               string  `json:"proxy"`
+	Healthy             bool    `json:"healthy"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	SuccessCount        int64   `json:"success_count"`
+	FailureCount        int64   `json:"failure_count"`
+	SuccessRate         float64 `json:"success_rate"`
+	LastLatencyMs       int64   `json:"last_latency_ms"`
+	AvgLatencyMs        int64   `json:"avg_latency_ms"`
+	LastCheck           string  `json:"last_check,omitempty"`
+	LastError           string  `json:"last_error,omitempty"`
+}
+
+// ParseProxy 解析代理地址
+// 支持 host:port、user:pass@host:port 以及带 http/https/socks5/socks5h 协议前缀的完整URL，
+// 未指定协议时默认使用HTTP代理
+func ParseProxy(addr string) (*Proxy, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return nil, fmt.Errorf("%w: 地址为空", ErrInvalidProxyAddr)
+	}
+
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	parsed, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyAddr, err)
+	}
+
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%w: 不支持的协议 %s", ErrInvalidProxyAddr, parsed.Scheme)
+	}
+
+	if parsed.Host == "" || parsed.Port() == "" {
+		return nil, fmt.Errorf("%w: 缺少主机或端口", ErrInvalidProxyAddr)
+	}
+
+	return &Proxy{
+		url:     parsed,
+		raw:     parsed.String(),
+		healthy: true,
+	}, nil
+}
+
+// LoadProxyFile 从文件加载代理列表，每行一个代理，忽略空行和 # 开头的注释
+func LoadProxyFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开代理文件失败: %w", err)
+	}
+	defer file.Close()
+
+	var proxies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		proxies = append(proxies, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取代理文件失败: %w", err)
+	}
+
+	return proxies, nil
+}
+
+// URL 返回代理的完整URL（包含凭据）
+func (p *Proxy) URL() *url.URL {
+	return p.url
+}
+
+// String 返回代理的完整地址（包含凭据）
+func (p *Proxy) String() string {
+	return p.raw
+}
+
+// Redacted 返回隐藏凭据后的代理地址，用于日志和指标
+// 用户名和密码都会隐藏，部分代理服务商把会话令牌放在用户名中
+func (p *Proxy) Redacted() string {
+	return redact.URL(p.raw)
+}
+
+// IsHealthy 检查代理是否健康
+func (p *Proxy) IsHealthy() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.healthy
+}
+
+// recordSuccess 记录一次成功
+func (p *Proxy) recordSuccess(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.successCount++
+	p.consecutiveFailures = 0
+	p.healthy = true
+	p.lastError = ""
+	p.recordLatencyLocked(latency)
+}
+
+// recordFailure 记录一次失败，连续失败达到阈值时将代理移出轮换，返回是否刚被移出
+func (p *Proxy) recordFailure(err error, maxFailures int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failureCount++
+	p.consecutiveFailures++
+	if err != nil {
+		p.lastError = err.Error()
+	}
+
+	if p.healthy && maxFailures > 0 && p.consecutiveFailures >= maxFailures {
+		p.healthy = false
+		return true
+	}
+	return false
+}
+
+// recordLatencyLocked 更新延迟统计（调用方需持有锁）
+func (p *Proxy) recordLatencyLocked(latency time.Duration) {
+	if latency <= 0 {
+		return
+	}
+	p.lastLatency = latency
+	if p.avgLatency == 0 {
+		p.avgLatency = latency
+		return
+	}
+	p.avgLatency = time.Duration(latencyEWMAAlpha*float64(latency) + (1-latencyEWMAAlpha)*float64(p.avgLatency))
+}
+
+// Stats 获取代理统计快照
+func (p *Proxy) Stats() ProxyStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stats := ProxyStats{
+		Proxy:               p.Redacted(),
+		Healthy:             p.healthy,
+		ConsecutiveFailures: p.consecutiveFailures,
+		SuccessCount:        p.successCount,
+		FailureCount:        p.failureCount,
+		LastLatencyMs:       p.lastLatency.Milliseconds(),
+		AvgLatencyMs:        p.avgLatency.Milliseconds(),
+		LastError:           p.lastError,
+	}
+	if total := p.successCount + p.failureCount; total > 0 {
+		stats.SuccessRate = float64(p.successCount) / float64(total) * 100
+	}
+	if !p.lastCheck.IsZero() {
+		stats.LastCheck = p.lastCheck.Format(time.RFC3339)
+	}
+	return stats
+}
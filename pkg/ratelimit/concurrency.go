@@ -0,0 +1,251 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrConcurrencyLimit 并发数已达上限
+var ErrConcurrencyLimit = errors.New("concurrency limit reached")
+
+// ConcurrencyOptions 并发限制配置
+type ConcurrencyOptions struct {
+	Limit   int           // 最大并发数，0 表示不限制
+	Queue   bool          // 达到上限时是否排队等待，否则立即拒绝
+	MaxWait time.Duration // 排队的最长等待时间
+}
+
+// Semaphore 先到先得的计数信号量，用于限制同时进行的上游请求数
+type Semaphore struct {
+	opts ConcurrencyOptions
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	waiters  *list.List // 元素为 chan struct{}，关闭表示获得名额
+
+	acquired int64
+	rejected int64
+	timeouts int64
+}
+
+// NewSemaphore 创建信号量
+func NewSemaphore(opts ConcurrencyOptions) *Semaphore {
+	return &Semaphore{opts: opts, waiters: list.New()}
+}
+
+// Acquire 获取一个名额；未达上限时立即返回，否则按配置排队或返回 ErrConcurrencyLimit
+// 成功后必须调用 Release 归还名额
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	s.mu.Lock()
+	if s.opts.Limit <= 0 || (s.inFlight < s.opts.Limit && s.waiters.Len() == 0) {
+		s.inFlight++
+		s.acquired++
+		if s.inFlight > s.peak {
+			s.peak = s.inFlight
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if !s.opts.Queue {
+		s.rejected++
+		s.mu.Unlock()
+		return ErrConcurrencyLimit
+	}
+
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if s.opts.MaxWait > 0 {
+		timer := time.NewTimer(s.opts.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		err = ErrConcurrencyLimit
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	select {
+	case <-ready:
+		// 放弃等待的同时获得了名额，直接交给下一个等待者
+		s.mu.Unlock()
+		s.Release()
+	default:
+		s.waiters.Remove(elem)
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	if err == ErrConcurrencyLimit {
+		s.timeouts++
+	}
+	s.rejected++
+	s.mu.Unlock()
+	return err
+}
+
+// Release 归还一个名额，有等待者时直接交给队首的等待者
+func (s *Semaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if front := s.waiters.Front(); front != nil {
+		s.waiters.Remove(front)
+		s.acquired++
+		close(front.Value.(chan struct{}))
+		return
+	}
+	if s.inFlight > 0 {
+		s.inFlight--
+	}
+}
+
+// InFlight 返回当前进行中的请求数
+func (s *Semaphore) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlight
+}
+
+// GetMetrics 获取指标
+func (s *Semaphore) GetMetrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return map[string]interface{}{
+		"limit":     s.opts.Limit,
+		"in_flight": s.inFlight,
+		"peak":      s.peak,
+		"waiting":   s.waiters.Len(),
+		"acquired":  s.acquired,
+		"rejected":  s.rejected,
+		"timeouts":  s.timeouts,
+	}
+}
+
+// KeyedSemaphore 按键（API密钥或上游身份）分别限制并发，没有请求引用的键会被立即删除
+type KeyedSemaphore struct {
+	name string
+	opts ConcurrencyOptions
+
+	mu      sync.Mutex
+	entries map[string]*keyedSemaphore
+	total   int // 所有键合计的当前值
+	peak    int // 所有键合计的峰值
+}
+
+// keyedSemaphore 单个键的信号量及引用计数（进行中和等待中的请求数）
+type keyedSemaphore struct {
+	sem  *Semaphore
+	refs int
+}
+
+// NewKeyedSemaphore 创建按键并发限制
+func NewKeyedSemaphore(name string, opts ConcurrencyOptions) *KeyedSemaphore {
+	return &KeyedSemaphore{name: name, opts: opts, entries: make(map[string]*keyedSemaphore)}
+}
+
+// Acquire 获取键的一个名额，成功后必须调用 Release
+func (k *KeyedSemaphore) Acquire(ctx context.Context, key string) error {
+	k.mu.Lock()
+	entry, ok := k.entries[key]
+	if !ok {
+		entry = &keyedSemaphore{sem: NewSemaphore(k.opts)}
+		k.entries[key] = entry
+	}
+	entry.refs++
+	k.mu.Unlock()
+
+	if err := entry.sem.Acquire(ctx); err != nil {
+		k.unref(key, entry)
+		return err
+	}
+
+	k.mu.Lock()
+	k.total++
+	if k.total > k.peak {
+		k.peak = k.total
+	}
+	k.mu.Unlock()
+	return nil
+}
+
+// Release 归还键的一个名额
+func (k *KeyedSemaphore) Release(key string) {
+	k.mu.Lock()
+	entry, ok := k.entries[key]
+	if ok && k.total > 0 {
+		k.total--
+	}
+	k.mu.Unlock()
+
+	if ok {
+		entry.sem.Release()
+		k.unref(key, entry)
+	}
+}
+
+// unref 减少键的引用计数，没有引用时删除
+func (k *KeyedSemaphore) unref(key string, entry *keyedSemaphore) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry.refs--
+	if entry.refs <= 0 && k.entries[key] == entry {
+		delete(k.entries, key)
+	}
+}
+
+// GetMetrics 获取指标，包括进行中请求最多的键
+func (k *KeyedSemaphore) GetMetrics() map[string]interface{} {
+	type keyStats struct {
+		Key      string `json:"key"`
+		InFlight int    `json:"in_flight"`
+		Peak     int    `json:"peak"`
+		Waiting  int    `json:"waiting"`
+	}
+
+	k.mu.Lock()
+	total, peak := k.total, k.peak
+	stats := make([]keyStats, 0, len(k.entries))
+	for key, entry := range k.entries {
+		entry.sem.mu.Lock()
+		stats = append(stats, keyStats{Key: key, InFlight: entry.sem.inFlight, Peak: entry.sem.peak, Waiting: entry.sem.waiters.Len()})
+		entry.sem.mu.Unlock()
+	}
+	k.mu.Unlock()
+
+	activeKeys := len(stats)
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].InFlight != stats[j].InFlight {
+			return stats[i].InFlight > stats[j].InFlight
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if len(stats) > 10 {
+		stats = stats[:10]
+	}
+
+	return map[string]interface{}{
+		"dimension":     k.name,
+		"limit":         k.opts.Limit,
+		"in_flight":     total,
+		"peak":          peak,
+		"active_keys":   activeKeys,
+		"top_in_flight": stats,
+	}
+}
@@ -0,0 +1,243 @@
+package ratelimit
+
+import (
+	"scira2api/log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit 令牌桶参数
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// IsZero 检查是否未设置限制
+func (l Limit) IsZero() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// ConsumerStats 单个限流对象的统计
+type ConsumerStats struct {
+	Key      string  `json:"key"`
+	Requests int64   `json:"requests"`
+	Rejected int64   `json:"rejected"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+	LastSeen string  `json:"last_seen"`
+}
+
+// keyedEntry 单个键的令牌桶及统计
+type keyedEntry struct {
+	limiter  *TokenBucketLimiter
+	requests int64
+	rejected int64
+	lastSeen int64 // UnixNano，原子读写
+}
+
+// KeyedLimiter 按键（API密钥、客户端IP或模型）分别限流，每个键一个令牌桶
+// 长时间未使用的令牌桶会被清理
+type KeyedLimiter struct {
+	name    string
+	entries map[string]*keyedEntry
+	mu      sync.RWMutex
+	idleTTL time.Duration
+	store   *RedisStore // 共享存储，为nil时只使用本地令牌桶
+
+	stopCleanup chan struct{}
+	closeOnce   sync.Once
+	evictions   int64
+}
+
+// NewKeyedLimiter 创建按键限流器，idleTTL 为令牌桶的空闲过期时间
+func NewKeyedLimiter(name string, idleTTL time.Duration) *KeyedLimiter {
+	if idleTTL <= 0 {
+		idleTTL = 10 * time.Minute
+	}
+
+	l := &KeyedLimiter{
+		name:        name,
+		entries:     make(map[string]*keyedEntry),
+		idleTTL:     idleTTL,
+		stopCleanup: make(chan struct{}),
+	}
+	go l.cleanupLoop()
+	return l
+}
+
+// SetStore 使用共享存储中的令牌桶，使多个副本共享同一限制；存储不可用时回退到本地令牌桶
+func (l *KeyedLimiter) SetStore(store *RedisStore) {
+	l.store = store
+}
+
+// Allow 判断键是否允许请求，令牌桶不存在时按 limit 创建，limit 变化时更新已有令牌桶
+// 拒绝时同时返回距离下一个令牌可用的时间；fallback 表示令牌由本地令牌桶授予（未配置或无法使用共享存储），归还时需要传回
+func (l *KeyedLimiter) Allow(key string, limit Limit) (ok bool, retryAfter time.Duration, fallback bool) {
+	if limit.IsZero() {
+		return true, 0, true
+	}
+
+	entry := l.entry(key, limit)
+	atomic.AddInt64(&entry.requests, 1)
+	atomic.StoreInt64(&entry.lastSeen, time.Now().UnixNano())
+
+	if l.store != nil {
+		result, err := l.store.tokenBucket(l.storeKey(key), limit.Rate, limit.Burst, 0, 1)
+		if err == nil {
+			if !result.allowed {
+				atomic.AddInt64(&entry.rejected, 1)
+				return false, result.delay, false
+			}
+			return true, 0, false
+		}
+		l.store.fallback()
+	}
+
+	if r := entry.limiter.Reserve(0); !r.OK {
+		atomic.AddInt64(&entry.rejected, 1)
+		return false, r.Delay, true
+	}
+	return true, 0, true
+}
+
+// Refund 归还键的一个令牌到授予它的令牌桶，fallback 为 Allow 返回的值
+// 共享存储出错时放弃归还，令牌随时间补充；不改为归还本地令牌桶，避免凭空多出一个本地令牌
+func (l *KeyedLimiter) Refund(key string, fallback bool) {
+	l.mu.RLock()
+	entry, ok := l.entries[key]
+	l.mu.RUnlock()
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&entry.requests, -1)
+
+	if fallback || l.store == nil {
+		entry.limiter.Refund()
+		return
+	}
+	rate, burst := entry.limiter.Limit()
+	if _, err := l.store.tokenBucket(l.storeKey(key), rate, burst, 0, -1); err != nil {
+		log.Warn("归还共享令牌失败，等待令牌随时间补充: %s: %v", l.storeKey(key), err)
+	}
+}
+
+// storeKey 返回键在共享存储中的名称
+func (l *KeyedLimiter) storeKey(key string) string {
+	return "bucket:" + l.name + ":" + key
+}
+
+// entry 获取或创建键的令牌桶
+func (l *KeyedLimiter) entry(key string, limit Limit) *keyedEntry {
+	l.mu.RLock()
+	entry, ok := l.entries[key]
+	l.mu.RUnlock()
+
+	if !ok {
+		l.mu.Lock()
+		if entry, ok = l.entries[key]; !ok {
+			entry = &keyedEntry{limiter: NewTokenBucketLimiter(limit.Rate, limit.Burst)}
+			l.entries[key] = entry
+		}
+		l.mu.Unlock()
+	}
+
+	if rate, burst := entry.limiter.Limit(); rate != limit.Rate || burst != limit.Burst {
+		entry.limiter.SetLimit(limit.Rate, limit.Burst)
+	}
+	return entry
+}
+
+// cleanupLoop 定期清理空闲令牌桶
+func (l *KeyedLimiter) cleanupLoop() {
+	interval := l.idleTTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.evictIdle()
+		case <-l.stopCleanup:
+			return
+		}
+	}
+}
+
+// evictIdle 删除空闲超过TTL的令牌桶
+func (l *KeyedLimiter) evictIdle() {
+	cutoff := time.Now().Add(-l.idleTTL).UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, entry := range l.entries {
+		if atomic.LoadInt64(&entry.lastSeen) < cutoff {
+			delete(l.entries, key)
+			l.evictions++
+		}
+	}
+}
+
+// TopConsumers 返回请求数最多的前 n 个键
+func (l *KeyedLimiter) TopConsumers(n int) []ConsumerStats {
+	l.mu.RLock()
+	stats := make([]ConsumerStats, 0, len(l.entries))
+	for key, entry := range l.entries {
+		rate, burst := entry.limiter.Limit()
+		stats = append(stats, ConsumerStats{
+			Key:      key,
+			Requests: atomic.LoadInt64(&entry.requests),
+			Rejected: atomic.LoadInt64(&entry.rejected),
+			Rate:     rate,
+			Burst:    burst,
+			LastSeen: time.Unix(0, atomic.LoadInt64(&entry.lastSeen)).Format(time.RFC3339),
+		})
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// GetMetrics 获取指标
+func (l *KeyedLimiter) GetMetrics() map[string]interface{} {
+	l.mu.RLock()
+	buckets := len(l.entries)
+	evictions := l.evictions
+	l.mu.RUnlock()
+
+	return map[string]interface{}{
+		"enabled":       true,
+		"dimension":     l.name,
+		"buckets":       buckets,
+		"evictions":     evictions,
+		"idle_ttl":      l.idleTTL.String(),
+		"shared":        l.store != nil,
+		"top_consumers": l.TopConsumers(10),
+	}
+}
+
+// Close 停止后台清理
+func (l *KeyedLimiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.stopCleanup)
+	})
+	return nil
+}
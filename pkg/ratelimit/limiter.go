@@ -2,6 +2,7 @@ package ratelimit
 
 import (
 	"context"
+	"fmt"
 	"scira2api/log"
 	"sync"
 	"sync/atomic"
@@ -16,10 +17,72 @@ type RateLimiter interface {
 	// Wait 阻塞直到允许请求或上下文取消
 	Wait(ctx context.Context) error
 	
+	// Reserve 预留一个令牌并返回需要等待的时间，不阻塞
+	// 需要等待的时间超过 maxWait 时不消耗令牌，返回的预留 OK 为 false
+	Reserve(maxWait time.Duration) *Reservation
+	
+	// Status 返回当前配额状态，不消耗令牌
+	Status() Status
+	
 	// GetMetrics 获取指标
 	GetMetrics() map[string]interface{}
 }
 
+// maxDuration 表示无限等待
+const maxDuration time.Duration = 1<<63 - 1
+
+// Status 限流器的配额状态，对应 x-ratelimit-*-requests 响应头
+type Status struct {
+	Enabled   bool          // 限流器是否启用，未启用时其余字段无意义
+	Limit     int           // 桶容量
+	Remaining int           // 剩余的完整令牌数
+	Reset     time.Duration // 令牌桶回满所需时间
+}
+
+// Reservation 令牌预留结果
+type Reservation struct {
+	OK    bool          // 是否预留成功
+	Delay time.Duration // 令牌可用前需要等待的时间；预留失败时为距离下一个令牌可用的时间
+	Status              // 预留后的配额状态
+
+	limiter  refunder
+	consumed bool
+	fallback bool // 令牌由共享限流器回退的本地令牌桶授予
+	once     sync.Once
+}
+
+// Cancel 撤销预留并归还令牌，用于等待被取消或后续层级拒绝请求的情况
+func (r *Reservation) Cancel() {
+	if r == nil || !r.consumed {
+		return
+	}
+	r.once.Do(func() {
+		r.limiter.refund(r.fallback)
+	})
+}
+
+// refunder 归还令牌到授予它的令牌桶，fallback 表示令牌由共享限流器回退的本地令牌桶授予
+type refunder interface {
+	refund(fallback bool)
+}
+
+// bucket 等待队列使用的令牌桶操作，本地令牌桶和 Redis 令牌桶都实现了该接口
+type bucket interface {
+	refunder
+	take() (ok bool, delay time.Duration, fallback bool)
+	countAllowed()
+	countRejected()
+	Status() Status
+	Limit() (float64, int)
+}
+
+// Toggleable 可在运行时启用或禁用的组件（可选接口）
+type Toggleable interface {
+	Enable()
+	Disable()
+	IsEnabled() bool
+}
+
 // TokenBucketLimiter 令牌桶限制器
 type TokenBucketLimiter struct {
 	rate           float64       // 每秒生成的令牌数
@@ -46,47 +109,195 @@ func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
 
 // Allow 判断是否允许当前请求
 func (l *TokenBucketLimiter) Allow() bool {
+	return l.Reserve(0).OK
+}
+
+// Reserve 预留一个令牌，令牌不足时计算需要等待的时间而不是轮询
+// 等待中的预留会让令牌数变为负数，后来的请求需要等待更久，从而保证先到先得
+func (l *TokenBucketLimiter) Reserve(maxWait time.Duration) *Reservation {
 	atomic.AddInt64(&l.requestCount, 1)
 	
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	
 	if !l.enabled {
 		atomic.AddInt64(&l.allowedCount, 1)
-		return true
+		return &Reservation{OK: true}
 	}
 	
+	l.advance(time.Now())
+	
+	// 计算令牌可用前需要等待的时间
+	var delay time.Duration
+	if l.tokens < 1 {
+		if l.rate <= 0 {
+			delay = maxDuration
+		} else {
+			delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		}
+	}
+	
+	r := &Reservation{limiter: l, Delay: delay}
+	if delay > maxWait {
+		atomic.AddInt64(&l.rejectedCount, 1)
+		r.Status = l.statusLocked()
+		return r
+	}
+	
+	// 消耗一个令牌
+	l.tokens--
+	atomic.AddInt64(&l.allowedCount, 1)
+	r.OK = true
+	r.consumed = true
+	r.Status = l.statusLocked()
+	return r
+}
+
+// take 立即消耗一个令牌，令牌不足时返回下一个令牌可用前的等待时间；不更新统计，供等待队列使用
+func (l *TokenBucketLimiter) take() (bool, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	
+	if !l.enabled {
+		return true, 0, false
+	}
+	
+	l.advance(time.Now())
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0, false
+	}
+	if l.rate <= 0 {
+		return false, maxDuration, false
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), false
+}
+
+// countAllowed 记录一次允许的请求
+func (l *TokenBucketLimiter) countAllowed() {
+	atomic.AddInt64(&l.requestCount, 1)
+	atomic.AddInt64(&l.allowedCount, 1)
+}
+
+// countRejected 记录一次拒绝的请求
+func (l *TokenBucketLimiter) countRejected() {
+	atomic.AddInt64(&l.requestCount, 1)
+	atomic.AddInt64(&l.rejectedCount, 1)
+}
+
+// Status 返回当前配额状态
+func (l *TokenBucketLimiter) Status() Status {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	
-	now := time.Now()
+	if !l.enabled {
+		return Status{}
+	}
+	l.advance(time.Now())
+	return l.statusLocked()
+}
+
+// advance 按经过的时间添加新令牌（最多不超过桶容量），调用方需持有锁
+func (l *TokenBucketLimiter) advance(now time.Time) {
 	elapsed := now.Sub(l.lastTime).Seconds()
 	l.lastTime = now
-	
-	// 添加新令牌（最多不超过桶容量）
 	l.tokens = min(float64(l.burst), l.tokens+elapsed*l.rate)
+}
+
+// statusLocked 计算当前配额状态，调用方需持有锁
+func (l *TokenBucketLimiter) statusLocked() Status {
+	status := Status{Enabled: true, Limit: l.burst}
+	if l.tokens >= 1 {
+		status.Remaining = int(l.tokens)
+	}
+	if missing := float64(l.burst) - l.tokens; missing > 0 {
+		if l.rate > 0 {
+			status.Reset = time.Duration(missing / l.rate * float64(time.Second))
+		} else {
+			status.Reset = maxDuration
+		}
+	}
+	return status
+}
+
+// Refund 归还一个令牌，用于分层限流中后续层级拒绝请求时撤销已消耗的令牌
+func (l *TokenBucketLimiter) Refund() {
+	if !l.restore() {
+		return
+	}
+	atomic.AddInt64(&l.allowedCount, -1)
+	atomic.AddInt64(&l.requestCount, -1)
+}
+
+// refund 归还预留的令牌，本地令牌桶只有一个后端，忽略 fallback
+func (l *TokenBucketLimiter) refund(bool) {
+	l.Refund()
+}
+
+// restore 把一个令牌放回桶中，不更新统计；限制器未启用时返回 false
+func (l *TokenBucketLimiter) restore() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	
-	if l.tokens < 1 {
-		atomic.AddInt64(&l.rejectedCount, 1)
+	if !l.enabled {
 		return false
 	}
-	
-	// 消耗一个令牌
-	l.tokens--
-	atomic.AddInt64(&l.allowedCount, 1)
+	l.tokens = min(float64(l.burst), l.tokens+1)
 	return true
 }
 
+// SetLimit 修改速率和桶容量，已有令牌不超过新容量
+func (l *TokenBucketLimiter) SetLimit(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	
+	l.rate = rate
+	l.burst = burst
+	l.tokens = min(float64(burst), l.tokens)
+}
+
+// Limit 返回当前速率和桶容量
+func (l *TokenBucketLimiter) Limit() (float64, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.burst
+}
+
 // Wait 阻塞直到允许请求或上下文取消
+// 通过预留计算等待时间，上下文的截止时间早于令牌可用时间时立即返回错误
 func (l *TokenBucketLimiter) Wait(ctx context.Context) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			if l.Allow() {
-				return nil
-			}
-			// 指数退避，避免频繁检查
-			time.Sleep(10 * time.Millisecond)
-		}
+	return waitReserve(ctx, l)
+}
+
+// waitReserve 按上下文截止时间预留令牌并等待
+func waitReserve(ctx context.Context, l RateLimiter) error {
+	maxWait := maxDuration
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = time.Until(deadline)
+	}
+	
+	r := l.Reserve(maxWait)
+	if !r.OK {
+		return fmt.Errorf("rate limit: wait %s exceeds context deadline", r.Delay)
+	}
+	return r.WaitContext(ctx)
+}
+
+// WaitContext 等待预留的令牌可用，上下文取消时撤销预留
+func (r *Reservation) WaitContext(ctx context.Context) error {
+	if r.Delay <= 0 {
+		return nil
+	}
+	
+	timer := time.NewTimer(r.Delay)
+	defer timer.Stop()
+	
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
 	}
 }
 
@@ -117,6 +328,7 @@ func (l *TokenBucketLimiter) IsEnabled() bool {
 func (l *TokenBucketLimiter) GetMetrics() map[string]interface{} {
 	l.mu.Lock()
 	availableTokens := l.tokens
+	rate, burst := l.rate, l.burst
 	l.mu.Unlock()
 	
 	requestCount := atomic.LoadInt64(&l.requestCount)
@@ -125,8 +337,8 @@ func (l *TokenBucketLimiter) GetMetrics() map[string]interface{} {
 	
 	return map[string]interface{}{
 		"enabled":          l.IsEnabled(),
-		"rate":             l.rate,
-		"burst":            l.burst,
+		"rate":             rate,
+		"burst":            burst,
 		"available_tokens": availableTokens,
 		"request_count":    requestCount,
 		"allowed_count":    allowedCount,
@@ -0,0 +1,312 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull 等待队列已满
+	ErrQueueFull = errors.New("rate limit wait queue is full")
+	// ErrQueueTimeout 排队超过最长等待时间
+	ErrQueueTimeout = errors.New("rate limit wait timed out")
+)
+
+// waitSampleSize 用于计算等待时间百分位的样本数
+const waitSampleSize = 1024
+
+// QueueOptions 等待队列配置
+type QueueOptions struct {
+	MaxDepth int           // 最大排队请求数，超出时立即拒绝
+	MaxWait  time.Duration // 单个请求的最长排队时间
+}
+
+// waiter 排队中的请求
+type waiter struct {
+	priority int
+	ready    chan struct{}
+	granted  bool
+	fallback bool // 令牌由共享限流器回退的本地令牌桶授予
+	elem     *list.Element
+}
+
+// WaitQueue 令牌桶前的公平等待队列
+// 令牌不足时请求按优先级（数值越大越优先）和到达顺序排队，由定时器在下一个令牌可用时依次唤醒，
+// 避免轮询等待中后到的请求抢走令牌
+// 获取令牌时不持有 mu，共享令牌桶的 Redis 往返不会阻塞入队、出队和指标读取
+type WaitQueue struct {
+	limiter bucket
+	opts    QueueOptions
+
+	mu          sync.Mutex
+	waiters     *list.List
+	timer       *time.Timer
+	dispatching bool // 调度循环正在运行或定时器已设置，保证同一时间只有一个调度者
+	closed      bool
+
+	peakLength int
+	samples    []time.Duration
+	sampleNext int
+
+	immediate int64
+	queued    int64
+	granted   int64
+	full      int64
+	timeouts  int64
+	canceled  int64
+}
+
+// NewWaitQueue 创建等待队列，limiter 为本地令牌桶（*TokenBucketLimiter）或共享令牌桶（*RedisLimiter）
+func NewWaitQueue(limiter bucket, opts QueueOptions) *WaitQueue {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = 100
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = 30 * time.Second
+	}
+	return &WaitQueue{
+		limiter: limiter,
+		opts:    opts,
+		waiters: list.New(),
+		samples: make([]time.Duration, 0, waitSampleSize),
+	}
+}
+
+// Acquire 获取一个令牌，令牌不足时排队等待
+// 队列已满时返回 ErrQueueFull，超过最长等待时间返回 ErrQueueTimeout，上下文取消时返回上下文错误
+func (q *WaitQueue) Acquire(ctx context.Context, priority int) (*Reservation, error) {
+	start := time.Now()
+
+	q.mu.Lock()
+	closed, empty := q.closed, q.waiters.Len() == 0
+	q.mu.Unlock()
+	if closed {
+		return nil, ErrQueueFull
+	}
+
+	// 没有排队的请求时直接尝试获取令牌
+	if empty {
+		if ok, _, fallback := q.limiter.take(); ok {
+			atomic.AddInt64(&q.immediate, 1)
+			return q.grant(fallback), nil
+		}
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	if q.waiters.Len() >= q.opts.MaxDepth {
+		q.mu.Unlock()
+		atomic.AddInt64(&q.full, 1)
+		q.limiter.countRejected()
+		return nil, ErrQueueFull
+	}
+
+	w := &waiter{priority: priority, ready: make(chan struct{})}
+	startDispatch := q.enqueueLocked(w)
+	q.mu.Unlock()
+	atomic.AddInt64(&q.queued, 1)
+	if startDispatch {
+		q.dispatch()
+	}
+
+	timer := time.NewTimer(q.opts.MaxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		q.recordWait(time.Since(start))
+		return q.grant(w.fallback), nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+		atomic.AddInt64(&q.timeouts, 1)
+	case <-ctx.Done():
+		err = ctx.Err()
+		atomic.AddInt64(&q.canceled, 1)
+	}
+
+	q.mu.Lock()
+	if w.granted {
+		// 超时与唤醒同时发生，归还已经分配的令牌
+		q.mu.Unlock()
+		q.refund(w.fallback)
+	} else {
+		q.waiters.Remove(w.elem)
+		q.mu.Unlock()
+	}
+	q.limiter.countRejected()
+	return nil, err
+}
+
+// enqueueLocked 按优先级插入等待者，同优先级保持先到先得，调用方需持有锁
+// 没有调度者时返回 true，调用方需在释放锁后调用 dispatch
+func (q *WaitQueue) enqueueLocked(w *waiter) bool {
+	e := q.waiters.Back()
+	for e != nil && e.Value.(*waiter).priority < w.priority {
+		e = e.Prev()
+	}
+	if e == nil {
+		w.elem = q.waiters.PushFront(w)
+	} else {
+		w.elem = q.waiters.InsertAfter(w, e)
+	}
+
+	if n := q.waiters.Len(); n > q.peakLength {
+		q.peakLength = n
+	}
+	if q.dispatching {
+		return false
+	}
+	q.dispatching = true
+	return true
+}
+
+// dispatch 按顺序把可用令牌分配给队首的等待者，令牌不足时在下一个令牌可用时再次调度
+// 由入队的请求或定时器调用，获取令牌时释放锁，拿到令牌后再重新加锁唤醒当时的队首
+func (q *WaitQueue) dispatch() {
+	for {
+		q.mu.Lock()
+		q.timer = nil
+		if q.waiters.Len() == 0 || q.closed {
+			q.dispatching = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		ok, delay, fallback := q.limiter.take()
+
+		q.mu.Lock()
+		if q.closed {
+			q.dispatching = false
+			q.mu.Unlock()
+			if ok {
+				q.refund(fallback)
+			}
+			return
+		}
+		if !ok {
+			q.timer = time.AfterFunc(delay, q.dispatch)
+			q.mu.Unlock()
+			return
+		}
+		front := q.waiters.Front()
+		if front == nil {
+			// 获取令牌期间等待者都已超时或取消，归还令牌
+			q.dispatching = false
+			q.mu.Unlock()
+			q.refund(fallback)
+			return
+		}
+		w := q.waiters.Remove(front).(*waiter)
+		w.granted = true
+		w.fallback = fallback
+		close(w.ready)
+		q.mu.Unlock()
+	}
+}
+
+// refund 归还调度时取得但没有分配出去的令牌
+// take 不更新统计而 refund 会撤销一次允许的请求，先补记一次允许使两者抵消
+func (q *WaitQueue) refund(fallback bool) {
+	q.limiter.countAllowed()
+	q.limiter.refund(fallback)
+}
+
+// grant 记录一次成功获取令牌并返回对应的预留
+func (q *WaitQueue) grant(fallback bool) *Reservation {
+	atomic.AddInt64(&q.granted, 1)
+	q.limiter.countAllowed()
+	return &Reservation{OK: true, Status: q.limiter.Status(), limiter: q.limiter, consumed: true, fallback: fallback}
+}
+
+// recordWait 记录排队时间样本
+func (q *WaitQueue) recordWait(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.samples) < waitSampleSize {
+		q.samples = append(q.samples, d)
+	} else {
+		q.samples[q.sampleNext] = d
+	}
+	q.sampleNext = (q.sampleNext + 1) % waitSampleSize
+}
+
+// Len 返回当前排队的请求数
+func (q *WaitQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
+
+// EstimatedWait 估算新请求需要等待的时间，用于 Retry-After
+func (q *WaitQueue) EstimatedWait() time.Duration {
+	rate, _ := q.limiter.Limit()
+	if rate <= 0 {
+		return q.opts.MaxWait
+	}
+	return time.Duration(float64(q.Len()+1) / rate * float64(time.Second))
+}
+
+// GetMetrics 获取指标，包括队列长度和排队时间百分位
+func (q *WaitQueue) GetMetrics() map[string]interface{} {
+	q.mu.Lock()
+	length := q.waiters.Len()
+	peak := q.peakLength
+	samples := append([]time.Duration(nil), q.samples...)
+	q.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	return map[string]interface{}{
+		"length":        length,
+		"peak_length":   peak,
+		"max_depth":     q.opts.MaxDepth,
+		"max_wait":      q.opts.MaxWait.String(),
+		"immediate":     atomic.LoadInt64(&q.immediate),
+		"queued":        atomic.LoadInt64(&q.queued),
+		"granted":       atomic.LoadInt64(&q.granted),
+		"rejected_full": atomic.LoadInt64(&q.full),
+		"timeouts":      atomic.LoadInt64(&q.timeouts),
+		"canceled":      atomic.LoadInt64(&q.canceled),
+		"wait_p50_ms":   percentileMillis(samples, 0.50),
+		"wait_p90_ms":   percentileMillis(samples, 0.90),
+		"wait_p99_ms":   percentileMillis(samples, 0.99),
+		"wait_max_ms":   percentileMillis(samples, 1),
+	}
+}
+
+// Close 停止调度，仍在排队的请求会在超时或上下文取消后返回
+func (q *WaitQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	return nil
+}
+
+// percentileMillis 计算已排序样本的百分位（毫秒）
+func percentileMillis(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return float64(sorted[idx]) / float64(time.Millisecond)
+}
@@ -0,0 +1,309 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBucket 由测试手动补充令牌的令牌桶，令牌不足时让等待队列每 5ms 重试一次
+// fallback 为 true 时模拟共享存储不可用，令牌由本地令牌桶授予
+type fakeBucket struct {
+	mu        sync.Mutex
+	tokens    int
+	allowed   int
+	rejected  int
+	fallback  bool
+	refunds   int // 归还到共享令牌桶的次数
+	fallbacks int // 归还到本地令牌桶的次数
+}
+
+func (b *fakeBucket) take() (bool, time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens > 0 {
+		b.tokens--
+		return true, 0, b.fallback
+	}
+	return false, 5 * time.Millisecond, b.fallback
+}
+
+func (b *fakeBucket) countAllowed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.allowed++
+}
+
+func (b *fakeBucket) countRejected() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rejected++
+}
+
+func (b *fakeBucket) refund(fallback bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+	b.allowed--
+	if fallback {
+		b.fallbacks++
+	} else {
+		b.refunds++
+	}
+}
+
+func (b *fakeBucket) Status() Status        { return Status{} }
+func (b *fakeBucket) Limit() (float64, int) { return 0, 0 }
+
+func (b *fakeBucket) add(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += n
+}
+
+func (b *fakeBucket) counts() (tokens, allowed, rejected int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens, b.allowed, b.rejected
+}
+
+// acquireResult 排队请求的结果
+type acquireResult struct {
+	id  string
+	err error
+}
+
+// enqueue 在后台发起一个排队请求，并等待它进入队列，保证到达顺序确定
+func enqueue(t *testing.T, q *WaitQueue, id string, priority int, results chan<- acquireResult) {
+	t.Helper()
+	want := q.Len() + 1
+	go func() {
+		_, err := q.Acquire(context.Background(), priority)
+		results <- acquireResult{id: id, err: err}
+	}()
+	waitFor(t, func() bool { return q.Len() == want })
+}
+
+// waitFor 轮询等待条件成立
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receive 等待下一个排队结果
+func receive(t *testing.T, results <-chan acquireResult) acquireResult {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("no waiter finished within 1s")
+		return acquireResult{}
+	}
+}
+
+// grantOrder 逐个补充令牌，返回等待者获得令牌的顺序
+func grantOrder(t *testing.T, b *fakeBucket, results <-chan acquireResult, n int) []string {
+	t.Helper()
+	order := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b.add(1)
+		r := receive(t, results)
+		if r.err != nil {
+			t.Fatalf("waiter %s: %v", r.id, r.err)
+		}
+		order = append(order, r.id)
+	}
+	return order
+}
+
+func assertOrder(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWaitQueueImmediate(t *testing.T) {
+	b := &fakeBucket{tokens: 1}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: time.Second})
+	defer q.Close()
+
+	r, err := q.Acquire(context.Background(), 0)
+	if err != nil || !r.OK {
+		t.Fatalf("Acquire: ok=%v err=%v", r != nil && r.OK, err)
+	}
+	if metrics := q.GetMetrics(); metrics["immediate"] != int64(1) || metrics["queued"] != int64(0) {
+		t.Fatalf("unexpected metrics: %v", metrics)
+	}
+
+	// 取消预留归还令牌
+	r.Cancel()
+	if tokens, allowed, _ := b.counts(); tokens != 1 || allowed != 0 {
+		t.Fatalf("after cancel: tokens=%d allowed=%d, want 1 and 0", tokens, allowed)
+	}
+}
+
+func TestWaitQueueFIFO(t *testing.T) {
+	b := &fakeBucket{}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: time.Second})
+	defer q.Close()
+
+	results := make(chan acquireResult, 3)
+	for _, id := range []string{"a", "b", "c"} {
+		enqueue(t, q, id, 0, results)
+	}
+
+	assertOrder(t, grantOrder(t, b, results, 3), "a", "b", "c")
+	if _, allowed, _ := b.counts(); allowed != 3 {
+		t.Fatalf("allowed = %d, want 3", allowed)
+	}
+}
+
+func TestWaitQueuePriority(t *testing.T) {
+	b := &fakeBucket{}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: time.Second})
+	defer q.Close()
+
+	// 优先级高的插到前面，同优先级保持到达顺序
+	results := make(chan acquireResult, 5)
+	enqueue(t, q, "a", 0, results)
+	enqueue(t, q, "b", 0, results)
+	enqueue(t, q, "c", 5, results)
+	enqueue(t, q, "d", 1, results)
+	enqueue(t, q, "e", 5, results)
+
+	assertOrder(t, grantOrder(t, b, results, 5), "c", "e", "d", "a", "b")
+}
+
+func TestWaitQueueMaxDepth(t *testing.T) {
+	b := &fakeBucket{}
+	q := NewWaitQueue(b, QueueOptions{MaxDepth: 2, MaxWait: time.Second})
+	defer q.Close()
+
+	results := make(chan acquireResult, 2)
+	enqueue(t, q, "a", 0, results)
+	enqueue(t, q, "b", 0, results)
+
+	// 队列已满时立即拒绝，高优先级也不例外
+	if _, err := q.Acquire(context.Background(), 10); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("err = %v, want ErrQueueFull", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", q.Len())
+	}
+	if metrics := q.GetMetrics(); metrics["rejected_full"] != int64(1) || metrics["peak_length"] != 2 {
+		t.Fatalf("unexpected metrics: %v", metrics)
+	}
+	if _, _, rejected := b.counts(); rejected != 1 {
+		t.Fatalf("rejected = %d, want 1", rejected)
+	}
+
+	assertOrder(t, grantOrder(t, b, results, 2), "a", "b")
+}
+
+func TestWaitQueueMaxWait(t *testing.T) {
+	b := &fakeBucket{}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: 20 * time.Millisecond})
+	defer q.Close()
+
+	start := time.Now()
+	if _, err := q.Acquire(context.Background(), 0); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("err = %v, want ErrQueueTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("returned after %v, before MaxWait", elapsed)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("Len = %d, want 0 after timeout", q.Len())
+	}
+	if metrics := q.GetMetrics(); metrics["timeouts"] != int64(1) {
+		t.Fatalf("unexpected metrics: %v", metrics)
+	}
+
+	// 超时的请求不占用之后补充的令牌
+	b.add(1)
+	time.Sleep(20 * time.Millisecond)
+	if tokens, allowed, rejected := b.counts(); tokens != 1 || allowed != 0 || rejected != 1 {
+		t.Fatalf("tokens=%d allowed=%d rejected=%d, want 1, 0 and 1", tokens, allowed, rejected)
+	}
+}
+
+func TestWaitQueueContextCanceled(t *testing.T) {
+	b := &fakeBucket{}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: time.Second})
+	defer q.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if metrics := q.GetMetrics(); metrics["canceled"] != int64(1) || metrics["length"] != 0 {
+		t.Fatalf("unexpected metrics: %v", metrics)
+	}
+}
+
+func TestWaitQueueClose(t *testing.T) {
+	b := &fakeBucket{}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: 50 * time.Millisecond})
+
+	results := make(chan acquireResult, 1)
+	enqueue(t, q, "a", 0, results)
+	q.Close()
+
+	// 关闭后不再分配令牌，排队中的请求等到超时返回
+	b.add(1)
+	if r := receive(t, results); !errors.Is(r.err, ErrQueueTimeout) {
+		t.Fatalf("queued waiter err = %v, want ErrQueueTimeout", r.err)
+	}
+	if tokens, _, _ := b.counts(); tokens != 1 {
+		t.Fatalf("tokens = %d, want 1: closed queue must not consume tokens", tokens)
+	}
+
+	// 关闭后的新请求立即拒绝
+	if _, err := q.Acquire(context.Background(), 0); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("err = %v, want ErrQueueFull after close", err)
+	}
+}
+
+func TestWaitQueueRefundsGrantingBackend(t *testing.T) {
+	b := &fakeBucket{tokens: 1, fallback: true}
+	q := NewWaitQueue(b, QueueOptions{MaxWait: time.Second})
+	defer q.Close()
+
+	// 回退时授予的令牌归还到本地令牌桶
+	r, err := q.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Cancel()
+
+	// 共享令牌桶授予的令牌归还到共享令牌桶
+	b.mu.Lock()
+	b.fallback = false
+	b.mu.Unlock()
+	if r, err = q.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	r.Cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fallbacks != 1 || b.refunds != 1 || b.allowed != 0 {
+		t.Fatalf("fallbacks=%d refunds=%d allowed=%d, want 1, 1 and 0", b.fallbacks, b.refunds, b.allowed)
+	}
+}
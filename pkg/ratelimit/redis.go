@@ -0,0 +1,463 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"scira2api/log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrStoreUnavailable 共享存储暂时不可用，调用方应使用本地限流
+var ErrStoreUnavailable = errors.New("rate limit store unavailable")
+
+// storeRetryInterval 共享存储出错后多久再次尝试
+const storeRetryInterval = 5 * time.Second
+
+// tokenBucketScript 原子地更新令牌桶并返回结果
+// KEYS[1] 令牌桶；ARGV: 速率(每秒)、容量、最长等待(毫秒)、消耗的令牌数（0 只查询状态，负数为归还）
+// 返回 {是否允许, 等待毫秒(-1 表示永远不可用), 剩余令牌数, 回满毫秒}
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local max_wait = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+  tokens = burst
+  ts = now
+end
+if now > ts then
+  tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+end
+
+local allowed = 0
+local delay = 0
+if cost > 0 then
+  if tokens < cost then
+    if rate <= 0 then
+      delay = -1
+    else
+      delay = math.ceil((cost - tokens) / rate * 1000)
+    end
+  end
+  if delay >= 0 and delay <= max_wait then
+    tokens = tokens - cost
+    allowed = 1
+  end
+elseif cost < 0 then
+  tokens = math.min(burst, tokens - cost)
+  allowed = 1
+end
+
+local reset = 0
+if tokens < burst and rate > 0 then
+  reset = math.ceil((burst - tokens) / rate * 1000)
+end
+
+if cost ~= 0 then
+  redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+  redis.call('PEXPIRE', KEYS[1], reset + 1000)
+end
+
+return {allowed, delay, math.floor(math.max(tokens, 0)), reset}
+`)
+
+// slidingWindowScript 滑动窗口计数：按上一个窗口的剩余比例加上当前窗口的计数估算用量
+// KEYS[1] 计数器；ARGV: 增加的数量、上限、窗口毫秒
+// 返回 {是否允许, 估算用量, 距离当前窗口结束毫秒, 当前窗口开始毫秒}
+var slidingWindowScript = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local start = now - (now % window)
+
+local state = redis.call('HMGET', KEYS[1], 'start', 'cur', 'prev')
+local s = tonumber(state[1])
+local cur = tonumber(state[2]) or 0
+local prev = tonumber(state[3]) or 0
+if s ~= start then
+  if s ~= nil and start - s == window then
+    prev = cur
+  else
+    prev = 0
+  end
+  cur = 0
+end
+
+local estimated = prev * (window - (now - start)) / window + cur
+local allowed = 1
+if limit > 0 and estimated + n > limit then
+  allowed = 0
+else
+  cur = cur + n
+  estimated = estimated + n
+end
+
+redis.call('HSET', KEYS[1], 'start', start, 'cur', cur, 'prev', prev)
+redis.call('PEXPIRE', KEYS[1], window * 2)
+return {allowed, math.floor(estimated), window - (now - start), start}
+`)
+
+// adjustWindowScript 在窗口未滚动时调整当前窗口的计数，用于按实际用量结算
+// KEYS[1] 计数器；ARGV: 预留时的窗口开始毫秒、调整量；返回 {是否调整}
+var adjustWindowScript = redis.NewScript(`
+local state = redis.call('HMGET', KEYS[1], 'start', 'cur')
+if tonumber(state[1]) ~= tonumber(ARGV[1]) then
+  return {0}
+end
+local cur = math.max((tonumber(state[2]) or 0) + tonumber(ARGV[2]), 0)
+redis.call('HSET', KEYS[1], 'cur', cur)
+return {1}
+`)
+
+// RedisStore 基于 Redis 协议的共享限流存储，多个副本共享同一组令牌桶和计数器
+// 出错后在一段时间内直接返回 ErrStoreUnavailable，由调用方回退到本地限流
+type RedisStore struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+
+	unavailableUntil int64 // UnixNano，原子读写
+	calls            int64
+	failures         int64
+	fallbacks        int64
+}
+
+// NewRedisStore 创建共享存储，url 形如 redis://[:password@]host:port/db
+// 连接失败不会返回错误，此时先使用本地限流，之后定期重试
+func NewRedisStore(url, prefix string, timeout time.Duration) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if timeout <= 0 {
+		timeout = 200 * time.Millisecond
+	}
+
+	s := &RedisStore{
+		client:  redis.NewClient(opts),
+		prefix:  prefix,
+		timeout: timeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.fail(err)
+	}
+	return s, nil
+}
+
+// Available 检查共享存储当前是否可用
+func (s *RedisStore) Available() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&s.unavailableUntil)
+}
+
+// fail 记录错误并在一段时间内停止使用共享存储
+func (s *RedisStore) fail(err error) {
+	atomic.AddInt64(&s.failures, 1)
+	until := time.Now().Add(storeRetryInterval).UnixNano()
+	if atomic.SwapInt64(&s.unavailableUntil, until) < time.Now().UnixNano() {
+		log.Warn("限流共享存储不可用，%s 内回退到本地限流: %v", storeRetryInterval, err)
+	}
+}
+
+// fallback 记录一次回退到本地限流
+func (s *RedisStore) fallback() {
+	atomic.AddInt64(&s.fallbacks, 1)
+}
+
+// run 执行脚本，存储不可用或出错时返回 ErrStoreUnavailable
+func (s *RedisStore) run(script *redis.Script, key string, args ...interface{}) ([]int64, error) {
+	if !s.Available() {
+		return nil, ErrStoreUnavailable
+	}
+	return s.exec(script, key, args...)
+}
+
+// exec 执行脚本，不检查存储是否被标记为不可用
+func (s *RedisStore) exec(script *redis.Script, key string, args ...interface{}) ([]int64, error) {
+	atomic.AddInt64(&s.calls, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	values, err := script.Run(ctx, s.client, []string{s.prefix + key}, args...).Int64Slice()
+	if err != nil {
+		s.fail(err)
+		return nil, fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return values, nil
+}
+
+// bucketResult 令牌桶脚本的结果
+type bucketResult struct {
+	allowed   bool
+	delay     time.Duration
+	remaining int
+	reset     time.Duration
+}
+
+// tokenBucket 在共享令牌桶中消耗 cost 个令牌（0 只查询，负数为归还）
+func (s *RedisStore) tokenBucket(key string, rate float64, burst int, maxWait time.Duration, cost int) (bucketResult, error) {
+	values, err := s.run(tokenBucketScript, key,
+		strconv.FormatFloat(rate, 'f', -1, 64), burst, maxWait.Milliseconds(), cost)
+	if err != nil {
+		return bucketResult{}, err
+	}
+	if len(values) != 4 {
+		return bucketResult{}, fmt.Errorf("%w: unexpected token bucket reply %v", ErrStoreUnavailable, values)
+	}
+
+	result := bucketResult{
+		allowed:   values[0] == 1,
+		delay:     time.Duration(values[1]) * time.Millisecond,
+		remaining: int(values[2]),
+		reset:     time.Duration(values[3]) * time.Millisecond,
+	}
+	if values[1] < 0 {
+		result.delay = maxDuration
+	}
+	return result, nil
+}
+
+// windowResult 滑动窗口脚本的结果
+type windowResult struct {
+	allowed bool
+	used    int
+	reset   time.Duration
+	start   int64
+}
+
+// slidingWindow 在滑动窗口计数器中增加 n，超过 limit 时不增加
+func (s *RedisStore) slidingWindow(key string, n, limit int, window time.Duration) (windowResult, error) {
+	values, err := s.run(slidingWindowScript, key, n, limit, window.Milliseconds())
+	if err != nil {
+		return windowResult{}, err
+	}
+	if len(values) != 4 {
+		return windowResult{}, fmt.Errorf("%w: unexpected sliding window reply %v", ErrStoreUnavailable, values)
+	}
+	return windowResult{
+		allowed: values[0] == 1,
+		used:    int(values[1]),
+		reset:   time.Duration(values[2]) * time.Millisecond,
+		start:   values[3],
+	}, nil
+}
+
+// adjustWindow 调整预留时所在窗口的计数
+func (s *RedisStore) adjustWindow(key string, start int64, delta int) error {
+	_, err := s.run(adjustWindowScript, key, start, delta)
+	return err
+}
+
+// rollbackWindow 撤销刚在窗口中预留的 n 个计数
+// 预留的下一步出错时存储已被标记为不可用，仍然尝试一次，否则这部分计数会一直留在共享窗口中
+func (s *RedisStore) rollbackWindow(key string, start int64, n int) error {
+	_, err := s.exec(adjustWindowScript, key, start, -n)
+	return err
+}
+
+// GetMetrics 获取指标
+func (s *RedisStore) GetMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"backend":   "redis",
+		"available": s.Available(),
+		"calls":     atomic.LoadInt64(&s.calls),
+		"failures":  atomic.LoadInt64(&s.failures),
+		"fallbacks": atomic.LoadInt64(&s.fallbacks),
+	}
+}
+
+// Close 关闭连接
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// RedisLimiter 基于共享令牌桶的全局限流器，所有副本合计不超过配置的速率
+// 共享存储不可用时回退到本地令牌桶
+type RedisLimiter struct {
+	store *RedisStore
+	key   string
+	local *TokenBucketLimiter // 回退用的本地令牌桶，同时保存速率、容量和启用状态
+
+	requestCount  int64
+	allowedCount  int64
+	rejectedCount int64
+}
+
+// NewRedisLimiter 创建共享限流器
+func NewRedisLimiter(store *RedisStore, key string, rate float64, burst int) *RedisLimiter {
+	return &RedisLimiter{
+		store: store,
+		key:   key,
+		local: NewTokenBucketLimiter(rate, burst),
+	}
+}
+
+// Allow 判断是否允许当前请求
+func (l *RedisLimiter) Allow() bool {
+	return l.Reserve(0).OK
+}
+
+// Wait 阻塞直到允许请求或上下文取消
+func (l *RedisLimiter) Wait(ctx context.Context) error {
+	return waitReserve(ctx, l)
+}
+
+// Reserve 在共享令牌桶中预留一个令牌
+func (l *RedisLimiter) Reserve(maxWait time.Duration) *Reservation {
+	if !l.local.IsEnabled() {
+		return l.local.Reserve(maxWait)
+	}
+
+	rate, burst := l.local.Limit()
+	result, err := l.store.tokenBucket(l.key, rate, burst, maxWait, 1)
+	if err != nil {
+		l.store.fallback()
+		return l.local.Reserve(maxWait)
+	}
+
+	r := &Reservation{
+		OK:     result.allowed,
+		Delay:  result.delay,
+		Status: Status{Enabled: true, Limit: burst, Remaining: result.remaining, Reset: result.reset},
+	}
+	if result.allowed {
+		r.limiter = l
+		r.consumed = true
+		l.countAllowed()
+	} else {
+		l.countRejected()
+	}
+	return r
+}
+
+// take 立即消耗一个令牌，供等待队列使用；不更新统计
+// 共享存储不可用时从本地令牌桶获取，fallback 为 true，归还时需要传回
+func (l *RedisLimiter) take() (bool, time.Duration, bool) {
+	if !l.local.IsEnabled() {
+		return true, 0, false
+	}
+
+	rate, burst := l.local.Limit()
+	result, err := l.store.tokenBucket(l.key, rate, burst, 0, 1)
+	if err != nil {
+		l.store.fallback()
+		ok, delay, _ := l.local.take()
+		return ok, delay, true
+	}
+	return result.allowed, result.delay, false
+}
+
+// Refund 归还一个共享令牌桶授予的令牌
+// 共享存储出错时放弃归还，令牌随时间补充；不改为归还本地令牌桶，避免凭空多出一个本地令牌
+func (l *RedisLimiter) Refund() {
+	atomic.AddInt64(&l.allowedCount, -1)
+	atomic.AddInt64(&l.requestCount, -1)
+	if !l.local.IsEnabled() {
+		return
+	}
+
+	rate, burst := l.local.Limit()
+	if _, err := l.store.tokenBucket(l.key, rate, burst, 0, -1); err != nil {
+		log.Warn("归还共享令牌失败，等待令牌随时间补充: %s: %v", l.key, err)
+	}
+}
+
+// refund 归还令牌到授予它的令牌桶：回退时由本地令牌桶授予的令牌放回本地令牌桶，其余归还共享令牌桶
+// 两种情况都只撤销共享限流器的统计，本地令牌桶的 take 不计数
+func (l *RedisLimiter) refund(fallback bool) {
+	if !fallback {
+		l.Refund()
+		return
+	}
+	l.local.restore()
+	atomic.AddInt64(&l.allowedCount, -1)
+	atomic.AddInt64(&l.requestCount, -1)
+}
+
+// countAllowed 记录一次允许的请求
+func (l *RedisLimiter) countAllowed() {
+	atomic.AddInt64(&l.requestCount, 1)
+	atomic.AddInt64(&l.allowedCount, 1)
+}
+
+// countRejected 记录一次拒绝的请求
+func (l *RedisLimiter) countRejected() {
+	atomic.AddInt64(&l.requestCount, 1)
+	atomic.AddInt64(&l.rejectedCount, 1)
+}
+
+// Status 返回共享令牌桶的配额状态
+func (l *RedisLimiter) Status() Status {
+	if !l.local.IsEnabled() {
+		return Status{}
+	}
+
+	rate, burst := l.local.Limit()
+	result, err := l.store.tokenBucket(l.key, rate, burst, 0, 0)
+	if err != nil {
+		return l.local.Status()
+	}
+	return Status{Enabled: true, Limit: burst, Remaining: result.remaining, Reset: result.reset}
+}
+
+// SetLimit 修改速率和桶容量
+func (l *RedisLimiter) SetLimit(rate float64, burst int) {
+	l.local.SetLimit(rate, burst)
+}
+
+// Limit 返回当前速率和桶容量
+func (l *RedisLimiter) Limit() (float64, int) {
+	return l.local.Limit()
+}
+
+// Enable 启用限制器
+func (l *RedisLimiter) Enable() {
+	l.local.Enable()
+}
+
+// Disable 禁用限制器
+func (l *RedisLimiter) Disable() {
+	l.local.Disable()
+}
+
+// IsEnabled 检查限制器是否启用
+func (l *RedisLimiter) IsEnabled() bool {
+	return l.local.IsEnabled()
+}
+
+// GetMetrics 获取指标，local 为回退时使用的本地令牌桶的指标
+func (l *RedisLimiter) GetMetrics() map[string]interface{} {
+	rate, burst := l.local.Limit()
+	requestCount := atomic.LoadInt64(&l.requestCount)
+	rejectedCount := atomic.LoadInt64(&l.rejectedCount)
+
+	return map[string]interface{}{
+		"enabled":        l.IsEnabled(),
+		"rate":           rate,
+		"burst":          burst,
+		"request_count":  requestCount,
+		"allowed_count":  atomic.LoadInt64(&l.allowedCount),
+		"rejected_count": rejectedCount,
+		"rejection_rate": calculatePercentage(rejectedCount, requestCount),
+		"store":          l.store.GetMetrics(),
+		"local":          l.local.GetMetrics(),
+	}
+}
@@ -0,0 +1,309 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestStore 启动内存中的 Redis 替身并创建共享存储，时间固定在整分钟，便于断言窗口
+func newTestStore(t *testing.T) (*miniredis.Miniredis, *RedisStore) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	server.SetTime(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	store, err := NewRedisStore("redis://"+server.Addr(), "test:", time.Second)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if !store.Available() {
+		t.Fatal("store should be available")
+	}
+	return server, store
+}
+
+func TestRedisLimiterSharedAcrossReplicas(t *testing.T) {
+	_, store := newTestStore(t)
+
+	// 两个副本共享同一个容量为 3 的令牌桶
+	a := NewRedisLimiter(store, "global", 1, 3)
+	b := NewRedisLimiter(store, "global", 1, 3)
+
+	for i, l := range []*RedisLimiter{a, b, a} {
+		if !l.Allow() {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("fourth request should be rejected across replicas")
+	}
+
+	status := a.Status()
+	if !status.Enabled || status.Limit != 3 || status.Remaining != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestRedisLimiterReserveDelayAndRefund(t *testing.T) {
+	server, store := newTestStore(t)
+	l := NewRedisLimiter(store, "global", 2, 1)
+
+	if r := l.Reserve(0); !r.OK {
+		t.Fatal("first reservation should succeed")
+	}
+
+	r := l.Reserve(0)
+	if r.OK {
+		t.Fatal("reservation without wait should be rejected")
+	}
+	if r.Delay != 500*time.Millisecond {
+		t.Fatalf("delay = %v, want 500ms", r.Delay)
+	}
+
+	// 允许等待时预留成功，并返回需要等待的时间
+	r = l.Reserve(time.Second)
+	if !r.OK || r.Delay != 500*time.Millisecond {
+		t.Fatalf("reservation with wait: ok=%v delay=%v", r.OK, r.Delay)
+	}
+
+	// 取消的预留归还令牌
+	r.Cancel()
+	server.SetTime(time.Date(2025, 1, 1, 12, 0, 0, int(500*time.Millisecond), time.UTC))
+	if !l.Allow() {
+		t.Fatal("token should be available after refund and refill")
+	}
+}
+
+func TestRedisLimiterDisabled(t *testing.T) {
+	_, store := newTestStore(t)
+	l := NewRedisLimiter(store, "global", 1, 1)
+	l.Disable()
+
+	for i := 0; i < 5; i++ {
+		if !l.Allow() {
+			t.Fatal("disabled limiter should allow all requests")
+		}
+	}
+	if calls := store.GetMetrics()["calls"].(int64); calls != 0 {
+		t.Fatalf("disabled limiter should not call the store, got %d calls", calls)
+	}
+}
+
+func TestRedisLimiterFallsBackToLocal(t *testing.T) {
+	server, store := newTestStore(t)
+	l := NewRedisLimiter(store, "global", 1, 2)
+
+	server.Close()
+
+	// 存储不可达时使用本地令牌桶，仍然限制速率
+	if !l.Allow() || !l.Allow() {
+		t.Fatal("local fallback should allow burst")
+	}
+	if l.Allow() {
+		t.Fatal("local fallback should enforce the limit")
+	}
+	if store.Available() {
+		t.Fatal("store should be marked unavailable")
+	}
+	if fallbacks := store.GetMetrics()["fallbacks"].(int64); fallbacks == 0 {
+		t.Fatal("fallbacks should be counted")
+	}
+}
+
+func TestRedisLimiterRefundsGrantingBackend(t *testing.T) {
+	server, store := newTestStore(t)
+	l := NewRedisLimiter(store, "global", 0, 2)
+
+	// 共享令牌桶授予的令牌在存储不可达时放弃归还，不凭空多出本地令牌
+	r := l.Reserve(0)
+	if !r.OK {
+		t.Fatal("reservation should succeed")
+	}
+	server.Close()
+	r.Cancel()
+	if metrics := l.GetMetrics(); metrics["allowed_count"] != int64(0) || metrics["request_count"] != int64(0) {
+		t.Fatalf("shared counters not refunded: %v", metrics)
+	}
+	if local := l.local.GetMetrics(); local["available_tokens"] != float64(2) || local["allowed_count"] != int64(0) {
+		t.Fatalf("local bucket touched by shared refund: %v", local)
+	}
+
+	// 回退时等待队列从本地令牌桶取得的令牌归还到本地令牌桶
+	q := NewWaitQueue(l, QueueOptions{MaxWait: time.Second})
+	defer q.Close()
+	r, err := q.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.fallback {
+		t.Fatal("reservation should record the local fallback")
+	}
+	r.Cancel()
+	if local := l.local.GetMetrics(); local["available_tokens"] != float64(2) || local["allowed_count"] != int64(0) {
+		t.Fatalf("fallback token not returned to local bucket: %v", local)
+	}
+	if metrics := l.GetMetrics(); metrics["allowed_count"] != int64(0) || metrics["request_count"] != int64(0) {
+		t.Fatalf("shared counters not refunded: %v", metrics)
+	}
+}
+
+func TestKeyedLimiterShared(t *testing.T) {
+	_, store := newTestStore(t)
+
+	a := NewKeyedLimiter("key", time.Minute)
+	b := NewKeyedLimiter("key", time.Minute)
+	defer a.Close()
+	defer b.Close()
+	a.SetStore(store)
+	b.SetStore(store)
+
+	limit := Limit{Rate: 1, Burst: 1}
+	if ok, _, _ := a.Allow("alice", limit); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	ok, delay, _ := b.Allow("alice", limit)
+	if ok {
+		t.Fatal("second request from another replica should be rejected")
+	}
+	if delay != time.Second {
+		t.Fatalf("delay = %v, want 1s", delay)
+	}
+	if ok, _, _ := b.Allow("bob", limit); !ok {
+		t.Fatal("other keys should have their own bucket")
+	}
+
+	a.Refund("alice", false)
+	if ok, _, _ := b.Allow("alice", limit); !ok {
+		t.Fatal("refunded token should be shared")
+	}
+}
+
+func TestKeyedLimiterRefundsGrantingBackend(t *testing.T) {
+	server, store := newTestStore(t)
+	l := NewKeyedLimiter("key", time.Minute)
+	defer l.Close()
+	l.SetStore(store)
+
+	limit := Limit{Rate: 0.001, Burst: 2}
+	ok, _, fallback := l.Allow("alice", limit)
+	if !ok || fallback {
+		t.Fatalf("first request: ok=%v fallback=%v, want shared grant", ok, fallback)
+	}
+
+	// 共享令牌桶授予的令牌在存储不可达时放弃归还，不凭空多出本地令牌
+	server.Close()
+	l.Refund("alice", fallback)
+	local := l.entry("alice", limit).limiter
+	if metrics := local.GetMetrics(); metrics["allowed_count"] != int64(0) || metrics["request_count"] != int64(0) {
+		t.Fatalf("local bucket touched by shared refund: %v", metrics)
+	}
+
+	// 回退时本地令牌桶授予的令牌归还到本地令牌桶
+	ok, _, fallback = l.Allow("alice", limit)
+	if !ok || !fallback {
+		t.Fatalf("request during outage: ok=%v fallback=%v, want local grant", ok, fallback)
+	}
+	before := local.GetMetrics()["available_tokens"].(float64)
+	l.Refund("alice", fallback)
+	if after := local.GetMetrics()["available_tokens"].(float64); after < before+0.99 {
+		t.Fatalf("local tokens = %v after refund, want about %v", after, before+1)
+	}
+	if stats := l.TopConsumers(1); stats[0].Requests != 0 {
+		t.Fatalf("requests = %d, want 0 after refunds", stats[0].Requests)
+	}
+}
+
+func TestTokenQuotaSharedAndSettle(t *testing.T) {
+	_, store := newTestStore(t)
+
+	a := NewTokenQuota("key", time.Minute)
+	b := NewTokenQuota("key", time.Minute)
+	defer a.Close()
+	defer b.Close()
+	a.SetStore(store)
+	b.SetStore(store)
+
+	limit := TokenLimit{PerMinute: 1000, PerDay: 5000}
+
+	r1, status, ok := a.Reserve("alice", 600, limit)
+	if !ok {
+		t.Fatal("first reservation should succeed")
+	}
+	if status.Limit != 1000 || status.Remaining != 400 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	if _, status, ok := b.Reserve("alice", 600, limit); ok {
+		t.Fatal("second replica should see the shared minute window")
+	} else if status.Remaining != 400 || status.Reset != time.Minute {
+		t.Fatalf("unexpected rejection status: %+v", status)
+	}
+
+	// 按实际用量结算后释放多预留的令牌
+	r1.Settle(100)
+	if _, _, ok := b.Reserve("alice", 600, limit); !ok {
+		t.Fatal("reservation should succeed after settling")
+	}
+}
+
+func TestTokenQuotaDayWindowRollsBackMinute(t *testing.T) {
+	_, store := newTestStore(t)
+
+	q := NewTokenQuota("model", time.Minute)
+	defer q.Close()
+	q.SetStore(store)
+
+	limit := TokenLimit{PerMinute: 1000, PerDay: 500}
+	if _, _, ok := q.Reserve("gpt", 800, limit); ok {
+		t.Fatal("reservation should exceed the day quota")
+	}
+
+	// 天窗口拒绝后分钟窗口的预留已撤销
+	if _, _, ok := q.Reserve("gpt", 500, TokenLimit{PerMinute: 500}); !ok {
+		t.Fatal("minute window should not keep the rejected reservation")
+	}
+}
+
+func TestTokenQuotaDayWindowErrorRollsBackMinute(t *testing.T) {
+	server, store := newTestStore(t)
+
+	q := NewTokenQuota("model", time.Minute)
+	defer q.Close()
+	q.SetStore(store)
+
+	// 天窗口的键类型错误，脚本出错，预留回退到本地计数
+	server.Set("test:tokens:model:gpt:d", "corrupt")
+	if _, _, ok := q.Reserve("gpt", 300, TokenLimit{PerMinute: 1000, PerDay: 5000}); !ok {
+		t.Fatal("reservation should fall back to local counting")
+	}
+	if store.Available() {
+		t.Fatal("store should be marked unavailable")
+	}
+
+	// 分钟窗口的预留已撤销，不会一直占用所有副本共享的额度
+	if cur := server.HGet("test:tokens:model:gpt:m", "cur"); cur != "0" {
+		t.Fatalf("shared minute window cur = %q, want 0", cur)
+	}
+}
+
+func TestTokenQuotaFallsBackToLocal(t *testing.T) {
+	server, store := newTestStore(t)
+
+	q := NewTokenQuota("key", time.Minute)
+	defer q.Close()
+	q.SetStore(store)
+	server.Close()
+
+	limit := TokenLimit{PerMinute: 100}
+	if _, _, ok := q.Reserve("alice", 80, limit); !ok {
+		t.Fatal("local fallback should allow reservation")
+	}
+	if _, _, ok := q.Reserve("alice", 80, limit); ok {
+		t.Fatal("local fallback should enforce the quota")
+	}
+}
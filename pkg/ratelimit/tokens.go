@@ -0,0 +1,415 @@
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TokenLimit 令牌数配额，0 表示该窗口不限制
+type TokenLimit struct {
+	PerMinute int `json:"tokens_per_minute"`
+	PerDay    int `json:"tokens_per_day"`
+}
+
+// IsZero 检查是否未设置任何配额
+func (l TokenLimit) IsZero() bool {
+	return l.PerMinute <= 0 && l.PerDay <= 0
+}
+
+// TokenStatus 配额状态，对应 OpenAI 的 x-ratelimit-*-tokens 响应头
+type TokenStatus struct {
+	Limit     int           // 当前起约束作用的窗口的配额
+	Remaining int           // 该窗口剩余的令牌数
+	Reset     time.Duration // 距离该窗口重置的时间
+}
+
+// tokenWindow 固定时间窗口内的令牌用量
+type tokenWindow struct {
+	size  time.Duration
+	start time.Time
+	used  int
+}
+
+// roll 窗口过期时开始新窗口
+func (w *tokenWindow) roll(now time.Time) {
+	if start := now.Truncate(w.size); !start.Equal(w.start) {
+		w.start = start
+		w.used = 0
+	}
+}
+
+// status 计算窗口在给定配额下的状态
+func (w *tokenWindow) status(limit int, now time.Time) TokenStatus {
+	remaining := limit - w.used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return TokenStatus{Limit: limit, Remaining: remaining, Reset: w.start.Add(w.size).Sub(now)}
+}
+
+// tokenEntry 单个键的分钟和天窗口
+type tokenEntry struct {
+	minute   tokenWindow
+	day      tokenWindow
+	consumed int64
+	rejected int64
+	lastSeen time.Time
+}
+
+// TokenReservation 请求发出前预留的令牌，响应结束后按实际用量结算
+type TokenReservation struct {
+	quota       *TokenQuota
+	key         string
+	tokens      int
+	minuteStart time.Time
+	dayStart    time.Time
+	once        sync.Once
+
+	// 在共享存储中预留时使用，记录各窗口的开始时间（毫秒），0 表示该窗口未预留
+	remote         bool
+	remoteMinuteMs int64
+	remoteDayMs    int64
+}
+
+// TokenConsumerStats 单个键的令牌用量统计
+type TokenConsumerStats struct {
+	Key        string `json:"key"`
+	Consumed   int64  `json:"consumed"`
+	Rejected   int64  `json:"rejected"`
+	MinuteUsed int    `json:"minute_used"`
+	DayUsed    int    `json:"day_used"`
+	LastSeen   string `json:"last_seen"`
+}
+
+// TokenQuota 按键（API密钥、客户端IP或模型）统计每分钟和每天的令牌用量
+// 请求前按估算的提示令牌预留，响应后按实际用量结算
+type TokenQuota struct {
+	name    string
+	entries map[string]*tokenEntry
+	mu      sync.Mutex
+	idleTTL time.Duration
+	store   *RedisStore // 共享存储，为nil时只使用本地计数
+
+	stopCleanup chan struct{}
+	closeOnce   sync.Once
+	evictions   int64
+}
+
+// NewTokenQuota 创建令牌配额，idleTTL 为空闲键的过期时间，仍有当天用量的键不会被清理
+func NewTokenQuota(name string, idleTTL time.Duration) *TokenQuota {
+	if idleTTL <= 0 {
+		idleTTL = 10 * time.Minute
+	}
+
+	q := &TokenQuota{
+		name:        name,
+		entries:     make(map[string]*tokenEntry),
+		idleTTL:     idleTTL,
+		stopCleanup: make(chan struct{}),
+	}
+	go q.cleanupLoop()
+	return q
+}
+
+// SetStore 使用共享存储中的滑动窗口计数，使多个副本共享同一配额；存储不可用时回退到本地计数
+func (q *TokenQuota) SetStore(store *RedisStore) {
+	q.store = store
+}
+
+// Reserve 为键预留 tokens 个令牌
+// 超出任一窗口的配额时返回 false，此时状态为拒绝请求的窗口；否则状态为剩余最少的窗口
+func (q *TokenQuota) Reserve(key string, tokens int, limit TokenLimit) (*TokenReservation, TokenStatus, bool) {
+	if limit.IsZero() {
+		return nil, TokenStatus{}, true
+	}
+	if tokens < 0 {
+		tokens = 0
+	}
+
+	if q.store != nil {
+		reservation, status, ok, err := q.reserveRemote(key, tokens, limit)
+		if err == nil {
+			q.record(key, tokens, ok)
+			return reservation, status, ok
+		}
+		q.store.fallback()
+	}
+
+	now := time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := q.entryLocked(key)
+	entry.lastSeen = now
+	entry.minute.roll(now)
+	entry.day.roll(now)
+
+	if limit.PerMinute > 0 && entry.minute.used+tokens > limit.PerMinute {
+		entry.rejected++
+		return nil, entry.minute.status(limit.PerMinute, now), false
+	}
+	if limit.PerDay > 0 && entry.day.used+tokens > limit.PerDay {
+		entry.rejected++
+		return nil, entry.day.status(limit.PerDay, now), false
+	}
+
+	entry.minute.used += tokens
+	entry.day.used += tokens
+	entry.consumed += int64(tokens)
+
+	reservation := &TokenReservation{
+		quota:       q,
+		key:         key,
+		tokens:      tokens,
+		minuteStart: entry.minute.start,
+		dayStart:    entry.day.start,
+	}
+	return reservation, bindingStatus(entry, limit, now), true
+}
+
+// entryLocked 获取或创建键的统计，调用方需持有锁
+func (q *TokenQuota) entryLocked(key string) *tokenEntry {
+	entry, ok := q.entries[key]
+	if !ok {
+		entry = &tokenEntry{
+			minute: tokenWindow{size: time.Minute},
+			day:    tokenWindow{size: 24 * time.Hour},
+		}
+		q.entries[key] = entry
+	}
+	return entry
+}
+
+// record 记录在共享存储中预留的统计
+func (q *TokenQuota) record(key string, tokens int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := q.entryLocked(key)
+	entry.lastSeen = time.Now()
+	if ok {
+		entry.consumed += int64(tokens)
+	} else {
+		entry.rejected++
+	}
+}
+
+// reserveRemote 依次在共享存储的分钟和天窗口中预留，天窗口拒绝或出错时撤销分钟窗口的预留
+func (q *TokenQuota) reserveRemote(key string, tokens int, limit TokenLimit) (*TokenReservation, TokenStatus, bool, error) {
+	reservation := &TokenReservation{quota: q, key: key, tokens: tokens, remote: true}
+	var status TokenStatus
+
+	if limit.PerMinute > 0 {
+		result, err := q.store.slidingWindow(q.windowKey(key, "m"), tokens, limit.PerMinute, time.Minute)
+		if err != nil {
+			return nil, TokenStatus{}, false, err
+		}
+		status = TokenStatus{Limit: limit.PerMinute, Remaining: max(limit.PerMinute-result.used, 0), Reset: result.reset}
+		if !result.allowed {
+			return nil, status, false, nil
+		}
+		reservation.remoteMinuteMs = result.start
+	}
+
+	if limit.PerDay > 0 {
+		result, err := q.store.slidingWindow(q.windowKey(key, "d"), tokens, limit.PerDay, 24*time.Hour)
+		if err != nil {
+			// 调用方会回退到本地计数，撤销分钟窗口的预留，否则这部分tokens永远不会结算
+			if reservation.remoteMinuteMs != 0 {
+				_ = q.store.rollbackWindow(q.windowKey(key, "m"), reservation.remoteMinuteMs, tokens)
+			}
+			return nil, TokenStatus{}, false, err
+		}
+		day := TokenStatus{Limit: limit.PerDay, Remaining: max(limit.PerDay-result.used, 0), Reset: result.reset}
+		if !result.allowed {
+			if reservation.remoteMinuteMs != 0 {
+				_ = q.store.rollbackWindow(q.windowKey(key, "m"), reservation.remoteMinuteMs, tokens)
+			}
+			return nil, day, false, nil
+		}
+		if limit.PerMinute <= 0 || day.Remaining < status.Remaining {
+			status = day
+		}
+		reservation.remoteDayMs = result.start
+	}
+
+	return reservation, status, true, nil
+}
+
+// windowKey 返回键的窗口在共享存储中的名称
+func (q *TokenQuota) windowKey(key, window string) string {
+	return "tokens:" + q.name + ":" + key + ":" + window
+}
+
+// bindingStatus 返回剩余最少的窗口的状态
+func bindingStatus(entry *tokenEntry, limit TokenLimit, now time.Time) TokenStatus {
+	var status TokenStatus
+	if limit.PerMinute > 0 {
+		status = entry.minute.status(limit.PerMinute, now)
+	}
+	if limit.PerDay > 0 {
+		day := entry.day.status(limit.PerDay, now)
+		if limit.PerMinute <= 0 || day.Remaining < status.Remaining {
+			status = day
+		}
+	}
+	return status
+}
+
+// Settle 按实际用量结算预留，多退少补；只结算一次，nil 预留直接忽略
+func (r *TokenReservation) Settle(actual int) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.quota.settle(r, actual)
+	})
+}
+
+// settle 把实际用量与预留的差额计入预留时所在的窗口，窗口已经滚动时不再调整
+func (q *TokenQuota) settle(r *TokenReservation, actual int) {
+	if actual < 0 {
+		actual = 0
+	}
+	delta := actual - r.tokens
+
+	if r.remote {
+		q.settleRemote(r, delta)
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.entries[r.key]
+	if !ok {
+		return
+	}
+	if entry.minute.start.Equal(r.minuteStart) {
+		entry.minute.used = max(entry.minute.used+delta, 0)
+	}
+	if entry.day.start.Equal(r.dayStart) {
+		entry.day.used = max(entry.day.used+delta, 0)
+	}
+	entry.consumed = max(entry.consumed+int64(delta), 0)
+	entry.lastSeen = time.Now()
+}
+
+// settleRemote 在共享存储中结算，出错时放弃调整（预留的令牌仍计入用量）
+func (q *TokenQuota) settleRemote(r *TokenReservation, delta int) {
+	if delta != 0 {
+		if r.remoteMinuteMs != 0 {
+			_ = q.store.adjustWindow(q.windowKey(r.key, "m"), r.remoteMinuteMs, delta)
+		}
+		if r.remoteDayMs != 0 {
+			_ = q.store.adjustWindow(q.windowKey(r.key, "d"), r.remoteDayMs, delta)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.entries[r.key]; ok {
+		entry.consumed = max(entry.consumed+int64(delta), 0)
+		entry.lastSeen = time.Now()
+	}
+}
+
+// cleanupLoop 定期清理空闲键
+func (q *TokenQuota) cleanupLoop() {
+	interval := q.idleTTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.evictIdle()
+		case <-q.stopCleanup:
+			return
+		}
+	}
+}
+
+// evictIdle 删除空闲超过TTL且没有当天用量的键，避免清理后日配额被重置
+func (q *TokenQuota) evictIdle() {
+	now := time.Now()
+	cutoff := now.Add(-q.idleTTL)
+	today := now.Truncate(24 * time.Hour)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for key, entry := range q.entries {
+		if entry.lastSeen.Before(cutoff) && (entry.day.used == 0 || !entry.day.start.Equal(today)) {
+			delete(q.entries, key)
+			q.evictions++
+		}
+	}
+}
+
+// TopConsumers 返回令牌用量最多的前 n 个键
+func (q *TokenQuota) TopConsumers(n int) []TokenConsumerStats {
+	now := time.Now()
+
+	q.mu.Lock()
+	stats := make([]TokenConsumerStats, 0, len(q.entries))
+	for key, entry := range q.entries {
+		entry.minute.roll(now)
+		entry.day.roll(now)
+		stats = append(stats, TokenConsumerStats{
+			Key:        key,
+			Consumed:   entry.consumed,
+			Rejected:   entry.rejected,
+			MinuteUsed: entry.minute.used,
+			DayUsed:    entry.day.used,
+			LastSeen:   entry.lastSeen.Format(time.RFC3339),
+		})
+	}
+	q.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Consumed != stats[j].Consumed {
+			return stats[i].Consumed > stats[j].Consumed
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// GetMetrics 获取指标
+func (q *TokenQuota) GetMetrics() map[string]interface{} {
+	q.mu.Lock()
+	keys := len(q.entries)
+	evictions := q.evictions
+	q.mu.Unlock()
+
+	return map[string]interface{}{
+		"enabled":       true,
+		"dimension":     q.name,
+		"keys":          keys,
+		"evictions":     evictions,
+		"idle_ttl":      q.idleTTL.String(),
+		"shared":        q.store != nil,
+		"top_consumers": q.TopConsumers(10),
+	}
+}
+
+// Close 停止后台清理
+func (q *TokenQuota) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.stopCleanup)
+	})
+	return nil
+}
@@ -0,0 +1,106 @@
+// Package rotate 提供按大小轮转的追加写文件，供日志和请求捕获使用
+package rotate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File 按大小轮转的文件：超过 maxSize 时把 app.log 重命名为 app.log.1，
+// 已有的 app.log.N 依次后移，超过 maxBackups 的最旧文件被删除
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open 以追加方式打开文件并创建所在目录，maxSize 为0时不轮转
+func Open(path string, maxSize int64, maxBackups int) (*File, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create directory: %w", err)
+		}
+	}
+	f := &File{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open 打开文件并读取当前大小
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write 写入数据，写入后超过大小限制时先轮转
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotate file %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate 关闭当前文件，后移备份文件并重新打开，调用方需持有锁
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if f.maxBackups > 0 {
+		os.Remove(f.backup(f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		if err := os.Rename(f.path, f.backup(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.Truncate(f.path, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
+
+// backup 第 n 个备份文件的路径
+func (f *File) backup(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
+
+// Close 关闭文件
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"scira2api/pkg/auth"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 存储桶名称
+var (
+	bucketAPIKeys       = []byte("api_keys")
+	bucketModelMappings = []byte("model_mappings")
+)
+
+// Store 基于bbolt的本地持久化存储，保存通过管理接口所做的修改
+// 删除记录以墓碑形式保存，使配置文件或环境变量中定义的条目在重启后仍保持删除状态
+type Store struct {
+	db *bolt.DB
+}
+
+// keyRecord API密钥记录
+type keyRecord struct {
+	Key     *auth.APIKey `json:"key,omitempty"`
+	Deleted bool         `json:"deleted,omitempty"`
+}
+
+// Open 打开或创建存储文件
+func Open(path string) (*Store, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("创建存储目录失败: %w", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("打开存储文件失败: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketAPIKeys, bucketModelMappings} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化存储失败: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// PutAPIKey 保存API密钥（只保存哈希）
+func (s *Store) PutAPIKey(key auth.APIKey) error {
+	key.Key = ""
+	return s.putKeyRecord(key.Name, keyRecord{Key: &key})
+}
+
+// DeleteAPIKey 记录API密钥已删除
+func (s *Store) DeleteAPIKey(name string) error {
+	return s.putKeyRecord(name, keyRecord{Deleted: true})
+}
+
+// putKeyRecord 写入密钥记录
+func (s *Store) putKeyRecord(name string, record keyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPIKeys).Put([]byte(name), data)
+	})
+}
+
+// APIKeys 返回保存的API密钥和已删除的密钥名称
+func (s *Store) APIKeys() (keys []auth.APIKey, deleted []string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPIKeys).ForEach(func(name, data []byte) error {
+			var record keyRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("解析密钥记录 %s 失败: %w", name, err)
+			}
+			if record.Deleted || record.Key == nil {
+				deleted = append(deleted, string(name))
+				return nil
+			}
+			keys = append(keys, *record.Key)
+			return nil
+		})
+	})
+	return keys, deleted, err
+}
+
+// PutModelMapping 保存模型映射
+func (s *Store) PutModelMapping(external, internal string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketModelMappings).Put([]byte(external), []byte(internal))
+	})
+}
+
+// DeleteModelMapping 记录模型映射已删除（以空值作为墓碑）
+func (s *Store) DeleteModelMapping(external string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketModelMappings).Put([]byte(external), []byte{})
+	})
+}
+
+// ModelMappings 返回保存的模型映射和已删除的外部模型名
+func (s *Store) ModelMappings() (mappings map[string]string, deleted []string, err error) {
+	mappings = make(map[string]string)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketModelMappings).ForEach(func(external, internal []byte) error {
+			if len(internal) == 0 {
+				deleted = append(deleted, string(external))
+			} else {
+				mappings[string(external)] = string(internal)
+			}
+			return nil
+		})
+	})
+	sort.Strings(deleted)
+	return mappings, deleted, err
+}
+
+// Close 关闭存储
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,234 @@
+package tokenizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"scira2api/log"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// 支持的BPE编码，词表随二进制一起打包，运行时不需要下载
+const (
+	EncodingO200k  = "o200k_base"
+	EncodingCl100k = "cl100k_base"
+	EncodingP50k   = "p50k_base"
+	EncodingR50k   = "r50k_base"
+)
+
+// OpenAI聊天格式的计数开销，见 OpenAI Cookbook 的 num_tokens_from_messages
+const (
+	tokensPerMessage = 3 // 每条消息的 <|start|>{role}\n ... <|end|>\n 格式tokens
+	tokensPerName    = 1 // 消息带 name 字段时额外的tokens
+	tokensPerReply   = 3 // 回复以 <|start|>assistant<|message|> 开头
+)
+
+// builtinModels 常见模型前缀到编码的映射，按前缀长度从长到短匹配
+var builtinModels = map[string]string{
+	"gpt-4o":        EncodingO200k,
+	"gpt-4.1":       EncodingO200k,
+	"gpt-4.5":       EncodingO200k,
+	"o1":            EncodingO200k,
+	"o3":            EncodingO200k,
+	"o4":            EncodingO200k,
+	"gpt-4":         EncodingCl100k,
+	"gpt-3.5-turbo": EncodingCl100k,
+}
+
+func init() {
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// IsSupported 检查编码名称是否受支持
+func IsSupported(encoding string) bool {
+	switch encoding {
+	case EncodingO200k, EncodingCl100k, EncodingP50k, EncodingR50k:
+		return true
+	}
+	return false
+}
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = make(map[string]*Tokenizer)
+)
+
+// Tokenizer 基于BPE词表的分词器，nil 时回退到近似估算
+type Tokenizer struct {
+	name string
+	enc  *tiktoken.Tiktoken
+}
+
+// Get 返回指定编码的分词器，词表只在首次使用时解析
+func Get(encoding string) (*Tokenizer, error) {
+	if !IsSupported(encoding) {
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if t, ok := encodings[encoding]; ok {
+		return t, nil
+	}
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, fmt.Errorf("load encoding %s: %w", encoding, err)
+	}
+	t := &Tokenizer{name: encoding, enc: enc}
+	encodings[encoding] = t
+	return t, nil
+}
+
+// Name 返回编码名称，近似估算时为 "estimate"
+func (t *Tokenizer) Name() string {
+	if t == nil {
+		return "estimate"
+	}
+	return t.name
+}
+
+// Count 计算文本的token数量，特殊token按普通文本计数
+func (t *Tokenizer) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	if t == nil {
+		return Estimate(text)
+	}
+	return len(t.enc.EncodeOrdinary(text))
+}
+
+// Message 参与计数的消息字段
+type Message struct {
+	Role    string
+	Name    string
+	Content string
+}
+
+// CountMessage 计算单条消息的tokens，包含消息格式开销
+func (t *Tokenizer) CountMessage(m Message) int {
+	tokens := tokensPerMessage + t.Count(m.Role) + t.Count(m.Content)
+	if m.Name != "" {
+		tokens += tokensPerName + t.Count(m.Name)
+	}
+	return tokens
+}
+
+// CountMessages 按OpenAI的方式计算提示tokens：各消息tokens之和再加上回复前缀
+func (t *Tokenizer) CountMessages(messages []Message) int {
+	total := tokensPerReply
+	for _, m := range messages {
+		total += t.CountMessage(m)
+	}
+	return total
+}
+
+// Selector 按模型选择分词器
+type Selector struct {
+	fallback string
+	models   map[string]string // 模型名或以 * 结尾的前缀到编码
+	prefixes []string          // models 中的前缀，按长度从长到短
+}
+
+// NewSelector 创建分词器选择器
+// models 优先于内置映射，键为模型名或以 * 结尾的前缀；未匹配的模型使用 fallback 编码
+func NewSelector(fallback string, models map[string]string) (*Selector, error) {
+	if !IsSupported(fallback) {
+		return nil, fmt.Errorf("unsupported default encoding: %s", fallback)
+	}
+	s := &Selector{fallback: fallback, models: make(map[string]string, len(models))}
+	for model, encoding := range models {
+		if !IsSupported(encoding) {
+			return nil, fmt.Errorf("unsupported encoding %s for model %s", encoding, model)
+		}
+		s.models[model] = encoding
+		if prefix, ok := strings.CutSuffix(model, "*"); ok {
+			s.prefixes = append(s.prefixes, prefix)
+		}
+	}
+	sort.Slice(s.prefixes, func(i, j int) bool { return len(s.prefixes[i]) > len(s.prefixes[j]) })
+
+	// 提前解析默认词表，避免首个请求承担加载耗时
+	if _, err := Get(fallback); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EncodingFor 返回模型使用的编码名称；nil 选择器使用 o200k_base
+func (s *Selector) EncodingFor(model string) string {
+	if s == nil {
+		return builtinEncoding(model, EncodingO200k)
+	}
+	if encoding, ok := s.models[model]; ok {
+		return encoding
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(model, prefix) {
+			return s.models[prefix+"*"]
+		}
+	}
+	return builtinEncoding(model, s.fallback)
+}
+
+// For 返回模型使用的分词器，词表加载失败时返回nil（近似估算）
+func (s *Selector) For(model string) *Tokenizer {
+	encoding := s.EncodingFor(model)
+	t, err := Get(encoding)
+	if err != nil {
+		log.Error("加载分词器失败，使用近似估算: 模型=%s, 错误=%v", model, err)
+		return nil
+	}
+	return t
+}
+
+// builtinEncoding 按内置前缀映射选择编码
+func builtinEncoding(model, fallback string) string {
+	best := ""
+	for prefix := range builtinModels {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return fallback
+	}
+	return builtinModels[best]
+}
+
+// Estimate 近似估算token数量，仅在词表不可用时使用
+// 每个英文单词约1.3个token，标点符号1个token，CJK字符约1.5个token
+func Estimate(text string) int {
+	words, punctuation, cjk := 0, 0, 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune(" \t\n\r\f\v", r):
+			if inWord {
+				words++
+				inWord = false
+			}
+		case strings.ContainsRune(".,;:!?()[]{}-_=+*/\\\"'`~@#$%^&<>|", r):
+			punctuation++
+			inWord = false
+		case utf8.RuneLen(r) > 1:
+			cjk++
+		default:
+			inWord = true
+		}
+	}
+	if inWord {
+		words++
+	}
+
+	tokens := int(float64(words)*1.3) + punctuation + int(float64(cjk)*1.5)
+	if tokens < 1 && strings.TrimSpace(text) != "" {
+		tokens = 1
+	}
+	return tokens
+}
@@ -0,0 +1,90 @@
+package tokenizer
+
+import "testing"
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		want     int
+	}{
+		{EncodingCl100k, "hello world", 2},
+		{EncodingO200k, "hello world", 2},
+		{EncodingCl100k, "tiktoken is great!", 6},
+		{EncodingCl100k, "<|endoftext|>", 7}, // 特殊token按普通文本计数
+		{EncodingO200k, "", 0},
+	}
+	for _, tt := range tests {
+		tok, err := Get(tt.encoding)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", tt.encoding, err)
+		}
+		if got := tok.Count(tt.text); got != tt.want {
+			t.Errorf("%s Count(%q) = %d, want %d", tt.encoding, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCountMessages(t *testing.T) {
+	tok, err := Get(EncodingCl100k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []Message{{Role: "user", Content: "hello world"}}
+	// 3 (消息开销) + 1 (user) + 2 (hello world) + 3 (回复前缀)
+	if got := tok.CountMessages(messages); got != 9 {
+		t.Errorf("CountMessages = %d, want 9", got)
+	}
+	named := Message{Role: "user", Name: "bob", Content: "hello world"}
+	if got := tok.CountMessage(named); got != 3+1+2+1+1 {
+		t.Errorf("CountMessage with name = %d, want 8", got)
+	}
+}
+
+func TestNilTokenizerEstimates(t *testing.T) {
+	var tok *Tokenizer
+	if got, want := tok.Count("hello world"), Estimate("hello world"); got != want {
+		t.Errorf("nil Count = %d, want estimate %d", got, want)
+	}
+	if tok.Name() != "estimate" {
+		t.Errorf("nil Name = %q", tok.Name())
+	}
+}
+
+func TestSelector(t *testing.T) {
+	s, err := NewSelector(EncodingCl100k, map[string]string{
+		"grok-3":   EncodingO200k,
+		"claude-*": EncodingP50k,
+		"gpt-4o-*": EncodingCl100k,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"gpt-4o":          EncodingO200k,  // 内置映射
+		"gpt-4o-mini":     EncodingCl100k, // 自定义前缀优先于内置映射
+		"gpt-4-turbo":     EncodingCl100k,
+		"o4-mini":         EncodingO200k,
+		"grok-3":          EncodingO200k,
+		"grok-3-mini":     EncodingCl100k, // 精确匹配不作为前缀
+		"claude-4-sonnet": EncodingP50k,
+		"gemini-2.5-pro":  EncodingCl100k, // 默认编码
+	}
+	for model, want := range tests {
+		if got := s.EncodingFor(model); got != want {
+			t.Errorf("EncodingFor(%s) = %s, want %s", model, got, want)
+		}
+	}
+
+	var nilSelector *Selector
+	if got := nilSelector.EncodingFor("claude-4-sonnet"); got != EncodingO200k {
+		t.Errorf("nil selector EncodingFor = %s, want %s", got, EncodingO200k)
+	}
+
+	if _, err := NewSelector("gpt2", nil); err == nil {
+		t.Error("NewSelector accepted unsupported default encoding")
+	}
+	if _, err := NewSelector(EncodingO200k, map[string]string{"x": "bogus"}); err == nil {
+		t.Error("NewSelector accepted unsupported model encoding")
+	}
+}
@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 导出方式
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// instrumentationName 本服务创建的span所属的instrumentation名称
+const instrumentationName = "scira2api"
+
+// Options 链路追踪配置
+type Options struct {
+	Exporter    string  // none, otlp, stdout, file
+	Endpoint    string  // OTLP/HTTP 地址，如 http://localhost:4318；为空时使用 OTEL_EXPORTER_OTLP_* 环境变量
+	File        string  // file 导出方式的文件路径，每行一个JSON格式的span
+	ServiceName string  // 资源属性 service.name
+	SampleRatio float64 // 没有上游采样决定的请求的采样比例
+}
+
+// Provider 已初始化的链路追踪，Shutdown 时导出剩余的span
+type Provider struct {
+	provider *sdktrace.TracerProvider
+	closer   io.Closer
+}
+
+// Setup 按配置初始化全局的TracerProvider和W3C traceparent/baggage传播
+// 导出方式为 none 时只启用传播，不记录span，返回的Provider可以直接Shutdown
+func Setup(ctx context.Context, opts Options) (*Provider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, closer, err := newExporter(ctx, opts)
+	if err != nil || exporter == nil {
+		return &Provider{}, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		return &Provider{}, fmt.Errorf("create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return &Provider{provider: provider, closer: closer}, nil
+}
+
+// newExporter 创建span导出器，导出方式为 none 时返回nil
+func newExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, io.Closer, error) {
+	switch strings.ToLower(opts.Exporter) {
+	case "", ExporterNone:
+		return nil, nil, nil
+	case ExporterOTLP:
+		var clientOpts []otlptracehttp.Option
+		if opts.Endpoint != "" {
+			clientOpts = append(clientOpts, otlptracehttp.WithEndpointURL(opts.Endpoint))
+		}
+		exporter, err := otlptracehttp.New(ctx, clientOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create OTLP exporter: %w", err)
+		}
+		return exporter, nil, nil
+	case ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, err
+	case ExporterFile:
+		if opts.File == "" {
+			return nil, nil, errors.New("file exporter requires a file path")
+		}
+		if dir := filepath.Dir(opts.File); dir != "" {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, nil, fmt.Errorf("create trace directory: %w", err)
+			}
+		}
+		file, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return exporter, file, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported trace exporter %q, expected none, otlp, stdout or file", opts.Exporter)
+	}
+}
+
+// Enabled 是否在记录span
+func (p *Provider) Enabled() bool {
+	return p != nil && p.provider != nil
+}
+
+// Shutdown 导出剩余的span并关闭导出器
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if !p.Enabled() {
+		return nil
+	}
+	err := p.provider.Shutdown(ctx)
+	if p.closer != nil {
+		if closeErr := p.closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Start 创建子span，未启用追踪时返回不记录的span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer 创建服务端入口span
+func StartServer(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// End 结束span，err 不为nil时记录错误并把状态设为Error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,217 @@
+package usage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分组维度
+const (
+	GroupKey   = "key"
+	GroupDay   = "day"
+	GroupModel = "model"
+)
+
+// Filter 查询条件，零值字段表示不过滤
+type Filter struct {
+	From  time.Time // 包含
+	To    time.Time // 不包含
+	Key   string
+	Model string
+}
+
+// Match 检查记录是否满足过滤条件（不检查时间范围）
+func (f Filter) Match(record Record) bool {
+	if f.Key != "" && record.Key != f.Key {
+		return false
+	}
+	if f.Model != "" && record.Model != f.Model {
+		return false
+	}
+	return true
+}
+
+// ParseGroupBy 解析逗号分隔的分组维度，维度按 key、day、model 的固定顺序返回
+func ParseGroupBy(value string) ([]string, error) {
+	selected := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(strings.ToLower(part))
+		switch part {
+		case "":
+		case GroupKey, GroupDay, GroupModel:
+			selected[part] = true
+		default:
+			return nil, fmt.Errorf("unsupported group_by %q, expected key, day or model", part)
+		}
+	}
+
+	var groups []string
+	for _, group := range []string{GroupKey, GroupDay, GroupModel} {
+		if selected[group] {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// Summary 一组记录的用量汇总
+type Summary struct {
+	Key              string  `json:"key,omitempty"`
+	Day              string  `json:"day,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	CacheHits        int64   `json:"cache_hits"`
+	StreamRequests   int64   `json:"stream_requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	ReasoningTokens  int64   `json:"reasoning_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+
+	latencyTotal int64
+}
+
+// add 累加一条记录
+func (s *Summary) add(record Record) {
+	s.Requests++
+	if record.Status >= 400 {
+		s.Errors++
+	}
+	if record.CacheHit {
+		s.CacheHits++
+	}
+	if record.Stream {
+		s.StreamRequests++
+	}
+	s.PromptTokens += int64(record.PromptTokens)
+	s.CompletionTokens += int64(record.CompletionTokens)
+	s.ReasoningTokens += int64(record.ReasoningTokens)
+	s.TotalTokens += int64(record.TotalTokens)
+	s.latencyTotal += record.LatencyMs
+	s.AvgLatencyMs = float64(s.latencyTotal) / float64(s.Requests)
+}
+
+// Aggregator 按分组维度汇总记录，day 维度按 location 中的自然日划分
+type Aggregator struct {
+	groups   []string
+	location *time.Location
+
+	total   Summary
+	entries map[string]*Summary
+}
+
+// NewAggregator 创建汇总器，location 为nil时使用UTC
+func NewAggregator(groups []string, location *time.Location) *Aggregator {
+	if location == nil {
+		location = time.UTC
+	}
+	return &Aggregator{
+		groups:   groups,
+		location: location,
+		entries:  make(map[string]*Summary),
+	}
+}
+
+// Add 累加一条记录
+func (a *Aggregator) Add(record Record) error {
+	a.total.add(record)
+	if len(a.groups) == 0 {
+		return nil
+	}
+
+	var group Summary
+	for _, g := range a.groups {
+		switch g {
+		case GroupKey:
+			group.Key = record.Key
+		case GroupDay:
+			group.Day = record.Time.In(a.location).Format(time.DateOnly)
+		case GroupModel:
+			group.Model = record.Model
+		}
+	}
+
+	id := group.Key + "\x00" + group.Day + "\x00" + group.Model
+	entry, ok := a.entries[id]
+	if !ok {
+		entry = &group
+		a.entries[id] = entry
+	}
+	entry.add(record)
+	return nil
+}
+
+// Total 返回所有记录的汇总
+func (a *Aggregator) Total() Summary {
+	return a.total
+}
+
+// Groups 返回分组汇总，按 key、day、model 排序
+func (a *Aggregator) Groups() []Summary {
+	groups := make([]Summary, 0, len(a.entries))
+	for _, entry := range a.entries {
+		groups = append(groups, *entry)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Key != groups[j].Key {
+			return groups[i].Key < groups[j].Key
+		}
+		if groups[i].Day != groups[j].Day {
+			return groups[i].Day < groups[j].Day
+		}
+		return groups[i].Model < groups[j].Model
+	})
+	return groups
+}
+
+// WriteCSV 以CSV格式写出分组汇总，未分组时只写出合计一行
+func (a *Aggregator) WriteCSV(w io.Writer) error {
+	header := append([]string(nil), a.groups...)
+	header = append(header, "requests", "errors", "cache_hits", "stream_requests",
+		"prompt_tokens", "completion_tokens", "reasoning_tokens", "total_tokens", "avg_latency_ms")
+
+	rows := a.Groups()
+	if len(a.groups) == 0 {
+		rows = []Summary{a.total}
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var record []string
+		for _, g := range a.groups {
+			switch g {
+			case GroupKey:
+				record = append(record, row.Key)
+			case GroupDay:
+				record = append(record, row.Day)
+			case GroupModel:
+				record = append(record, row.Model)
+			}
+		}
+		record = append(record,
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.Errors, 10),
+			strconv.FormatInt(row.CacheHits, 10),
+			strconv.FormatInt(row.StreamRequests, 10),
+			strconv.FormatInt(row.PromptTokens, 10),
+			strconv.FormatInt(row.CompletionTokens, 10),
+			strconv.FormatInt(row.ReasoningTokens, 10),
+			strconv.FormatInt(row.TotalTokens, 10),
+			strconv.FormatFloat(row.AvgLatencyMs, 'f', 1, 64),
+		)
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
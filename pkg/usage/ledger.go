@@ -0,0 +1,273 @@
+package usage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"scira2api/log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 存储桶名称
+var bucketRecords = []byte("usage_records")
+
+const (
+	// pendingSize 等待写入的记录缓冲区大小，缓冲区满时丢弃新记录，避免阻塞请求
+	pendingSize = 4096
+	// batchSize 单个事务最多写入的记录数
+	batchSize = 256
+	// pruneInterval 清理过期记录的间隔
+	pruneInterval = time.Hour
+)
+
+// Record 一次已完成请求的用量记录
+type Record struct {
+	Time             time.Time `json:"time"`
+	Key              string    `json:"key"`
+	Model            string    `json:"model"`
+	InternalModel    string    `json:"internal_model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"` // 包含推理tokens
+	ReasoningTokens  int       `json:"reasoning_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Status           int       `json:"status"`
+	Stream           bool      `json:"stream"`
+	CacheHit         bool      `json:"cache_hit"`
+}
+
+// Ledger 用量账本，把每个请求的用量记录保存在本地bbolt文件中
+// 记录按时间顺序保存，由后台协程批量写入，并定期删除超过保留期的记录
+type Ledger struct {
+	db        *bolt.DB
+	retention time.Duration
+
+	pending chan Record
+	stop    chan struct{}
+	done    sync.WaitGroup
+	once    sync.Once
+
+	written int64
+	dropped int64
+	failed  int64
+	pruned  int64
+}
+
+// Open 打开或创建账本文件，retention 为记录保留时间，0 表示永久保留
+func Open(path string, retention time.Duration) (*Ledger, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("创建用量账本目录失败: %w", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("打开用量账本失败: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketRecords)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化用量账本失败: %w", err)
+	}
+
+	l := &Ledger{
+		db:        db,
+		retention: retention,
+		pending:   make(chan Record, pendingSize),
+		stop:      make(chan struct{}),
+	}
+	l.done.Add(1)
+	go l.writeLoop()
+	return l, nil
+}
+
+// Add 异步写入一条记录，缓冲区已满时丢弃并计数
+func (l *Ledger) Add(record Record) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	select {
+	case <-l.stop:
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	default:
+	}
+
+	select {
+	case l.pending <- record:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+// writeLoop 批量写入缓冲区中的记录，并定期清理过期记录
+func (l *Ledger) writeLoop() {
+	defer l.done.Done()
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	l.prune()
+
+	batch := make([]Record, 0, batchSize)
+	for {
+		select {
+		case record := <-l.pending:
+			batch = append(batch[:0], record)
+			batch = l.drain(batch)
+			l.write(batch)
+		case <-ticker.C:
+			l.prune()
+		case <-l.stop:
+			// 写入关闭前已经提交的记录
+			for {
+				batch = l.drain(batch[:0])
+				if len(batch) == 0 {
+					return
+				}
+				l.write(batch)
+			}
+		}
+	}
+}
+
+// drain 从缓冲区中取出已有的记录，最多取到 batchSize 条
+func (l *Ledger) drain(batch []Record) []Record {
+	for len(batch) < batchSize {
+		select {
+		case record := <-l.pending:
+			batch = append(batch, record)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// write 在一个事务中写入一批记录
+func (l *Ledger) write(batch []Record) {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRecords)
+		for _, record := range batch {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(recordKey(record.Time, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		atomic.AddInt64(&l.failed, int64(len(batch)))
+		log.Error("写入用量记录失败: %v", err)
+		return
+	}
+	atomic.AddInt64(&l.written, int64(len(batch)))
+}
+
+// prune 删除超过保留时间的记录
+func (l *Ledger) prune() {
+	if l.retention <= 0 {
+		return
+	}
+	cutoff := recordKey(time.Now().Add(-l.retention), 0)
+
+	var removed int64
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketRecords).Cursor()
+		for k, _ := cursor.First(); k != nil && string(k) < string(cutoff); k, _ = cursor.Next() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("清理过期用量记录失败: %v", err)
+		return
+	}
+	if removed > 0 {
+		atomic.AddInt64(&l.pruned, removed)
+		log.Info("已清理 %d 条过期用量记录", removed)
+	}
+}
+
+// Query 返回 [from, to) 时间范围内满足过滤条件的记录，按时间顺序依次调用 fn
+func (l *Ledger) Query(filter Filter, fn func(Record) error) error {
+	start := recordKey(filter.From, 0)
+
+	return l.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketRecords).Cursor()
+		for k, data := cursor.Seek(start); k != nil; k, data = cursor.Next() {
+			if !filter.To.IsZero() && int64(binary.BigEndian.Uint64(k[:8])) >= filter.To.UnixNano() {
+				return nil
+			}
+
+			var record Record
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("解析用量记录失败: %w", err)
+			}
+			if !filter.Match(record) {
+				continue
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetMetrics 获取指标
+func (l *Ledger) GetMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"pending":   len(l.pending),
+		"written":   atomic.LoadInt64(&l.written),
+		"dropped":   atomic.LoadInt64(&l.dropped),
+		"failed":    atomic.LoadInt64(&l.failed),
+		"pruned":    atomic.LoadInt64(&l.pruned),
+		"retention": l.retention.String(),
+	}
+}
+
+// Close 写入剩余的记录并关闭账本
+func (l *Ledger) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		l.done.Wait()
+		err = l.db.Close()
+	})
+	return err
+}
+
+// recordKey 记录的键：8字节纳秒时间戳加8字节序号，保证按时间排序且不重复
+func recordKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	ts := t.UnixNano()
+	if ts < 0 {
+		ts = 0
+	}
+	binary.BigEndian.PutUint64(key[:8], uint64(ts))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"scira2api/log"
+	"scira2api/pkg/capture"
+	"scira2api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runReplay 执行 replay 子命令：用当前的解析逻辑重新处理捕获文件中的上游数据
+// 用法: scira2api replay [-id 请求ID] <capture.jsonl>
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	id := flags.String("id", "", "只回放指定请求ID的记录")
+	verbose := flags.Bool("v", false, "输出解析过程中的日志")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "用法: scira2api replay [-id 请求ID] [-v] <capture.jsonl>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	// 回放结果写到标准输出，默认只保留警告和错误日志
+	gin.SetMode(gin.ReleaseMode)
+	if !*verbose {
+		log.SetLevel(log.WARN)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "打开捕获文件失败: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	replayed, failed := 0, 0
+	err = capture.Read(file, func(record capture.Record) error {
+		if *id != "" && record.RequestID != *id {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "==> %s model=%s stream=%t upstream_lines=%d status=%d\n",
+			record.RequestID, record.Model, record.Stream, len(record.UpstreamLines), record.Status)
+		if record.Truncated {
+			fmt.Fprintf(os.Stderr, "    记录已截断，回放结果可能不完整\n")
+		}
+		if err := service.Replay(record, os.Stdout); err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "    回放失败: %v\n", err)
+			return nil
+		}
+		replayed++
+		io.WriteString(os.Stdout, "\n")
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取捕获文件失败: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "回放完成: 成功 %d 条，失败 %d 条\n", replayed, failed)
+	if failed > 0 || (replayed == 0 && *id != "") {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,609 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"scira2api/config"
+	"scira2api/log"
+	"scira2api/pkg/audit"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/chaos"
+	"scira2api/pkg/errors"
+	"scira2api/pkg/ratelimit"
+	"scira2api/pkg/redact"
+	"scira2api/pkg/store"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler 管理接口处理器
+// 管理API密钥和模型映射（持久化到本地存储），在运行时切换缓存和限流器、
+// 调整日志级别并查看身份、代理和熔断状态，所有修改操作写入审计日志
+type AdminHandler struct {
+	config   *config.Config
+	chat     *ChatHandler
+	keyStore *auth.KeyStore
+	store    *store.Store
+	audit    *audit.Logger
+}
+
+// apiKeyRequest 创建或更新API密钥的请求体
+// 更新时只修改提供了的字段；expires_at 传零值时间表示取消过期时间
+type apiKeyRequest struct {
+	Name             string            `json:"name"`
+	Key              string            `json:"key"`
+	Enabled          *bool             `json:"enabled"`
+	ExpiresAt        *time.Time        `json:"expires_at"`
+	AllowedModels    []string          `json:"allowed_models"`
+	AllowedEndpoints []string          `json:"allowed_endpoints"`
+	RateLimit        *auth.RateLimit   `json:"rate_limit"`
+	Budget           *auth.Budget      `json:"budget"`
+	Tier             *string           `json:"tier"`
+	Priority         *int              `json:"priority"`
+	TimeZone         *string           `json:"timezone"`
+	Group            *string           `json:"group"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// NewAdminHandler 创建管理接口处理器，并把存储中保存的修改应用到密钥和模型映射
+func NewAdminHandler(cfg *config.Config, chat *ChatHandler, keyStore *auth.KeyStore) (*AdminHandler, error) {
+	st, err := store.Open(cfg.Admin.StorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLogger, err := audit.NewLogger(cfg.Admin.AuditLogPath)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	a := &AdminHandler{
+		config:   cfg,
+		chat:     chat,
+		keyStore: keyStore,
+		store:    st,
+		audit:    auditLogger,
+	}
+
+	if err := a.restore(); err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	log.Info("管理接口已启用: 存储=%s, 审计日志=%s", cfg.Admin.StorePath, cfg.Admin.AuditLogPath)
+	return a, nil
+}
+
+// restore 应用存储中保存的API密钥和模型映射，存储中的记录优先于配置
+func (a *AdminHandler) restore() error {
+	keys, deletedKeys, err := a.store.APIKeys()
+	if err != nil {
+		return err
+	}
+	for _, name := range deletedKeys {
+		a.keyStore.Remove(name)
+	}
+	for _, key := range keys {
+		if err := a.keyStore.Put(key); err != nil {
+			return fmt.Errorf("恢复API密钥 %s 失败: %w", key.Name, err)
+		}
+	}
+
+	mappings, deletedMappings, err := a.store.ModelMappings()
+	if err != nil {
+		return err
+	}
+	for _, external := range deletedMappings {
+		a.config.DeleteModelMapping(external)
+	}
+	for external, internal := range mappings {
+		a.config.SetModelMapping(external, internal)
+	}
+
+	if len(keys)+len(deletedKeys)+len(mappings)+len(deletedMappings) > 0 {
+		log.Info("已恢复管理接口修改: 密钥=%d, 删除密钥=%d, 模型映射=%d, 删除映射=%d",
+			len(keys), len(deletedKeys), len(mappings), len(deletedMappings))
+	}
+	return nil
+}
+
+// RegisterRoutes 注册管理接口路由
+func (a *AdminHandler) RegisterRoutes(group *gin.RouterGroup) {
+	group.GET("/keys", a.listKeys)
+	group.POST("/keys", a.createKey)
+	group.GET("/keys/:name", a.getKey)
+	group.PUT("/keys/:name", a.updateKey)
+	group.DELETE("/keys/:name", a.deleteKey)
+
+	group.GET("/models", a.listModelMappings)
+	group.PUT("/models/:name", a.putModelMapping)
+	group.DELETE("/models/:name", a.deleteModelMapping)
+
+	group.PUT("/cache", a.toggleCache)
+	group.POST("/cache/purge", a.purgeCache)
+	group.PUT("/ratelimit", a.toggleRateLimiter)
+	group.GET("/log-level", a.getLogLevel)
+	group.PUT("/log-level", a.setLogLevel)
+
+	group.GET("/state", a.getState)
+	group.GET("/audit", a.getAudit)
+	group.GET("/usage", a.getUsage)
+	group.GET("/latency", a.getLatency)
+
+	group.GET("/chaos", a.getChaos)
+	group.PUT("/chaos", a.putChaos)
+}
+
+// record 写入审计记录
+func (a *AdminHandler) record(c *gin.Context, action, target string, detail interface{}, err error) {
+	entry := audit.Entry{
+		Actor:    "admin",
+		RemoteIP: c.ClientIP(),
+		Action:   action,
+		Target:   target,
+		Detail:   detail,
+		Success:  err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	a.audit.Log(entry)
+}
+
+// respondError 返回错误响应
+func respondError(c *gin.Context, apiErr *errors.APIError) {
+	c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+}
+
+// listKeys 列出所有API密钥（不含哈希）
+func (a *AdminHandler) listKeys(c *gin.Context) {
+	keys := a.keyStore.List()
+	data := make([]auth.APIKey, 0, len(keys))
+	for _, key := range keys {
+		data = append(data, key.Public())
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+// getKey 获取单个API密钥
+func (a *AdminHandler) getKey(c *gin.Context) {
+	key, ok := a.keyStore.Get(c.Param("name"))
+	if !ok {
+		respondError(c, &errors.APIError{Code: http.StatusNotFound, Message: "API key not found", Type: "not_found"})
+		return
+	}
+	c.JSON(http.StatusOK, key.Public())
+}
+
+// createKey 创建API密钥，未提供 key 时自动生成，明文只在响应中返回一次
+func (a *AdminHandler) createKey(c *gin.Context) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, errors.NewInvalidRequestError("无法解析请求JSON", err))
+		return
+	}
+
+	plaintext := req.Key
+	if plaintext == "" {
+		generated, err := generateAPIKey()
+		if err != nil {
+			respondError(c, errors.NewInternalServerError("生成API密钥失败", err))
+			return
+		}
+		plaintext = generated
+	}
+	redact.AddSecrets(plaintext)
+
+	key := auth.APIKey{Name: req.Name, Key: plaintext, Enabled: true}
+	applyKeyRequest(&key, req)
+
+	err := a.keyStore.Add(key)
+	if err == nil {
+		key, _ = a.keyStore.Get(strings.TrimSpace(req.Name))
+		if err = a.store.PutAPIKey(key); err != nil {
+			// 未能持久化的密钥不生效，否则重启后会消失且与审计记录不一致
+			a.keyStore.Remove(key.Name)
+		}
+	}
+	a.record(c, "key.create", req.Name, key.Public(), err)
+	if err != nil {
+		a.respondKeyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":     plaintext,
+		"api_key": key.Public(),
+	})
+}
+
+// updateKey 更新API密钥策略，提供 key 时轮换密钥
+func (a *AdminHandler) updateKey(c *gin.Context) {
+	name := c.Param("name")
+	key, ok := a.keyStore.Get(name)
+	if !ok {
+		respondError(c, &errors.APIError{Code: http.StatusNotFound, Message: "API key not found", Type: "not_found"})
+		return
+	}
+
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, errors.NewInvalidRequestError("无法解析请求JSON", err))
+		return
+	}
+
+	previous := key
+	rotated := req.Key != ""
+	if rotated {
+		key.Key = req.Key
+		redact.AddSecrets(req.Key)
+	}
+	applyKeyRequest(&key, req)
+
+	err := a.keyStore.Put(key)
+	if err == nil {
+		key, _ = a.keyStore.Get(name)
+		if err = a.store.PutAPIKey(key); err != nil {
+			a.restoreKey(previous)
+		}
+	}
+	a.record(c, "key.update", name, gin.H{"api_key": key.Public(), "rotated": rotated}, err)
+	if err != nil {
+		a.respondKeyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, key.Public())
+}
+
+// deleteKey 删除API密钥
+func (a *AdminHandler) deleteKey(c *gin.Context) {
+	name := c.Param("name")
+	previous, _ := a.keyStore.Get(name)
+	err := a.keyStore.Remove(name)
+	if err == nil {
+		if err = a.store.DeleteAPIKey(name); err != nil {
+			a.restoreKey(previous)
+		}
+	}
+	a.record(c, "key.delete", name, nil, err)
+	if err != nil {
+		a.respondKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": name})
+}
+
+// restoreKey 持久化失败时把内存中的密钥恢复为修改前的状态
+func (a *AdminHandler) restoreKey(previous auth.APIKey) {
+	if err := a.keyStore.Put(previous); err != nil {
+		log.Error("恢复API密钥 %s 失败: %v", previous.Name, err)
+	}
+}
+
+// respondKeyError 把密钥存储错误转换为HTTP响应
+func (a *AdminHandler) respondKeyError(c *gin.Context, err error) {
+	switch {
+	case stderrors.Is(err, auth.ErrKeyNotFound):
+		respondError(c, &errors.APIError{Code: http.StatusNotFound, Message: err.Error(), Type: "not_found"})
+	case stderrors.Is(err, auth.ErrKeyExists):
+		respondError(c, &errors.APIError{Code: http.StatusConflict, Message: err.Error(), Type: "conflict"})
+	default:
+		respondError(c, errors.NewInvalidRequestError(err.Error(), err))
+	}
+}
+
+// applyKeyRequest 把请求中提供的字段应用到密钥
+func applyKeyRequest(key *auth.APIKey, req apiKeyRequest) {
+	if req.Enabled != nil {
+		key.Enabled = *req.Enabled
+	}
+	if req.ExpiresAt != nil {
+		if req.ExpiresAt.IsZero() {
+			key.ExpiresAt = nil
+		} else {
+			expiresAt := *req.ExpiresAt
+			key.ExpiresAt = &expiresAt
+		}
+	}
+	if req.AllowedModels != nil {
+		key.AllowedModels = req.AllowedModels
+	}
+	if req.AllowedEndpoints != nil {
+		key.AllowedEndpoints = req.AllowedEndpoints
+	}
+	if req.RateLimit != nil {
+		key.RateLimit = *req.RateLimit
+	}
+	if req.Budget != nil {
+		key.Budget = *req.Budget
+	}
+	if req.Tier != nil {
+		key.Tier = *req.Tier
+	}
+	if req.Priority != nil {
+		key.Priority = *req.Priority
+	}
+	if req.TimeZone != nil {
+		key.TimeZone = *req.TimeZone
+	}
+	if req.Group != nil {
+		key.Group = *req.Group
+	}
+	if req.Metadata != nil {
+		key.Metadata = req.Metadata
+	}
+}
+
+// generateAPIKey 生成随机API密钥
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(buf), nil
+}
+
+// listModelMappings 列出模型映射
+func (a *AdminHandler) listModelMappings(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": a.config.GetModelMapping()})
+}
+
+// putModelMapping 添加或更新模型映射
+func (a *AdminHandler) putModelMapping(c *gin.Context) {
+	external := c.Param("name")
+	var req struct {
+		Internal string `json:"internal"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Internal) == "" {
+		respondError(c, errors.NewInvalidRequestError("请求体必须包含 internal 字段", err))
+		return
+	}
+	internal := strings.TrimSpace(req.Internal)
+
+	err := a.store.PutModelMapping(external, internal)
+	if err == nil {
+		a.config.SetModelMapping(external, internal)
+		a.invalidateModelCache()
+	}
+	a.record(c, "model.put", external, gin.H{"internal": internal}, err)
+	if err != nil {
+		respondError(c, errors.NewInternalServerError("保存模型映射失败", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"external": external, "internal": internal})
+}
+
+// deleteModelMapping 删除模型映射
+func (a *AdminHandler) deleteModelMapping(c *gin.Context) {
+	external := c.Param("name")
+	if _, ok := a.config.GetModelMapping()[external]; !ok {
+		respondError(c, &errors.APIError{Code: http.StatusNotFound, Message: "model mapping not found", Type: "not_found"})
+		return
+	}
+
+	err := a.store.DeleteModelMapping(external)
+	if err == nil {
+		a.config.DeleteModelMapping(external)
+		a.invalidateModelCache()
+	}
+	a.record(c, "model.delete", external, nil, err)
+	if err != nil {
+		respondError(c, errors.NewInternalServerError("删除模型映射失败", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": external})
+}
+
+// invalidateModelCache 模型映射变化后使模型列表缓存失效
+func (a *AdminHandler) invalidateModelCache() {
+	if a.chat.responseCache != nil {
+		a.chat.responseCache.InvalidateModelCache()
+	}
+}
+
+// toggleRequest 启用或禁用组件的请求体
+type toggleRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// toggleCache 启用或禁用响应缓存
+func (a *AdminHandler) toggleCache(c *gin.Context) {
+	var component ratelimit.Toggleable
+	if a.chat.responseCache != nil {
+		component = a.chat.responseCache
+	}
+	a.toggle(c, "cache.toggle", "cache", component)
+}
+
+// toggleRateLimiter 启用或禁用限流器
+func (a *AdminHandler) toggleRateLimiter(c *gin.Context) {
+	toggleable, _ := a.chat.rateLimiter.(ratelimit.Toggleable)
+	a.toggle(c, "ratelimit.toggle", "rate_limiter", toggleable)
+}
+
+// toggle 切换组件的启用状态
+func (a *AdminHandler) toggle(c *gin.Context, action, target string, component ratelimit.Toggleable) {
+	var req toggleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		respondError(c, errors.NewInvalidRequestError("请求体必须包含 enabled 字段", err))
+		return
+	}
+	if component == nil {
+		respondError(c, errors.NewServiceUnavailableError(target+" is not available", nil))
+		return
+	}
+
+	if *req.Enabled {
+		component.Enable()
+	} else {
+		component.Disable()
+	}
+	a.record(c, action, target, gin.H{"enabled": *req.Enabled}, nil)
+
+	c.JSON(http.StatusOK, gin.H{target: gin.H{"enabled": component.IsEnabled()}})
+}
+
+// purgeCache 清空响应缓存
+func (a *AdminHandler) purgeCache(c *gin.Context) {
+	if a.chat.responseCache == nil {
+		respondError(c, errors.NewServiceUnavailableError("cache is not available", nil))
+		return
+	}
+	a.chat.responseCache.Clear()
+	a.record(c, "cache.purge", "cache", nil, nil)
+	c.JSON(http.StatusOK, gin.H{"purged": true})
+}
+
+// getLogLevel 获取日志级别
+func (a *AdminHandler) getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": log.GetLevelName(log.GetLevel())})
+}
+
+// setLogLevel 修改日志级别
+func (a *AdminHandler) setLogLevel(c *gin.Context) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, errors.NewInvalidRequestError("无法解析请求JSON", err))
+		return
+	}
+	level, ok := log.ParseLevel(req.Level)
+	if !ok {
+		respondError(c, errors.NewInvalidRequestError(fmt.Sprintf("未知的日志级别: %s", req.Level), nil))
+		return
+	}
+
+	previous := log.GetLevelName(log.GetLevel())
+	log.SetLevel(level)
+	a.record(c, "log.level", "log", gin.H{"from": previous, "to": log.GetLevelName(level)}, nil)
+
+	c.JSON(http.StatusOK, gin.H{"level": log.GetLevelName(level)})
+}
+
+// getState 查看运行时状态：缓存、限流器、上游身份、代理和熔断状态
+// 项目没有独立的熔断器，这里把被隔离的上游身份和被移出轮换的代理视为处于熔断打开状态
+func (a *AdminHandler) getState(c *gin.Context) {
+	h := a.chat
+	state := gin.H{
+		"log_level":    log.GetLevelName(log.GetLevel()),
+		"cache":        h.GetCacheMetrics(),
+		"rate_limiter": h.GetRateLimiterMetrics(),
+		"proxies":      h.GetProxyPoolMetrics(),
+		"chaos":        h.GetChaosMetrics(),
+	}
+
+	openIdentities := gin.H{}
+	identities := gin.H{"sessions_enabled": h.sessionManager != nil}
+	if h.sessionManager != nil {
+		identities["sessions"] = h.sessionManager.Sessions()
+		for userId, until := range h.sessionManager.Quarantined() {
+			openIdentities[userId] = until.Format(time.RFC3339)
+		}
+		identities["quarantined"] = openIdentities
+	}
+	state["identities"] = identities
+
+	openProxies := make([]string, 0)
+	if h.proxyPool != nil {
+		for _, stats := range h.proxyPool.Stats() {
+			if !stats.Healthy {
+				openProxies = append(openProxies, stats.Proxy)
+			}
+		}
+	}
+	state["breakers"] = gin.H{
+		"identities": openIdentities,
+		"proxies":    openProxies,
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// getAudit 查看最近的审计记录
+func (a *AdminHandler) getAudit(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	c.JSON(http.StatusOK, gin.H{"data": a.audit.Recent(limit)})
+}
+
+// getUsage 查询所有API密钥的用量汇总，参数同 /v1/usage，另外支持 key 过滤和 group_by=key
+func (a *AdminHandler) getUsage(c *gin.Context) {
+	a.chat.respondUsage(c, "", true)
+}
+
+// getLatency 查询按模型的延迟分位数：总耗时、上游首字节、首个token和流式数据块间隔
+func (a *AdminHandler) getLatency(c *gin.Context) {
+	c.JSON(http.StatusOK, a.chat.GetLatencyMetrics())
+}
+
+// chaosRequest 修改故障注入的请求体，只修改提供了的字段；rules 替换全部规则
+type chaosRequest struct {
+	Enabled *bool         `json:"enabled"`
+	Rules   *[]chaos.Rule `json:"rules"`
+}
+
+// getChaos 查看故障注入规则和注入统计
+func (a *AdminHandler) getChaos(c *gin.Context) {
+	c.JSON(http.StatusOK, a.chaosState())
+}
+
+// putChaos 启用或禁用故障注入并替换规则，修改不持久化，重启后恢复为配置
+func (a *AdminHandler) putChaos(c *gin.Context) {
+	var req chaosRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, errors.NewInvalidRequestError("无法解析请求JSON", err))
+		return
+	}
+
+	injector := a.chat.chaos
+	var err error
+	if req.Rules != nil {
+		err = injector.SetRules(*req.Rules)
+	}
+	if err == nil && req.Enabled != nil {
+		if *req.Enabled {
+			injector.Enable()
+		} else {
+			injector.Disable()
+		}
+	}
+	a.record(c, "chaos.update", "chaos", req, err)
+	if err != nil {
+		respondError(c, errors.NewInvalidRequestError(err.Error(), err))
+		return
+	}
+
+	c.JSON(http.StatusOK, a.chaosState())
+}
+
+// chaosState 故障注入的当前状态
+func (a *AdminHandler) chaosState() gin.H {
+	injector := a.chat.chaos
+	return gin.H{
+		"enabled": injector.IsEnabled(),
+		"rules":   injector.Rules(),
+		"metrics": injector.GetMetrics(),
+	}
+}
+
+// Close 关闭存储和审计日志
+func (a *AdminHandler) Close() error {
+	var errs []error
+	if err := a.audit.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.store.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return stderrors.Join(errs...)
+}
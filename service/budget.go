@@ -0,0 +1,124 @@
+package service
+
+import (
+	stderrors "errors"
+	"fmt"
+	"scira2api/config"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/budget"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/errors"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/usage"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelPrice 查找模型价格：先按外部模型名，再按映射后的内部模型名，未配置价格的模型不计费
+func modelPrice(cfg *config.Config, model string) budget.Price {
+	price, ok := cfg.Budget.Prices[model]
+	if !ok {
+		price = cfg.Budget.Prices[MapModelName(cfg, model)]
+	}
+	return budget.Price{Input: price.Input, Output: price.Output, Reasoning: price.Reasoning}
+}
+
+// budgetAccount 预算按密钥名称统计，未认证的请求统一计入 anonymous
+func budgetAccount(key *auth.APIKey) string {
+	if key == nil {
+		return constants.UsageAnonymousKey
+	}
+	return key.Name
+}
+
+// keyBudget 计算密钥的预算：密钥单独设置的预算优先，否则使用默认预算
+func (h *ChatHandler) keyBudget(key *auth.APIKey) budget.Limit {
+	limit := budget.Limit{Daily: h.config.Budget.Daily, Monthly: h.config.Budget.Monthly}
+	if key != nil {
+		if key.Budget.Daily > 0 {
+			limit.Daily = key.Budget.Daily
+		}
+		if key.Budget.Monthly > 0 {
+			limit.Monthly = key.Budget.Monthly
+		}
+	}
+	return limit
+}
+
+// reserveBudget 在调用上游之前按提示tokens的费用预留预算
+// 剩余预算不足时返回402，同时设置 x-budget-* 响应头；已用比例达到告警阈值时设置 x-budget-warning
+func (h *ChatHandler) reserveBudget(c *gin.Context, request models.OpenAIChatCompletionsRequest, promptTokens int) (*budget.Reservation, error) {
+	if h.budgets == nil {
+		return nil, nil
+	}
+
+	key := auth.FromContext(c.Request.Context())
+	account := budgetAccount(key)
+	estimated := modelPrice(h.config, request.Model).Cost(promptTokens, 0, 0)
+
+	reservation, statuses, err := h.budgets.Reserve(account, estimated, h.keyBudget(key))
+	h.setBudgetHeaders(c, statuses)
+	if err != nil {
+		log.Ctx(c.Request.Context()).Warn("%s 预算不足: %v", account, err)
+		metrics.LimiterRejected(metrics.LimiterBudget)
+		message := "预算不足，请求已拒绝"
+		if stderrors.Is(err, budget.ErrBudgetExceeded) {
+			message = err.Error()
+		}
+		apiErr := errors.NewInsufficientQuotaError(message, err)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return nil, apiErr
+	}
+	return reservation, nil
+}
+
+// settleBudget 按实际用量的费用结算预算
+func (h *ChatHandler) settleBudget(reservation *budget.Reservation, request models.OpenAIChatCompletionsRequest, counter *TokenCounter) {
+	if reservation == nil {
+		return
+	}
+	billed := billedUsage(counter)
+	reasoning := counter.GetReasoningTokens()
+	if billed.CompletionTokens == 0 {
+		reasoning = 0
+	}
+	reservation.Settle(modelPrice(h.config, request.Model).Cost(billed.PromptTokens, billed.CompletionTokens, reasoning))
+}
+
+// setBudgetHeaders 设置预算响应头
+func (h *ChatHandler) setBudgetHeaders(c *gin.Context, statuses []budget.Status) {
+	for _, status := range statuses {
+		limitHeader, remainingHeader := constants.HeaderBudgetLimitDaily, constants.HeaderBudgetRemainingDaily
+		if status.Period == budget.PeriodMonthly {
+			limitHeader, remainingHeader = constants.HeaderBudgetLimitMonthly, constants.HeaderBudgetRemainingMonthly
+		}
+		c.Header(limitHeader, strconv.FormatFloat(status.Limit, 'f', 4, 64))
+		c.Header(remainingHeader, strconv.FormatFloat(status.Remaining, 'f', 4, 64))
+
+		if threshold := h.budgets.Warning(status); threshold > 0 {
+			c.Header(constants.HeaderBudgetWarning, fmt.Sprintf("%s budget %.0f%% used ($%.4f of $%.4f)",
+				status.Period, status.UsedRatio()*100, status.Spent, status.Limit))
+		}
+	}
+}
+
+// seedBudgets 从用量账本恢复本月各密钥已产生的费用，缓存命中的请求不计费
+func seedBudgets(cfg *config.Config, tracker *budget.Tracker, ledger *usage.Ledger) error {
+	now := time.Now().UTC()
+	filter := usage.Filter{
+		From: time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		To:   now.Add(time.Second),
+	}
+
+	return ledger.Query(filter, func(record usage.Record) error {
+		if !record.CacheHit {
+			cost := modelPrice(cfg, record.Model).Cost(record.PromptTokens, record.CompletionTokens, record.ReasoningTokens)
+			tracker.Seed(record.Key, record.Time, cost)
+		}
+		return nil
+	})
+}
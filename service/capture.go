@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"scira2api/config"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/capture"
+
+	"github.com/gin-gonic/gin"
+)
+
+// captureWriter 在写给客户端的同时把响应追加到捕获会话
+type captureWriter struct {
+	gin.ResponseWriter
+	session *capture.Session
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.session.AppendResponse(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.session.AppendResponse([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// startCapture 按密钥或采样比例决定是否捕获请求，捕获时把会话放入请求上下文并包装响应写入器
+func (h *ChatHandler) startCapture(c *gin.Context, request models.OpenAIChatCompletionsRequest) *capture.Session {
+	ctx := c.Request.Context()
+	key := auth.KeyName(ctx)
+	if !h.capture.ShouldCapture(key) {
+		return nil
+	}
+	ctx, session := h.capture.Start(ctx, requestID(c), key, request.Model, request.Stream, request)
+	c.Request = c.Request.WithContext(ctx)
+	c.Writer = &captureWriter{ResponseWriter: c.Writer, session: session}
+	return session
+}
+
+// Replay 用当前的解析逻辑重新处理捕获记录中的上游数据，把生成的客户端响应写入 w
+// 流式记录输出SSE事件，非流式记录输出JSON响应；响应ID和时间戳会重新生成
+func Replay(record capture.Record, w io.Writer) error {
+	var request models.OpenAIChatCompletionsRequest
+	if err := json.Unmarshal(record.Request, &request); err != nil {
+		return fmt.Errorf("decode captured request: %w", err)
+	}
+	if request.Model == "" {
+		request.Model = record.Model
+	}
+	request.Stream = record.Stream
+
+	// 回放不访问上游，只需要解析和token统计用到的配置
+	h := &ChatHandler{config: &config.Config{}}
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	// 回放产生的日志带上原请求的ID和模型
+	c.Request = c.Request.WithContext(log.WithFields(c.Request.Context(), log.FieldRequestID, record.RequestID, log.FieldModel, request.Model))
+
+	counter := NewTokenCounter()
+	h.calculateInputTokens(c.Request.Context(), request, counter)
+
+	if record.Stream {
+		responseID := h.generateResponseID()
+		created := record.Time.Unix()
+		if err := h.sendInitialMessage(c.Writer, c.Writer, responseID, created, request.Model, counter); err != nil {
+			return err
+		}
+		for _, line := range record.UpstreamLines {
+			if err := h.processStreamLine(c.Request.Context(), c.Writer, c.Writer, line, responseID, created, request.Model, counter); err != nil {
+				return fmt.Errorf("process upstream line %q: %w", line, err)
+			}
+		}
+		if err := h.sendFinalMessage(c.Request.Context(), c.Writer, c.Writer, responseID, created, request.Model, counter); err != nil {
+			return err
+		}
+	} else {
+		content, reasoningContent, usage, finishReason := "", "", models.Usage{}, "stop"
+		for _, line := range record.UpstreamLines {
+			processLineData(c.Request.Context(), line, &content, &reasoningContent, &usage, &finishReason)
+		}
+		correctedUsage := h.processTokenCounting(c.Request.Context(), content, reasoningContent, usage, counter)
+		h.createAndSendResponse(c, request, request.Model, content, reasoningContent, finishReason, correctedUsage)
+	}
+
+	_, err := w.Write(recorder.Body.Bytes())
+	return err
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	stdErrors "errors"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/chaos"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errChaosDisconnect 故障注入断开客户端连接后的写入错误
+var errChaosDisconnect = stdErrors.New("client connection closed by fault injection")
+
+// startChaos 按API密钥和模型选择故障规则放入请求上下文，上游Transport和SSE写入器从上下文读取
+func (h *ChatHandler) startChaos(c *gin.Context, request models.OpenAIChatCompletionsRequest) {
+	ctx := c.Request.Context()
+	if plan := h.chaos.Plan(auth.KeyName(ctx), request.Model); plan != nil {
+		c.Request = c.Request.WithContext(chaos.NewContext(ctx, plan))
+	}
+}
+
+// chaosWriter 在写出SSE事件时按故障规则插入格式错误的数据块或断开客户端连接
+type chaosWriter struct {
+	gin.ResponseWriter
+	ctx    context.Context // 请求上下文，日志带上请求字段
+	faults *chaos.StreamFaults
+	closed bool
+}
+
+func (w *chaosWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errChaosDisconnect
+	}
+	// 心跳注释不计入事件
+	if bytes.HasPrefix(p, []byte("data: ")) {
+		malformed, disconnect := w.faults.Next()
+		if disconnect {
+			w.disconnect()
+			return 0, errChaosDisconnect
+		}
+		if malformed {
+			if _, err := w.ResponseWriter.Write(chaos.Malformed(p)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *chaosWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *chaosWriter) Flush() {
+	if !w.closed {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// disconnect 刷新已写出的事件后直接关闭底层连接，客户端读到不完整的分块响应，与网络中断相同
+func (w *chaosWriter) disconnect() {
+	w.closed = true
+	w.ResponseWriter.Flush()
+	conn, _, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		log.Ctx(w.ctx).Warn("故障注入无法断开客户端连接: %v", err)
+		return
+	}
+	conn.Close()
+}
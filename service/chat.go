@@ -3,18 +3,25 @@ package service
 import (
 	"bufio"
 	"context"
+	stdErrors "errors"
 	"fmt"
 	"net/http"
-	"scira2api/config"
 	"scira2api/log"
 	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/capture"
 	"scira2api/pkg/constants"
+	"scira2api/pkg/fixture"
 	"scira2api/pkg/errors"
 	httpClient "scira2api/pkg/http"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/redact"
+	"scira2api/pkg/tracing"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // 优化点: 添加请求结果结构体的详细注释
@@ -33,6 +40,8 @@ type chatRequestResult struct {
 // 预期效果: 更清晰的处理流程和错误处理
 // ChatCompletionsHandler 处理聊天完成请求
 func (h *ChatHandler) ChatCompletionsHandler(c *gin.Context) {
+	start := time.Now()
+	
 	// 预处理请求
 	request, err := h.preprocessChatRequest(c)
 	if err != nil {
@@ -40,11 +49,61 @@ func (h *ChatHandler) ChatCompletionsHandler(c *gin.Context) {
 		return
 	}
 	
+	// 按密钥或采样比例捕获请求，处理结束后写出记录
+	if session := h.startCapture(c, request); session != nil {
+		defer func() {
+			session.Finish(c.Writer.Status())
+		}()
+	}
+	
+	// 按密钥和模型选择故障注入规则，上游请求和SSE写出时按规则注入
+	h.startChaos(c, request)
+	
 	// 创建新的token计数器，确保每个请求数据隔离
 	tokenCounter := NewTokenCounter()
 	
 	// 计算输入tokens
-	h.calculateInputTokens(request, tokenCounter)
+	h.calculateInputTokens(c.Request.Context(), request, tokenCounter)
+	
+	// 按估算的提示tokens预留令牌配额，请求结束后按实际用量结算
+	_, span := tracing.Start(c.Request.Context(), "ratelimit.tokens")
+	reservations, err := h.reserveTokens(c, request, tokenCounter.GetUsage().PromptTokens)
+	tracing.End(span, err)
+	if err != nil {
+		return
+	}
+	defer func() {
+		reservations.settle(settledTokens(tokenCounter))
+	}()
+	
+	// 按提示tokens的费用预留预算，剩余预算不足时在调用上游之前拒绝
+	_, span = tracing.Start(c.Request.Context(), "budget.reserve")
+	budgetReservation, err := h.reserveBudget(c, request, tokenCounter.GetUsage().PromptTokens)
+	tracing.End(span, err)
+	if err != nil {
+		return
+	}
+	defer h.settleBudget(budgetReservation, request, tokenCounter)
+	
+	// 获取并发名额，流式请求会一直占用到响应流处理结束
+	_, span = tracing.Start(c.Request.Context(), "concurrency.acquire")
+	release, apiErr := h.acquireConcurrency(c)
+	endStage(span, apiErr)
+	if apiErr != nil {
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+	defer release()
+	
+	// 请求结束后写入用量账本；在此之前被拒绝的请求没有调用上游，不记录
+	defer func() {
+		h.recordUsage(c, request, billedUsage(tokenCounter), tokenCounter.GetReasoningTokens(), time.Since(start), false)
+	}()
+	
+	// 记录实际调用上游的请求的总耗时
+	defer func() {
+		h.observeLatency(request.Model, metrics.LatencyTotal, time.Since(start))
+	}()
 
 	// 明确分离流式和非流式处理路径
 	if request.Stream {
@@ -59,40 +118,76 @@ func (h *ChatHandler) ChatCompletionsHandler(c *gin.Context) {
 // 预期效果: 主函数更简洁，职责更明确
 func (h *ChatHandler) preprocessChatRequest(c *gin.Context) (models.OpenAIChatCompletionsRequest, error) {
 	var request models.OpenAIChatCompletionsRequest
+	start := time.Now()
 	
-	// 应用请求限制
+	// 所有响应都携带当前的请求限流状态
 	if h.rateLimiter != nil {
-		ctx := c.Request.Context()
-		if err := h.rateLimiter.Wait(ctx); err != nil {
-			log.Warn("请求限制器拒绝请求: %v", err)
-			apiErr := errors.NewTooManyRequestsError("请求过于频繁，请稍后重试", err)
-			c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
-			return request, err
-		}
+		setRequestHeaders(c, h.rateLimiter.Status())
 	}
 
 	// 解析请求体
+	_, span := tracing.Start(c.Request.Context(), "validate")
 	if err := c.ShouldBindJSON(&request); err != nil {
-		log.Error("绑定JSON错误: %s", err)
+		log.Ctx(c.Request.Context()).Error("绑定JSON错误: %s", err)
 		apiErr := errors.NewInvalidRequestError("无法解析请求JSON", err)
+		tracing.End(span, err)
 		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
 		return request, err
 	}
+	span.SetAttributes(attribute.String("llm.model", request.Model), attribute.Bool("stream", request.Stream))
 
 	// 参数检查
 	if err := h.chatParamCheck(request); err != nil {
-		log.Error("聊天参数检查错误: %s", err)
+		log.Ctx(c.Request.Context()).Error("聊天参数检查错误: %s", err)
 		apiErr := errors.NewInvalidRequestError(err.Error(), err)
+		tracing.End(span, err)
 		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
 		return request, err
 	}
+	c.Set(constants.ContextKeyModel, request.Model)
+	log.AddFields(c.Request.Context(), log.FieldModel, request.Model)
+	
+	// 检查API密钥是否允许使用该模型
+	if key := auth.FromContext(c.Request.Context()); key != nil && !key.AllowsModel(request.Model) {
+		log.Ctx(c.Request.Context()).Warn("API密钥 %s 无权使用模型 %s", key.Name, request.Model)
+		apiErr := errors.NewForbiddenError(fmt.Sprintf("API key is not allowed to use model %s", request.Model))
+		endStage(span, apiErr)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return request, fmt.Errorf("模型 %s 不在密钥允许范围内", request.Model)
+	}
+	span.End()
+	
+	// 全局限流（在请求校验之后，避免无效请求消耗令牌），wait 模式下包含排队时间
+	_, span = tracing.Start(c.Request.Context(), "ratelimit.global")
+	global, apiErr := h.reserveGlobal(c)
+	endStage(span, apiErr)
+	if apiErr != nil {
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return request, apiErr
+	}
+	
+	// 按密钥/IP和模型限流
+	_, span = tracing.Start(c.Request.Context(), "ratelimit.keyed")
+	apiErr = h.applyKeyedLimits(c, request, global)
+	endStage(span, apiErr)
+	if apiErr != nil {
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return request, apiErr
+	}
 	
 	// 非流式请求，尝试从缓存获取响应
 	if !request.Stream && h.responseCache != nil && h.responseCache.IsEnabled() {
+		_, span = tracing.Start(c.Request.Context(), "cache.lookup")
 		cachedResponse, found := h.responseCache.GetResponseCache(request)
+		metrics.CacheLookup(metrics.CacheResponse, found)
+		span.SetAttributes(attribute.Bool("cache.hit", found))
+		span.End()
 		if found {
-			log.Info("从缓存返回聊天完成响应")
+			log.Ctx(c.Request.Context()).Info("从缓存返回聊天完成响应")
+			_, span = tracing.Start(c.Request.Context(), "response.write")
 			c.JSON(http.StatusOK, cachedResponse)
+			span.End()
+			h.recordUsage(c, request, cachedResponse.Usage, 0, time.Since(start), true)
 			return request, fmt.Errorf("使用缓存响应")
 		}
 	}
@@ -100,22 +195,39 @@ func (h *ChatHandler) preprocessChatRequest(c *gin.Context) (models.OpenAIChatCo
 	return request, nil
 }
 
+// upstreamErrorMessage 返回给客户端的上游错误信息，回放模式未命中时带上请求哈希，便于补充录制
+func upstreamErrorMessage(err error, message string) string {
+	var miss *fixture.MissError
+	if stdErrors.As(err, &miss) {
+		return miss.Error()
+	}
+	return message
+}
+
+// requestID 返回请求日志中间件分配的请求ID，未经过该中间件时生成新的ID
+func requestID(c *gin.Context) string {
+	if id := c.GetString(constants.ContextKeyRequestID); id != "" {
+		return id
+	}
+	return fmt.Sprintf("req_%s", randString(8))
+}
+
 // 优化点: 添加流式请求处理包装函数
 // 目的: 统一错误处理和日志记录
 // 预期效果: 更一致的错误处理机制
 func (h *ChatHandler) handleStreamRequest(c *gin.Context, request models.OpenAIChatCompletionsRequest, counter *TokenCounter) {
-	reqID := fmt.Sprintf("req_%s", randString(8))
-	log.Info("[%s] 开始处理流式请求", reqID)
+	log.Ctx(c.Request.Context()).Info("开始处理流式请求")
+	defer metrics.StreamStarted()()
 	
 	if err := h.doChatRequestAsync(c, request, counter); err != nil {
-		log.Error("[%s] 异步请求失败: %s", reqID, err)
+		log.Ctx(c.Request.Context()).Error("异步请求失败: %s", err)
 		if !c.Writer.Written() { // 只有在还没开始写响应时才返回错误
-			apiErr := errors.NewInternalServerError("流处理失败", err)
+			apiErr := errors.NewInternalServerError(upstreamErrorMessage(err, "流处理失败"), err)
 			c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
 		}
 	}
 	
-	log.Info("[%s] 流式请求处理完成", reqID)
+	log.Ctx(c.Request.Context()).Info("流式请求处理完成")
 }
 
 // 优化点: 改进同步请求处理函数
@@ -123,53 +235,54 @@ func (h *ChatHandler) handleStreamRequest(c *gin.Context, request models.OpenAIC
 // 预期效果: 更易于诊断问题和跟踪请求生命周期
 // handleSyncRequest 处理同步请求
 func (h *ChatHandler) handleSyncRequest(c *gin.Context, request models.OpenAIChatCompletionsRequest, counter *TokenCounter) {
-	reqID := fmt.Sprintf("req_%s", randString(8))
-	log.Info("[%s] 开始处理同步请求", reqID)
+	reqID := requestID(c)
+	log.Ctx(c.Request.Context()).Info("开始处理同步请求")
 	
 	ctx, cancel := context.WithTimeout(c.Request.Context(), h.config.Client.Timeout)
 	defer cancel()
 
-	resultChan := h.doChatRequestRegular(ctx, request, counter, reqID)
+	sessionKey := h.getSessionKey(c, request)
+	resultChan := h.doChatRequestRegular(ctx, request, counter, reqID, sessionKey)
 
 	select {
 	case result := <-resultChan:
 		resp, chatId, userId, err := result.Resp, result.ChatId, result.UserId, result.Err
 		if err != nil {
-			log.Error("[%s] 请求在重试后失败: %s. UserId: %s, ChatId: %s", reqID, err, userId, chatId)
-			apiErr := errors.NewServiceUnavailableError("聊天服务暂时不可用", err)
+			log.Ctx(c.Request.Context()).Error("请求在重试后失败: %s. UserId: %s, ChatId: %s", err, userId, chatId)
+			apiErr := errors.NewServiceUnavailableError(upstreamErrorMessage(err, "聊天服务暂时不可用"), err)
 			c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
 			return
 		}
-		log.Info("[%s] 请求成功，开始处理响应", reqID)
-		h.handleRegularResponse(c, resp, request.Model, request, counter, reqID)
+		log.Ctx(c.Request.Context()).Info("请求成功，开始处理响应")
+		h.handleRegularResponse(c, resp, request.Model, request, counter)
 
 	case <-ctx.Done():
-		log.Error("[%s] 请求超时: %v", reqID, ctx.Err())
+		log.Ctx(c.Request.Context()).Error("请求超时: %v", ctx.Err())
 		apiErr := errors.NewInternalServerError("请求超时", ctx.Err())
 		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
 	}
 	
-	log.Info("[%s] 同步请求处理完成", reqID)
+	log.Ctx(c.Request.Context()).Info("同步请求处理完成")
 }
 
 // 优化点: 改进常规请求处理函数
 // 目的: 提高错误跟踪和上下文传递
 // 预期效果: 更容易跟踪单个请求的完整生命周期
 // doChatRequestRegular 执行常规聊天请求（非流式）
-func (h *ChatHandler) doChatRequestRegular(ctx context.Context, request models.OpenAIChatCompletionsRequest, _ *TokenCounter, reqID string) <-chan chatRequestResult {
+func (h *ChatHandler) doChatRequestRegular(ctx context.Context, request models.OpenAIChatCompletionsRequest, _ *TokenCounter, reqID, sessionKey string) <-chan chatRequestResult {
 	resultChan := make(chan chatRequestResult, constants.ChannelBufferSize)
 
 	go func() {
 		defer close(resultChan)
-		log.Info("[%s] 开始执行带重试的请求", reqID)
+		log.Ctx(ctx).Info("开始执行带重试的请求")
 		
-		result := h.executeRequestWithRetry(ctx, request, reqID)
+		result := h.executeRequestWithRetry(ctx, request, reqID, sessionKey)
 
 		select {
 		case resultChan <- result:
-			log.Debug("[%s] 请求结果已发送到通道", reqID)
+			log.Ctx(ctx).Debug("请求结果已发送到通道")
 		case <-ctx.Done():
-			log.Warn("[%s] 上下文在发送结果前取消: %v", reqID, ctx.Err())
+			log.Ctx(ctx).Warn("上下文在发送结果前取消: %v", ctx.Err())
 		}
 	}()
 
@@ -180,7 +293,7 @@ func (h *ChatHandler) doChatRequestRegular(ctx context.Context, request models.O
 // 目的: 提高系统在高负载下的稳定性
 // 预期效果: 减少对下游服务的压力，提高成功率
 // executeRequestWithRetry 执行带重试的请求
-func (h *ChatHandler) executeRequestWithRetry(ctx context.Context, request models.OpenAIChatCompletionsRequest, reqID string) chatRequestResult {
+func (h *ChatHandler) executeRequestWithRetry(ctx context.Context, request models.OpenAIChatCompletionsRequest, reqID, sessionKey string) chatRequestResult {
 	attempts := h.config.Client.Retry
 	if attempts <= 0 {
 		attempts = constants.DefaultRetryCount
@@ -192,23 +305,42 @@ func (h *ChatHandler) executeRequestWithRetry(ctx context.Context, request model
 	for i := 0; i < attempts; i++ {
 		select {
 		case <-ctx.Done():
-			log.Info("[%s] 上下文取消，终止重试", reqID)
+			log.Ctx(ctx).Info("上下文取消，终止重试")
 			return chatRequestResult{Err: ctx.Err()}
 		default:
 		}
 
-		chatId := h.getChatId()
-		userId := h.getUserId()
-		log.Info("[%s] 尝试 %d/%d: 使用 userId: %s, 生成 chatId: %s", reqID, i+1, attempts, userId, chatId)
+		chatId, userId := h.resolveUpstreamIdentity(sessionKey)
+		log.Ctx(ctx).Info("尝试 %d/%d: 使用 userId: %s, 生成 chatId: %s", i+1, attempts, userId, chatId)
+		attemptCtx, span := startAttemptSpan(ctx, request, i, userId)
+		log.AddFields(ctx, log.FieldUpstreamIdentity, userId)
 
-		resp, err := h.executeRequest(ctx, request, chatId, userId, reqID)
+		releaseIdentity, err := h.acquireIdentity(attemptCtx, userId)
+		if err != nil {
+			// 上游身份繁忙不是身份本身的故障，不隔离，直接换下一个身份重试
+			lastErr = err
+			log.Ctx(ctx).Warn("尝试 %d/%d: %s", i+1, attempts, err)
+			metrics.UpstreamAttempt(request.Model, false, i, metrics.OutcomeBusy)
+			tracing.End(span, err)
+			continue
+		}
+		resp, err := h.executeRequest(attemptCtx, request, chatId, userId, reqID)
+		releaseIdentity()
+		tracing.End(span, err)
 		if err == nil {
-			log.Info("[%s] 尝试 %d/%d 成功. UserId: %s, ChatId: %s", reqID, i+1, attempts, userId, chatId)
+			log.Ctx(ctx).Info("尝试 %d/%d 成功. UserId: %s, ChatId: %s", i+1, attempts, userId, chatId)
+			metrics.UpstreamAttempt(request.Model, false, i, metrics.OutcomeSuccess)
 			return chatRequestResult{Resp: resp, ChatId: chatId, UserId: userId}
 		}
 
 		lastErr = err
-		log.Error("[%s] 尝试 %d/%d 失败. UserId: %s, ChatId: %s, 错误: %s", reqID, i+1, attempts, userId, chatId, err)
+		log.Ctx(ctx).Error("尝试 %d/%d 失败. UserId: %s, ChatId: %s, 错误: %s", i+1, attempts, userId, chatId, err)
+		metrics.UpstreamAttempt(request.Model, false, i, metrics.OutcomeFailure)
+		// 回放模式下没有录制的请求换身份重试也不会命中，上游身份本身没有问题
+		if stdErrors.Is(err, fixture.ErrMiss) {
+			break
+		}
+		h.quarantineIdentity(ctx, sessionKey, userId, err)
 
 		if i < attempts-1 {
 			// 优化点: 指数退避策略
@@ -220,7 +352,7 @@ func (h *ChatHandler) executeRequestWithRetry(ctx context.Context, request model
 				retryDelay = maxDelay
 			}
 			
-			log.Info("[%s] 等待 %v 后重试", reqID, retryDelay)
+			log.Ctx(ctx).Info("等待 %v 后重试", retryDelay)
 			
 			select {
 			case <-time.After(retryDelay):
@@ -230,7 +362,8 @@ func (h *ChatHandler) executeRequestWithRetry(ctx context.Context, request model
 		}
 	}
 
-	log.Error("[%s] 所有 %d 次尝试均失败. 最后错误: %s", reqID, attempts, lastErr)
+	log.Ctx(ctx).Error("所有 %d 次尝试均失败. 最后错误: %s", attempts, lastErr)
+	metrics.UpstreamFailed(request.Model, false)
 	return chatRequestResult{Err: fmt.Errorf("all retry attempts failed: %w", lastErr)}
 }
 
@@ -238,44 +371,44 @@ func (h *ChatHandler) executeRequestWithRetry(ctx context.Context, request model
 // 目的: 提高代码可读性和可维护性
 // 预期效果: 更清晰的响应处理流程，更易于追踪问题
 // handleRegularResponse 处理常规响应
-func (h *ChatHandler) handleRegularResponse(c *gin.Context, resp *httpClient.Response, model string, request models.OpenAIChatCompletionsRequest, counter *TokenCounter, reqID string) {
-	log.Info("[%s] 开始处理常规响应", reqID)
+func (h *ChatHandler) handleRegularResponse(c *gin.Context, resp *httpClient.Response, model string, request models.OpenAIChatCompletionsRequest, counter *TokenCounter) {
+	log.Ctx(c.Request.Context()).Info("开始处理常规响应")
 	
 	// 确保响应中使用的是外部模型名称
-	externalModel := h.getExternalModelName(model, reqID)
+	externalModel := h.getExternalModelName(c.Request.Context(), model)
 	
 	// 设置响应头
 	h.setResponseHeaders(c)
 
 	// 解析响应内容
-	content, reasoningContent, usage, finishReason, err := h.parseResponseBody(c, resp, reqID)
+	content, reasoningContent, usage, finishReason, err := h.parseResponseBody(c, resp)
 	if err != nil {
-		log.Error("[%s] 解析响应失败: %v", reqID, err)
+		log.Ctx(c.Request.Context()).Error("解析响应失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "处理响应失败"})
 		return
 	}
 	
 	// 处理token计数
-	correctedUsage := h.processTokenCounting(content, reasoningContent, usage, counter, reqID)
+	correctedUsage := h.processTokenCounting(c.Request.Context(), content, reasoningContent, usage, counter)
 	
 	// 创建并返回最终响应
-	h.createAndSendResponse(c, request, externalModel, content, reasoningContent, finishReason, correctedUsage, reqID)
+	h.createAndSendResponse(c, request, externalModel, content, reasoningContent, finishReason, correctedUsage)
 	
-	log.Info("[%s] 常规响应处理完成", reqID)
+	log.Ctx(c.Request.Context()).Info("常规响应处理完成")
 }
 
 // 优化点: 提取模型名称处理为独立函数
 // 目的: 提高代码可读性和可维护性
 // 预期效果: 更清晰的代码结构
-func (h *ChatHandler) getExternalModelName(model string, reqID string) string {
-	if _, exists := config.ModelMapping[model]; exists {
+func (h *ChatHandler) getExternalModelName(ctx context.Context, model string) string {
+	if _, exists := h.config.GetModelMapping()[model]; exists {
 		// 如果传入的是外部模型名，直接使用
-		log.Debug("[%s] 使用外部模型名: %s", reqID, model)
+		log.Ctx(ctx).Debug("使用外部模型名: %s", model)
 		return model
 	} else {
 		// 如果传入的是内部模型名，尝试转换为外部模型名
 		externalName := GetExternalModelName(h.config, model)
-		log.Debug("[%s] 将内部模型名 %s 转换为外部模型名: %s", reqID, model, externalName)
+		log.Ctx(ctx).Debug("将内部模型名 %s 转换为外部模型名: %s", model, externalName)
 		return externalName
 	}
 }
@@ -291,12 +424,12 @@ func (h *ChatHandler) setResponseHeaders(c *gin.Context) {
 // 优化点: 提取响应体解析为独立函数
 // 目的: 提高代码可读性和可维护性
 // 预期效果: 更清晰的响应处理流程
-func (h *ChatHandler) parseResponseBody(c *gin.Context, resp *httpClient.Response, reqID string) (content, reasoningContent string, usage models.Usage, finishReason string, err error) {
+func (h *ChatHandler) parseResponseBody(c *gin.Context, resp *httpClient.Response) (content, reasoningContent string, usage models.Usage, finishReason string, err error) {
 	ctx := c.Request.Context()
 	bodyBytes := resp.Body()
 	bodyString := string(bodyBytes)
 	
-	log.Debug("[%s] 开始解析响应体，大小: %d 字节", reqID, len(bodyBytes))
+	log.Ctx(c.Request.Context()).Debug("开始解析响应体，大小: %d 字节", len(bodyBytes))
 	
 	scanner := bufio.NewScanner(strings.NewReader(bodyString))
 	// 设置较大的缓冲区以处理长行
@@ -307,11 +440,12 @@ func (h *ChatHandler) parseResponseBody(c *gin.Context, resp *httpClient.Respons
 	reasoningContent = ""
 	usage = models.Usage{}
 	finishReason = "stop"
+	session := capture.FromContext(ctx)
 
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
-			log.Info("[%s] 客户端在响应处理期间断开连接", reqID)
+			log.Ctx(c.Request.Context()).Info("客户端在响应处理期间断开连接")
 			return "", "", models.Usage{}, "", ctx.Err()
 		default:
 		}
@@ -320,38 +454,40 @@ func (h *ChatHandler) parseResponseBody(c *gin.Context, resp *httpClient.Respons
 		if line == "" {
 			continue
 		}
+		session.AddUpstreamLine(line)
 
-		processLineData(line, &content, &reasoningContent, &usage, &finishReason)
+		processLineData(ctx, line, &content, &reasoningContent, &usage, &finishReason)
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Error("[%s] 扫描响应时出错: %v", reqID, err)
+		log.Ctx(c.Request.Context()).Error("扫描响应时出错: %v", err)
 		return "", "", models.Usage{}, "", err
 	}
 	
-	log.Debug("[%s] 响应体解析完成，内容长度: %d, 推理内容长度: %d", reqID, len(content), len(reasoningContent))
+	log.Ctx(c.Request.Context()).Debug("响应体解析完成，内容长度: %d, 推理内容长度: %d", len(content), len(reasoningContent))
 	return content, reasoningContent, usage, finishReason, nil
 }
 
 // 优化点: 提取token计数处理为独立函数
 // 目的: 提高代码可读性和可维护性
 // 预期效果: 更清晰的token处理流程
-func (h *ChatHandler) processTokenCounting(content, reasoningContent string, usage models.Usage, counter *TokenCounter, reqID string) models.Usage {
+func (h *ChatHandler) processTokenCounting(ctx context.Context, content, reasoningContent string, usage models.Usage, counter *TokenCounter) models.Usage {
 	// 使用我们自己的方法计算输出tokens
-	h.updateOutputTokens(content, counter)
+	h.updateOutputTokens(ctx, content, counter)
 	if len(reasoningContent) > 0 {
-		h.updateOutputTokens(reasoningContent, counter)
+		h.updateReasoningTokens(reasoningContent, counter)
 	}
 	
 	// 获取我们计算的tokens统计
 	calculatedUsage := counter.GetUsage()
 	
 	// 将我们计算的tokens与服务器返回的进行对比和校正
-	correctedUsage := h.correctUsage(usage, calculatedUsage)
+	correctedUsage := h.correctUsage(ctx, usage, calculatedUsage)
+	counter.SetFinalUsage(correctedUsage)
 	
 	// 记录原始和校正后的统计数据
-	log.Info("[%s] Token统计对比 - 服务器: 输入=%d, 输出=%d, 总计=%d | 计算值: 输入=%d, 输出=%d, 总计=%d",
-		reqID, usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens,
+	log.Ctx(ctx).Info("Token统计对比 - 服务器: 输入=%d, 输出=%d, 总计=%d | 计算值: 输入=%d, 输出=%d, 总计=%d",
+		usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens,
 		calculatedUsage.PromptTokens, calculatedUsage.CompletionTokens, calculatedUsage.TotalTokens)
 	
 	return correctedUsage
@@ -361,11 +497,14 @@ func (h *ChatHandler) processTokenCounting(content, reasoningContent string, usa
 // 目的: 提高代码可读性和可维护性
 // 预期效果: 更清晰的响应创建流程
 func (h *ChatHandler) createAndSendResponse(c *gin.Context, request models.OpenAIChatCompletionsRequest,
-	model, content, reasoningContent, finishReason string, usage models.Usage, reqID string) {
+	model, content, reasoningContent, finishReason string, usage models.Usage) {
 	
 	// 创建响应对象
 	responseID := h.generateResponseID()
-	log.Debug("[%s] 生成响应ID: %s", reqID, responseID)
+	log.Ctx(c.Request.Context()).Debug("生成响应ID: %s", responseID)
+	
+	_, span := tracing.Start(c.Request.Context(), "response.write")
+	defer span.End()
 	
 	// 创建OpenAI格式的响应
 	openAIResp := &models.OpenAIChatCompletionsResponse{
@@ -392,12 +531,12 @@ func (h *ChatHandler) createAndSendResponse(c *gin.Context, request models.OpenA
 	// 缓存响应
 	if h.responseCache != nil && h.responseCache.IsEnabled() {
 		h.responseCache.SetResponseCache(request, openAIResp)
-		log.Debug("[%s] 已缓存聊天完成响应", reqID)
+		log.Ctx(c.Request.Context()).Debug("已缓存聊天完成响应")
 	}
 	
 	// 返回响应
 	c.JSON(http.StatusOK, openAIResp)
-	log.Debug("[%s] 已向客户端发送JSON响应", reqID)
+	log.Ctx(c.Request.Context()).Debug("已向客户端发送JSON响应")
 }
 
 // 优化点: 改进请求执行函数，添加请求ID跟踪
@@ -408,8 +547,10 @@ func (h *ChatHandler) executeRequest(ctx context.Context, request models.OpenAIC
 	// 将外部模型名称映射为内部模型名称
 	internalModel := MapModelName(h.config, request.Model)
 	sciraRequest := request.ToSciraChatCompletionsRequest(internalModel, chatId, userId)
+	applyKeyDefaults(ctx, sciraRequest)
+	capture.FromContext(ctx).SetUpstreamRequest(sciraRequest)
 
-	log.Debug("[%s] 发送请求到 %s，模型: %s -> %s", reqID, constants.APISearchEndpoint, request.Model, internalModel)
+	log.Ctx(ctx).Debug("发送请求到 %s，模型: %s -> %s", constants.APISearchEndpoint, request.Model, internalModel)
 	
 	// 确保使用随机User-Agent
 	resp, err := h.client.R().
@@ -417,12 +558,14 @@ func (h *ChatHandler) executeRequest(ctx context.Context, request models.OpenAIC
 		SetHeader("Referer", h.config.Client.BaseURL).
 		SetHeader("User-Agent", constants.GetRandomUserAgent()).
 		SetHeader("X-Request-ID", reqID). // 添加请求ID到头部，便于跟踪
+		SetProxyKey(userId). // 粘性代理策略下按上游身份选择代理
 		SetBody(sciraRequest).
 		Post(constants.APISearchEndpoint)
 
 	if err != nil {
 		return nil, fmt.Errorf("HTTP请求失败: %w", err)
 	}
+	h.observeLatency(request.Model, metrics.LatencyUpstreamTTFB, resp.TimeToFirstByte())
 
 	if resp.StatusCode() != http.StatusOK {
 		bodyStr := ""
@@ -433,10 +576,12 @@ func (h *ChatHandler) executeRequest(ctx context.Context, request models.OpenAIC
 			if len(bodyStr) > maxLen {
 				bodyStr = bodyStr[:maxLen] + "...(截断)"
 			}
+			// 上游可能回显请求头或Cookie，错误信息会写入日志并可能返回给客户端
+			bodyStr = redact.String(bodyStr)
 		}
 		return nil, fmt.Errorf("HTTP错误: 状态码=%d, 响应体=%s", resp.StatusCode(), bodyStr)
 	}
 
-	log.Debug("[%s] 请求成功, 响应大小: %d 字节", reqID, len(resp.Body()))
+	log.Ctx(ctx).Debug("请求成功, 响应大小: %d 字节", len(resp.Body()))
 	return resp, nil
 }
@@ -1,20 +1,34 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"scira2api/config"
 	"scira2api/log"
 	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/budget"
 	"scira2api/pkg/cache"
+	"scira2api/pkg/capture"
+	"scira2api/pkg/chaos"
+	"scira2api/pkg/tokenizer"
+	"scira2api/pkg/fixture"
 	"scira2api/pkg/connpool"
 	"scira2api/pkg/constants"
 	httpClient "scira2api/pkg/http"
 	"scira2api/pkg/manager"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/proxy"
 	"scira2api/pkg/ratelimit"
+	"scira2api/pkg/redact"
+	"scira2api/pkg/usage"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 // 优化点: 定义自定义错误类型
@@ -37,14 +51,31 @@ type ChatHandler struct {
 	// 网络与通信组件
 	client          *httpClient.HttpClient  // HTTP客户端
 	connPool        *connpool.ConnPool      // 连接池
+	proxyPool       *proxy.Pool             // 动态代理池（未启用时为nil）
 	
 	// 用户与会话管理
 	userManager     *manager.UserManager    // 用户管理器
 	chatIdGenerator *manager.ChatIdGenerator // 会话ID生成器
+	sessionManager  *manager.SessionManager  // 粘性会话管理器（未启用时为nil）
 	
 	// 性能优化组件
 	responseCache   *cache.ResponseCache    // 响应缓存
 	rateLimiter     ratelimit.RateLimiter   // 请求限制器
+	waitQueue       *ratelimit.WaitQueue    // wait 模式下的公平等待队列（reject 模式下为nil）
+	keyLimiter      *ratelimit.KeyedLimiter // 按API密钥/客户端IP限流（未启用时为nil）
+	modelLimiter    *ratelimit.KeyedLimiter // 按模型限流（未启用时为nil）
+	keyTokens       *ratelimit.TokenQuota   // 按API密钥/客户端IP的令牌配额（未启用时为nil）
+	modelTokens     *ratelimit.TokenQuota   // 按模型的令牌配额（未启用时为nil）
+	rateLimitStore  *ratelimit.RedisStore   // 多副本共享的限流存储（未配置时为nil）
+	concurrency     *ratelimit.Semaphore      // 全局上游并发限制
+	keyConcurrency  *ratelimit.KeyedSemaphore // 按API密钥/客户端IP的并发限制
+	userConcurrency *ratelimit.KeyedSemaphore // 按上游身份（userId）的并发限制
+	usage           *usage.Ledger             // 用量账本（未启用时为nil）
+	budgets         *budget.Tracker           // 按密钥的费用预算（未启用时为nil）
+	budgetWebhook   *budget.WebhookNotifier   // 预算告警webhook（未配置时为nil）
+	capture         *capture.Recorder         // 请求捕获（未启用时为nil）
+	chaos           *chaos.Injector           // 故障注入，可在运行时通过管理接口启用
+	tokenizers      *tokenizer.Selector       // 按模型选择的BPE分词器
 	
 	// 运行时统计与资源管理
 	metrics         *handlerMetrics         // 运行时指标
@@ -61,15 +92,15 @@ type handlerMetrics struct {
 	proxyUseCount       int64         // 代理使用次数
 	proxyErrors         int64         // 代理错误次数
 	lastRequestTime     time.Time     // 最后请求时间
-	responseLatencies   []time.Duration // 响应延迟历史
+	latencies           *metrics.LatencyTracker // 按模型的延迟分布
 	mu                  sync.RWMutex  // 指标读写锁
 }
 
-// newHandlerMetrics 创建新的指标收集器
-func newHandlerMetrics() *handlerMetrics {
+// newHandlerMetrics 创建新的指标收集器，latencyWindow 为延迟分位数的统计窗口
+func newHandlerMetrics(latencyWindow time.Duration) *handlerMetrics {
 	return &handlerMetrics{
-		responseLatencies: make([]time.Duration, 0, 100),
-		lastRequestTime:   time.Now(),
+		latencies:       metrics.NewLatencyTracker(latencyWindow),
+		lastRequestTime: time.Now(),
 	}
 }
 
@@ -81,10 +112,27 @@ type ChatHandlerBuilder struct {
 	config      *config.Config
 	connPool    *connpool.ConnPool
 	client      *httpClient.HttpClient
+	proxyPool   *proxy.Pool
 	userManager *manager.UserManager
 	chatIdGenerator *manager.ChatIdGenerator
+	sessionManager *manager.SessionManager
 	responseCache *cache.ResponseCache
 	rateLimiter  ratelimit.RateLimiter
+	waitQueue    *ratelimit.WaitQueue
+	keyLimiter   *ratelimit.KeyedLimiter
+	modelLimiter *ratelimit.KeyedLimiter
+	keyTokens    *ratelimit.TokenQuota
+	modelTokens  *ratelimit.TokenQuota
+	rateLimitStore *ratelimit.RedisStore
+	concurrency     *ratelimit.Semaphore
+	keyConcurrency  *ratelimit.KeyedSemaphore
+	userConcurrency *ratelimit.KeyedSemaphore
+	usage           *usage.Ledger
+	budgets         *budget.Tracker
+	budgetWebhook   *budget.WebhookNotifier
+	capture         *capture.Recorder
+	chaos           *chaos.Injector
+	tokenizers      *tokenizer.Selector
 }
 
 // NewChatHandler 创建新的聊天处理器实例
@@ -102,10 +150,17 @@ func NewChatHandler(cfg *config.Config) *ChatHandler {
 	
 	// 按照依赖顺序初始化各组件
 	builder = builder.setupConnPool().
+		setupProxyPool().
 		setupHTTPClient().
 		setupManagers().
 		setupCache().
-		setupRateLimiter()
+		setupRateLimiter().
+		setupConcurrency().
+		setupUsage().
+		setupBudget().
+		setupCapture().
+		setupChaos().
+		setupTokenizer()
 	
 	// 构建并返回ChatHandler实例
 	return builder.build()
@@ -151,6 +206,42 @@ func (b *ChatHandlerBuilder) setupConnPool() *ChatHandlerBuilder {
 	return b
 }
 
+// setupProxyPool 设置动态代理池
+func (b *ChatHandlerBuilder) setupProxyPool() *ChatHandlerBuilder {
+	cfg := b.config.ProxyPool
+	if !cfg.Enabled {
+		return b
+	}
+	
+	// 合并配置中的代理和代理文件中的代理
+	addrs := append([]string{}, cfg.Proxies...)
+	if cfg.File != "" {
+		fileProxies, err := proxy.LoadProxyFile(cfg.File)
+		if err != nil {
+			log.Error("加载代理文件失败: %v", err)
+		} else {
+			addrs = append(addrs, fileProxies...)
+		}
+	}
+	
+	pool, err := proxy.NewPool(addrs, proxy.PoolOptions{
+		Strategy:            proxy.Strategy(cfg.Strategy),
+		HealthCheckURL:      cfg.HealthCheckURL,
+		HealthCheckInterval: cfg.HealthCheckInterval,
+		HealthCheckTimeout:  cfg.HealthCheckTimeout,
+		MaxFailures:         cfg.MaxFailures,
+	})
+	if err != nil {
+		log.Error("创建代理池失败，将不使用动态代理: %v", err)
+		return b
+	}
+	
+	pool.Start()
+	b.proxyPool = pool
+	log.Info("动态代理池已启用: 代理数=%d, 策略=%s", len(pool.Stats()), cfg.Strategy)
+	return b
+}
+
 // setupHTTPClient 设置HTTP客户端
 // 优化点: 分离HTTP客户端创建逻辑
 // 目的: 降低函数复杂度，提高可读性
@@ -158,9 +249,33 @@ func (b *ChatHandlerBuilder) setupConnPool() *ChatHandlerBuilder {
 func (b *ChatHandlerBuilder) setupHTTPClient() *ChatHandlerBuilder {
 	b.client = createHTTPClient(b.config)
 	
-	// 如果启用了连接池，记录日志
+	// 如果启用了连接池，静态客户端和动态代理Transport都使用连接池参数并上报连接指标
 	if b.config.ConnPool.Enabled {
-		log.Info("使用标准库HTTP客户端，连接池由http.Transport内部管理")
+		b.client.SetConnPool(b.connPool)
+		log.Info("HTTP客户端已应用连接池参数，动态代理按代理地址复用Transport")
+	}
+	
+	// 动态代理优先于静态代理
+	if b.proxyPool != nil {
+		b.client.SetTransportCacheOptions(httpClient.TransportCacheOptions{
+			MaxEntries:  b.config.ProxyPool.TransportCacheSize,
+			IdleTimeout: b.config.ProxyPool.TransportIdleTimeout,
+		})
+		b.client.SetProxyManager(b.proxyPool)
+	}
+	
+	// 录制/回放模式，配置加载时已校验模式
+	fixtures, err := fixture.New(fixture.Options{
+		Mode:         b.config.Upstream.Mode,
+		Dir:          b.config.Upstream.FixturesDir,
+		IgnoreFields: b.config.Upstream.IgnoreFields,
+	})
+	if err != nil {
+		log.Fatal("初始化上游录制/回放失败: %v", err)
+	}
+	if fixtures != nil {
+		b.client.SetFixtures(fixtures)
+		log.Warn("上游模式: %s，录制目录: %s", fixtures.Mode(), b.config.Upstream.FixturesDir)
 	}
 	
 	return b
@@ -170,6 +285,17 @@ func (b *ChatHandlerBuilder) setupHTTPClient() *ChatHandlerBuilder {
 func (b *ChatHandlerBuilder) setupManagers() *ChatHandlerBuilder {
 	b.userManager = manager.NewUserManager()
 	b.chatIdGenerator = manager.NewChatIdGenerator(constants.ChatGroup)
+	
+	// 粘性会话为可选功能
+	if b.config.Session.Enabled {
+		b.sessionManager = manager.NewSessionManager(
+			b.config.Session.TTL,
+			b.config.Session.QuarantineTTL,
+			b.chatIdGenerator,
+			b.userManager)
+		log.Info("粘性会话已启用: TTL=%v, 隔离时长=%v",
+			b.config.Session.TTL, b.config.Session.QuarantineTTL)
+	}
 	return b
 }
 
@@ -208,6 +334,10 @@ func (b *ChatHandlerBuilder) setupRateLimiter() *ChatHandlerBuilder {
 	limiter := ratelimit.NewTokenBucketLimiter(1000, 1000) // 默认值
 	
 	if !cfg.RateLimit.Enabled {
+		// 使用配置的速率创建，便于通过管理接口在运行时启用
+		if cfg.RateLimit.RequestsPerSecond > 0 && cfg.RateLimit.Burst > 0 {
+			limiter = ratelimit.NewTokenBucketLimiter(cfg.RateLimit.RequestsPerSecond, cfg.RateLimit.Burst)
+		}
 		limiter.Disable()
 		log.Info("请求限制器已禁用")
 	} else {
@@ -220,6 +350,204 @@ func (b *ChatHandlerBuilder) setupRateLimiter() *ChatHandlerBuilder {
 	}
 	
 	b.rateLimiter = limiter
+	queueOptions := ratelimit.QueueOptions{
+		MaxDepth: cfg.RateLimit.QueueDepth,
+		MaxWait:  cfg.RateLimit.MaxWait,
+	}
+	
+	// 多副本共享限流：全局令牌桶、按键令牌桶和令牌配额都保存在共享存储中，存储不可用时回退到本地
+	if cfg.RateLimit.RedisURL != "" {
+		store, err := ratelimit.NewRedisStore(cfg.RateLimit.RedisURL, cfg.RateLimit.RedisPrefix, cfg.RateLimit.RedisTimeout)
+		if err != nil {
+			log.Error("创建限流共享存储失败，使用本地限流: %v", err)
+		} else {
+			b.rateLimitStore = store
+			rate, burst := limiter.Limit()
+			shared := ratelimit.NewRedisLimiter(store, "global", rate, burst)
+			if !limiter.IsEnabled() {
+				shared.Disable()
+			}
+			b.rateLimiter = shared
+			if cfg.RateLimit.Mode == constants.RateLimitModeWait {
+				b.waitQueue = ratelimit.NewWaitQueue(shared, queueOptions)
+			}
+			log.Info("限流共享存储已启用: 前缀=%s, 超时=%v", cfg.RateLimit.RedisPrefix, cfg.RateLimit.RedisTimeout)
+		}
+	}
+	
+	// wait 模式下令牌不足的请求按优先级和到达顺序排队
+	if cfg.RateLimit.Mode == constants.RateLimitModeWait && b.waitQueue == nil {
+		b.waitQueue = ratelimit.NewWaitQueue(limiter, queueOptions)
+	}
+	
+	// 分层限流：全局之后依次按密钥（或客户端IP）和模型限流
+	if cfg.RateLimit.PerKeyEnabled {
+		b.keyLimiter = ratelimit.NewKeyedLimiter("key", cfg.RateLimit.IdleTTL)
+		log.Info("按密钥限流已启用: 默认=%.2f/秒, 突发=%d, 等级数=%d",
+			cfg.RateLimit.KeyLimit.RequestsPerSecond, cfg.RateLimit.KeyLimit.Burst, len(cfg.RateLimit.Tiers))
+	}
+	if cfg.RateLimit.PerModelEnabled {
+		b.modelLimiter = ratelimit.NewKeyedLimiter("model", cfg.RateLimit.IdleTTL)
+		log.Info("按模型限流已启用: 默认=%.2f/秒, 突发=%d, 单独配置的模型数=%d",
+			cfg.RateLimit.ModelLimit.RequestsPerSecond, cfg.RateLimit.ModelLimit.Burst, len(cfg.RateLimit.ModelLimits))
+	}
+	
+	// 令牌配额（TPM/TPD）
+	if cfg.RateLimit.TokensEnabled {
+		b.keyTokens = ratelimit.NewTokenQuota("key", cfg.RateLimit.IdleTTL)
+		b.modelTokens = ratelimit.NewTokenQuota("model", cfg.RateLimit.IdleTTL)
+		log.Info("令牌配额已启用: 密钥默认=%d/分钟 %d/天, 模型默认=%d/分钟 %d/天",
+			cfg.RateLimit.KeyTokenLimit.TokensPerMinute, cfg.RateLimit.KeyTokenLimit.TokensPerDay,
+			cfg.RateLimit.ModelTokenLimit.TokensPerMinute, cfg.RateLimit.ModelTokenLimit.TokensPerDay)
+	}
+	
+	if b.rateLimitStore != nil {
+		for _, limiter := range []*ratelimit.KeyedLimiter{b.keyLimiter, b.modelLimiter} {
+			if limiter != nil {
+				limiter.SetStore(b.rateLimitStore)
+			}
+		}
+		for _, quota := range []*ratelimit.TokenQuota{b.keyTokens, b.modelTokens} {
+			if quota != nil {
+				quota.SetStore(b.rateLimitStore)
+			}
+		}
+	}
+	return b
+}
+
+// setupConcurrency 设置全局、按密钥和按上游身份的并发限制
+func (b *ChatHandlerBuilder) setupConcurrency() *ChatHandlerBuilder {
+	cfg := b.config.Concurrency
+	options := func(limit int) ratelimit.ConcurrencyOptions {
+		return ratelimit.ConcurrencyOptions{
+			Limit:   limit,
+			Queue:   cfg.Mode == constants.ConcurrencyModeQueue,
+			MaxWait: cfg.MaxWait,
+		}
+	}
+	
+	b.concurrency = ratelimit.NewSemaphore(options(cfg.Global))
+	b.keyConcurrency = ratelimit.NewKeyedSemaphore("key", options(cfg.PerKey))
+	b.userConcurrency = ratelimit.NewKeyedSemaphore("identity", options(cfg.PerIdentity))
+	
+	if cfg.Global > 0 || cfg.PerKey > 0 || cfg.PerIdentity > 0 {
+		log.Info("并发限制已启用: 全局=%d, 每密钥=%d, 每上游身份=%d, 模式=%s",
+			cfg.Global, cfg.PerKey, cfg.PerIdentity, cfg.Mode)
+	}
+	return b
+}
+
+// setupUsage 设置用量账本，打开失败时只记录日志，不影响请求处理
+func (b *ChatHandlerBuilder) setupUsage() *ChatHandlerBuilder {
+	cfg := b.config.Usage
+	if !cfg.Enabled {
+		log.Info("用量账本已禁用")
+		return b
+	}
+	
+	ledger, err := usage.Open(cfg.StorePath, cfg.Retention)
+	if err != nil {
+		log.Error("打开用量账本失败，不记录用量: %v", err)
+		return b
+	}
+	b.usage = ledger
+	log.Info("用量账本已启用: 存储=%s, 保留时间=%v", cfg.StorePath, cfg.Retention)
+	return b
+}
+
+// setupBudget 设置费用预算，并从用量账本恢复本月已产生的费用
+func (b *ChatHandlerBuilder) setupBudget() *ChatHandlerBuilder {
+	cfg := b.config.Budget
+	if !cfg.Enabled {
+		return b
+	}
+	
+	var notifier budget.Notifier
+	if cfg.WebhookURL != "" {
+		b.budgetWebhook = budget.NewWebhookNotifier(cfg.WebhookURL, cfg.WebhookTimeout)
+		notifier = b.budgetWebhook
+	}
+	b.budgets = budget.NewTracker(cfg.WarnThresholds, notifier)
+	
+	var unpriced []string
+	for external, internal := range b.config.GetModelMapping() {
+		_, externalPriced := cfg.Prices[external]
+		_, internalPriced := cfg.Prices[internal]
+		if !externalPriced && !internalPriced {
+			unpriced = append(unpriced, external)
+		}
+	}
+	if len(unpriced) > 0 {
+		sort.Strings(unpriced)
+		log.Warn("以下模型未配置价格，使用这些模型的请求不计入预算: %s", strings.Join(unpriced, ", "))
+	}
+	
+	if b.usage == nil {
+		log.Warn("用量账本未启用，重启后预算的已用费用将从零开始")
+	} else if err := seedBudgets(b.config, b.budgets, b.usage); err != nil {
+		log.Error("从用量账本恢复预算费用失败: %v", err)
+	}
+	
+	log.Info("费用预算已启用: 默认日预算=$%.2f, 默认月预算=$%.2f, 告警阈值=%v, 已配置价格的模型数=%d",
+		cfg.Daily, cfg.Monthly, cfg.WarnThresholds, len(cfg.Prices))
+	return b
+}
+
+// setupCapture 设置请求捕获，打开捕获文件失败时只记录日志，不影响请求处理
+func (b *ChatHandlerBuilder) setupCapture() *ChatHandlerBuilder {
+	cfg := b.config.Capture
+	recorder, err := capture.New(capture.Options{
+		File:          cfg.File,
+		MaxSize:       cfg.MaxSize,
+		MaxBackups:    cfg.MaxBackups,
+		Keys:          cfg.Keys,
+		SampleRate:    cfg.SampleRate,
+		MaxRecordSize: constants.DefaultCaptureMaxRecordSize,
+	})
+	if err != nil {
+		log.Error("打开请求捕获文件失败，不捕获请求: %v", err)
+		return b
+	}
+	if recorder != nil {
+		b.capture = recorder
+		log.Warn("请求捕获已启用: 文件=%s, 密钥=%v, 采样比例=%.3f，捕获内容包含完整的对话", cfg.File, cfg.Keys, cfg.SampleRate)
+	}
+	return b
+}
+
+// setupChaos 设置故障注入，未启用时同样创建注入器，管理接口可以在运行时启用
+func (b *ChatHandlerBuilder) setupChaos() *ChatHandlerBuilder {
+	cfg := b.config.Chaos
+	var rules []chaos.Rule
+	if cfg.RulesFile != "" {
+		loaded, err := chaos.LoadRules(cfg.RulesFile)
+		if err != nil {
+			log.Fatal("加载故障注入规则失败: %v", err)
+		}
+		rules = loaded
+	}
+	injector, err := chaos.New(cfg.Enabled, rules)
+	if err != nil {
+		log.Fatal("故障注入规则无效: %v", err)
+	}
+	b.chaos = injector
+	b.client.SetChaos(injector)
+	if cfg.Enabled {
+		log.Warn("故障注入已启用: 规则数=%d，匹配的请求会收到注入的延迟、错误和断开", len(rules))
+	}
+	return b
+}
+
+// setupTokenizer 设置按模型选择的分词器，默认编码的词表在启动时解析
+func (b *ChatHandlerBuilder) setupTokenizer() *ChatHandlerBuilder {
+	cfg := b.config.Tokenizer
+	selector, err := tokenizer.NewSelector(cfg.Default, cfg.Models)
+	if err != nil {
+		log.Fatal("初始化分词器失败: %v", err)
+	}
+	b.tokenizers = selector
+	log.Info("分词器已初始化: 默认编码=%s, 自定义映射=%d, 用量校正策略=%s", cfg.Default, len(cfg.Models), cfg.UsageCorrection)
 	return b
 }
 
@@ -230,10 +558,27 @@ func (b *ChatHandlerBuilder) build() *ChatHandler {
 		client:          b.client,
 		userManager:     b.userManager,
 		chatIdGenerator: b.chatIdGenerator,
+		sessionManager:  b.sessionManager,
 		responseCache:   b.responseCache,
 		connPool:        b.connPool,
+		proxyPool:       b.proxyPool,
 		rateLimiter:     b.rateLimiter,
-		metrics:         newHandlerMetrics(), // 初始化指标收集
+		waitQueue:       b.waitQueue,
+		keyLimiter:      b.keyLimiter,
+		modelLimiter:    b.modelLimiter,
+		keyTokens:       b.keyTokens,
+		modelTokens:     b.modelTokens,
+		rateLimitStore:  b.rateLimitStore,
+		concurrency:     b.concurrency,
+		keyConcurrency:  b.keyConcurrency,
+		userConcurrency: b.userConcurrency,
+		usage:           b.usage,
+		budgets:         b.budgets,
+		budgetWebhook:   b.budgetWebhook,
+		capture:         b.capture,
+		chaos:           b.chaos,
+		tokenizers:      b.tokenizers,
+		metrics:         newHandlerMetrics(b.config.Metrics.LatencyWindow), // 初始化指标收集
 	}
 }
 
@@ -296,7 +641,7 @@ func configureStaticSocks5Proxy(client *httpClient.HttpClient, proxyAddr string)
 		return
 	}
 	
-	log.Info("使用静态SOCKS5代理: %s", proxyAddr)
+	log.Info("使用静态SOCKS5代理: %s", redact.URL(proxyAddr))
 }
 
 // configureStaticHttpProxy 配置静态HTTP代理
@@ -315,7 +660,7 @@ func configureStaticHttpProxy(client *httpClient.HttpClient, proxyAddr string) {
 		return
 	}
 	
-	log.Info("使用静态HTTP代理: %s", proxyAddr)
+	log.Info("使用静态HTTP代理: %s", redact.URL(proxyAddr))
 }
 
 // getUserId 获取用户ID（轮询方式）
@@ -328,6 +673,62 @@ func (h *ChatHandler) getChatId() string {
 	return h.chatIdGenerator.GenerateId()
 }
 
+// getSessionKey 获取请求的粘性会话键
+// 优先使用 X-Session-ID 请求头，其次使用 OpenAI 的 user 字段；未启用会话时返回空串
+// 会话键按API密钥隔离，不同密钥使用相同的会话标识不会共享上游会话
+func (h *ChatHandler) getSessionKey(c *gin.Context, request models.OpenAIChatCompletionsRequest) string {
+	if h.sessionManager == nil {
+		return ""
+	}
+	
+	scope := ""
+	if keyName := auth.KeyName(c.Request.Context()); keyName != "" {
+		scope = "key:" + keyName + "|"
+	}
+	
+	if sessionID := strings.TrimSpace(c.GetHeader(constants.SessionIDHeader)); sessionID != "" {
+		return scope + "sid:" + sessionID
+	}
+	if user := strings.TrimSpace(request.User); user != "" {
+		return scope + "user:" + user
+	}
+	return ""
+}
+
+// applyKeyDefaults 使用API密钥配置的默认时区和分组覆盖上游请求的默认值
+func applyKeyDefaults(ctx context.Context, sciraRequest *models.SciraChatCompletionsRequest) {
+	key := auth.FromContext(ctx)
+	if key == nil {
+		return
+	}
+	if key.TimeZone != "" {
+		sciraRequest.TimeZone = key.TimeZone
+	}
+	if key.Group != "" {
+		sciraRequest.Group = key.Group
+	}
+}
+
+// resolveUpstreamIdentity 获取本次尝试使用的 chatId/userId
+// 有会话键时复用会话绑定，否则每次生成新的身份
+func (h *ChatHandler) resolveUpstreamIdentity(sessionKey string) (chatId, userId string) {
+	if h.sessionManager != nil && sessionKey != "" {
+		return h.sessionManager.Acquire(sessionKey)
+	}
+	return h.getChatId(), h.getUserId()
+}
+
+// quarantineIdentity 尝试失败后隔离会话绑定的上游身份，下次尝试会重新分配
+// 客户端断开或请求超时导致的失败不是上游身份的故障，不隔离，避免解除使用该身份的其他会话的绑定
+func (h *ChatHandler) quarantineIdentity(ctx context.Context, sessionKey, userId string, err error) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if h.sessionManager != nil && sessionKey != "" {
+		h.sessionManager.Quarantine(userId)
+	}
+}
+
 // GetConfig 获取配置
 func (h *ChatHandler) GetConfig() *config.Config {
 	return h.config
@@ -342,32 +743,21 @@ func (h *ChatHandler) GetClient() *httpClient.HttpClient {
 // 优化点: 改进注释和变量命名，增加错误处理
 // 目的: 提高代码可读性和可维护性
 // 预期效果: 更易于理解和维护的代码
-func (h *ChatHandler) calculateInputTokens(request models.OpenAIChatCompletionsRequest, counter *TokenCounter) {
+func (h *ChatHandler) calculateInputTokens(ctx context.Context, request models.OpenAIChatCompletionsRequest, counter *TokenCounter) {
 	if counter == nil {
-		log.Error("Token计数器为空，无法计算输入tokens")
+		log.Ctx(ctx).Error("Token计数器为空，无法计算输入tokens")
 		return
 	}
 	
 	// 记录开始计算的时间，用于性能分析
 	startTime := time.Now()
 	
-	// 将消息转换为可计算格式
-	messagesInterface := make([]interface{}, len(request.Messages))
-	for i, msg := range request.Messages {
-		// 创建包含消息属性的映射
-		msgMap := map[string]interface{}{
-			"role":    msg.Role,
-			"content": msg.Content,
-		}
-		
-		// 注意: 现有模型中不支持name和function_call字段
-		// 如需扩展，请先更新models.Message结构体定义
-		
-		messagesInterface[i] = msgMap
-	}
+	// 选择模型对应的分词器，输出tokens也使用同一分词器计算
+	tok := h.tokenizers.For(request.Model)
+	counter.SetTokenizer(tok)
 	
-	// 计算提示tokens并更新计数器
-	inputTokens := calculateMessageTokens(messagesInterface)
+	// 按OpenAI的方式计算提示tokens并更新计数器，/v1/tokenize 使用相同的计数方式
+	inputTokens := tok.CountMessages(promptMessages(request))
 	counter.SetInputTokens(inputTokens)
 	
 	// 记录指标
@@ -378,16 +768,16 @@ func (h *ChatHandler) calculateInputTokens(request models.OpenAIChatCompletionsR
 	}
 	
 	// 记录计算耗时
-	log.Debug("计算输入tokens耗时: %v，tokens数量: %d", time.Since(startTime), inputTokens)
+	log.Ctx(ctx).Debug("计算输入tokens耗时: %v，编码: %s，tokens数量: %d", time.Since(startTime), tok.Name(), inputTokens)
 }
 
 // updateOutputTokens 更新完成tokens计算
 // 优化点: 增加错误处理和性能指标
 // 目的: 提高代码健壮性和可观测性
 // 预期效果: 更可靠的token计算和更好的性能监控
-func (h *ChatHandler) updateOutputTokens(content string, counter *TokenCounter) {
+func (h *ChatHandler) updateOutputTokens(ctx context.Context, content string, counter *TokenCounter) {
 	if counter == nil {
-		log.Error("Token计数器为空，无法更新输出tokens")
+		log.Ctx(ctx).Error("Token计数器为空，无法更新输出tokens")
 		return
 	}
 	
@@ -395,23 +785,31 @@ func (h *ChatHandler) updateOutputTokens(content string, counter *TokenCounter)
 	startTime := time.Now()
 	
 	// 计算内容的token数量
-	tokens := countTokens(content)
-	counter.AddOutputTokens(tokens)
+	tokens := counter.AddOutputText(content)
 	
 	// 记录计算耗时
-	log.Debug("计算输出tokens耗时: %v，tokens数量: %d", time.Since(startTime), tokens)
+	log.Ctx(ctx).Debug("计算输出tokens耗时: %v，tokens数量: %d", time.Since(startTime), tokens)
+}
+
+// updateReasoningTokens 更新推理tokens计算，推理tokens同时计入完成tokens
+func (h *ChatHandler) updateReasoningTokens(content string, counter *TokenCounter) {
+	if counter == nil || content == "" {
+		return
+	}
+	counter.AddReasoningText(content)
 }
 
 // correctUsage 校正用量统计数据
 // 优化点: 提取重复逻辑为函数，改进算法结构
 // 目的: 减少代码重复，提高可维护性
 // 预期效果: 更简洁、更易维护的代码
-func (h *ChatHandler) correctUsage(serverUsage, calculatedUsage models.Usage) models.Usage {
+func (h *ChatHandler) correctUsage(ctx context.Context, serverUsage, calculatedUsage models.Usage) models.Usage {
 	// 创建校正后的用量数据
 	correctedUsage := serverUsage
 	
 	// 校正提示tokens
 	correctedUsage.PromptTokens = h.correctTokenCount(
+		ctx,
 		"提示tokens",
 		serverUsage.PromptTokens,
 		calculatedUsage.PromptTokens,
@@ -419,6 +817,7 @@ func (h *ChatHandler) correctUsage(serverUsage, calculatedUsage models.Usage) mo
 	
 	// 校正完成tokens
 	correctedUsage.CompletionTokens = h.correctTokenCount(
+		ctx,
 		"完成tokens",
 		serverUsage.CompletionTokens,
 		calculatedUsage.CompletionTokens,
@@ -430,26 +829,33 @@ func (h *ChatHandler) correctUsage(serverUsage, calculatedUsage models.Usage) mo
 	return correctedUsage
 }
 
-// correctTokenCount 校正单个token计数
-// 优化点: 提取公共逻辑为独立函数
-// 目的: 减少代码重复，提高可维护性
-// 预期效果: 更简洁的代码结构
-func (h *ChatHandler) correctTokenCount(tokenType string, serverCount, calculatedCount int) int {
+// correctTokenCount 按配置的校正策略选择单个token计数
+// server: 信任服务器返回值，服务器未返回时使用计算值
+// local: 始终使用本地分词器的计算值
+// threshold: 偏差超过阈值时使用计算值，否则使用服务器返回值
+func (h *ChatHandler) correctTokenCount(ctx context.Context, tokenType string, serverCount, calculatedCount int) int {
+	policy := h.config.Tokenizer.UsageCorrection
+	
+	// 本地计数优先，计算值为0时（如回放缺少数据）仍回退到服务器返回值
+	if policy == "local" && calculatedCount > 0 {
+		return calculatedCount
+	}
+	
 	// 如果服务器返回值为0但计算值大于0，使用计算值
 	if serverCount == 0 && calculatedCount > 0 {
-		log.Info("%s: 服务器未返回数据，使用计算值=%d", tokenType, calculatedCount)
+		log.Ctx(ctx).Info("%s: 服务器未返回数据，使用计算值=%d", tokenType, calculatedCount)
 		return calculatedCount
 	}
 	
 	// 如果两者都大于0，比较差异
-	if serverCount > 0 && calculatedCount > 0 {
+	if policy != "server" && serverCount > 0 && calculatedCount > 0 {
 		// 计算差异比例
 		diff := float64(serverCount - calculatedCount) / float64(calculatedCount)
 		
 		// 差异超过阈值时，使用计算值
-		const thresholdPct = 0.2 // 20%差异阈值
+		thresholdPct := h.correctionThreshold()
 		if diff > thresholdPct || diff < -thresholdPct {
-			log.Warn("%s统计偏差超过%.0f%%，使用计算值：服务器=%d, 计算值=%d",
+			log.Ctx(ctx).Warn("%s统计偏差超过%.0f%%，使用计算值：服务器=%d, 计算值=%d",
 				tokenType, thresholdPct*100, serverCount, calculatedCount)
 			return calculatedCount
 		}
@@ -459,6 +865,14 @@ func (h *ChatHandler) correctTokenCount(tokenType string, serverCount, calculate
 	return serverCount
 }
 
+// correctionThreshold 返回threshold策略的偏差阈值，未加载配置时（如回放）使用默认值
+func (h *ChatHandler) correctionThreshold() float64 {
+	if h.config.Tokenizer.UsageCorrection == "" {
+		return constants.DefaultUsageCorrectionThreshold
+	}
+	return h.config.Tokenizer.CorrectionThreshold
+}
+
 // GetCacheMetrics 获取缓存指标
 // 优化点: 增加安全检查和详细注释
 // 目的: 提高代码健壮性和可读性
@@ -496,9 +910,89 @@ func (h *ChatHandler) GetConnPoolMetrics() map[string]interface{} {
 		}
 	}
 	
+	// 动态代理Transport缓存指标
+	if h.client != nil {
+		metrics["transport_cache"] = h.client.GetTransportCacheMetrics()
+	}
+	
+	return metrics
+}
+
+// GetProxyPoolMetrics 获取代理池指标
+func (h *ChatHandler) GetProxyPoolMetrics() map[string]interface{} {
+	if h.proxyPool == nil {
+		return map[string]interface{}{
+			"enabled": false,
+		}
+	}
+	return h.proxyPool.GetMetrics()
+}
+
+// GetConcurrencyMetrics 获取并发限制指标（当前和峰值的进行中请求数）
+func (h *ChatHandler) GetConcurrencyMetrics() map[string]interface{} {
+	metrics := make(map[string]interface{})
+	if h.concurrency != nil {
+		metrics["global"] = h.concurrency.GetMetrics()
+	}
+	if h.keyConcurrency != nil {
+		metrics["per_key"] = h.keyConcurrency.GetMetrics()
+	}
+	if h.userConcurrency != nil {
+		metrics["per_identity"] = h.userConcurrency.GetMetrics()
+	}
+	return metrics
+}
+
+// observeLatency 记录一个延迟样本
+func (h *ChatHandler) observeLatency(model, kind string, d time.Duration) {
+	if h.metrics != nil {
+		h.metrics.latencies.Observe(model, kind, d)
+	}
+}
+
+// GetLatencyMetrics 获取按模型的延迟分位数
+func (h *ChatHandler) GetLatencyMetrics() map[string]interface{} {
+	if h.metrics == nil {
+		return nil
+	}
+	return h.metrics.latencies.GetMetrics()
+}
+
+// GetUsageMetrics 获取用量账本指标
+func (h *ChatHandler) GetUsageMetrics() map[string]interface{} {
+	if h.usage == nil {
+		return nil
+	}
+	return h.usage.GetMetrics()
+}
+
+// GetBudgetMetrics 获取费用预算指标
+func (h *ChatHandler) GetBudgetMetrics() map[string]interface{} {
+	if h.budgets == nil {
+		return nil
+	}
+	metrics := h.budgets.GetMetrics()
+	if h.budgetWebhook != nil {
+		metrics["webhook"] = h.budgetWebhook.GetMetrics()
+	}
 	return metrics
 }
 
+// GetFixtureMetrics 获取上游录制/回放统计
+func (h *ChatHandler) GetFixtureMetrics() map[string]interface{} {
+	return h.client.GetFixtureMetrics()
+}
+
+// GetCaptureMetrics 获取请求捕获指标
+func (h *ChatHandler) GetCaptureMetrics() map[string]interface{} {
+	return h.capture.GetMetrics()
+}
+
+// GetChaosMetrics 获取故障注入指标
+func (h *ChatHandler) GetChaosMetrics() map[string]interface{} {
+	return h.chaos.GetMetrics()
+}
+
 // GetRateLimiterMetrics 获取限流器指标
 // 优化点: 增加安全检查和详细注释
 // 目的: 提高代码健壮性和可读性
@@ -516,6 +1010,28 @@ func (h *ChatHandler) GetRateLimiterMetrics() map[string]interface{} {
 		}
 	}
 	
+	// 等待队列指标（队列长度和排队时间百分位）
+	if h.waitQueue != nil {
+		metrics["wait_queue"] = h.waitQueue.GetMetrics()
+	}
+	
+	// 分层限流指标（包含请求最多的调用方）
+	if h.keyLimiter != nil {
+		metrics["per_key"] = h.keyLimiter.GetMetrics()
+	}
+	if h.modelLimiter != nil {
+		metrics["per_model"] = h.modelLimiter.GetMetrics()
+	}
+	if h.keyTokens != nil {
+		metrics["key_tokens"] = h.keyTokens.GetMetrics()
+	}
+	if h.modelTokens != nil {
+		metrics["model_tokens"] = h.modelTokens.GetMetrics()
+	}
+	if h.rateLimitStore != nil {
+		metrics["store"] = h.rateLimitStore.GetMetrics()
+	}
+	
 	return metrics
 }
 
@@ -578,6 +1094,26 @@ func (h *ChatHandler) Close() error {
 			}
 		}
 		
+		// 停止代理池健康检查
+		if h.proxyPool != nil {
+			if err := h.proxyPool.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("关闭代理池失败: %w", err))
+				log.Error("关闭代理池失败: %v", err)
+			} else {
+				log.Info("代理池资源已成功释放")
+			}
+		}
+		
+		// 关闭会话管理器
+		if h.sessionManager != nil {
+			if err := h.sessionManager.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("关闭会话管理器失败: %w", err))
+				log.Error("关闭会话管理器失败: %v", err)
+			} else {
+				log.Info("会话管理器资源已成功释放")
+			}
+		}
+		
 		// 关闭限流器
 		if h.rateLimiter != nil {
 			if closer, ok := interface{}(h.rateLimiter).(interface{ Close() error }); ok {
@@ -591,6 +1127,35 @@ func (h *ChatHandler) Close() error {
 				log.Info("请求限制器资源已标记为释放")
 			}
 		}
+		if h.waitQueue != nil {
+			h.waitQueue.Close()
+		}
+		for _, limiter := range []*ratelimit.KeyedLimiter{h.keyLimiter, h.modelLimiter} {
+			if limiter != nil {
+				limiter.Close()
+			}
+		}
+		for _, quota := range []*ratelimit.TokenQuota{h.keyTokens, h.modelTokens} {
+			if quota != nil {
+				quota.Close()
+			}
+		}
+		if h.usage != nil {
+			if err := h.usage.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("关闭用量账本失败: %w", err))
+				log.Error("关闭用量账本失败: %v", err)
+			}
+		}
+		if h.rateLimitStore != nil {
+			if err := h.rateLimitStore.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("关闭限流共享存储失败: %w", err))
+				log.Error("关闭限流共享存储失败: %v", err)
+			}
+		}
+		if err := h.capture.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("关闭请求捕获文件失败: %w", err))
+			log.Error("关闭请求捕获文件失败: %v", err)
+		}
 		
 		log.Info("ChatHandler资源释放完成")
 	})
@@ -639,5 +1204,17 @@ func (h *ChatHandler) GetMetrics() map[string]interface{} {
 		metrics["rateLimit_"+k] = v
 	}
 	
+	// 添加代理池指标
+	for k, v := range h.GetProxyPoolMetrics() {
+		metrics["proxyPool_"+k] = v
+	}
+	
+	// 添加会话指标
+	if h.sessionManager != nil {
+		for k, v := range h.sessionManager.GetMetrics() {
+			metrics["session_"+k] = v
+		}
+	}
+	
 	return metrics
 }
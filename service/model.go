@@ -5,6 +5,7 @@ import (
 	"runtime/debug"
 	"scira2api/log"
 	"scira2api/models"
+	"scira2api/pkg/metrics"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,17 +16,18 @@ func (h *ChatHandler) ModelGetHandler(c *gin.Context) {
 	clientIP := c.ClientIP()
 	userAgent := c.Request.UserAgent()
 	referer := c.Request.Referer()
-	log.Debug("收到models请求: IP=%s, User-Agent=%s, Referer=%s", clientIP, userAgent, referer)
+	log.Ctx(c.Request.Context()).Debug("收到models请求: IP=%s, User-Agent=%s, Referer=%s", clientIP, userAgent, referer)
 	
 	// 记录调用堆栈，帮助确定调用来源
 	stack := string(debug.Stack())
-	log.Debug("ModelGetHandler调用堆栈: %s", stack)
+	log.Ctx(c.Request.Context()).Debug("ModelGetHandler调用堆栈: %s", stack)
 	
 	// 尝试从缓存获取模型列表
 	if h.responseCache != nil && h.responseCache.IsEnabled() {
 		cachedModels, found := h.responseCache.GetModelCache()
+		metrics.CacheLookup(metrics.CacheModels, found)
 		if found {
-			log.Debug("从缓存返回模型列表")
+			log.Ctx(c.Request.Context()).Debug("从缓存返回模型列表")
 			c.JSON(http.StatusOK, gin.H{
 				"object": "list",
 				"data":   cachedModels,
@@ -35,7 +37,7 @@ func (h *ChatHandler) ModelGetHandler(c *gin.Context) {
 	}
 	
 	// 缓存未命中，生成模型列表
-	log.Debug("从配置生成模型列表")
+	log.Ctx(c.Request.Context()).Debug("从配置生成模型列表")
 	// 使用更新后的 Models() 函数获取模型列表
 	availableModels := h.config.Models()
 	data := make([]models.OpenAIModelResponse, 0, len(availableModels))
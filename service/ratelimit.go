@@ -0,0 +1,279 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/errors"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/ratelimit"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reserveGlobal 在全局限流器中获取一个令牌
+// wait 模式下令牌不足时进入公平等待队列，队列已满或排队超时返回429；reject 模式下没有令牌时立即返回429
+// 拒绝时设置 Retry-After；无论结果如何都会设置 x-ratelimit-*-requests 响应头
+func (h *ChatHandler) reserveGlobal(c *gin.Context) (*ratelimit.Reservation, *errors.APIError) {
+	if h.rateLimiter == nil {
+		return nil, nil
+	}
+
+	if h.waitQueue != nil {
+		priority := 0
+		if key := auth.FromContext(c.Request.Context()); key != nil {
+			priority = key.Priority
+		}
+		reservation, err := h.waitQueue.Acquire(c.Request.Context(), priority)
+		if err != nil {
+			setRequestHeaders(c, h.rateLimiter.Status())
+			setRetryAfter(c, h.waitQueue.EstimatedWait())
+			log.Ctx(c.Request.Context()).Warn("请求限制器拒绝请求: %v", err)
+			metrics.LimiterRejected(metrics.LimiterGlobal)
+			return nil, errors.NewTooManyRequestsError("请求过于频繁，请稍后重试", err)
+		}
+		setRequestHeaders(c, reservation.Status)
+		return reservation, nil
+	}
+
+	reservation := h.rateLimiter.Reserve(0)
+	setRequestHeaders(c, reservation.Status)
+	if !reservation.OK {
+		setRetryAfter(c, reservation.Delay)
+		log.Ctx(c.Request.Context()).Warn("请求限制器拒绝请求: 需要等待 %s", reservation.Delay)
+		metrics.LimiterRejected(metrics.LimiterGlobal)
+		return nil, errors.NewTooManyRequestsError("请求过于频繁，请稍后重试", fmt.Errorf("需要等待 %s", reservation.Delay))
+	}
+	return reservation, nil
+}
+
+// applyKeyedLimits 在全局限流之后依次检查密钥（或客户端IP）和模型的限流
+// 后一层拒绝时归还前面各层已消耗的令牌，避免被拒绝的请求占用配额
+func (h *ChatHandler) applyKeyedLimits(c *gin.Context, request models.OpenAIChatCompletionsRequest, global *ratelimit.Reservation) *errors.APIError {
+	consumer, consumerFallback := "", false
+	if h.keyLimiter != nil {
+		key := auth.FromContext(c.Request.Context())
+		consumer = rateLimitConsumer(c, key)
+		ok, retryAfter, fallback := h.keyLimiter.Allow(consumer, h.keyLimit(key))
+		if !ok {
+			global.Cancel()
+			setRetryAfter(c, retryAfter)
+			log.Ctx(c.Request.Context()).Warn("调用方 %s 请求过于频繁", consumer)
+			metrics.LimiterRejected(metrics.LimiterKey)
+			return errors.NewTooManyRequestsError("请求过于频繁，请稍后重试", fmt.Errorf("%s 超出限流", consumer))
+		}
+		consumerFallback = fallback
+	}
+
+	if h.modelLimiter != nil {
+		if ok, retryAfter, _ := h.modelLimiter.Allow(request.Model, h.modelLimit(request.Model)); !ok {
+			if consumer != "" {
+				h.keyLimiter.Refund(consumer, consumerFallback)
+			}
+			global.Cancel()
+			setRetryAfter(c, retryAfter)
+			log.Ctx(c.Request.Context()).Warn("模型 %s 请求过于频繁", request.Model)
+			metrics.LimiterRejected(metrics.LimiterModel)
+			return errors.NewTooManyRequestsError(fmt.Sprintf("模型 %s 请求过于频繁，请稍后重试", request.Model), fmt.Errorf("模型 %s 超出限流", request.Model))
+		}
+	}
+
+	return nil
+}
+
+// setRequestHeaders 设置 OpenAI 风格的请求限流响应头，限流器未启用时不设置
+func setRequestHeaders(c *gin.Context, status ratelimit.Status) {
+	if !status.Enabled {
+		return
+	}
+	c.Header(constants.HeaderRateLimitLimitRequests, strconv.Itoa(status.Limit))
+	c.Header(constants.HeaderRateLimitRemainingRequests, strconv.Itoa(status.Remaining))
+	c.Header(constants.HeaderRateLimitResetRequests, status.Reset.Round(time.Millisecond).String())
+}
+
+// setRetryAfter 设置 Retry-After 响应头（秒，向上取整）
+func setRetryAfter(c *gin.Context, delay time.Duration) {
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header(constants.HeaderRetryAfter, strconv.FormatInt(seconds, 10))
+}
+
+// rateLimitConsumer 返回限流使用的调用方标识：已认证时为API密钥，否则为客户端IP
+func rateLimitConsumer(c *gin.Context, key *auth.APIKey) string {
+	if key != nil {
+		return "key:" + key.Name
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// keyLimit 计算调用方的限制：密钥单独配置的限制优先，其次是密钥的等级，最后是默认限制
+func (h *ChatHandler) keyLimit(key *auth.APIKey) ratelimit.Limit {
+	cfg := h.config.RateLimit
+	if key != nil {
+		if key.RateLimit.RequestsPerSecond > 0 && key.RateLimit.Burst > 0 {
+			return ratelimit.Limit{Rate: key.RateLimit.RequestsPerSecond, Burst: key.RateLimit.Burst}
+		}
+		if tier, ok := cfg.Tiers[key.Tier]; key.Tier != "" && ok {
+			return ratelimit.Limit{Rate: tier.RequestsPerSecond, Burst: tier.Burst}
+		}
+		if key.Tier != "" {
+			log.Warn("API密钥 %s 的限流等级 %s 未配置，使用默认限制", key.Name, key.Tier)
+		}
+	}
+	return ratelimit.Limit{Rate: cfg.KeyLimit.RequestsPerSecond, Burst: cfg.KeyLimit.Burst}
+}
+
+// modelLimit 计算模型的限制
+func (h *ChatHandler) modelLimit(model string) ratelimit.Limit {
+	cfg := h.config.RateLimit
+	if limit, ok := cfg.ModelLimits[model]; ok {
+		return ratelimit.Limit{Rate: limit.RequestsPerSecond, Burst: limit.Burst}
+	}
+	return ratelimit.Limit{Rate: cfg.ModelLimit.RequestsPerSecond, Burst: cfg.ModelLimit.Burst}
+}
+
+// tokenReservations 一次请求在各层令牌配额中的预留
+type tokenReservations []*ratelimit.TokenReservation
+
+// settle 按实际用量结算所有预留
+func (r tokenReservations) settle(actual int) {
+	for _, reservation := range r {
+		reservation.Settle(actual)
+	}
+}
+
+// reserveTokens 依次在密钥（或客户端IP）和模型的令牌配额中预留估算的提示tokens
+// 任一层超出配额时取消已有预留并返回429，同时设置 x-ratelimit-*-tokens 响应头
+func (h *ChatHandler) reserveTokens(c *gin.Context, request models.OpenAIChatCompletionsRequest, estimated int) (tokenReservations, error) {
+	if h.keyTokens == nil || h.modelTokens == nil {
+		return nil, nil
+	}
+
+	key := auth.FromContext(c.Request.Context())
+	layers := []struct {
+		quota *ratelimit.TokenQuota
+		key   string
+		limit ratelimit.TokenLimit
+	}{
+		{h.keyTokens, rateLimitConsumer(c, key), h.keyTokenLimit(key)},
+		{h.modelTokens, request.Model, h.modelTokenLimit(request.Model)},
+	}
+
+	var (
+		reservations tokenReservations
+		binding      ratelimit.TokenStatus
+		limited      bool
+	)
+	for _, layer := range layers {
+		reservation, status, ok := layer.quota.Reserve(layer.key, estimated, layer.limit)
+		if !ok {
+			reservations.settle(0)
+			setTokenHeaders(c, status)
+			log.Ctx(c.Request.Context()).Warn("%s 超出令牌配额: 预估=%d, 剩余=%d, 重置=%s", layer.key, estimated, status.Remaining, status.Reset)
+			metrics.LimiterRejected(metrics.LimiterTokens)
+			apiErr := errors.NewTooManyRequestsError("超出令牌配额，请稍后重试", fmt.Errorf("%s 超出令牌配额", layer.key))
+			c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+			return nil, apiErr
+		}
+		if reservation == nil {
+			continue
+		}
+		reservations = append(reservations, reservation)
+		if !limited || status.Remaining < binding.Remaining {
+			binding, limited = status, true
+		}
+	}
+
+	if limited {
+		setTokenHeaders(c, binding)
+	}
+	return reservations, nil
+}
+
+// setTokenHeaders 设置 OpenAI 风格的令牌限流响应头
+func setTokenHeaders(c *gin.Context, status ratelimit.TokenStatus) {
+	c.Header(constants.HeaderRateLimitLimitTokens, strconv.Itoa(status.Limit))
+	c.Header(constants.HeaderRateLimitRemainingTokens, strconv.Itoa(status.Remaining))
+	c.Header(constants.HeaderRateLimitResetTokens, status.Reset.Round(time.Millisecond).String())
+}
+
+// settledTokens 返回用于结算令牌配额的实际tokens
+func settledTokens(counter *TokenCounter) int {
+	return billedUsage(counter).TotalTokens
+}
+
+// keyTokenLimit 计算调用方的令牌配额：密钥单独配置的配额优先，其次是密钥的等级，最后是默认配额
+func (h *ChatHandler) keyTokenLimit(key *auth.APIKey) ratelimit.TokenLimit {
+	cfg := h.config.RateLimit
+	if key != nil {
+		if key.RateLimit.TokensPerMinute > 0 || key.RateLimit.TokensPerDay > 0 {
+			return ratelimit.TokenLimit{PerMinute: key.RateLimit.TokensPerMinute, PerDay: key.RateLimit.TokensPerDay}
+		}
+		if tier, ok := cfg.TokenTiers[key.Tier]; key.Tier != "" && ok {
+			return ratelimit.TokenLimit{PerMinute: tier.TokensPerMinute, PerDay: tier.TokensPerDay}
+		}
+	}
+	return ratelimit.TokenLimit{PerMinute: cfg.KeyTokenLimit.TokensPerMinute, PerDay: cfg.KeyTokenLimit.TokensPerDay}
+}
+
+// modelTokenLimit 计算模型的令牌配额
+func (h *ChatHandler) modelTokenLimit(model string) ratelimit.TokenLimit {
+	cfg := h.config.RateLimit
+	if limit, ok := cfg.ModelTokenLimits[model]; ok {
+		return ratelimit.TokenLimit{PerMinute: limit.TokensPerMinute, PerDay: limit.TokensPerDay}
+	}
+	return ratelimit.TokenLimit{PerMinute: cfg.ModelTokenLimit.TokensPerMinute, PerDay: cfg.ModelTokenLimit.TokensPerDay}
+}
+
+// acquireConcurrency 获取全局和调用方的并发名额，返回的函数用于归还名额
+// 达到上限时按配置排队或立即拒绝，拒绝时返回429
+// 两种模式的拒绝都带固定的 Retry-After（constants.ConcurrencyRetryAfter）：名额何时释放取决于进行中的请求，
+// MaxWait 和已经排队的时间都不能说明还要等多久
+func (h *ChatHandler) acquireConcurrency(c *gin.Context) (func(), *errors.APIError) {
+	ctx := c.Request.Context()
+	consumer := rateLimitConsumer(c, auth.FromContext(ctx))
+
+	if err := h.concurrency.Acquire(ctx); err != nil {
+		return nil, concurrencyError(c, "全局并发数已达上限", err)
+	}
+	if err := h.keyConcurrency.Acquire(ctx, consumer); err != nil {
+		h.concurrency.Release()
+		return nil, concurrencyError(c, fmt.Sprintf("调用方 %s 并发数已达上限", consumer), err)
+	}
+
+	return func() {
+		h.keyConcurrency.Release(consumer)
+		h.concurrency.Release()
+	}, nil
+}
+
+// concurrencyError 把获取并发名额失败转换为响应错误
+// 调用方在排队时断开不是被拒绝，不设置 Retry-After，也不计入拒绝指标
+func concurrencyError(c *gin.Context, reason string, err error) *errors.APIError {
+	ctx := c.Request.Context()
+	if ctx.Err() != nil {
+		log.Ctx(ctx).Info("客户端在等待并发名额时断开: %v", err)
+		return errors.NewClientClosedError("客户端已断开", err)
+	}
+	log.Ctx(ctx).Warn("%s: %v", reason, err)
+	metrics.LimiterRejected(metrics.LimiterConcurrency)
+	setRetryAfter(c, constants.ConcurrencyRetryAfter)
+	return errors.NewTooManyRequestsError("同时进行的请求过多，请稍后重试", err)
+}
+
+// acquireIdentity 获取上游身份的并发名额，返回的函数用于归还名额
+func (h *ChatHandler) acquireIdentity(ctx context.Context, userId string) (func(), error) {
+	if err := h.userConcurrency.Acquire(ctx, userId); err != nil {
+		return nil, fmt.Errorf("上游身份 %s 并发数已达上限: %w", userId, err)
+	}
+	return func() {
+		h.userConcurrency.Release(userId)
+	}, nil
+}
@@ -8,9 +8,15 @@ import (
 	"net/http"
 	"scira2api/log"
 	"scira2api/models"
+	"scira2api/pkg/capture"
+	"scira2api/pkg/chaos"
 	"scira2api/pkg/constants"
 	"scira2api/pkg/errors"
+	"scira2api/pkg/fixture"
 	httpClient "scira2api/pkg/http"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/redact"
+	"scira2api/pkg/tracing"
 	"strings"
 	"sync"
 	"time"
@@ -26,10 +32,20 @@ func (h *ChatHandler) doChatRequestAsync(c *gin.Context, request models.OpenAICh
 
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
-		log.Error("Streaming unsupported: ResponseWriter does not implement http.Flusher")
+		log.Ctx(c.Request.Context()).Error("Streaming unsupported: ResponseWriter does not implement http.Flusher")
 		return errors.ErrStreamingNotSupported
 	}
 
+	// 故障注入的客户端断开和格式错误数据块在写出SSE事件时注入
+	if faults := chaos.FromContext(c.Request.Context()).StreamFaults(c.Request.Context()); faults != nil {
+		c.Writer = &chaosWriter{ResponseWriter: c.Writer, ctx: c.Request.Context(), faults: faults}
+	}
+
+	// 心跳goroutine与响应流并发写入，写入和刷新需要串行化
+	writer := &lockedWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	flusher = writer
+
 	ctx, cancel := context.WithCancel(c.Request.Context())
 	// 不使用defer cancel()，而是在流式响应结束后手动取消上下文
 	// 这样可以确保心跳goroutine在流式响应结束后立即停止
@@ -44,7 +60,7 @@ func (h *ChatHandler) doChatRequestAsync(c *gin.Context, request models.OpenAICh
 	err := h.executeStreamRequest(ctx, c, request, flusher, counter)
 	
 	// 流式响应结束后，立即取消上下文，通知心跳goroutine停止
-	log.Info("流式响应已完成，取消上下文以停止心跳")
+	log.Ctx(c.Request.Context()).Info("流式响应已完成，取消上下文以停止心跳")
 	cancel()
 	
 	// 等待心跳goroutine完成
@@ -74,7 +90,7 @@ func (h *ChatHandler) startHeartbeat(ctx context.Context, writer gin.ResponseWri
 			select {
 			case <-ticker.C:
 				if _, err := fmt.Fprint(writer, constants.HeartbeatMessage); err != nil {
-					log.Error("Error sending heartbeat: %v", err)
+					log.Ctx(ctx).Error("Error sending heartbeat: %v", err)
 					return
 				}
 				flusher.Flush()
@@ -88,6 +104,7 @@ func (h *ChatHandler) startHeartbeat(ctx context.Context, writer gin.ResponseWri
 // executeStreamRequest 执行流式请求
 func (h *ChatHandler) executeStreamRequest(ctx context.Context, c *gin.Context, request models.OpenAIChatCompletionsRequest, flusher http.Flusher, counter *TokenCounter) error {
 	attempts := h.getRetryAttempts()
+	sessionKey := h.getSessionKey(c, request)
 
 	for i := 0; i < attempts; i++ {
 		select {
@@ -96,18 +113,43 @@ func (h *ChatHandler) executeStreamRequest(ctx context.Context, c *gin.Context,
 		default:
 		}
 
-		chatId := h.getChatId()
-		userId := h.getUserId()
-		log.Info("Attempt %d/%d: Request use userId: %s, generate chatId: %s", i+1, attempts, userId, chatId)
+		chatId, userId := h.resolveUpstreamIdentity(sessionKey)
+		log.Ctx(ctx).Info("Attempt %d/%d: Request use userId: %s, generate chatId: %s", i+1, attempts, userId, chatId)
+		attemptCtx, span := startAttemptSpan(ctx, request, i, userId)
+		log.AddFields(ctx, log.FieldUpstreamIdentity, userId)
 
-		if err := h.processStreamResponse(ctx, c, request, chatId, userId, flusher, counter); err == nil {
-			log.Info("Attempt %d/%d successful. UserId: %s, ChatId: %s", i+1, attempts, userId, chatId)
+		releaseIdentity, err := h.acquireIdentity(attemptCtx, userId)
+		if err != nil {
+			// 上游身份繁忙不是身份本身的故障，不隔离，直接换下一个身份重试
+			log.Ctx(ctx).Warn("Attempt %d/%d: %s", i+1, attempts, err)
+			metrics.UpstreamAttempt(request.Model, true, i, metrics.OutcomeBusy)
+			tracing.End(span, err)
+			if i == attempts-1 {
+				metrics.UpstreamFailed(request.Model, true)
+				return err
+			}
+			continue
+		}
+		err = h.processStreamResponse(attemptCtx, c, request, chatId, userId, flusher, counter)
+		releaseIdentity()
+		tracing.End(span, err)
+		if err == nil {
+			log.Ctx(ctx).Info("Attempt %d/%d successful. UserId: %s, ChatId: %s", i+1, attempts, userId, chatId)
+			metrics.UpstreamAttempt(request.Model, true, i, metrics.OutcomeSuccess)
 			return nil
 		} else {
-			log.Error("Attempt %d/%d failed. UserId: %s, ChatId: %s, Error: %s", i+1, attempts, userId, chatId, err)
+			log.Ctx(ctx).Error("Attempt %d/%d failed. UserId: %s, ChatId: %s, Error: %s", i+1, attempts, userId, chatId, err)
+			metrics.UpstreamAttempt(request.Model, true, i, metrics.OutcomeFailure)
+			// 回放模式下没有录制的请求换身份重试也不会命中，上游身份本身没有问题
+			if stdErrors.Is(err, fixture.ErrMiss) {
+				metrics.UpstreamFailed(request.Model, true)
+				return err
+			}
+			h.quarantineIdentity(ctx, sessionKey, userId, err)
 
 			if i == attempts-1 {
-				log.Error("All %d attempts failed for stream request. Last error: %s", attempts, err)
+				log.Ctx(ctx).Error("All %d attempts failed for stream request. Last error: %s", attempts, err)
+				metrics.UpstreamFailed(request.Model, true)
 				return err
 			}
 
@@ -136,11 +178,14 @@ func (h *ChatHandler) processStreamResponse(ctx context.Context, c *gin.Context,
 	// 将外部模型名称映射为内部模型名称
 	internalModel := MapModelName(h.config, request.Model)
 	sciraRequest := request.ToSciraChatCompletionsRequest(internalModel, chatId, userId)
+	applyKeyDefaults(ctx, sciraRequest)
+	capture.FromContext(ctx).SetUpstreamRequest(sciraRequest)
 
 	// 发送请求
 	resp, err := h.client.R().
 		SetContext(ctx).
 		SetHeader("Referer", h.config.Client.BaseURL).
+		SetProxyKey(userId).
 		SetBody(sciraRequest).
 		SetDoNotParseResponse(true).
 		Execute("POST", constants.APISearchEndpoint)
@@ -149,16 +194,17 @@ func (h *ChatHandler) processStreamResponse(ctx context.Context, c *gin.Context,
 	if err != nil {
 		return fmt.Errorf("HTTP request failed: %w, URL: %s, Method: POST", err, constants.APISearchEndpoint)
 	}
+	h.observeLatency(request.Model, metrics.LatencyUpstreamTTFB, resp.TimeToFirstByte())
 	
 	// 确保响应体被关闭
 	if resp != nil && resp.RawBody() != nil {
 		defer func() {
 			if closeErr := resp.RawBody().Close(); closeErr != nil {
-				log.Error("关闭响应体失败: %v", closeErr)
+				log.Ctx(ctx).Error("关闭响应体失败: %v", closeErr)
 			}
 		}()
 	} else {
-		log.Warn("HTTP请求成功但响应体为空")
+		log.Ctx(ctx).Warn("HTTP请求成功但响应体为空")
 		return fmt.Errorf("HTTP请求成功但响应体为空")
 	}
 
@@ -173,6 +219,8 @@ func (h *ChatHandler) processStreamResponse(ctx context.Context, c *gin.Context,
 			} else {
 				responseBody = string(resp.Body())
 			}
+			// 上游可能回显请求头或Cookie，错误信息会写入日志并可能返回给客户端
+			responseBody = redact.String(responseBody)
 		}
 		
 		return fmt.Errorf("HTTP错误: 状态码=%d, 响应体=%s, URL=%s, Method=POST",
@@ -185,21 +233,27 @@ func (h *ChatHandler) processStreamResponse(ctx context.Context, c *gin.Context,
 
 // processResponseStream 处理响应流数据
 func (h *ChatHandler) processResponseStream(ctx context.Context, c *gin.Context, resp *httpClient.Response, request models.OpenAIChatCompletionsRequest, flusher http.Flusher, counter *TokenCounter) (err error) {
+	// 包含向客户端写出数据块的时间；先于panic恢复注册，结束时能记录恢复后的错误
+	ctx, span := tracing.Start(ctx, "stream.process")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	defer func() {
 		if r := recover(); r != nil {
-			log.Error("Panic recovered in processResponseStream: %v", r)
+			log.Ctx(ctx).Error("Panic recovered in processResponseStream: %v", r)
 			// Ensure an error is returned from the function
 			err = fmt.Errorf("panic occurred: %v", r)
 
 			// Send SSE error message and [DONE]
 			errorMsgContent := fmt.Sprintf("Internal Server Error during stream processing. Details: %v", r)
-			h.sendPanicErrorSSE(c.Writer, flusher, GetExternalModelName(h.config, request.Model), errorMsgContent)
+			h.sendPanicErrorSSE(ctx, c.Writer, flusher, GetExternalModelName(h.config, request.Model), errorMsgContent)
 		}
 	}()
 
 	// 使用传入的token计数器，确保每个请求数据隔离
 	// 计算输入tokens（如果在外层已经计算过，这里会重新计算，确保数据一致）
-	h.calculateInputTokens(request, counter)
+	h.calculateInputTokens(ctx, request, counter)
 	
 	scanner := bufio.NewScanner(resp.RawBody())
 
@@ -222,12 +276,16 @@ func (h *ChatHandler) processResponseStream(ctx context.Context, c *gin.Context,
 	// 错误计数和阈值
 	errCount := 0
 	const maxErrors = 5 // 最大允许的连续错误数
+	session := capture.FromContext(ctx)
+	
+	// 数据行的刷新频率按每个流单独控制
+	lineFlusher := newThrottledFlusher(flusher, minFlushInterval)
 	
 	// 处理流式数据
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
-			log.Info("Client disconnected, stopping stream.")
+			log.Ctx(ctx).Info("Client disconnected, stopping stream.")
 			return nil
 		default:
 		}
@@ -236,15 +294,16 @@ func (h *ChatHandler) processResponseStream(ctx context.Context, c *gin.Context,
 		if line == "" {
 			continue
 		}
+		session.AddUpstreamLine(line)
 
-		if err := h.processStreamLine(c.Writer, flusher, line, responseID, created, externalModel, counter); err != nil {
-			log.Error("Error processing stream line: %v", err)
+		if err := h.processStreamLine(ctx, c.Writer, lineFlusher, line, responseID, created, externalModel, counter); err != nil {
+			log.Ctx(ctx).Error("Error processing stream line: %v", err)
 			errCount++
 			
 			// 如果连续错误超过阈值，向客户端发送错误通知并中断处理
 			if errCount >= maxErrors {
 				errMsg := fmt.Sprintf("Too many errors processing stream (reached threshold of %d). Last error: %v", maxErrors, err)
-				log.Error(errMsg)
+				log.Ctx(ctx).Error(errMsg)
 				
 				// 发送错误消息给客户端
 				// 获取当前的token统计
@@ -293,30 +352,30 @@ func (h *ChatHandler) processResponseStream(ctx context.Context, c *gin.Context,
 	// 表明在读取上游数据时客户端已断开连接。
 	// 这种情况下，不应尝试发送最终的成功消息。
 	if stdErrors.Is(scannerError, context.Canceled) {
-		log.Warn("processResponseStream: Scanner stopped because context was canceled (likely client disconnected during upstream read). Upstream data might be incomplete. Returning context.Canceled.")
+		log.Ctx(ctx).Warn("processResponseStream: Scanner stopped because context was canceled (likely client disconnected during upstream read). Upstream data might be incomplete. Returning context.Canceled.")
 		return context.Canceled // 直接返回 context.Canceled
 	}
 
 	// 如果 scanner 遇到其他错误（例如 bufio.ErrTooLong 或其他IO错误）
 	if scannerError != nil {
-		log.Error("processResponseStream: Scanner encountered an unhandled error: %v. Attempting to send error SSE.", scannerError)
+		log.Ctx(ctx).Error("processResponseStream: Scanner encountered an unhandled error: %v. Attempting to send error SSE.", scannerError)
 		// 在这里，我们应该尝试向客户端发送一个包含此错误的SSE消息，然后发送[DONE]
 		// 这部分可以复用或借鉴 panic 或 maxErrors 时的错误发送逻辑
 		// 例如: sendSpecificErrorSSE(writer, flusher, model, details, counter, responseID, created)
 		// 此处简化处理：记录错误，然后尝试发送一个通用的错误完成reason
 		// 理想情况下，应该发送具体的错误信息给客户端
-		h.sendErrorFinishSSE(c.Writer, flusher, responseID, created, externalModel, fmt.Sprintf("scanner error: %v", scannerError), counter)
+		h.sendErrorFinishSSE(ctx, c.Writer, flusher, responseID, created, externalModel, fmt.Sprintf("scanner error: %v", scannerError), counter)
 		return fmt.Errorf("scanner error: %w", scannerError) // 返回原始的 scanner 错误
 	}
 
 	// scannerError is nil, indicating upstream likely sent EOF. This is the "normal" success path.
 	// 只有在 scannerError 为 nil (上游正常结束) 时，才发送成功的 finalMessage.
-	finalMessageErr := h.sendFinalMessage(c.Writer, flusher, responseID, created, externalModel, counter)
+	finalMessageErr := h.sendFinalMessage(ctx, c.Writer, flusher, responseID, created, externalModel, counter)
 	if finalMessageErr != nil {
-		log.Error("processResponseStream: Error from sendFinalMessage: %v", finalMessageErr)
+		log.Ctx(ctx).Error("processResponseStream: Error from sendFinalMessage: %v", finalMessageErr)
 		return finalMessageErr // 如果发送最终消息失败，返回该错误
 	}
-	log.Info("processResponseStream: Successfully sent final message and [DONE].")
+	log.Ctx(ctx).Info("processResponseStream: Successfully sent final message and [DONE].")
 	return nil // 正常成功完成
 }
 
@@ -368,12 +427,9 @@ func (h *ChatHandler) sendInitialMessage(writer gin.ResponseWriter, flusher http
 	return nil
 }
 
-// processStreamLine 处理流式数据行
-// 添加变量跟踪上次flush时间
-var lastFlushTime time.Time
-const minFlushInterval = 100 * time.Millisecond
+// processStreamLine 处理流式数据行，flusher 由调用方控制刷新频率（见 throttledFlusher）
 
-func (h *ChatHandler) processStreamLine(writer gin.ResponseWriter, flusher http.Flusher, line, responseID string, created int64, model string, counter *TokenCounter) error {
+func (h *ChatHandler) processStreamLine(ctx context.Context, writer gin.ResponseWriter, flusher http.Flusher, line, responseID string, created int64, model string, counter *TokenCounter) error {
 	// 处理不同类型的数据并转换为OpenAI流式格式
 	if strings.HasPrefix(line, "g:") || strings.HasPrefix(line, "0:") {
 		var content string
@@ -383,13 +439,22 @@ func (h *ChatHandler) processStreamLine(writer gin.ResponseWriter, flusher http.
 			reasoningContent = processContent(line[2:])
 			// 更新推理内容的token计数
 			if reasoningContent != "" {
-				h.updateOutputTokens(reasoningContent, counter)
+				h.updateReasoningTokens(reasoningContent, counter)
 			}
 		} else if strings.HasPrefix(line, "0:") {
 			content = processContent(line[2:])
 			// 更新内容的token计数
 			if content != "" {
-				h.updateOutputTokens(content, counter)
+				h.updateOutputTokens(ctx, content, counter)
+			}
+		}
+
+		// 记录首个token延迟和数据块间隔
+		if content != "" || reasoningContent != "" {
+			if latency, first := counter.MarkOutput(); first {
+				h.observeLatency(model, metrics.LatencyFirstToken, latency)
+			} else {
+				h.observeLatency(model, metrics.LatencyChunkGap, latency)
 			}
 		}
 
@@ -432,17 +497,12 @@ func (h *ChatHandler) processStreamLine(writer gin.ResponseWriter, flusher http.
 			return fmt.Errorf("error writing to stream: %w", err)
 		}
 
-		// 控制刷新频率，避免过于频繁的flush
-		now := time.Now()
-		if now.Sub(lastFlushTime) > minFlushInterval {
-			flusher.Flush()
-			lastFlushTime = now
-		}
+		flusher.Flush()
 	} else if strings.HasPrefix(line, "d:") {
 		// 处理用量数据
 		usage := &models.Usage{}
 		var dummyContent, dummyReasoningContent, dummyFinishReason string
-		processLineData(line, &dummyContent, &dummyReasoningContent, usage, &dummyFinishReason)
+		processLineData(ctx, line, &dummyContent, &dummyReasoningContent, usage, &dummyFinishReason)
 		counter.SetStreamUsage(usage) // 保存用量数据供后续使用
 	}
 
@@ -450,7 +510,7 @@ func (h *ChatHandler) processStreamLine(writer gin.ResponseWriter, flusher http.
 }
 
 // sendFinalMessage 发送结束消息
-func (h *ChatHandler) sendFinalMessage(writer gin.ResponseWriter, flusher http.Flusher, responseID string, created int64, model string, counter *TokenCounter) error {
+func (h *ChatHandler) sendFinalMessage(ctx context.Context, writer gin.ResponseWriter, flusher http.Flusher, responseID string, created int64, model string, counter *TokenCounter) error {
 	// 发送带有完成原因的最终消息
 	finalChoice := []models.Choice{
 		{
@@ -470,7 +530,8 @@ func (h *ChatHandler) sendFinalMessage(writer gin.ResponseWriter, flusher http.F
 		Choices: finalChoice,
 	}
 
-	// 获取我们计算的token统计数据
+	// 获取我们计算的token统计数据，输出内容整体重新计数
+	counter.RecountOutput()
 	calculatedUsage := counter.GetUsage()
 	
 	// 服务器返回的统计数据
@@ -481,7 +542,8 @@ func (h *ChatHandler) sendFinalMessage(writer gin.ResponseWriter, flusher http.F
 	}
 	
 	// 对比和校正token统计
-	correctedUsage := h.correctUsage(serverUsage, calculatedUsage)
+	correctedUsage := h.correctUsage(ctx, serverUsage, calculatedUsage)
+	counter.SetFinalUsage(correctedUsage)
 	
 	// 记录原始和校正后的统计数据
 	// log.Info("流式Token统计对比 - 服务器: 提示=%d, 完成=%d, 总计=%d | 计算值: 提示=%d, 完成=%d, 总计=%d",
@@ -507,20 +569,20 @@ func (h *ChatHandler) sendFinalMessage(writer gin.ResponseWriter, flusher http.F
 		return fmt.Errorf("error writing [DONE] to stream: %w", err)
 	}
 
-	log.Info("Stream completed. Final message and [DONE] sent to client.")
+	log.Ctx(ctx).Info("Stream completed. Final message and [DONE] sent to client.")
 	flusher.Flush()
 	return nil
 }
 
 // sendPanicErrorSSE sends a standardized SSE error message in case of a panic.
-func (h *ChatHandler) sendPanicErrorSSE(writer gin.ResponseWriter, flusher http.Flusher, model string, panicDetails string) {
+func (h *ChatHandler) sendPanicErrorSSE(ctx context.Context, writer gin.ResponseWriter, flusher http.Flusher, model string, panicDetails string) {
 	// 确保使用外部模型名称
 	// 注意：这里的 model 参数已经是外部模型名称了，因为它是从 request.Model 传递过来的，
 	// 而 request.Model 通常是客户端直接指定的外部模型名。
 	// 如果 model 是内部名，则需要 GetExternalModelName(h.config, model)
 	// 但在此上下文中，它更有可能是外部名。为保持一致性，我们假设它可能是内部名并进行转换。
 	externalModel := GetExternalModelName(h.config, model)
-	log.Info("Attempting to send panic error SSE to client.")
+	log.Ctx(ctx).Info("Attempting to send panic error SSE to client.")
 
 	// Generate a new ID and timestamp for this panic event
 	errorID := h.generateResponseID()
@@ -555,24 +617,24 @@ func (h *ChatHandler) sendPanicErrorSSE(writer gin.ResponseWriter, flusher http.
 
 	errorJSON, jsonErr := json.Marshal(errorResponse)
 	if jsonErr != nil {
-		log.Error("Failed to marshal panic SSE error response: %v. Sending plain text fallback.", jsonErr)
+		log.Ctx(ctx).Error("Failed to marshal panic SSE error response: %v. Sending plain text fallback.", jsonErr)
 		// Fallback to plain text if JSON marshalling fails. Escape quotes in panicDetails for JSON-like structure.
 		escapedDetails := strings.ReplaceAll(panicDetails, "\"", "'")
 		escapedDetails = strings.ReplaceAll(escapedDetails, "\n", " ") // Newlines can break SSE
 		if _, writeErr := fmt.Fprintf(writer, "event: error\ndata: {\"error\": \"Internal Server Error\", \"details\": \"%s\"}\n\n", escapedDetails); writeErr != nil {
-			log.Error("Failed to write plain text panic SSE error: %v", writeErr)
+			log.Ctx(ctx).Error("Failed to write plain text panic SSE error: %v", writeErr)
 		}
 	} else {
 		if _, writeErr := fmt.Fprintf(writer, "data: %s\n\n", errorJSON); writeErr != nil {
-			log.Error("Failed to write JSON panic SSE error: %v", writeErr)
+			log.Ctx(ctx).Error("Failed to write JSON panic SSE error: %v", writeErr)
 		}
 	}
 
 	// 一次性发送完整的 [DONE] 信号，避免换行符被错误地插入到字符串中间
 	if _, writeErr := fmt.Fprint(writer, "data: [DONE]\n\n"); writeErr != nil {
-		log.Error("Failed to write [DONE] after panic SSE error: %v", writeErr)
+		log.Ctx(ctx).Error("Failed to write [DONE] after panic SSE error: %v", writeErr)
 	}
 
 	flusher.Flush()
-	log.Info("Panic error SSE and [DONE] message sent to client.")
+	log.Ctx(ctx).Info("Panic error SSE and [DONE] message sent to client.")
 }
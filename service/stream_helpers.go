@@ -1,13 +1,16 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"scira2api/log"
 	"scira2api/models"
 	"scira2api/pkg/constants"
-	// "time" // Removed as it's not used in this file
+	"scira2api/pkg/redact"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,8 +18,10 @@ import (
 // sendErrorFinishSSE sends a final SSE message with a specified error reason and [DONE].
 // This is used when the stream terminates due to an error detected after the main scanning loop,
 // and we want to inform the client about the error before closing the stream with [DONE].
-func (h *ChatHandler) sendErrorFinishSSE(writer gin.ResponseWriter, flusher http.Flusher, responseID string, created int64, model string, errorMsgContent string, counter *TokenCounter) {
-	log.Warn("Sending error finish SSE to client. Error: %s", errorMsgContent)
+func (h *ChatHandler) sendErrorFinishSSE(ctx context.Context, writer gin.ResponseWriter, flusher http.Flusher, responseID string, created int64, model string, errorMsgContent string, counter *TokenCounter) {
+	// The message is sent to the client, so strip any credentials it may carry first
+	errorMsgContent = redact.String(errorMsgContent)
+	log.Ctx(ctx).Warn("Sending error finish SSE to client. Error: %s", errorMsgContent)
 
 	// 获取当前的token统计
 	currentUsage := counter.GetUsage()
@@ -43,22 +48,70 @@ func (h *ChatHandler) sendErrorFinishSSE(writer gin.ResponseWriter, flusher http
 
 	errorJSON, jsonErr := json.Marshal(errorResponse)
 	if jsonErr != nil {
-		log.Error("Failed to marshal error finish SSE response: %v. Sending plain text fallback.", jsonErr)
+		log.Ctx(ctx).Error("Failed to marshal error finish SSE response: %v. Sending plain text fallback.", jsonErr)
 		// Fallback to plain text if JSON marshalling fails
 		if _, writeErr := fmt.Fprintf(writer, "event: error\ndata: {\"error\": \"Stream processing error\", \"details\": \"%s\"}\n\n", errorMsgContent); writeErr != nil {
-			log.Error("Failed to write plain text error finish SSE: %v", writeErr)
+			log.Ctx(ctx).Error("Failed to write plain text error finish SSE: %v", writeErr)
 		}
 	} else {
 		if _, writeErr := fmt.Fprintf(writer, "data: %s\n\n", errorJSON); writeErr != nil {
-			log.Error("Failed to write JSON error finish SSE: %v", writeErr)
+			log.Ctx(ctx).Error("Failed to write JSON error finish SSE: %v", writeErr)
 		}
 	}
 
 	// Always send [DONE] after an error message to properly close the stream from client's perspective
 	if _, writeErr := fmt.Fprint(writer, "data: [DONE]\n\n"); writeErr != nil {
-		log.Error("Failed to write [DONE] after error finish SSE: %v", writeErr)
+		log.Ctx(ctx).Error("Failed to write [DONE] after error finish SSE: %v", writeErr)
 	}
 
 	flusher.Flush()
-	log.Info("Error finish SSE and [DONE] message sent to client.")
-}
\ No newline at end of file
+	log.Ctx(ctx).Info("Error finish SSE and [DONE] message sent to client.")
+}
+
+// minFlushInterval 数据行之间的最小刷新间隔，避免过于频繁的flush
+const minFlushInterval = 100 * time.Millisecond
+
+// throttledFlusher 限制单个流的刷新频率，每个流单独记录上次刷新时间
+type throttledFlusher struct {
+	http.Flusher
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+// newThrottledFlusher 创建限制刷新频率的flusher
+func newThrottledFlusher(flusher http.Flusher, interval time.Duration) *throttledFlusher {
+	return &throttledFlusher{Flusher: flusher, interval: interval}
+}
+
+// Flush 距上次刷新超过间隔时才刷新
+func (f *throttledFlusher) Flush() {
+	now := time.Now()
+	if now.Sub(f.lastFlush) > f.interval {
+		f.Flusher.Flush()
+		f.lastFlush = now
+	}
+}
+
+// lockedWriter 串行化响应流和心跳goroutine的写入和刷新
+type lockedWriter struct {
+	gin.ResponseWriter
+	mu sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *lockedWriter) WriteString(s string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *lockedWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ResponseWriter.Flush()
+}
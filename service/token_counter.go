@@ -2,7 +2,10 @@ package service
 
 import (
 	"scira2api/models"
+	"scira2api/pkg/tokenizer"
+	"strings"
 	"sync"
+	"time"
 )
 
 // TokenCounter 跟踪单个请求的token统计
@@ -10,13 +13,35 @@ type TokenCounter struct {
 	mu                 sync.Mutex
 	inputTokens        int
 	outputTokens       int
+	reasoningTokens    int
 	totalTokens        int
 	streamUsage        *models.Usage
+	finalUsage         *models.Usage
+	started            time.Time
+	lastOutput         time.Time
+	tokenizer          *tokenizer.Tokenizer // 请求模型的分词器，nil 时近似估算
+	outputText         strings.Builder      // 流式输出的完整内容，结束时整体重新计数
+	reasoningText      strings.Builder
 }
 
 // NewTokenCounter 创建新的token计数器
 func NewTokenCounter() *TokenCounter {
-	return &TokenCounter{}
+	return &TokenCounter{started: time.Now()}
+}
+
+// MarkOutput 记录一次内容输出
+// 首次输出时 first 为true，latency 为距计数器创建的时间；之后 latency 为距上一次输出的间隔
+func (tc *TokenCounter) MarkOutput() (latency time.Duration, first bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	now := time.Now()
+	if tc.lastOutput.IsZero() {
+		latency, first = now.Sub(tc.started), true
+	} else {
+		latency = now.Sub(tc.lastOutput)
+	}
+	tc.lastOutput = now
+	return latency, first
 }
 
 // ResetCalculation 重置token计算数据
@@ -25,7 +50,52 @@ func (tc *TokenCounter) ResetCalculation() {
 	defer tc.mu.Unlock()
 	tc.inputTokens = 0
 	tc.outputTokens = 0
+	tc.reasoningTokens = 0
 	tc.totalTokens = 0
+	tc.outputText.Reset()
+	tc.reasoningText.Reset()
+}
+
+// SetTokenizer 设置计算输出tokens使用的分词器
+func (tc *TokenCounter) SetTokenizer(t *tokenizer.Tokenizer) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.tokenizer = t
+}
+
+// AddOutputText 累计输出内容并返回该段内容的tokens数量
+func (tc *TokenCounter) AddOutputText(text string) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tokens := tc.tokenizer.Count(text)
+	tc.outputText.WriteString(text)
+	tc.outputTokens += tokens
+	tc.totalTokens = tc.inputTokens + tc.outputTokens
+	return tokens
+}
+
+// AddReasoningText 累计推理内容，推理tokens同时计入输出tokens
+func (tc *TokenCounter) AddReasoningText(text string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tokens := tc.tokenizer.Count(text)
+	tc.reasoningText.WriteString(text)
+	tc.reasoningTokens += tokens
+	tc.outputTokens += tokens
+	tc.totalTokens = tc.inputTokens + tc.outputTokens
+}
+
+// RecountOutput 按累计的完整内容重新计算输出tokens
+// 流式响应逐块计数时BPE合并会在块边界断开，结束时整体计数才与上游分词一致
+func (tc *TokenCounter) RecountOutput() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.outputText.Len() == 0 && tc.reasoningText.Len() == 0 {
+		return
+	}
+	tc.reasoningTokens = tc.tokenizer.Count(tc.reasoningText.String())
+	tc.outputTokens = tc.tokenizer.Count(tc.outputText.String()) + tc.reasoningTokens
+	tc.totalTokens = tc.inputTokens + tc.outputTokens
 }
 
 // SetInputTokens 设置输入tokens数量
@@ -44,6 +114,22 @@ func (tc *TokenCounter) AddOutputTokens(tokens int) {
 	tc.totalTokens = tc.inputTokens + tc.outputTokens
 }
 
+// AddReasoningTokens 添加推理tokens数量，推理tokens同时计入输出tokens
+func (tc *TokenCounter) AddReasoningTokens(tokens int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.reasoningTokens += tokens
+	tc.outputTokens += tokens
+	tc.totalTokens = tc.inputTokens + tc.outputTokens
+}
+
+// GetReasoningTokens 获取推理tokens数量
+func (tc *TokenCounter) GetReasoningTokens() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.reasoningTokens
+}
+
 // GetUsage 获取当前的usage统计
 func (tc *TokenCounter) GetUsage() models.Usage {
 	tc.mu.Lock()
@@ -68,4 +154,18 @@ func (tc *TokenCounter) GetStreamUsage() *models.Usage {
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
 	return tc.streamUsage
+}
+
+// SetFinalUsage 设置返回给客户端的最终（校正后的）统计数据
+func (tc *TokenCounter) SetFinalUsage(usage models.Usage) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.finalUsage = &usage
+}
+
+// GetFinalUsage 获取最终统计数据，响应未完成时返回nil
+func (tc *TokenCounter) GetFinalUsage() *models.Usage {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.finalUsage
 }
\ No newline at end of file
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"net/http"
+	"scira2api/config"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/budget"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/errors"
+	"scira2api/pkg/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenizeHandler 计算聊天请求的提示tokens、上下文窗口和预估费用
+// 与聊天请求使用同一分词器和计数方式，不调用上游，也不消耗限流配额和预算
+func (h *ChatHandler) TokenizeHandler(c *gin.Context) {
+	var request models.OpenAIChatCompletionsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		apiErr := errors.NewInvalidRequestError("无法解析请求JSON", err)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+	if err := h.chatParamCheck(request); err != nil {
+		apiErr := errors.NewInvalidRequestError(err.Error(), err)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+	if key := auth.FromContext(c.Request.Context()); key != nil && !key.AllowsModel(request.Model) {
+		apiErr := errors.NewForbiddenError("API key is not allowed to use model " + request.Model)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+
+	tok := h.tokenizers.For(request.Model)
+	messages := promptMessages(request)
+	response := models.TokenizeResponse{
+		Object:       constants.ObjectTokenize,
+		Model:        request.Model,
+		Encoding:     tok.Name(),
+		PromptTokens: tok.CountMessages(messages),
+		Messages:     make([]models.TokenizeMessage, len(messages)),
+	}
+	response.ReplyTokens = response.PromptTokens
+	for i, m := range messages {
+		tokens := tok.CountMessage(m)
+		response.Messages[i] = models.TokenizeMessage{Index: i, Role: m.Role, Tokens: tokens}
+		response.ReplyTokens -= tokens
+	}
+
+	if window := contextWindow(h.config, request.Model); window > 0 {
+		remaining := window - response.PromptTokens
+		response.ContextWindow = &window
+		response.RemainingTokens = &remaining
+	}
+	if price := modelPrice(h.config, request.Model); price != (budget.Price{}) {
+		cost := price.Cost(response.PromptTokens, 0, 0)
+		response.EstimatedCost = &cost
+	}
+
+	log.Ctx(c.Request.Context()).Debug("提示tokens计数: 模型=%s, 编码=%s, tokens=%d", request.Model, response.Encoding, response.PromptTokens)
+	c.JSON(http.StatusOK, response)
+}
+
+// promptMessages 把请求消息转换为分词器的计数格式
+func promptMessages(request models.OpenAIChatCompletionsRequest) []tokenizer.Message {
+	// 注意: 现有模型中不支持name和function_call字段
+	// 如需扩展，请先更新models.Message结构体定义
+	messages := make([]tokenizer.Message, len(request.Messages))
+	for i, msg := range request.Messages {
+		messages[i] = tokenizer.Message{Role: msg.Role, Content: msg.Content}
+	}
+	return messages
+}
+
+// contextWindow 返回模型的上下文窗口，外部模型名优先，其次是映射后的内部模型名；未知时为0
+func contextWindow(cfg *config.Config, model string) int {
+	if window, ok := cfg.Tokenizer.ContextWindows[model]; ok {
+		return window
+	}
+	return cfg.Tokenizer.ContextWindows[MapModelName(cfg, model)]
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"context"
+	"scira2api/models"
+	"scira2api/pkg/errors"
+	"scira2api/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// endStage 结束请求处理阶段的span，apiErr 不为nil时记录错误
+// 单独处理 *errors.APIError，避免nil指针被当作非nil的error
+func endStage(span trace.Span, apiErr *errors.APIError) {
+	if apiErr != nil {
+		tracing.End(span, apiErr)
+		return
+	}
+	span.End()
+}
+
+// startAttemptSpan 为一次上游请求尝试创建span，代理和状态码由HTTP客户端写入
+func startAttemptSpan(ctx context.Context, request models.OpenAIChatCompletionsRequest, attempt int, userId string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "upstream.attempt",
+		attribute.Int("upstream.attempt", attempt+1),
+		attribute.String("upstream.identity", userId),
+		attribute.String("llm.model", request.Model),
+		attribute.Bool("stream", request.Stream),
+	)
+}
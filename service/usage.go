@@ -0,0 +1,204 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"scira2api/log"
+	"scira2api/models"
+	"scira2api/pkg/auth"
+	"scira2api/pkg/constants"
+	"scira2api/pkg/errors"
+	"scira2api/pkg/metrics"
+	"scira2api/pkg/usage"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordUsage 把一次已完成的聊天请求写入用量账本，状态码取自已写出的响应
+// 只记录调用了上游的请求和缓存命中，校验、限流、预算和并发拒绝不写入账本
+// 缓存命中以外的请求同时计入tokens指标
+func (h *ChatHandler) recordUsage(c *gin.Context, request models.OpenAIChatCompletionsRequest, billed models.Usage, reasoningTokens int, latency time.Duration, cacheHit bool) {
+	key := auth.KeyName(c.Request.Context())
+	if key == "" {
+		key = constants.UsageAnonymousKey
+	}
+	if !cacheHit {
+		metrics.AddTokens(request.Model, key, billed.PromptTokens, billed.CompletionTokens, reasoningTokens)
+	}
+
+	if h.usage == nil {
+		return
+	}
+
+	h.usage.Add(usage.Record{
+		Time:             time.Now(),
+		Key:              key,
+		Model:            request.Model,
+		InternalModel:    MapModelName(h.config, request.Model),
+		PromptTokens:     billed.PromptTokens,
+		CompletionTokens: billed.CompletionTokens,
+		ReasoningTokens:  reasoningTokens,
+		TotalTokens:      billed.TotalTokens,
+		LatencyMs:        latency.Milliseconds(),
+		Status:           c.Writer.Status(),
+		Stream:           request.Stream,
+		CacheHit:         cacheHit,
+	})
+}
+
+// billedUsage 请求实际产生的用量：优先使用返回给客户端的最终统计；
+// 流式响应中途中断时使用已计算的部分输出；请求失败且没有任何输出时为零
+func billedUsage(counter *TokenCounter) models.Usage {
+	if usage := counter.GetFinalUsage(); usage != nil {
+		return *usage
+	}
+	if usage := counter.GetUsage(); usage.CompletionTokens > 0 {
+		return usage
+	}
+	return models.Usage{}
+}
+
+// UsageHandler 查询当前API密钥的用量汇总
+// 支持 from/to（日期或RFC3339时间）、model、group_by（day,model）、tz 和 format=csv 参数
+func (h *ChatHandler) UsageHandler(c *gin.Context) {
+	key := auth.KeyName(c.Request.Context())
+	if key == "" {
+		key = constants.UsageAnonymousKey
+	}
+	h.respondUsage(c, key, false)
+}
+
+// respondUsage 按查询参数汇总用量并返回JSON或CSV；allKeys 为true时允许按密钥分组和过滤
+func (h *ChatHandler) respondUsage(c *gin.Context, key string, allKeys bool) {
+	if h.usage == nil {
+		apiErr := errors.NewServiceUnavailableError("usage accounting is disabled", nil)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+
+	query, err := parseUsageQuery(c, allKeys)
+	if err != nil {
+		apiErr := errors.NewInvalidRequestError(err.Error(), err)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+	if !allKeys {
+		query.filter.Key = key
+	}
+
+	aggregator := usage.NewAggregator(query.groups, query.location)
+	if err := h.usage.Query(query.filter, aggregator.Add); err != nil {
+		log.Ctx(c.Request.Context()).Error("查询用量记录失败: %v", err)
+		apiErr := errors.NewInternalServerError("failed to query usage", err)
+		c.JSON(apiErr.Code, gin.H{"error": apiErr.Message})
+		return
+	}
+
+	if query.csv {
+		filename := fmt.Sprintf("usage_%s_%s.csv",
+			query.filter.From.In(query.location).Format("20060102"),
+			query.filter.To.Add(-time.Nanosecond).In(query.location).Format("20060102"))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Status(http.StatusOK)
+		if err := aggregator.WriteCSV(c.Writer); err != nil {
+			log.Ctx(c.Request.Context()).Error("写出用量CSV失败: %v", err)
+		}
+		return
+	}
+
+	response := gin.H{
+		"object":   "usage",
+		"from":     query.filter.From.In(query.location).Format(time.RFC3339),
+		"to":       query.filter.To.In(query.location).Format(time.RFC3339),
+		"group_by": query.groups,
+		"total":    aggregator.Total(),
+		"data":     aggregator.Groups(),
+	}
+	if !allKeys {
+		response["key"] = key
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// usageQuery 用量查询参数
+type usageQuery struct {
+	filter   usage.Filter
+	groups   []string
+	location *time.Location
+	csv      bool
+}
+
+// parseUsageQuery 解析用量查询参数；to 为日期时包含当天，默认查询最近30天
+func parseUsageQuery(c *gin.Context, allKeys bool) (usageQuery, error) {
+	query := usageQuery{location: time.UTC}
+
+	if tz := c.Query("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return query, fmt.Errorf("invalid tz %q", tz)
+		}
+		query.location = location
+	}
+
+	groups, err := usage.ParseGroupBy(c.Query("group_by"))
+	if err != nil {
+		return query, err
+	}
+	for _, group := range groups {
+		if group == usage.GroupKey && !allKeys {
+			return query, fmt.Errorf("group_by key is only available to administrators")
+		}
+	}
+	query.groups = groups
+
+	now := time.Now()
+	query.filter.To = now
+	if value := c.Query("to"); value != "" {
+		to, dateOnly, err := parseUsageTime(value, query.location)
+		if err != nil {
+			return query, fmt.Errorf("invalid to %q", value)
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		query.filter.To = to
+	}
+
+	query.filter.From = query.filter.To.Add(-constants.DefaultUsageRange)
+	if value := c.Query("from"); value != "" {
+		from, _, err := parseUsageTime(value, query.location)
+		if err != nil {
+			return query, fmt.Errorf("invalid from %q", value)
+		}
+		query.filter.From = from
+	}
+	if !query.filter.From.Before(query.filter.To) {
+		return query, fmt.Errorf("from must be before to")
+	}
+
+	query.filter.Model = c.Query("model")
+	if allKeys {
+		query.filter.Key = c.Query("key")
+	}
+
+	switch strings.ToLower(c.DefaultQuery("format", "json")) {
+	case "json":
+	case "csv":
+		query.csv = true
+	default:
+		return query, fmt.Errorf("unsupported format %q, expected json or csv", c.Query("format"))
+	}
+	return query, nil
+}
+
+// parseUsageTime 解析 YYYY-MM-DD 日期（当地零点）或 RFC3339 时间
+func parseUsageTime(value string, location *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, value, location); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
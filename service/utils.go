@@ -1,10 +1,10 @@
 package service
 
 import (
+	"context"
 	"crypto/rand"
 	"strings"
 	"strconv"
-	"unicode/utf8"
 	"encoding/json"
 	"scira2api/config"
 	"scira2api/log"
@@ -81,80 +81,8 @@ func randString(n int) string {
 	return string(b)
 }
 
-// countTokens 计算文本中的token数量(近似值)
-// 这是一个优化版计算，使用单次遍历
-func countTokens(text string) int {
-    words := 0
-    punctuation := 0
-    cjk := 0
-    
-    // 单词状态跟踪
-    inWord := false
-    
-    // 单次遍历
-    for _, r := range text {
-        if strings.ContainsRune(" \t\n\r\f\v", r) { // 空白字符
-            if inWord {
-                words++
-                inWord = false
-            }
-        } else if strings.ContainsRune(".,;:!?()[]{}-_=+*/\\\"'`~@#$%^&<>|", r) {
-            punctuation++
-            inWord = false
-        } else {
-            if utf8.RuneLen(r) > 1 { // 多字节字符（CJK等）
-                cjk++
-            } else {
-                inWord = true
-            }
-        }
-    }
-    
-    // 确保最后一个单词被计数
-    if inWord {
-        words++
-    }
-    
-    // 粗略估计：每个英文单词约1.3个token，标点符号1个token，CJK字符约1.5个token
-    tokenEstimate := int(float64(words) * 1.3) + punctuation + int(float64(cjk) * 1.5)
-    
-    // 确保至少返回1个token
-    if tokenEstimate < 1 && len(strings.TrimSpace(text)) > 0 {
-        tokenEstimate = 1
-    }
-    
-    return tokenEstimate
-}
-
-// calculateMessageTokens 计算消息的token数量
-func calculateMessageTokens(messages []interface{}) int {
-	totalTokens := 0
-	for _, msg := range messages {
-		if message, ok := msg.(map[string]interface{}); ok {
-			// 计算角色名的tokens
-			if role, ok := message["role"].(string); ok {
-				totalTokens += countTokens(role)
-			}
-			
-			// 计算内容的tokens
-			if content, ok := message["content"].(string); ok {
-				totalTokens += countTokens(content)
-			}
-		}
-	}
-	
-	// 添加消息格式的基础tokens(每条消息的元数据)
-	// 每条消息额外添加约4个tokens作为格式开销
-	totalTokens += len(messages) * 4
-	
-	// 再加上请求本身的固定tokens(约3个)
-	totalTokens += 3
-	
-	return totalTokens
-}
-
 // processLineData 处理响应行数据，统一处理不同前缀的行
-func processLineData(line string, content, reasoningContent *string, usage *models.Usage, finishReason *string) {
+func processLineData(ctx context.Context, line string, content, reasoningContent *string, usage *models.Usage, finishReason *string) {
 	switch {
 	case strings.HasPrefix(line, "0:"):
 		// 内容部分
@@ -173,7 +101,7 @@ func processLineData(line string, content, reasoningContent *string, usage *mode
 		// 完成信息，只更新最新的完成原因
 		var finishData map[string]interface{}
 		if err := json.Unmarshal([]byte(line[2:]), &finishData); err != nil {
-			log.Warn("Failed to parse finish data: %v", err)
+			log.Ctx(ctx).Warn("Failed to parse finish data: %v", err)
 			return
 		}
 		if reason, ok := finishData["finishReason"].(string); ok {
@@ -193,7 +121,7 @@ func processLineData(line string, content, reasoningContent *string, usage *mode
 		}
 		
 		if err := json.Unmarshal([]byte(line[2:]), &usageData); err != nil {
-			log.Warn("Failed to parse usage data: %v", err)
+			log.Ctx(ctx).Warn("Failed to parse usage data: %v", err)
 			return
 		}
 		